@@ -0,0 +1,129 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of exported access logs
+const (
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+)
+
+const (
+	haproxyLogDateLayout = "02/Jan/2006:15:04:05.000"
+	clfDateLayout        = "02/Jan/2006:15:04:05 -0700"
+)
+
+// haproxyHTTPLogRegexp matches the lines of the HTTP log format of haproxy
+// (option httplog), with optional captured headers.
+var haproxyHTTPLogRegexp = regexp.MustCompile(`^(\S+):\d+ \[([^\]]+)\] \S+ \S+/\S+ (?:-?\d+/){4}\+?-?\d+ (-?\d+) \+?(\d+) \S+ \S+ \S{4} \S+ \S+(?: \{([^}]*)\})?(?: \{([^}]*)\})? "(.*)"$`)
+
+// haproxyHTTPLog contains the fields of an HTTP log line of haproxy needed
+// to export it.
+type haproxyHTTPLog struct {
+	Client          string
+	Date            time.Time
+	Status          string
+	Bytes           string
+	RequestCaptures []string
+	Request         string
+}
+
+func parseHaproxyHTTPLog(line string) (*haproxyHTTPLog, bool) {
+	m := haproxyHTTPLogRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return nil, false
+	}
+	date, err := time.ParseInLocation(haproxyLogDateLayout, m[2], time.Local)
+	if err != nil {
+		return nil, false
+	}
+	l := &haproxyHTTPLog{
+		Client:  m[1],
+		Date:    date,
+		Status:  m[3],
+		Bytes:   m[4],
+		Request: m[7],
+	}
+	// With only one block of captures, it can be of request or response
+	// headers, assume it's of request headers as they are usually captured
+	if m[5] != "" {
+		l.RequestCaptures = strings.Split(m[5], "|")
+	}
+	return l, true
+}
+
+func (l *haproxyHTTPLog) capture(n int) string {
+	if n < 1 || n > len(l.RequestCaptures) || l.RequestCaptures[n-1] == "" {
+		return "-"
+	}
+	return l.RequestCaptures[n-1]
+}
+
+// AccessLogExporter writes the HTTP logs of haproxy in the Common or
+// Combined Log Format, other lines are written unchanged.
+type AccessLogExporter struct {
+	format string
+	// Positions of the request headers captured in haproxy with the
+	// referer and the user agent, starting at 1, used in the combined
+	// format
+	referer, userAgent int
+
+	sync.Mutex
+	out io.Writer
+}
+
+func NewAccessLogExporter(format string, referer, userAgent int, out io.Writer) (*AccessLogExporter, error) {
+	switch format {
+	case AccessLogCommon, AccessLogCombined:
+	default:
+		return nil, fmt.Errorf("unknown access log format: %s", format)
+	}
+	return &AccessLogExporter{format: format, referer: referer, userAgent: userAgent, out: out}, nil
+}
+
+// Format formats a line, returning it unchanged if it is not an HTTP log.
+func (e *AccessLogExporter) Format(line string) string {
+	l, ok := parseHaproxyHTTPLog(line)
+	if !ok {
+		return line
+	}
+	bytes := l.Bytes
+	if bytes == "0" {
+		bytes = "-"
+	}
+	formatted := fmt.Sprintf("%s - - [%s] %s %s %s",
+		l.Client, l.Date.Format(clfDateLayout), strconv.Quote(l.Request), l.Status, bytes)
+	if e.format == AccessLogCombined {
+		formatted += fmt.Sprintf(" %s %s", strconv.Quote(l.capture(e.referer)), strconv.Quote(l.capture(e.userAgent)))
+	}
+	return formatted
+}
+
+func (e *AccessLogExporter) Write(line string) error {
+	e.Lock()
+	defer e.Unlock()
+	_, err := io.WriteString(e.out, e.Format(line)+"\n")
+	return err
+}
@@ -0,0 +1,75 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestAccessLogExporter(t *testing.T) {
+	defer func(l *time.Location) { time.Local = l }(time.Local)
+	time.Local = time.FixedZone("CET", 3600)
+
+	cases := []struct {
+		format, line, expected string
+	}{
+		{
+			AccessLogCommon,
+			`10.0.1.2:33317 [06/Feb/2009:12:14:14.655] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 {1wt.eu} {} "GET /index.html HTTP/1.1"`,
+			`10.0.1.2 - - [06/Feb/2009:12:14:14 +0100] "GET /index.html HTTP/1.1" 200 2750`,
+		},
+		{
+			AccessLogCombined,
+			`10.0.1.2:33317 [06/Feb/2009:12:14:14.655] http-in~ static/srv1 10/0/30/69/109 304 0 - - ---- 1/1/1/1/0 0/0 {http://example.com/|Mozilla/5.0 (X11; Linux)} {} "GET /logo.png HTTP/1.1"`,
+			`10.0.1.2 - - [06/Feb/2009:12:14:14 +0100] "GET /logo.png HTTP/1.1" 304 - "http://example.com/" "Mozilla/5.0 (X11; Linux)"`,
+		},
+		{
+			AccessLogCombined,
+			`::1:51000 [06/Feb/2009:12:14:14.655] http-in web/<NOSRV> -1/-1/-1/-1/+0 400 +187 - - PR-- 0/0/0/0/0 0/0 "<BADREQ>"`,
+			`::1 - - [06/Feb/2009:12:14:14 +0100] "<BADREQ>" 400 187 "-" "-"`,
+		},
+		{
+			AccessLogCommon,
+			`Proxy http-in started.`,
+			`Proxy http-in started.`,
+		},
+		{
+			AccessLogCommon,
+			`10.0.1.2:33317 [06/Feb/2009:12:14:14.655] tcp-in tcp/srv1 0/0/5007 212 -- 0/0/0/0/3 0/0`,
+			`10.0.1.2:33317 [06/Feb/2009:12:14:14.655] tcp-in tcp/srv1 0/0/5007 212 -- 0/0/0/0/3 0/0`,
+		},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		e, err := NewAccessLogExporter(c.format, 1, 2, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Write(c.line); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != c.expected+"\n" {
+			t.Errorf("expected %q, found %q", c.expected+"\n", out.String())
+		}
+	}
+}
+
+func TestAccessLogExporterFormat(t *testing.T) {
+	if _, err := NewAccessLogExporter("json", 1, 2, &bytes.Buffer{}); err == nil {
+		t.Fatal("expected error with unknown format")
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix of comments in the configuration with settings for the wrapper,
+// e.g. "#@wrapper: wait-healthy=10s capture=false"
+const annotationPrefix = "#@wrapper:"
+
+// ReloadSettings are the settings effective in a reload, defined by flags
+// and overridden by annotations in the configuration.
+type ReloadSettings struct {
+	Validate    bool          `json:"validate"`
+	Capture     bool          `json:"capture"`
+	WaitHealthy time.Duration `json:"wait_healthy_ns"`
+
+	// Annotations applied, as key=value
+	Annotations []string `json:"annotations,omitempty"`
+}
+
+// reloadAnnotations are the keys accepted in annotations, with the functions
+// applying their values.
+var reloadAnnotations = map[string]func(s *ReloadSettings, value string) error{
+	"validate": func(s *ReloadSettings, value string) (err error) {
+		s.Validate, err = strconv.ParseBool(value)
+		return
+	},
+	"capture": func(s *ReloadSettings, value string) (err error) {
+		s.Capture, err = strconv.ParseBool(value)
+		return
+	},
+	"wait-healthy": func(s *ReloadSettings, value string) error {
+		d, err := time.ParseDuration(value)
+		if err == nil && d < 0 {
+			return fmt.Errorf("negative duration")
+		}
+		s.WaitHealthy = d
+		return err
+	},
+}
+
+// applyAnnotations overrides the settings with the annotations found in the
+// configuration.
+func (s *ReloadSettings) applyAnnotations(content []byte) error {
+	annotations, err := parseAnnotations(content)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		apply, found := reloadAnnotations[key]
+		if !found {
+			return fmt.Errorf("unknown annotation %q", key)
+		}
+		if err := apply(s, annotations[key]); err != nil {
+			return fmt.Errorf("invalid value %q for annotation %q: %v", annotations[key], key, err)
+		}
+		s.Annotations = append(s.Annotations, key+"="+annotations[key])
+	}
+	return nil
+}
+
+// parseAnnotations returns the key=value pairs of annotations found in the
+// configuration, separated by spaces or commas. Keys cannot be repeated.
+func parseAnnotations(content []byte) (map[string]string, error) {
+	annotations := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, annotationPrefix) {
+			continue
+		}
+		fields := strings.FieldsFunc(line[len(annotationPrefix):], func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		for _, field := range fields {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("line %d: invalid annotation %q, expected key=value", n, field)
+			}
+			if _, found := annotations[kv[0]]; found {
+				return nil, fmt.Errorf("line %d: annotation %q already set", n, kv[0])
+			}
+			annotations[kv[0]] = kv[1]
+		}
+	}
+	return annotations, scanner.Err()
+}
@@ -0,0 +1,127 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadSettingsAnnotations(t *testing.T) {
+	content := []byte(`global
+  #@wrapper: wait-healthy=10s, capture=false
+  daemon
+#@wrapper: validate=true
+defaults
+  # not an annotation: capture=true
+`)
+	settings := &ReloadSettings{Capture: true, WaitHealthy: time.Second}
+	if err := settings.applyAnnotations(content); err != nil {
+		t.Fatal(err)
+	}
+	expected := &ReloadSettings{
+		Validate:    true,
+		Capture:     false,
+		WaitHealthy: 10 * time.Second,
+		Annotations: []string{"capture=false", "validate=true", "wait-healthy=10s"},
+	}
+	if !reflect.DeepEqual(settings, expected) {
+		t.Fatalf("expected %+v, found %+v", expected, settings)
+	}
+}
+
+func TestReloadSettingsInvalidAnnotations(t *testing.T) {
+	cases := []string{
+		"#@wrapper: preserve-everything=true",
+		"#@wrapper: capture=maybe",
+		"#@wrapper: wait-healthy=10",
+		"#@wrapper: wait-healthy=-1s",
+		"#@wrapper: capture",
+		"#@wrapper: capture=true capture=false",
+		"#@wrapper: capture=true\n#@wrapper: capture=false",
+	}
+	for _, c := range cases {
+		settings := &ReloadSettings{}
+		if err := settings.applyAnnotations([]byte(c)); err == nil {
+			t.Errorf("%q: expected error", c)
+		}
+	}
+}
+
+// fakeOptionsHaproxy records the options of reloads.
+type fakeOptionsHaproxy struct {
+	fakeHaproxy
+	options []ReloadOptions
+}
+
+func (h *fakeOptionsHaproxy) ReloadWithOptions(options ReloadOptions) error {
+	h.options = append(h.options, options)
+	return h.Reload()
+}
+
+func TestControllerReloadAnnotations(t *testing.T) {
+	config := tempConfig(t, "global\n#@wrapper: capture=false\n")
+	defer os.Remove(config)
+	h := &fakeOptionsHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/reload", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "OK\nAnnotation: capture=false\n" {
+		t.Fatalf("unexpected response %d: %q", w.Code, w.Body.String())
+	}
+	if len(h.options) != 1 || h.options[0].Capture {
+		t.Fatalf("unexpected reload options: %+v", h.options)
+	}
+	if settings := c.lastReload.Settings; settings == nil || settings.Capture {
+		t.Fatalf("unexpected settings in outcome: %+v", settings)
+	}
+}
+
+func TestControllerReloadAnnotationsValidate(t *testing.T) {
+	config := tempConfig(t, "global\n#@wrapper: validate=true\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{}
+	c := NewController("", config, h, &fakeValidator{err: errors.New("broken")})
+
+	outcome := c.Reload()
+	if outcome.Success || outcome.Phase != ReloadPhaseValidate {
+		t.Fatalf("expected validation to fail: %+v", outcome)
+	}
+	if h.reloads != 0 {
+		t.Fatal("invalid configuration reloaded")
+	}
+}
+
+func TestControllerReloadInvalidAnnotations(t *testing.T) {
+	config := tempConfig(t, "global\n#@wrapper: capture=sometimes\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+
+	outcome := c.Reload()
+	if outcome.Success || outcome.Phase != ReloadPhaseAnnotations || !strings.Contains(outcome.Error, "capture") {
+		t.Fatalf("expected annotations to fail: %+v", outcome)
+	}
+	if h.reloads != 0 {
+		t.Fatal("haproxy reloaded with invalid annotations")
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errNoPendingApproval = errors.New("no reload pending approval")
+
+// PendingApproval is a validated configuration staged until its reload is
+// approved.
+type PendingApproval struct {
+	Hash    string         `json:"hash"`
+	Actor   string         `json:"actor,omitempty"`
+	Staged  time.Time      `json:"staged"`
+	Expires time.Time      `json:"expires"`
+	Changes *TopologyDelta `json:"changes,omitempty"`
+}
+
+type approvalDecision struct {
+	approved bool
+	reason   string
+}
+
+// ApprovalGate holds reloads until they are approved, by a call to the
+// confirmation URL if set, or by a call to the API of the controller.
+// Reloads not approved before the TTL are rejected.
+type ApprovalGate struct {
+	sync.Mutex
+	TTL time.Duration
+	URL string
+
+	client   *http.Client
+	pending  *PendingApproval
+	decision chan approvalDecision
+}
+
+func NewApprovalGate(ttl time.Duration, url string) *ApprovalGate {
+	return &ApprovalGate{
+		TTL:    ttl,
+		URL:    url,
+		client: &http.Client{Timeout: ttl},
+	}
+}
+
+// Wait stages the reload and waits for its approval. It returns an error if
+// the reload is rejected, not approved in time, or cancelled.
+func (g *ApprovalGate) Wait(p PendingApproval, cancel <-chan struct{}) error {
+	p.Staged = time.Now()
+	p.Expires = p.Staged.Add(g.TTL)
+	decision := make(chan approvalDecision, 1)
+	g.Lock()
+	if g.pending != nil {
+		g.Unlock()
+		return fmt.Errorf("reload %s already pending approval", g.pending.Hash)
+	}
+	g.pending = &p
+	g.decision = decision
+	g.Unlock()
+	defer func() {
+		g.Lock()
+		g.pending = nil
+		g.decision = nil
+		g.Unlock()
+	}()
+	log.Printf("Reload of configuration %s pending approval until %s\n", p.Hash, p.Expires.Format(time.RFC3339))
+
+	if g.URL != "" {
+		go g.confirm(p)
+	}
+	timer := time.NewTimer(g.TTL)
+	defer timer.Stop()
+	select {
+	case d := <-decision:
+		if !d.approved {
+			if d.reason == "" {
+				return errors.New("reload rejected")
+			}
+			return fmt.Errorf("reload rejected: %s", d.reason)
+		}
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("reload not approved after %v", g.TTL)
+	case <-cancel:
+		return errControllerStopping
+	}
+}
+
+// confirm asks the confirmation URL for a decision about the reload,
+// responses with 2xx status approve it, any other result rejects it.
+func (g *ApprovalGate) confirm(p PendingApproval) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		g.Decide(p.Hash, false, fmt.Sprintf("couldn't encode request: %v", err))
+		return
+	}
+	resp, err := g.client.Post(g.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		g.Decide(p.Hash, false, fmt.Sprintf("confirmation failed: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		g.Decide(p.Hash, false, fmt.Sprintf("confirmation returned %s: %s", resp.Status, bytes.TrimSpace(message)))
+		return
+	}
+	g.Decide(p.Hash, true, "")
+}
+
+// Decide approves or rejects the pending reload. If a hash is given, it must
+// be the one of the configuration pending approval.
+func (g *ApprovalGate) Decide(hash string, approved bool, reason string) error {
+	g.Lock()
+	defer g.Unlock()
+	if g.pending == nil {
+		return errNoPendingApproval
+	}
+	if hash != "" && hash != g.pending.Hash {
+		return fmt.Errorf("configuration pending approval is %s", g.pending.Hash)
+	}
+	select {
+	case g.decision <- approvalDecision{approved: approved, reason: reason}:
+		return nil
+	default:
+		return errors.New("reload already decided")
+	}
+}
+
+// Pending returns the reload pending approval, if any.
+func (g *ApprovalGate) Pending() *PendingApproval {
+	if g == nil {
+		return nil
+	}
+	g.Lock()
+	defer g.Unlock()
+	if g.pending == nil {
+		return nil
+	}
+	p := *g.pending
+	return &p
+}
+
+func (c *Controller) approval(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		pending := c.Approval.Pending()
+		if pending == nil {
+			http.Error(w, "No reload pending approval\n", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, pending)
+	case http.MethodPost:
+		if !c.authorize(w, req) {
+			return
+		}
+		query := req.URL.Query()
+		var approved bool
+		switch action := query.Get("action"); action {
+		case "approve":
+			approved = true
+		case "reject":
+		default:
+			http.Error(w, fmt.Sprintf("Unknown approval action: %s\n", action), http.StatusBadRequest)
+			return
+		}
+		err := c.Approval.Decide(query.Get("hash"), approved, query.Get("reason"))
+		switch {
+		case err == errNoPendingApproval:
+			http.Error(w, "No reload pending approval\n", http.StatusNotFound)
+		case err != nil:
+			http.Error(w, fmt.Sprintf("Couldn't decide reload: %v\n", err), http.StatusConflict)
+		default:
+			fmt.Fprintf(w, "OK\n")
+		}
+	default:
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startPendingReload starts a reload and waits for it to be pending approval.
+func startPendingReload(t *testing.T, c *Controller) <-chan *ReloadOutcome {
+	outcomes := make(chan *ReloadOutcome, 1)
+	go func() {
+		outcomes <- c.Reload()
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Approval.Pending() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("reload not pending approval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return outcomes
+}
+
+func waitOutcome(t *testing.T, outcomes <-chan *ReloadOutcome) *ReloadOutcome {
+	select {
+	case outcome := <-outcomes:
+		return outcome
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload not finished")
+	}
+	return nil
+}
+
+func approvalRequest(c *Controller, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/approval?"+query, nil))
+	return w
+}
+
+func TestControllerReloadApproved(t *testing.T) {
+	config := tempConfig(t, "backend app\n    server app1 10.0.0.1:80\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+	c.Approval = NewApprovalGate(time.Minute, "")
+
+	if err := ioutil.WriteFile(config, []byte("backend app\n    server app2 10.0.0.2:80\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outcomes := startPendingReload(t, c)
+	if h.reloads != 0 {
+		t.Fatal("haproxy reloaded before approval")
+	}
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	var status struct {
+		PendingApproval *PendingApproval `json:"pending_approval"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	pending := status.PendingApproval
+	if pending == nil || pending.Changes == nil || len(pending.Changes.ServersAdded) != 1 {
+		t.Fatalf("unexpected pending approval in status: %s", w.Body.String())
+	}
+	if !pending.Expires.Equal(pending.Staged.Add(time.Minute)) {
+		t.Fatalf("unexpected expiration: %+v", pending)
+	}
+
+	if w := approvalRequest(c, "action=approve&hash=other"); w.Code != http.StatusConflict {
+		t.Fatalf("approved with a different hash: %d", w.Code)
+	}
+	if w := approvalRequest(c, "action=approve&hash="+pending.Hash); w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %q", w.Code, w.Body.String())
+	}
+	if outcome := waitOutcome(t, outcomes); !outcome.Success {
+		t.Fatalf("approved reload failed: %+v", outcome)
+	}
+	if h.reloads != 1 {
+		t.Fatalf("unexpected reloads: %d", h.reloads)
+	}
+	if c.Approval.Pending() != nil {
+		t.Fatal("reload still pending approval")
+	}
+	if w := approvalRequest(c, "action=approve"); w.Code != http.StatusNotFound {
+		t.Fatalf("approved without pending reload: %d", w.Code)
+	}
+}
+
+func TestControllerReloadRejected(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+	c.Approval = NewApprovalGate(time.Minute, "")
+
+	outcomes := startPendingReload(t, c)
+	if w := approvalRequest(c, "action=reject&reason=freeze"); w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %q", w.Code, w.Body.String())
+	}
+	outcome := waitOutcome(t, outcomes)
+	if outcome.Success || outcome.Phase != ReloadPhaseApproval || outcome.Error != "reload rejected: freeze" {
+		t.Fatalf("unexpected outcome: %+v", outcome)
+	}
+	if outcome.httpStatus() != http.StatusConflict {
+		t.Fatalf("unexpected status: %d", outcome.httpStatus())
+	}
+	if h.reloads != 0 {
+		t.Fatal("rejected reload applied")
+	}
+}
+
+func TestControllerReloadApprovalTimeout(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+	c.Approval = NewApprovalGate(10*time.Millisecond, "")
+
+	outcome := c.Reload()
+	if outcome.Success || outcome.Phase != ReloadPhaseApproval || !strings.Contains(outcome.Error, "not approved") {
+		t.Fatalf("unexpected outcome: %+v", outcome)
+	}
+	if h.reloads != 0 {
+		t.Fatal("reload applied without approval")
+	}
+}
+
+func TestControllerReloadApprovalValidates(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{}
+	v := &countingValidator{}
+	c := NewController("", config, h, v)
+	c.Approval = NewApprovalGate(10*time.Millisecond, "")
+
+	c.Reload()
+	if v.calls != 1 {
+		t.Fatalf("configuration not validated before approval: %d", v.calls)
+	}
+}
+
+func TestControllerReloadChangedWhilePending(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+	c.Approval = NewApprovalGate(time.Minute, "")
+
+	outcomes := startPendingReload(t, c)
+	if err := ioutil.WriteFile(config, []byte("global\n    maxconn 10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	approvalRequest(c, "action=approve")
+	if outcome := waitOutcome(t, outcomes); outcome.Success || outcome.Phase != ReloadPhaseApproval {
+		t.Fatalf("unexpected outcome: %+v", outcome)
+	}
+	if h.reloads != 0 {
+		t.Fatal("unapproved configuration applied")
+	}
+}
+
+func TestControllerReloadConfirmationURL(t *testing.T) {
+	var requested PendingApproval
+	approve := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewDecoder(req.Body).Decode(&requested)
+		if !approve {
+			http.Error(w, "change freeze", http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+	c.Approval = NewApprovalGate(time.Minute, server.URL)
+
+	if outcome := c.Reload(); !outcome.Success {
+		t.Fatalf("reload not approved: %+v", outcome)
+	} else if requested.Hash != outcome.Hash {
+		t.Fatalf("unexpected confirmation request: %+v", requested)
+	}
+
+	approve = false
+	outcome := c.Reload()
+	if outcome.Success || outcome.Phase != ReloadPhaseApproval || !strings.Contains(outcome.Error, "change freeze") {
+		t.Fatalf("unexpected outcome: %+v", outcome)
+	}
+	if h.reloads != 1 {
+		t.Fatalf("unexpected reloads: %d", h.reloads)
+	}
+}
+
+func TestControllerReloadApprovalCancelled(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+	c.Approval = NewApprovalGate(time.Minute, "")
+
+	outcomes := startPendingReload(t, c)
+	close(c.cancelReloads)
+	if outcome := waitOutcome(t, outcomes); outcome.Phase != ReloadPhaseShutdown {
+		t.Fatalf("unexpected outcome: %+v", outcome)
+	}
+}
+
+func TestApprovalInvalidAction(t *testing.T) {
+	c := NewController("", "", &fakeHaproxy{}, &fakeValidator{})
+	c.Approval = NewApprovalGate(time.Minute, "")
+	if w := approvalRequest(c, "action=maybe"); w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected response %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/approval", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected response %d", w.Code)
+	}
+}
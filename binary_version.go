@@ -0,0 +1,161 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// What to do when the version of the haproxy binary differs from the version
+// of the binary that started the running processes
+const (
+	BinaryMismatchWarn   = "warn"
+	BinaryMismatchRefuse = "refuse"
+)
+
+func validateBinaryMismatch(policy string) error {
+	switch policy {
+	case BinaryMismatchWarn, BinaryMismatchRefuse:
+		return nil
+	default:
+		return fmt.Errorf("unknown binary mismatch policy: %s", policy)
+	}
+}
+
+// BinaryVersions tracks the version of the haproxy binary that started the
+// running processes. Configurations are validated with the binary currently
+// in the path, that can be replaced while the old processes keep running.
+type BinaryVersions struct {
+	sync.Mutex
+
+	path   string
+	policy string
+
+	// Version of the binary when haproxy was last started or reloaded
+	running string
+
+	// Last version obtained, and identity of the binary it was obtained
+	// from, so haproxy is only run again when the binary changes
+	cached         string
+	cachedIdentity string
+
+	// Used to obtain the version of the binary, mockable for tests
+	versionFunc func(string) (string, error)
+}
+
+func NewBinaryVersions(path, policy string) *BinaryVersions {
+	return &BinaryVersions{
+		path:        path,
+		policy:      policy,
+		versionFunc: haproxyVersion,
+	}
+}
+
+// Started records the version of the binary as the one of the running
+// processes, it is called after haproxy is started or reloaded.
+func (v *BinaryVersions) Started() {
+	if v == nil {
+		return
+	}
+	version, err := v.version()
+	if err != nil {
+		log.Printf("Couldn't obtain version of running haproxy: %v\n", err)
+		return
+	}
+	v.Lock()
+	defer v.Unlock()
+	if v.running != "" && v.running != version {
+		log.Printf("Running haproxy upgraded from version %s to %s\n", v.running, version)
+	}
+	v.running = version
+}
+
+// Versions returns the version of the binary that started the running
+// processes, and the current version of the binary, used to validate
+// configurations.
+func (v *BinaryVersions) Versions() (running, validator string, err error) {
+	validator, err = v.version()
+	v.Lock()
+	defer v.Unlock()
+	return v.running, validator, err
+}
+
+// version returns the current version of the binary. It is cached while the
+// inode, size and modification time of the binary don't change, it is
+// obtained every time if they cannot be read.
+func (v *BinaryVersions) version() (string, error) {
+	identity, err := binaryIdentity(v.path)
+	if err != nil {
+		return v.versionFunc(v.path)
+	}
+	v.Lock()
+	version, cached := v.cached, v.cached != "" && v.cachedIdentity == identity
+	v.Unlock()
+	if cached {
+		return version, nil
+	}
+
+	version, err = v.versionFunc(v.path)
+	if err != nil {
+		return "", err
+	}
+	v.Lock()
+	defer v.Unlock()
+	v.cached, v.cachedIdentity = version, identity
+	return version, nil
+}
+
+// binaryIdentity identifies the file of a binary, looked up in PATH if
+// needed, so replacements of the binary can be detected.
+func binaryIdentity(path string) (string, error) {
+	path, err := exec.LookPath(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	identity := fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size())
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		identity = fmt.Sprintf("%d:%d:%s", stat.Dev, stat.Ino, identity)
+	}
+	return identity, nil
+}
+
+// Check compares the versions before reloading. If they differ, it logs a
+// warning, or returns an error if reloads have to be refused.
+func (v *BinaryVersions) Check() error {
+	if v == nil {
+		return nil
+	}
+	running, validator, err := v.Versions()
+	if err != nil {
+		return fmt.Errorf("couldn't obtain haproxy version: %v", err)
+	}
+	if running == "" || running == validator {
+		return nil
+	}
+	if v.policy == BinaryMismatchRefuse {
+		return fmt.Errorf("haproxy binary changed from version %s, running, to %s, restart the wrapper to upgrade", running, validator)
+	}
+	log.Printf("WARNING: haproxy binary changed from version %s, running, to %s, configuration validated with the new version\n", running, validator)
+	return nil
+}
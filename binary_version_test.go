@@ -0,0 +1,111 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestControllerBinaryMismatch(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	haproxy := &fakeHaproxy{running: true}
+	c := NewController("", config, haproxy, &fakeValidator{})
+	version := "1.8.14"
+	c.Binary = NewBinaryVersions("haproxy", BinaryMismatchRefuse)
+	c.Binary.versionFunc = func(string) (string, error) { return version, nil }
+	c.Binary.Started()
+
+	getHealth := func() health {
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		var h health
+		if err := json.Unmarshal(w.Body.Bytes(), &h); err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	if outcome := c.ValidatedReload(); !outcome.Success {
+		t.Fatalf("expected successful reload with same version, found %+v", outcome)
+	}
+
+	version = "1.9.0"
+	if h := getHealth(); h.RunningVersion != "1.8.14" || h.ValidatorVersion != "1.9.0" {
+		t.Fatalf("unexpected versions in health: %+v", h)
+	}
+	outcome := c.ValidatedReload()
+	if outcome.Success || outcome.Phase != ReloadPhaseBinary || outcome.httpStatus() != http.StatusConflict || haproxy.reloads != 1 {
+		t.Fatalf("expected refused reload after binary upgrade, found %+v", outcome)
+	}
+	if failures := counterValue(c.reloads, "failure", ReloadPhaseBinary); failures != 1 {
+		t.Fatalf("expected refused reload counted in the binary phase, found %v", failures)
+	}
+
+	// Stopped haproxy is started with the new binary
+	haproxy.running = false
+	if outcome := c.ValidatedReload(); !outcome.Success {
+		t.Fatalf("expected successful start after binary upgrade, found %+v", outcome)
+	}
+	if h := getHealth(); h.RunningVersion != "1.9.0" || h.ValidatorVersion != "1.9.0" {
+		t.Fatalf("unexpected versions in health after start: %+v", h)
+	}
+
+	c.Binary.policy = BinaryMismatchWarn
+	version = "2.0.0"
+	if outcome := c.ValidatedReload(); !outcome.Success {
+		t.Fatalf("expected successful reload with warning, found %+v", outcome)
+	}
+	if h := getHealth(); h.RunningVersion != "2.0.0" {
+		t.Fatalf("running version not updated after reload: %+v", h)
+	}
+}
+
+func TestBinaryVersionsCache(t *testing.T) {
+	dir, path := fakeHaproxyBinary(t, "echo 'HA-Proxy version 1.8.14 2018/09/20'")
+	defer os.RemoveAll(dir)
+
+	v := NewBinaryVersions(path, BinaryMismatchWarn)
+	calls := 0
+	v.versionFunc = func(path string) (string, error) {
+		calls++
+		return haproxyVersion(path)
+	}
+	for i := 0; i < 3; i++ {
+		if _, version, err := v.Versions(); err != nil || version != "1.8.14" {
+			t.Fatalf("found version %q (%v), expected 1.8.14", version, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("version obtained %d times for unchanged binary", calls)
+	}
+
+	// Replaced binaries have a different inode
+	replacement := path + ".new"
+	if err := ioutil.WriteFile(replacement, []byte("#!/bin/sh\necho 'HA-Proxy version 1.9.0 2018/12/19'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, version, err := v.Versions(); err != nil || version != "1.9.0" || calls != 2 {
+		t.Fatalf("found version %q (%v) after %d calls, expected 1.9.0 after 2", version, err, calls)
+	}
+}
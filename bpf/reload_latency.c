@@ -0,0 +1,140 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Measures the time from the arrival of the first SYN of a connection, before
+// netfilter hooks, to its establishment. Latencies are counted in log2 buckets
+// of microseconds, the entry after the last bucket keeps the sum of latencies
+// in nanoseconds.
+//
+// Build with: clang -O2 -target bpf -I$(KERNEL_HEADERS) -I$(GOBPF)/elf/include -c reload_latency.c
+
+#include <linux/kconfig.h>
+#include <linux/types.h>
+#include <linux/ip.h>
+#include <linux/tcp.h>
+#include <linux/skbuff.h>
+#include <uapi/linux/bpf.h>
+#include <net/tcp_states.h>
+#include "bpf_helpers.h"
+
+#define LATENCY_BUCKETS 32
+#define MAX_PENDING 65536
+
+struct conn_key {
+	__u32 saddr;
+	__u32 daddr;
+	__u16 sport;
+	__u16 dport;
+};
+
+// First SYN seen of connections not established yet
+struct bpf_map_def SEC("maps/pending") pending = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(struct conn_key),
+	.value_size = sizeof(__u64),
+	.max_entries = MAX_PENDING,
+};
+
+struct bpf_map_def SEC("maps/latency") latency = {
+	.type = BPF_MAP_TYPE_ARRAY,
+	.key_size = sizeof(__u32),
+	.value_size = sizeof(__u64),
+	.max_entries = LATENCY_BUCKETS + 1,
+};
+
+SEC("kprobe/ip_rcv")
+int kprobe__ip_rcv(struct pt_regs *ctx)
+{
+	struct sk_buff *skb = (struct sk_buff *)PT_REGS_PARM1(ctx);
+	unsigned char *head;
+	__u16 network_header;
+	struct iphdr ip;
+	struct tcphdr tcp;
+
+	bpf_probe_read(&head, sizeof(head), &skb->head);
+	bpf_probe_read(&network_header, sizeof(network_header), &skb->network_header);
+	bpf_probe_read(&ip, sizeof(ip), head + network_header);
+	if (ip.protocol != IPPROTO_TCP)
+		return 0;
+	bpf_probe_read(&tcp, sizeof(tcp), head + network_header + ip.ihl * 4);
+	if (!tcp.syn || tcp.ack)
+		return 0;
+
+	// Keys are oriented as seen by the listening socket
+	struct conn_key key = {
+		.saddr = ip.daddr,
+		.daddr = ip.saddr,
+		.sport = ntohs(tcp.dest),
+		.dport = ntohs(tcp.source),
+	};
+	__u64 now = bpf_ktime_get_ns();
+	// Retransmitted SYNs keep the time of the first one
+	bpf_map_update_elem(&pending, &key, &now, BPF_NOEXIST);
+	return 0;
+}
+
+struct inet_sock_set_state_args {
+	__u64 common;
+	const void *skaddr;
+	int oldstate;
+	int newstate;
+	__u16 sport;
+	__u16 dport;
+	__u16 family;
+	__u8 protocol;
+	__u8 saddr[4];
+	__u8 daddr[4];
+	__u8 saddr_v6[16];
+	__u8 daddr_v6[16];
+};
+
+SEC("tracepoint/sock/inet_sock_set_state")
+int tracepoint__inet_sock_set_state(struct inet_sock_set_state_args *args)
+{
+	if (args->protocol != IPPROTO_TCP || args->oldstate != TCP_SYN_RECV || args->newstate != TCP_ESTABLISHED)
+		return 0;
+
+	struct conn_key key = {
+		.sport = args->sport,
+		.dport = args->dport,
+	};
+	__builtin_memcpy(&key.saddr, args->saddr, sizeof(key.saddr));
+	__builtin_memcpy(&key.daddr, args->daddr, sizeof(key.daddr));
+
+	__u64 *start = bpf_map_lookup_elem(&pending, &key);
+	if (!start)
+		return 0;
+	__u64 delta = bpf_ktime_get_ns() - *start;
+	bpf_map_delete_elem(&pending, &key);
+
+	__u64 us = delta / 1000;
+	__u32 bucket = 0;
+#pragma unroll
+	for (int i = 0; i < LATENCY_BUCKETS - 1; i++) {
+		if (us >> (i + 1))
+			bucket = i + 1;
+	}
+	__u64 *count = bpf_map_lookup_elem(&latency, &bucket);
+	if (count)
+		__sync_fetch_and_add(count, 1);
+	__u32 sum_key = LATENCY_BUCKETS;
+	__u64 *sum = bpf_map_lookup_elem(&latency, &sum_key);
+	if (sum)
+		__sync_fetch_and_add(sum, delta);
+	return 0;
+}
+
+char _license[] SEC("license") = "GPL";
+// Replaced by gobpf with the version of the running kernel
+__u32 _version SEC("version") = 0xFFFFFFFE;
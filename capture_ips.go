@@ -0,0 +1,62 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// captureIPs replaces the addresses whose connections are retained during
+// reloads with the comma-separated list of IPs in the body of the request. It
+// is only registered if haproxy implements CaptureIPsUpdater.
+func (c *Controller) captureIPs(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorize(w, req) {
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxReloadBodySize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Couldn't read request: %v\n", err), http.StatusBadRequest)
+		return
+	}
+	ips, err := ipArgs(strings.TrimSpace(string(body)))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Expected comma-separated list of IPs: %v\n", err), http.StatusBadRequest)
+		return
+	}
+	if len(ips) == 0 {
+		http.Error(w, "Expected comma-separated list of IPs\n", http.StatusBadRequest)
+		return
+	}
+	if err := c.haproxy.(CaptureIPsUpdater).SetCaptureIPs(ips); err != nil {
+		status := http.StatusInternalServerError
+		if err == errCaptureDisabled {
+			status = http.StatusConflict
+		}
+		msg := fmt.Sprintf("Couldn't update capture IPs: %v\n", err)
+		log.Print(msg)
+		http.Error(w, msg, status)
+		return
+	}
+	log.Printf("Retaining connections to %s during reloads\n", strings.TrimSpace(string(body)))
+	fmt.Fprintf(w, "OK\n")
+}
@@ -0,0 +1,78 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type captureIPsHaproxy struct {
+	fakeHaproxy
+	ips []net.IP
+	err error
+}
+
+func (h *captureIPsHaproxy) SetCaptureIPs(ips []net.IP) error {
+	if h.err != nil {
+		return h.err
+	}
+	h.ips = ips
+	return nil
+}
+
+func TestControllerCaptureIPs(t *testing.T) {
+	haproxy := &captureIPsHaproxy{}
+	c := NewController("", "", haproxy, &fakeValidator{})
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/capture-ips", strings.NewReader(body)))
+		return w
+	}
+
+	if w := post("10.0.0.1,fd00::1\n"); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	if expected := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}; !reflect.DeepEqual(haproxy.ips, expected) {
+		t.Fatalf("found IPs %v, expected %v", haproxy.ips, expected)
+	}
+	for _, body := range []string{"", "10.0.0.1,invalid"} {
+		if w := post(body); w.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status %d for %q", w.Code, body)
+		}
+	}
+	haproxy.err = errCaptureDisabled
+	if w := post("10.0.0.2"); w.Code != http.StatusConflict {
+		t.Errorf("unexpected status %d updating IPs without capture", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/capture-ips", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status %d for GET", w.Code)
+	}
+
+	// Not available if haproxy doesn't retain connections
+	c = NewController("", "", &fakeHaproxy{}, &fakeValidator{})
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/capture-ips", strings.NewReader("10.0.0.1")))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unexpected status %d without capture support", w.Code)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Diagnoses of captures without packets
+const (
+	CaptureNoTraffic      = "no-traffic"
+	CaptureNotMatching    = "not-matching"
+	CaptureTrafficUnknown = "traffic-unknown"
+)
+
+var captureDiagnoses = map[string]string{
+	CaptureNoTraffic:      "no connections received during the capture",
+	CaptureNotMatching:    "connections reached haproxy during the capture without being retained, capture rules may not match the traffic (check the chain and addresses)",
+	CaptureTrafficUnknown: "traffic during the capture unknown without stats socket",
+}
+
+// frontendSessions is the number of sessions accepted by the frontends of
+// haproxy, or the error obtaining it.
+type frontendSessions struct {
+	sessions int
+	err      error
+}
+
+// countFrontendSessions counts the sessions accepted by the frontends of the
+// running haproxy. The capture is done while haproxy is reloaded, so the new
+// process cannot have accepted sessions during the capture unless they were
+// not retained.
+func (c *Controller) countFrontendSessions() frontendSessions {
+	records, err := c.StatsSocket.ShowStat()
+	if err != nil {
+		return frontendSessions{err: err}
+	}
+	total := 0
+	for _, r := range records {
+		if r.Server != "FRONTEND" {
+			continue
+		}
+		n, err := strconv.Atoi(r.Fields["stot"])
+		if err != nil {
+			return frontendSessions{err: fmt.Errorf("invalid sessions of frontend %s: %q", r.Proxy, r.Fields["stot"])}
+		}
+		total += n
+	}
+	return frontendSessions{sessions: total}
+}
+
+// startCaptureCheck starts counting the sessions of haproxy when the release
+// of a capture is requested, before retained connections are accepted.
+func (c *Controller) startCaptureCheck(id uint64) {
+	if c.StatsSocket == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.captureChecks == nil {
+		c.captureChecks = make(map[uint64]chan frontendSessions)
+	}
+	if _, found := c.captureChecks[id]; found {
+		return
+	}
+	result := make(chan frontendSessions, 1)
+	c.captureChecks[id] = result
+	go func() {
+		result <- c.countFrontendSessions()
+	}()
+}
+
+// diagnoseCapture sets the diagnosis of captures without packets, and records
+// the summary of the last capture.
+func (c *Controller) diagnoseCapture(id uint64, summary *CaptureSummary) {
+	c.Lock()
+	result, found := c.captureChecks[id]
+	delete(c.captureChecks, id)
+	c.Unlock()
+
+	if summary.Packets == 0 {
+		summary.Diagnosis = CaptureTrafficUnknown
+		if found {
+			select {
+			case r := <-result:
+				switch {
+				case r.err != nil:
+					log.Printf("Couldn't count sessions during capture: %v\n", r.err)
+				case r.sessions > 0:
+					summary.Diagnosis = CaptureNotMatching
+				default:
+					summary.Diagnosis = CaptureNoTraffic
+				}
+			case <-time.After(statsSocketTimeout):
+			}
+		}
+		log.Printf("No packets retained during reload %d: %s\n", id, captureDiagnoses[summary.Diagnosis])
+		c.emptyCaptures.Inc(summary.Diagnosis)
+	}
+
+	c.Lock()
+	c.lastCapture = summary
+	c.Unlock()
+}
@@ -0,0 +1,92 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// sessionsStatLine is a line of show stat of a frontend with the given total
+// of sessions.
+func sessionsStatLine(name string, sessions string) string {
+	return name + ",FRONTEND,,,0,0,100," + sessions + ",0,0,0,0,,,,,,OPEN,\n"
+}
+
+func captureWithSummary(c *Controller, id uint64, summary *CaptureSummary) {
+	c.CaptureEvent(CaptureEvent{Event: "capture", State: ReleaseRequested, ReloadID: id})
+	c.CaptureEvent(CaptureEvent{Event: "capture", State: CaptureSummarized, ReloadID: id, Summary: summary})
+}
+
+func TestControllerCaptureDiagnosis(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+
+	cases := []struct {
+		name      string
+		stats     string
+		packets   int64
+		diagnosis string
+	}{
+		{"retained", statHeader + sessionsStatLine("web", "3"), 5, ""},
+		{"bypassed", statHeader + sessionsStatLine("web", "0") + sessionsStatLine("api", "3"), 0, CaptureNotMatching},
+		{"idle", statHeader + sessionsStatLine("web", "0"), 0, CaptureNoTraffic},
+		{"broken stats", statHeader + sessionsStatLine("web", "many"), 0, CaptureTrafficUnknown},
+	}
+	for i, tc := range cases {
+		stats := tc.stats
+		socket := newFakeStatsSocket(t, func(string) string { return stats })
+		c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+		c.StatsSocket = NewStatsSocket(socket.Path())
+
+		summary := &CaptureSummary{Packets: tc.packets}
+		captureWithSummary(c, uint64(i+1), summary)
+		socket.Close()
+
+		if summary.Diagnosis != tc.diagnosis {
+			t.Errorf("%s: expected diagnosis %q, found %q", tc.name, tc.diagnosis, summary.Diagnosis)
+		}
+		if c.lastCapture != summary {
+			t.Errorf("%s: last capture not recorded", tc.name)
+		}
+		if len(c.captureChecks) != 0 {
+			t.Errorf("%s: checks of captures not cleaned up", tc.name)
+		}
+	}
+}
+
+func TestControllerCaptureDiagnosisWithoutStats(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	defer func(path string) { procNetfilterQueuePath = path }(procNetfilterQueuePath)
+	procNetfilterQueuePath = config + ".missing"
+
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+	c.NetQueues = []uint{0}
+	summary := &CaptureSummary{}
+	captureWithSummary(c, 1, summary)
+	if summary.Diagnosis != CaptureTrafficUnknown {
+		t.Fatalf("unexpected diagnosis %q", summary.Diagnosis)
+	}
+	if v := counterValue(c.emptyCaptures, CaptureTrafficUnknown); v != 1 {
+		t.Fatalf("expected capture without packets to be counted, found %v", v)
+	}
+
+	status := getStatus(t, c)
+	lastCapture, _ := status["net_queues"]["last_capture"].(map[string]interface{})
+	if lastCapture["diagnosis"] != CaptureTrafficUnknown {
+		t.Fatalf("last capture not reported in status: %v", status["net_queues"])
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DirectiveCompatibility describes the versions of haproxy supporting a
+// directive. Since is the first version supporting it and Until the first
+// version not supporting it anymore, any of them can be empty.
+type DirectiveCompatibility struct {
+	Section string
+	Keyword string
+	Since   string
+	Until   string
+}
+
+// CompatibilityTable contains the directives checked for compatibility with
+// the running haproxy version, entries can be added to it.
+var CompatibilityTable = []DirectiveCompatibility{
+	{Section: "global", Keyword: "hard-stop-after", Since: "1.7"},
+	{Section: "global", Keyword: "master-worker", Since: "1.8"},
+	{Section: "global", Keyword: "nbthread", Since: "1.8"},
+	{Section: "global", Keyword: "insecure-fork-wanted", Since: "2.2"},
+	{Section: "global", Keyword: "nbproc", Until: "2.5"},
+}
+
+// CompatibilityChecker warns about directives of a configuration that are not
+// supported by the version of an haproxy binary.
+type CompatibilityChecker struct {
+	path  string
+	table []DirectiveCompatibility
+
+	// Used to obtain the version of the binary, mockable for tests
+	versionFunc func(string) (string, error)
+}
+
+func NewCompatibilityChecker(path string, table []DirectiveCompatibility) *CompatibilityChecker {
+	return &CompatibilityChecker{
+		path:        path,
+		table:       table,
+		versionFunc: haproxyVersion,
+	}
+}
+
+// Check returns warnings for the directives in the configuration that are
+// not supported by the haproxy binary.
+func (c *CompatibilityChecker) Check(content []byte) ([]string, error) {
+	version, err := c.versionFunc(c.path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't obtain haproxy version: %v", err)
+	}
+	return checkCompatibility(c.table, version, parseHaproxyConfig(content)), nil
+}
+
+func checkCompatibility(table []DirectiveCompatibility, version string, config *haproxyConfig) []string {
+	var warnings []string
+	for _, entry := range table {
+		supported := (entry.Since == "" || compareVersions(version, entry.Since) >= 0) &&
+			(entry.Until == "" || compareVersions(version, entry.Until) < 0)
+		if supported {
+			continue
+		}
+		for _, section := range config.Sections(entry.Section) {
+			if !section.HasDirective(entry.Keyword) {
+				continue
+			}
+			if entry.Since != "" && compareVersions(version, entry.Since) < 0 {
+				warnings = append(warnings, fmt.Sprintf("directive '%s' in %s requires haproxy %s or later, running %s", entry.Keyword, entry.Section, entry.Since, version))
+			} else {
+				warnings = append(warnings, fmt.Sprintf("directive '%s' in %s is not supported since haproxy %s, running %s", entry.Keyword, entry.Section, entry.Until, version))
+			}
+			break
+		}
+	}
+	return warnings
+}
+
+// compareVersions compares the numeric components of two haproxy versions,
+// suffixes like "-dev" are ignored.
+func compareVersions(a, b string) int {
+	va, vb := versionComponents(a), versionComponents(b)
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var x, y int
+		if i < len(va) {
+			x = va[i]
+		}
+		if i < len(vb) {
+			y = vb[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionComponents(version string) []int {
+	if i := strings.IndexAny(version, "-+ "); i >= 0 {
+		version = version[:i]
+	}
+	var components []int
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			break
+		}
+		components = append(components, n)
+	}
+	return components
+}
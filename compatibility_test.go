@@ -0,0 +1,98 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.8.4", "1.8", 1},
+		{"1.8", "1.8.0", 0},
+		{"1.7.9", "1.8", -1},
+		{"2.0-dev1", "2.0", 0},
+		{"2.4.22-f8e3218", "2.10", -1},
+		{"1.10", "1.9", 1},
+	}
+	for _, c := range cases {
+		if found := compareVersions(c.a, c.b); found != c.expected {
+			t.Errorf("compareVersions(%q, %q) = %d, expected %d", c.a, c.b, found, c.expected)
+		}
+	}
+}
+
+func TestCheckCompatibility(t *testing.T) {
+	config := parseHaproxyConfig([]byte(`global
+    master-worker
+    nbproc 2
+    # nbthread 4
+
+defaults
+    hard-stop-after 1s
+`))
+	cases := []struct {
+		version  string
+		warnings []string
+	}{
+		{"1.7.9", []string{"'master-worker' in global requires haproxy 1.8"}},
+		{"1.8.4", nil},
+		{"2.4.22", nil},
+		{"2.5.0", []string{"'nbproc' in global is not supported since haproxy 2.5"}},
+	}
+	for _, c := range cases {
+		warnings := checkCompatibility(CompatibilityTable, c.version, config)
+		if len(warnings) != len(c.warnings) {
+			t.Errorf("version %s: expected %d warnings, found %v", c.version, len(c.warnings), warnings)
+			continue
+		}
+		for i := range warnings {
+			if !strings.Contains(warnings[i], c.warnings[i]) {
+				t.Errorf("version %s: unexpected warning %q, expected %q", c.version, warnings[i], c.warnings[i])
+			}
+		}
+	}
+}
+
+func TestCheckCompatibilityExtended(t *testing.T) {
+	table := append(CompatibilityTable, DirectiveCompatibility{Section: "defaults", Keyword: "http-reuse", Since: "1.6"})
+	config := parseHaproxyConfig([]byte("defaults\n    http-reuse safe\n"))
+	if warnings := checkCompatibility(table, "1.5.18", config); len(warnings) != 1 {
+		t.Fatalf("expected a warning, found %v", warnings)
+	}
+}
+
+func TestControllerValidateWarnings(t *testing.T) {
+	config := tempConfig(t, "global\n    nbthread 4\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+	c.Compatibility = NewCompatibilityChecker("haproxy", CompatibilityTable)
+	c.Compatibility.versionFunc = func(string) (string, error) { return "1.7.11", nil }
+
+	rec := httptest.NewRecorder()
+	c.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/validate", nil))
+	if rec.Code != 200 {
+		t.Fatalf("validation shouldn't fail because of warnings, found status %d", rec.Code)
+	}
+	if !strings.HasPrefix(rec.Body.String(), "OK\n") || !strings.Contains(rec.Body.String(), "Warning: directive 'nbthread'") {
+		t.Fatalf("unexpected response: %q", rec.Body.String())
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configHash returns the hex encoded SHA-256 of the given config content.
+func configHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// readConfig returns the content of the config file and its hash.
+func readConfig(path string) ([]byte, string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return content, configHash(content), nil
+}
+
+// configETag returns the hash of all the configuration files loaded by
+// haproxy, sent as ETag of the configuration and checked in If-Match headers.
+func (c *Controller) configETag() (string, error) {
+	if c.ConfigFiles == "" {
+		_, hash, err := readConfig(c.configFile)
+		return hash, err
+	}
+	return configFilesHash(c.ConfigFiles)
+}
+
+// etagMatches checks if an If-Match header value matches the given hash,
+// using strong comparison as required for If-Match.
+func etagMatches(header, hash string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == `"`+hash+`"` {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFileAtomic writes content to a temporary file in the same directory
+// and renames it to path, so readers never see a partially written file.
+// It keeps the permissions of the existing file.
+func writeFileAtomic(path string, content []byte) error {
+	temp, err := writeTempFile(path, content)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp)
+	return os.Rename(temp, path)
+}
+
+// writeTempFile writes content to a temporary file in the directory of path,
+// with the permissions of path if it exists, so it can be renamed to it.
+func writeTempFile(path string, content []byte) (string, error) {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+	err = func() error {
+		if _, err := f.Write(content); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return os.Chmod(f.Name(), mode)
+	}()
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
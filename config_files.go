@@ -0,0 +1,179 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The configuration of haproxy can be split in several files, given as a
+// comma-separated list of files and directories. They are passed in order
+// to haproxy with -f, that loads the files ending in .cfg of directories in
+// lexical order. The same arguments are used to run and to validate the
+// configuration.
+
+// configFileList returns the files and directories in a comma-separated
+// list of configuration files.
+func configFileList(configFiles string) []string {
+	var list []string
+	for _, f := range strings.Split(configFiles, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+// configFileArgs returns the arguments of haproxy to load a comma-separated
+// list of configuration files.
+func configFileArgs(configFiles string) []string {
+	var args []string
+	for _, f := range configFileList(configFiles) {
+		args = append(args, "-f", f)
+	}
+	return args
+}
+
+// configDirFiles returns the files haproxy loads from a directory, the ones
+// ending in .cfg, in lexical order.
+func configDirFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".cfg") {
+			continue
+		}
+		files = append(files, filepath.Join(dir, info.Name()))
+	}
+	return files, nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// expandConfigFiles returns the files loaded by haproxy from a
+// comma-separated list of configuration files, in the order they are
+// loaded.
+func expandConfigFiles(configFiles string) ([]string, error) {
+	var files []string
+	for _, f := range configFileList(configFiles) {
+		if !isDir(f) {
+			files = append(files, f)
+			continue
+		}
+		dirFiles, err := configDirFiles(f)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, dirFiles...)
+	}
+	return files, nil
+}
+
+// mainConfigFile returns the first file loaded from a comma-separated list
+// of configuration files. This is the file managed by the controller, the
+// rest are only read by haproxy.
+func mainConfigFile(configFiles string) (string, error) {
+	list := configFileList(configFiles)
+	if len(list) == 0 {
+		return "", fmt.Errorf("no configuration files")
+	}
+	if !isDir(list[0]) {
+		return list[0], nil
+	}
+	files, err := configDirFiles(list[0])
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("no .cfg files in %s", list[0])
+	}
+	return files[0], nil
+}
+
+// replaceMainConfigFile returns the comma-separated list of configuration
+// files with the main file replaced by another one, to validate alternative
+// configurations with the rest of files. The directory with the main file,
+// if any, is replaced by its files.
+func replaceMainConfigFile(configFiles, main, replacement string) (string, error) {
+	var list []string
+	for _, f := range configFileList(configFiles) {
+		if !isDir(f) {
+			if f == main {
+				f = replacement
+			}
+			list = append(list, f)
+			continue
+		}
+		files, err := configDirFiles(f)
+		if err != nil {
+			return "", err
+		}
+		inDir := false
+		for i := range files {
+			if files[i] == main {
+				files[i] = replacement
+				inDir = true
+			}
+		}
+		if inDir {
+			list = append(list, files...)
+		} else {
+			list = append(list, f)
+		}
+	}
+	return strings.Join(list, ","), nil
+}
+
+// configFilesHash returns a hash of the content of all the files loaded from
+// a comma-separated list of configuration files. It is the hash of the
+// content of the file if there is only one.
+func configFilesHash(configFiles string) (string, error) {
+	files, err := expandConfigFiles(configFiles)
+	if err != nil {
+		return "", err
+	}
+	var content bytes.Buffer
+	for _, f := range files {
+		c, err := ioutil.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		content.Write(c)
+	}
+	return configHash(content.Bytes()), nil
+}
+
+// newMainValidator returns a validator of the configuration files with the
+// main file replaced by another one.
+func newMainValidator(path, configFiles, main, replacement string) HaproxyConfigValidator {
+	replaced, err := replaceMainConfigFile(configFiles, main, replacement)
+	if err != nil {
+		log.Printf("Couldn't list configuration files, validating %s alone: %v\n", replacement, err)
+		replaced = replacement
+	}
+	return NewHaproxyDashC(path, replaced)
+}
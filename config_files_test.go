@@ -0,0 +1,81 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func configDir(t *testing.T, files ...string) string {
+	dir, err := ioutil.TempDir("", "haproxy-cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(f+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestConfigFiles(t *testing.T) {
+	dir := configDir(t, "b.cfg", "a.cfg", "c.txt")
+	defer os.RemoveAll(dir)
+	a, b := filepath.Join(dir, "a.cfg"), filepath.Join(dir, "b.cfg")
+
+	configFiles := "haproxy.cfg, " + dir
+	if args, expected := configFileArgs(configFiles), []string{"-f", "haproxy.cfg", "-f", dir}; !reflect.DeepEqual(args, expected) {
+		t.Fatalf("found arguments %v, expected %v", args, expected)
+	}
+	if main, err := mainConfigFile(configFiles); err != nil || main != "haproxy.cfg" {
+		t.Fatalf("found main file %q (%v), expected haproxy.cfg", main, err)
+	}
+	if main, err := mainConfigFile(dir); err != nil || main != a {
+		t.Fatalf("found main file %q (%v), expected %s", main, err, a)
+	}
+	if files, err := expandConfigFiles(configFiles); err != nil || !reflect.DeepEqual(files, []string{"haproxy.cfg", a, b}) {
+		t.Fatalf("found files %v (%v)", files, err)
+	}
+
+	if replaced, err := replaceMainConfigFile(configFiles, "haproxy.cfg", "new.cfg"); err != nil || replaced != "new.cfg,"+dir {
+		t.Fatalf("found replaced files %q (%v)", replaced, err)
+	}
+	if replaced, err := replaceMainConfigFile(dir+",other.cfg", a, "new.cfg"); err != nil || replaced != "new.cfg,"+b+",other.cfg" {
+		t.Fatalf("found replaced files %q (%v)", replaced, err)
+	}
+}
+
+func TestConfigFilesHash(t *testing.T) {
+	dir := configDir(t, "a.cfg", "b.cfg")
+	defer os.RemoveAll(dir)
+
+	if hash, err := configFilesHash(dir); err != nil || hash != configHash([]byte("a.cfg\nb.cfg\n")) {
+		t.Fatalf("unexpected hash %q (%v)", hash, err)
+	}
+	if hash, err := configFilesHash(filepath.Join(dir, "a.cfg")); err != nil || hash != configHash([]byte("a.cfg\n")) {
+		t.Fatalf("unexpected hash %q (%v)", hash, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.cfg"), []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := configFilesHash(dir); hash != configHash([]byte("a.cfg\nchanged\n")) {
+		t.Fatal("hash not changed after changing included file")
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum size of the table used to match the changed lines of two versions,
+// changes over this size are attributed to the newer version as a whole
+const maxBlameCells = 4 << 20
+
+// ConfigVersion is a configuration applied by a reload.
+type ConfigVersion struct {
+	Hash  string    `json:"hash"`
+	Time  time.Time `json:"time"`
+	Actor string    `json:"actor,omitempty"`
+
+	// Changes from the previous version, if retained
+	Changes *TopologyDelta `json:"changes,omitempty"`
+
+	content []byte
+}
+
+// ConfigHistory keeps the last configurations applied, up to its depth.
+// If persisted, versions are also kept in files, so they survive restarts.
+type ConfigHistory struct {
+	sync.Mutex
+	depth    int
+	versions []ConfigVersion
+
+	// Prefix of the files of the versions, path.1 is the newest one
+	path string
+}
+
+func NewConfigHistory(depth int) *ConfigHistory {
+	return &ConfigHistory{depth: depth}
+}
+
+// Add records the content as the last version applied, consecutive reloads
+// of the same content are recorded only once.
+func (h *ConfigHistory) Add(content []byte, actor string) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	hash := configHash(content)
+	version := ConfigVersion{
+		Hash:    hash,
+		Time:    time.Now(),
+		Actor:   actor,
+		content: content,
+	}
+	if n := len(h.versions); n > 0 {
+		if h.versions[n-1].Hash == hash {
+			return
+		}
+		version.Changes = topologyDelta(h.versions[n-1].content, content)
+	}
+	h.versions = append(h.versions, version)
+	if len(h.versions) > h.depth {
+		h.versions = append([]ConfigVersion{}, h.versions[len(h.versions)-h.depth:]...)
+	}
+	if h.path != "" {
+		if err := h.rotate(version); err != nil {
+			log.Printf("Couldn't keep configuration version in %s: %v\n", h.path, err)
+		}
+	}
+}
+
+// Persist keeps the versions in files with the given prefix, numbered from
+// path.1 for the newest one to path.N for the oldest one, with the time they
+// were applied as modification time. Versions found in these files are
+// loaded, it must be called before adding versions.
+func (h *ConfigHistory) Persist(path string) error {
+	h.Lock()
+	defer h.Unlock()
+	h.path = path
+	var versions []ConfigVersion
+	for i := h.depth; i > 0; i-- {
+		name := path + "." + strconv.Itoa(i)
+		content, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		versions = append(versions, ConfigVersion{Hash: configHash(content), Time: info.ModTime(), content: content})
+	}
+	for i := 1; i < len(versions); i++ {
+		versions[i].Changes = topologyDelta(versions[i-1].content, versions[i].content)
+	}
+	h.versions = versions
+	return nil
+}
+
+// rotate shifts the files of the versions, discarding the oldest one, and
+// writes the new version as path.1.
+func (h *ConfigHistory) rotate(version ConfigVersion) error {
+	os.Remove(h.path + "." + strconv.Itoa(h.depth))
+	for i := h.depth - 1; i > 0; i-- {
+		err := os.Rename(h.path+"."+strconv.Itoa(i), h.path+"."+strconv.Itoa(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	name := h.path + ".1"
+	if err := writeFileAtomic(name, version.content); err != nil {
+		return err
+	}
+	return os.Chtimes(name, version.Time, version.Time)
+}
+
+// Previous returns the newest version different to the given hash, or the
+// version with the target hash if set.
+func (h *ConfigHistory) Previous(current, target string) (ConfigVersion, bool) {
+	h.Lock()
+	defer h.Unlock()
+	for i := len(h.versions) - 1; i >= 0; i-- {
+		v := h.versions[i]
+		if (target == "" && v.Hash != current) || (target != "" && v.Hash == target) {
+			return v, true
+		}
+	}
+	return ConfigVersion{}, false
+}
+
+// Versions returns the versions retained, from the oldest to the newest.
+func (h *ConfigHistory) Versions() []ConfigVersion {
+	h.Lock()
+	defer h.Unlock()
+	return append([]ConfigVersion{}, h.versions...)
+}
+
+// BlameLine is a line of the configuration with the version that last
+// changed it. Lines not changed since the oldest version retained are marked
+// as boundary, as they could have been introduced before. Lines without
+// version are not applied yet.
+type BlameLine struct {
+	Line     int            `json:"line"`
+	Content  string         `json:"content"`
+	Version  *ConfigVersion `json:"version,omitempty"`
+	Boundary bool           `json:"boundary,omitempty"`
+}
+
+// ConfigBlame annotates each line of a configuration with its version.
+type ConfigBlame struct {
+	Hash     string      `json:"hash"`
+	Versions int         `json:"versions"`
+	Lines    []BlameLine `json:"lines"`
+}
+
+// Blame attributes each line of the content to the version of the history
+// that last changed it, diffing each version with the previous one.
+func (h *ConfigHistory) Blame(content []byte) *ConfigBlame {
+	versions := h.Versions()
+	blame := &ConfigBlame{Hash: configHash(content), Versions: len(versions)}
+
+	var lines []string
+	var owners []int
+	for i, v := range versions {
+		next := splitLines(v.content)
+		nextOwners := make([]int, len(next))
+		for j, k := range matchLines(lines, next) {
+			if k < 0 {
+				nextOwners[j] = i
+			} else {
+				nextOwners[j] = owners[k]
+			}
+		}
+		lines, owners = next, nextOwners
+	}
+
+	current := splitLines(content)
+	for j, k := range matchLines(lines, current) {
+		line := BlameLine{Line: j + 1, Content: current[j]}
+		if k >= 0 {
+			v := versions[owners[k]]
+			line.Version = &v
+			line.Boundary = owners[k] == 0
+		}
+		blame.Lines = append(blame.Lines, line)
+	}
+	return blame
+}
+
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+// matchLines returns for each line of b the index of the same line in a, or
+// -1 if the line was added, following their longest common subsequence.
+func matchLines(a, b []string) []int {
+	matches := make([]int, len(b))
+	for j := range matches {
+		matches[j] = -1
+	}
+
+	// Common prefix and suffix are matched directly, what is usually most of
+	// the configuration
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		matches[prefix] = prefix
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		matches[len(b)-1-suffix] = len(a) - 1 - suffix
+		suffix++
+	}
+
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(ma) == 0 || len(mb) == 0 || (len(ma)+1)*(len(mb)+1) > maxBlameCells {
+		return matches
+	}
+
+	// lengths[i][j] is the length of the common subsequence of ma[i:] and
+	// mb[j:]
+	width := len(mb) + 1
+	lengths := make([]int32, (len(ma)+1)*width)
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			switch {
+			case ma[i] == mb[j]:
+				lengths[i*width+j] = lengths[(i+1)*width+j+1] + 1
+			case lengths[(i+1)*width+j] >= lengths[i*width+j+1]:
+				lengths[i*width+j] = lengths[(i+1)*width+j]
+			default:
+				lengths[i*width+j] = lengths[i*width+j+1]
+			}
+		}
+	}
+	for i, j := 0, 0; i < len(ma) && j < len(mb); {
+		switch {
+		case ma[i] == mb[j]:
+			matches[prefix+j] = prefix + i
+			i++
+			j++
+		case lengths[(i+1)*width+j] >= lengths[i*width+j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return matches
+}
+
+// requestActor identifies who sent a request, by the From header if set, or
+// by its remote address.
+func requestActor(req *http.Request) string {
+	if from := req.Header.Get("From"); from != "" {
+		return from
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// configBlame annotates the current configuration with the reloads that
+// changed each line, within the retained history. Sensitive values are
+// masked.
+func (c *Controller) configBlame(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	if c.History == nil {
+		http.Error(w, "Configuration history not enabled\n", http.StatusNotFound)
+		return
+	}
+	content, _, err := readConfig(c.configFile)
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't read configuration: %v\n", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	blame := c.History.Blame(content)
+	for i := range blame.Lines {
+		blame.Lines[i].Content = c.Redactor.RedactString(blame.Lines[i].Content)
+	}
+	writeJSON(w, blame)
+}
+
+// configHistory lists the versions of the configuration retained, from the
+// newest to the oldest.
+func (c *Controller) configHistory(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	if c.History == nil {
+		http.Error(w, "Configuration history not enabled\n", http.StatusNotFound)
+		return
+	}
+	versions := c.History.Versions()
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
+	writeJSON(w, versions)
+}
+
+// rollback restores the previous version of the configuration applied, or the
+// one with the hash in the request, validates it and reloads haproxy.
+func (c *Controller) rollback(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorize(w, req) {
+		return
+	}
+	if c.History == nil {
+		http.Error(w, "Configuration history not enabled\n", http.StatusNotFound)
+		return
+	}
+	c.Lock()
+	current := configHash(c.applied)
+	c.Unlock()
+	version, found := c.History.Previous(current, req.URL.Query().Get("hash"))
+	if !found {
+		http.Error(w, "No configuration to roll back to\n", http.StatusConflict)
+		return
+	}
+	if !c.replaceConfig(w, version.content) {
+		return
+	}
+	log.Printf("Configuration rolled back to %s\n", version.Hash)
+	outcome := c.doReload(reloadRequest{actor: requestActor(req)})
+	if !outcome.Success {
+		msg := fmt.Sprintf("Couldn't reload: %v\n", outcome.Error)
+		log.Println(msg)
+		http.Error(w, msg, outcome.httpStatus())
+		return
+	}
+	fmt.Fprintf(w, "OK\n")
+}
@@ -0,0 +1,254 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchLines(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected []int
+	}{
+		{"", "a b", []int{-1, -1}},
+		{"a b", "", []int{}},
+		{"a b c", "a b c", []int{0, 1, 2}},
+		{"a b c", "a x c", []int{0, -1, 2}},
+		{"a b c", "a b x c", []int{0, 1, -1, 2}},
+		{"a b c d", "a d", []int{0, 3}},
+		{"a b c d e", "a c x b e", []int{0, 2, -1, -1, 4}},
+		{"x a b", "a b x", []int{1, 2, -1}},
+	}
+	for _, c := range cases {
+		found := matchLines(strings.Fields(c.a), strings.Fields(c.b))
+		if !reflect.DeepEqual(found, c.expected) {
+			t.Errorf("%q -> %q: expected %v, found %v", c.a, c.b, c.expected, found)
+		}
+	}
+}
+
+// blameSummary describes each line of a blame by its content, the actor of
+// its version and if it's a boundary.
+func blameSummary(blame *ConfigBlame) []string {
+	var summary []string
+	for _, l := range blame.Lines {
+		actor := "-"
+		if l.Version != nil {
+			actor = l.Version.Actor
+		}
+		if l.Boundary {
+			actor = "^" + actor
+		}
+		summary = append(summary, actor+" "+l.Content)
+	}
+	return summary
+}
+
+func TestConfigHistoryBlame(t *testing.T) {
+	h := NewConfigHistory(5)
+	h.Add([]byte("global\n    daemon\nbackend app\n    server app1 10.0.0.1:80\n"), "startup")
+	h.Add([]byte("global\n    daemon\nbackend app\n    server app1 10.0.0.1:80\n    server app2 10.0.0.2:80\n"), "alice")
+	h.Add([]byte("global\n    daemon\nbackend app\n    server app1 10.0.0.1:80\n    server app2 10.0.0.2:80\n"), "bob")
+	h.Add([]byte("global\n    daemon\n    maxconn 100\nbackend app\n    server app2 10.0.0.2:80\n"), "carol")
+
+	blame := h.Blame([]byte("global\n    daemon\n    maxconn 100\nbackend app\n    server app2 10.0.0.2:80\n    server app3 10.0.0.3:80\n"))
+	expected := []string{
+		"^startup global",
+		"^startup     daemon",
+		"carol     maxconn 100",
+		"^startup backend app",
+		"alice     server app2 10.0.0.2:80",
+		"-     server app3 10.0.0.3:80",
+	}
+	if found := blameSummary(blame); !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %q, found %q", expected, found)
+	}
+	if blame.Versions != 3 {
+		t.Errorf("expected 3 versions, the same content is recorded once, found %d", blame.Versions)
+	}
+	if blame.Lines[5].Line != 6 {
+		t.Errorf("expected line numbers starting at 1, found %+v", blame.Lines[5])
+	}
+}
+
+func TestConfigHistoryDepth(t *testing.T) {
+	h := NewConfigHistory(2)
+	h.Add([]byte("a\n"), "first")
+	h.Add([]byte("a\nb\n"), "second")
+	h.Add([]byte("a\nb\nc\n"), "third")
+
+	versions := h.Versions()
+	if len(versions) != 2 || versions[0].Actor != "second" || versions[1].Actor != "third" {
+		t.Fatalf("unexpected versions retained: %+v", versions)
+	}
+	expected := []string{"^second a", "^second b", "third c"}
+	if found := blameSummary(h.Blame([]byte("a\nb\nc\n"))); !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %q, found %q", expected, found)
+	}
+}
+
+func TestControllerConfigBlame(t *testing.T) {
+	config := tempConfig(t, "userlist users\n    user admin password secret\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+	c.Redactor, _ = NewConfigRedactor(defaultRedactPatterns)
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/config/blame", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without history, found %d", w.Code)
+	}
+
+	c.History = NewConfigHistory(5)
+	content, _ := ioutil.ReadFile(config)
+	c.History.Add(content, "startup")
+	if err := ioutil.WriteFile(config, append(content, "    user operator password other\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/reload", nil)
+	req.Header.Set("From", "alice@example.com")
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("reload failed: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/config/blame", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	if strings.Contains(body, "secret") || strings.Contains(body, "other") {
+		t.Errorf("secrets not masked: %s", body)
+	}
+	var blame ConfigBlame
+	if err := json.Unmarshal(w.Body.Bytes(), &blame); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"^startup userlist users",
+		"^startup     user admin password " + redactedValue,
+		"alice@example.com     user operator password " + redactedValue,
+	}
+	if found := blameSummary(&blame); !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %q, found %q", expected, found)
+	}
+	if last := blame.Lines[2].Version; last == nil || last.Hash != c.lastReload.Hash || last.Time.IsZero() {
+		t.Errorf("unexpected version of changed line: %+v", last)
+	}
+}
+
+func TestConfigHistoryPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "haproxy.cfg")
+
+	h := NewConfigHistory(2)
+	if err := h.Persist(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"a\n", "b\n", "c\n"} {
+		h.Add([]byte(content), "test")
+	}
+	for name, expected := range map[string]string{".1": "c\n", ".2": "b\n"} {
+		if content, err := ioutil.ReadFile(path + name); err != nil || string(content) != expected {
+			t.Errorf("%s: found %q, expected %q (%v)", name, content, expected, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("version over the depth of the history kept: %v", err)
+	}
+
+	// Versions are loaded after restarts
+	restarted := NewConfigHistory(2)
+	if err := restarted.Persist(path); err != nil {
+		t.Fatal(err)
+	}
+	restarted.Add([]byte("c\n"), "startup")
+	versions := restarted.Versions()
+	if len(versions) != 2 || string(versions[0].content) != "b\n" || string(versions[1].content) != "c\n" {
+		t.Fatalf("unexpected versions loaded: %+v", versions)
+	}
+	if !versions[1].Time.Equal(h.Versions()[1].Time) {
+		t.Errorf("time of version not kept: %s", versions[1].Time)
+	}
+}
+
+func TestControllerRollback(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	haproxy := &fakeHaproxy{}
+	c := NewController("", config, haproxy, &fakeValidator{})
+	c.NewValidator = func(configFile string) HaproxyConfigValidator {
+		return &contentValidator{path: configFile}
+	}
+	rollback := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, httptest.NewRequest("POST", target, nil))
+		return w
+	}
+	if w := rollback("/rollback"); w.Code != http.StatusNotFound {
+		t.Fatalf("rollback without history: %d", w.Code)
+	}
+
+	c.History = NewConfigHistory(5)
+	c.History.Add([]byte("global\n"), "startup")
+	if w := rollback("/rollback"); w.Code != http.StatusConflict {
+		t.Fatalf("rollback without previous version: %d", w.Code)
+	}
+	for _, content := range []string{"global\n    invalid\n", "global\n    maxconn 10\n"} {
+		ioutil.WriteFile(config, []byte(content), 0644)
+		if outcome := c.Reload(); !outcome.Success {
+			t.Fatalf("unexpected outcome: %+v", outcome)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/config/history", nil))
+	var versions []ConfigVersion
+	if err := json.Unmarshal(w.Body.Bytes(), &versions); err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0].Hash != configHash([]byte("global\n    maxconn 10\n")) || versions[2].Actor != "startup" {
+		t.Fatalf("unexpected history: %+v", versions)
+	}
+
+	// The previous version is not valid anymore
+	if w := rollback("/rollback"); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid version rolled back: %d", w.Code)
+	}
+	if w := rollback("/rollback?hash=" + versions[2].Hash); w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	if content, _ := ioutil.ReadFile(config); string(content) != "global\n" || haproxy.reloads != 3 {
+		t.Fatalf("configuration not rolled back: %q, %d reloads", content, haproxy.reloads)
+	}
+	if w := rollback("/rollback?hash=unknown"); w.Code != http.StatusConflict {
+		t.Fatalf("rollback to unknown version: %d", w.Code)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"unicode/utf8"
+)
+
+const (
+	// Maximum size of configurations uploaded
+	maxConfigSize = 16 << 20
+
+	// Maximum length of the lines of configurations uploaded, haproxy
+	// doesn't accept longer lines
+	maxConfigLineLength = 2048
+
+	// Maximum size of the options of a reload
+	maxReloadBodySize = 64 << 10
+)
+
+// checkConfigContent checks that uploaded content looks like a configuration
+// file, before writing it to disk or running the validator on it.
+func checkConfigContent(content []byte) error {
+	if len(bytes.TrimSpace(content)) == 0 {
+		return fmt.Errorf("empty configuration")
+	}
+	if !utf8.Valid(content) {
+		return fmt.Errorf("configuration is not text, found invalid UTF-8")
+	}
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		if len(line) > maxConfigLineLength {
+			return fmt.Errorf("line %d is longer than %d bytes", i+1, maxConfigLineLength)
+		}
+		if bytes.IndexByte(line, 0) >= 0 {
+			return fmt.Errorf("line %d contains null bytes", i+1)
+		}
+		for _, r := range string(line) {
+			if r < ' ' && r != '\t' && r != '\r' {
+				return fmt.Errorf("line %d contains control character %U, configuration is not text", i+1, r)
+			}
+		}
+	}
+	return nil
+}
+
+// readConfigBody reads a configuration from the body of the request. If it
+// cannot be read or it is malformed, it replies to the request and returns
+// false.
+func readConfigBody(w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	content, err := ioutil.ReadAll(io.LimitReader(req.Body, maxConfigSize+1))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Couldn't read configuration: %v\n", err), http.StatusBadRequest)
+		return nil, false
+	}
+	if len(content) > maxConfigSize {
+		http.Error(w, fmt.Sprintf("Invalid configuration: larger than %d bytes\n", maxConfigSize), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err := checkConfigContent(content); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid configuration: %v\n", err), http.StatusBadRequest)
+		return nil, false
+	}
+	return content, true
+}
@@ -0,0 +1,106 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+var malformedConfigs = []struct {
+	name, content, message string
+	code                   int
+}{
+	{"empty", "", "empty configuration", http.StatusBadRequest},
+	{"blank", " \n\t\n", "empty configuration", http.StatusBadRequest},
+	{"binary", "global\n\xff\xfe\x00\x01", "not text", http.StatusBadRequest},
+	{"null bytes", "global\n    maxconn 10\x00\n", "line 2 contains null bytes", http.StatusBadRequest},
+	{"control characters", "global\n\x1b[31m\n", "line 2 contains control character", http.StatusBadRequest},
+	{"long line", "global\n    " + strings.Repeat("a", maxConfigLineLength) + "\n", "line 2 is longer than", http.StatusBadRequest},
+	{"too large", strings.Repeat("#\n", maxConfigSize/2+1), "larger than", http.StatusRequestEntityTooLarge},
+}
+
+func TestCheckConfigContent(t *testing.T) {
+	valid := "global\r\n\tmaxconn 10\n\n# Configuración\nfrontend web\n    bind :80\n"
+	if err := checkConfigContent([]byte(valid)); err != nil {
+		t.Fatalf("valid configuration rejected: %v", err)
+	}
+	for _, c := range malformedConfigs {
+		if c.code != http.StatusBadRequest {
+			continue
+		}
+		err := checkConfigContent([]byte(c.content))
+		if err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s: found error %v, expected %q", c.name, err, c.message)
+		}
+	}
+}
+
+func TestControllerUploadMalformedConfig(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+	s, standbyValidator, dir := newTestStandby(t)
+	defer os.RemoveAll(dir)
+
+	haproxy := &fakeHaproxy{}
+	validator := &countingValidator{}
+	c := NewController("", path, haproxy, validator)
+	c.NewValidator = func(string) HaproxyConfigValidator { return validator }
+	c.Standby = s
+
+	for _, target := range []string{"/config", "/config/standby"} {
+		for _, m := range malformedConfigs {
+			w := httptest.NewRecorder()
+			c.handler().ServeHTTP(w, httptest.NewRequest("PUT", target, strings.NewReader(m.content)))
+			if w.Code != m.code || !strings.Contains(w.Body.String(), m.message) {
+				t.Errorf("%s %s: unexpected response %d: %s", target, m.name, w.Code, w.Body.String())
+			}
+		}
+	}
+	if validator.calls != 0 || standbyValidator.calls != 0 {
+		t.Fatalf("malformed configurations validated %d times", validator.calls+standbyValidator.calls)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "global\n" || haproxy.reloads != 0 {
+		t.Fatalf("malformed configuration applied: %q", content)
+	}
+	if _, err := os.Stat(s.path); !os.IsNotExist(err) {
+		t.Fatalf("malformed standby configuration written: %v", err)
+	}
+}
+
+func TestControllerReloadLargeBody(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	haproxy := &fakeHaproxy{}
+	c := NewController("", path, haproxy, &fakeValidator{})
+	body := bytes.Repeat([]byte(" "), maxReloadBodySize+1)
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/reload", bytes.NewReader(body)))
+	if w.Code != http.StatusBadRequest || haproxy.reloads != 0 {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/reload", strings.NewReader("{\"capture\":\x00}")))
+	if w.Code != http.StatusBadRequest || haproxy.reloads != 0 {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+}
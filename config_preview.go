@@ -0,0 +1,317 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Lines of context around the changes in diffs
+const diffContext = 3
+
+// ConfigPreview is what would happen if a candidate configuration was
+// applied, obtained without applying it.
+type ConfigPreview struct {
+	Hash string `json:"hash"`
+
+	// Whether the candidate passes the checks and the validation, and the
+	// phase failing otherwise
+	Valid bool   `json:"valid"`
+	Phase string `json:"phase,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	// Unified diff against the live configuration
+	Diff     string         `json:"diff"`
+	Changes  *TopologyDelta `json:"changes"`
+	Warnings []string       `json:"warnings"`
+}
+
+// configPreview is the last preview, that can be committed while the live
+// configuration doesn't change.
+type configPreview struct {
+	content  []byte
+	hash     string
+	liveHash string
+}
+
+// previewCheck is a check of the content of the configuration done before
+// validating it, with the phase of reloads doing it.
+type previewCheck struct {
+	phase string
+	check func([]byte) error
+}
+
+// previewConfig checks and validates a candidate configuration, and compares
+// it with the live one, without writing it over the configuration file.
+func (c *Controller) previewConfig(content []byte) (*ConfigPreview, error) {
+	live, liveHash, err := readConfig(c.configFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read configuration: %v", err)
+	}
+	preview := &ConfigPreview{
+		Hash:     configHash(content),
+		Valid:    true,
+		Diff:     unifiedDiff(splitLines(c.Redactor.Redact(live)), splitLines(c.Redactor.Redact(content))),
+		Changes:  topologyDelta(live, content),
+		Warnings: []string{},
+	}
+	fail := func(phase string, err error) {
+		preview.Valid = false
+		preview.Phase = phase
+		preview.Error = c.Redactor.RedactString(err.Error())
+	}
+
+	// Same checks as in reloads, in the same order
+	checks := []previewCheck{{ReloadPhaseAnnotations, (&ReloadSettings{}).applyAnnotations}}
+	if c.Policy != nil {
+		checks = append(checks, previewCheck{ReloadPhasePolicy, c.Policy.Check})
+	}
+	if c.Preflight != nil {
+		checks = append(checks, previewCheck{ReloadPhasePreflight, c.Preflight.Check})
+	}
+	for _, check := range checks {
+		if err := check.check(content); err != nil {
+			fail(check.phase, err)
+			break
+		}
+	}
+	if preview.Valid {
+		temp, err := writeTempFile(c.configFile, content)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't write configuration: %v", err)
+		}
+		defer os.Remove(temp)
+		warnings, err := validateWithWarnings(c.NewValidator(temp))
+		if err != nil {
+			fail(ReloadPhaseValidate, err)
+		}
+		for _, warning := range warnings {
+			preview.Warnings = append(preview.Warnings, c.Redactor.RedactString(warning))
+		}
+	}
+	if c.Compatibility != nil {
+		warnings, err := c.Compatibility.Check(content)
+		if err != nil {
+			log.Printf("Couldn't check compatibility of configuration: %v\n", err)
+		}
+		preview.Warnings = append(preview.Warnings, warnings...)
+	}
+
+	c.Lock()
+	if preview.Valid {
+		c.preview = &configPreview{content: content, hash: preview.Hash, liveHash: liveHash}
+	} else {
+		c.preview = nil
+	}
+	c.Unlock()
+	return preview, nil
+}
+
+// configPreviewHandler previews the configuration in the body of the request.
+func (c *Controller) configPreviewHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorize(w, req) {
+		return
+	}
+	if c.NewValidator == nil {
+		http.Error(w, "Validation of new configurations not enabled\n", http.StatusNotFound)
+		return
+	}
+	content, ok := readConfigBody(w, req)
+	if !ok {
+		return
+	}
+	preview, err := c.previewConfig(content)
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't preview configuration: %v\n", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, preview)
+}
+
+// configDiff returns the unified diff between the live configuration and the
+// one in the body of the request, without checking or applying it. The body
+// is empty if they are equal.
+func (c *Controller) configDiff(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorize(w, req) {
+		return
+	}
+	content, ok := readConfigBody(w, req)
+	if !ok {
+		return
+	}
+	live, _, err := readConfig(c.configFile)
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't read configuration: %v\n", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	fmt.Fprint(w, unifiedDiff(splitLines(c.Redactor.Redact(live)), splitLines(c.Redactor.Redact(content))))
+}
+
+// configCommit applies the last configuration previewed, identified by its
+// hash in the hash parameter, if the live configuration didn't change since
+// the preview.
+func (c *Controller) configCommit(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorize(w, req) {
+		return
+	}
+	if c.refuseTemplated(w) {
+		return
+	}
+	hash := req.URL.Query().Get("hash")
+	c.Lock()
+	preview := c.preview
+	c.Unlock()
+	if preview == nil || hash == "" || preview.hash != hash {
+		http.Error(w, fmt.Sprintf("No valid preview of configuration %q\n", hash), http.StatusConflict)
+		return
+	}
+	if _, liveHash, err := readConfig(c.configFile); err != nil || liveHash != preview.liveHash {
+		http.Error(w, "Configuration changed since the preview, preview it again\n", http.StatusPreconditionFailed)
+		return
+	}
+	if !c.replaceConfig(w, preview.content) {
+		return
+	}
+	c.Lock()
+	if c.preview == preview {
+		c.preview = nil
+	}
+	c.Unlock()
+	log.Printf("Configuration %s committed\n", hash)
+	outcome := c.doReload(reloadRequest{actor: requestActor(req)})
+	if !outcome.Success {
+		msg := fmt.Sprintf("Couldn't reload: %v\n", outcome.Error)
+		log.Println(msg)
+		http.Error(w, msg, outcome.httpStatus())
+		return
+	}
+	fmt.Fprintf(w, "OK\n")
+}
+
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines returns the operations converting a in b, following the lines
+// matched by matchLines.
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+	i := 0
+	for j, k := range matchLines(a, b) {
+		if k < 0 {
+			ops = append(ops, diffOp{'+', b[j]})
+			continue
+		}
+		for ; i < k; i++ {
+			ops = append(ops, diffOp{'-', a[i]})
+		}
+		ops = append(ops, diffOp{' ', b[j]})
+		i = k + 1
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	return ops
+}
+
+// unifiedDiff returns the differences between two configurations in unified
+// format, empty if they are equal.
+func unifiedDiff(a, b []string) string {
+	ops := diffLines(a, b)
+	var buf bytes.Buffer
+	oldLine, newLine := 0, 0
+	for start := 0; start < len(ops); {
+		change := start
+		for change < len(ops) && ops[change].kind == ' ' {
+			change++
+		}
+		if change == len(ops) {
+			break
+		}
+		if buf.Len() == 0 {
+			buf.WriteString("--- live\n+++ candidate\n")
+		}
+		// Changes closer than twice the context are in the same hunk
+		last := change
+		for k := change; k < len(ops); k++ {
+			if ops[k].kind != ' ' {
+				if k-last > 2*diffContext {
+					break
+				}
+				last = k
+			}
+		}
+		first := change - diffContext
+		if first < start {
+			first = start
+		}
+		end := last + diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		// Lines skipped before the hunk are not changed
+		oldLine += first - start
+		newLine += first - start
+		var hunk bytes.Buffer
+		oldCount, newCount := 0, 0
+		for _, op := range ops[first:end] {
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+			hunk.WriteByte(op.kind)
+			hunk.WriteString(op.line + "\n")
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(oldLine, oldCount), hunkRange(newLine, newCount))
+		buf.Write(hunk.Bytes())
+		oldLine += oldCount
+		newLine += newCount
+		start = end
+	}
+	return buf.String()
+}
+
+// hunkRange formats the range of lines of a hunk after the given line.
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
@@ -0,0 +1,207 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	var a, b []string
+	for i := 1; i <= 20; i++ {
+		a = append(a, "line"+string(rune('a'+i)))
+	}
+	b = append(b, a[:2]...)
+	b = append(b, "added")
+	b = append(b, a[2:15]...)
+	b = append(b, a[16:]...)
+
+	expected := `--- live
++++ candidate
+@@ -1,5 +1,6 @@
+ lineb
+ linec
++added
+ lined
+ linee
+ linef
+@@ -13,7 +14,6 @@
+ linen
+ lineo
+ linep
+-lineq
+ liner
+ lines
+ linet
+`
+	if diff := unifiedDiff(a, b); diff != expected {
+		t.Fatalf("found diff:\n%s\nexpected:\n%s", diff, expected)
+	}
+	if diff := unifiedDiff(a, a); diff != "" {
+		t.Fatalf("found diff of equal content: %q", diff)
+	}
+	if diff := unifiedDiff(nil, []string{"global"}); diff != "--- live\n+++ candidate\n@@ -0,0 +1,1 @@\n+global\n" {
+		t.Fatalf("unexpected diff of new content: %q", diff)
+	}
+}
+
+func TestControllerConfigPreview(t *testing.T) {
+	live := "global\n    maxconn 10\n\nbackend app\n    server app1 10.0.0.1:80\n"
+	path := tempConfig(t, live)
+	defer os.Remove(path)
+
+	haproxy := &fakeHaproxy{}
+	validator := &warningsValidator{warnings: []string{"config : missing timeouts for backend 'api'."}}
+	c := NewController("", path, haproxy, &fakeValidator{})
+	c.NewValidator = func(string) HaproxyConfigValidator { return validator }
+	c.History = NewConfigHistory(5)
+	post := func(target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, httptest.NewRequest("POST", target, strings.NewReader(body)))
+		return w
+	}
+
+	candidate := "global\n    maxconn 20\n\nbackend app\n    server app1 10.0.0.1:80\n\nbackend api\n    server api1 10.0.0.2:80\n"
+	w := post("/config/preview", candidate)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var preview ConfigPreview
+	if err := json.Unmarshal(w.Body.Bytes(), &preview); err != nil {
+		t.Fatal(err)
+	}
+	if !preview.Valid || preview.Hash != configHash([]byte(candidate)) {
+		t.Fatalf("unexpected preview: %+v", preview)
+	}
+	for _, line := range []string{"-    maxconn 10\n", "+    maxconn 20\n", "+backend api\n"} {
+		if !strings.Contains(preview.Diff, line) {
+			t.Errorf("line %q not found in diff:\n%s", line, preview.Diff)
+		}
+	}
+	if !reflect.DeepEqual(preview.Changes, &TopologyDelta{BackendsAdded: []string{"api"}, ServersAdded: []string{"api/api1"}}) {
+		t.Errorf("unexpected changes: %+v", preview.Changes)
+	}
+	if !reflect.DeepEqual(preview.Warnings, validator.warnings) {
+		t.Errorf("unexpected warnings: %v", preview.Warnings)
+	}
+
+	// Nothing is applied
+	if content, _ := ioutil.ReadFile(path); string(content) != live {
+		t.Fatalf("configuration changed by preview: %q", content)
+	}
+	if haproxy.reloads != 0 || len(c.History.Versions()) != 0 || c.lastReload != nil {
+		t.Fatalf("state changed by preview: %d reloads", haproxy.reloads)
+	}
+
+	if w := post("/config/commit?hash=other", ""); w.Code != http.StatusConflict {
+		t.Fatalf("commit of unknown preview: %d", w.Code)
+	}
+	if w := post("/config/commit?hash="+preview.Hash, ""); w.Code != http.StatusOK {
+		t.Fatalf("unexpected commit status %d: %s", w.Code, w.Body.String())
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != candidate || haproxy.reloads != 1 {
+		t.Fatalf("configuration not committed: %q, %d reloads", content, haproxy.reloads)
+	}
+	if w := post("/config/commit?hash="+preview.Hash, ""); w.Code != http.StatusConflict {
+		t.Fatalf("preview committed twice: %d", w.Code)
+	}
+}
+
+func TestControllerConfigPreviewInvalid(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	validator := &warningsValidator{countingValidator: countingValidator{err: errors.New("unknown keyword 'invalid'")}}
+	c := NewController("", path, &fakeHaproxy{}, &fakeValidator{})
+	c.NewValidator = func(string) HaproxyConfigValidator { return validator }
+	post := func(target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, httptest.NewRequest("POST", target, strings.NewReader(body)))
+		return w
+	}
+
+	w := post("/config/preview", "global\n    invalid\n")
+	var preview ConfigPreview
+	if err := json.Unmarshal(w.Body.Bytes(), &preview); err != nil {
+		t.Fatal(err)
+	}
+	if preview.Valid || preview.Phase != ReloadPhaseValidate || !strings.Contains(preview.Error, "unknown keyword") || preview.Diff == "" {
+		t.Fatalf("unexpected preview: %+v", preview)
+	}
+	if w := post("/config/commit?hash="+preview.Hash, ""); w.Code != http.StatusConflict {
+		t.Fatalf("invalid preview committed: %d", w.Code)
+	}
+
+	// Previews are not committed if the live configuration changes
+	validator.err = nil
+	w = post("/config/preview", "global\n    maxconn 10\n")
+	if err := json.Unmarshal(w.Body.Bytes(), &preview); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("global\n    maxconn 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if w := post("/config/commit?hash="+preview.Hash, ""); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("preview of outdated configuration committed: %d", w.Code)
+	}
+}
+
+func TestControllerConfigDiff(t *testing.T) {
+	live := "global\n    maxconn 10\n\nbackend app\n    server app1 10.0.0.1:80\n"
+	path := tempConfig(t, live)
+	defer os.Remove(path)
+
+	haproxy := &fakeHaproxy{}
+	c := NewController("", path, haproxy, &fakeValidator{err: errors.New("not validated")})
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/config/diff", strings.NewReader(body)))
+		return w
+	}
+
+	w := post("global\n    maxconn 20\n\nbackend app\n    server app1 10.0.0.1:80\n")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/x-diff") {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	expected := "--- live\n+++ candidate\n@@ -1,5 +1,5 @@\n global\n+    maxconn 20\n-    maxconn 10\n \n backend app\n     server app1 10.0.0.1:80\n"
+	if w.Body.String() != expected {
+		t.Fatalf("unexpected diff:\n%s", w.Body.String())
+	}
+	if w := post(live); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("expected empty diff for same configuration, found %d: %q", w.Code, w.Body.String())
+	}
+
+	// Nothing is applied
+	if content, _ := ioutil.ReadFile(path); string(content) != live {
+		t.Fatalf("configuration changed by diff: %q", content)
+	}
+	if haproxy.reloads != 0 {
+		t.Fatalf("haproxy reloaded by diff")
+	}
+
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/config/diff", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected response to GET %d", w.Code)
+	}
+}
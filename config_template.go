@@ -0,0 +1,128 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// ConfigTemplate renders a Go template with the environment variables into
+// the configuration of haproxy. Variables are available as fields, as in
+// {{ .HOSTNAME }}, and with the env function, as in {{ env "HOSTNAME" }}.
+// Referencing fields of variables not set is an error, env returns an empty
+// string for them.
+type ConfigTemplate struct {
+	sync.Mutex
+
+	path string
+
+	// Last content rendered into the configuration file, it is only
+	// rendered again if the template or the environment change, so
+	// configurations applied by other means are not overwritten
+	rendered []byte
+
+	// environ returns the environment variables, it can be replaced in
+	// tests.
+	environ func() []string
+}
+
+func NewConfigTemplate(path string) *ConfigTemplate {
+	return &ConfigTemplate{path: path, environ: os.Environ}
+}
+
+func (t *ConfigTemplate) environment() map[string]string {
+	env := make(map[string]string)
+	for _, v := range t.environ() {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	return env
+}
+
+// Render returns the content of the template rendered with the environment.
+func (t *ConfigTemplate) Render() ([]byte, error) {
+	source, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return nil, err
+	}
+	env := t.environment()
+	funcs := template.FuncMap{
+		"env": func(name string) string { return env[name] },
+	}
+	tmpl, err := template.New(t.path).Funcs(funcs).Option("missingkey=error").Parse(string(source))
+	if err != nil {
+		return nil, err
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, env); err != nil {
+		return nil, err
+	}
+	return rendered.Bytes(), nil
+}
+
+// RenderFile renders the template into the configuration file if the result
+// changed since it was last rendered. The result is written to a temporary
+// file and validated with the validator returned by newValidator, if any,
+// and the configuration file is only replaced if it is valid.
+func (t *ConfigTemplate) RenderFile(path string, newValidator func(string) HaproxyConfigValidator) error {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	rendered, err := t.Render()
+	if err != nil {
+		return fmt.Errorf("couldn't render configuration template: %v", err)
+	}
+	if t.rendered != nil && bytes.Equal(t.rendered, rendered) {
+		return nil
+	}
+	temp, err := writeTempFile(path, rendered)
+	if err != nil {
+		return fmt.Errorf("couldn't write rendered configuration: %v", err)
+	}
+	defer os.Remove(temp)
+	if newValidator != nil {
+		if err := newValidator(temp).Validate(); err != nil {
+			return fmt.Errorf("invalid rendered configuration: %v", err)
+		}
+	}
+	if err := os.Rename(temp, path); err != nil {
+		return fmt.Errorf("couldn't write rendered configuration: %v", err)
+	}
+	log.Printf("Configuration rendered from template %s, written to %s\n", t.path, path)
+	t.rendered = rendered
+	return nil
+}
+
+// refuseTemplated replies to requests uploading configurations when the
+// configuration is rendered from a template, and returns true if it did.
+func (c *Controller) refuseTemplated(w http.ResponseWriter) bool {
+	if c.Template == nil {
+		return false
+	}
+	http.Error(w, "Configuration is rendered from a template, uploads are not allowed\n", http.StatusConflict)
+	return true
+}
@@ -0,0 +1,147 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testConfigTemplate(t *testing.T, content string, environ ...string) *ConfigTemplate {
+	template := NewConfigTemplate(tempConfig(t, content))
+	template.environ = func() []string { return environ }
+	return template
+}
+
+func TestConfigTemplateRender(t *testing.T) {
+	template := testConfigTemplate(t, "global\n    maxconn {{ .MAXCONN }}\n    node {{ env \"NODE\" }}{{ env \"UNSET\" }}\n", "MAXCONN=100", "NODE=a=b")
+	defer os.Remove(template.path)
+	rendered, err := template.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "global\n    maxconn 100\n    node a=b\n"; string(rendered) != expected {
+		t.Fatalf("found %q, expected %q", rendered, expected)
+	}
+}
+
+func TestConfigTemplateRenderErrors(t *testing.T) {
+	for _, content := range []string{"global\n    maxconn {{ .MAXCONN }}\n", "global\n    maxconn {{ .MAXCONN\n"} {
+		template := testConfigTemplate(t, content)
+		defer os.Remove(template.path)
+		if _, err := template.Render(); err == nil {
+			t.Fatalf("expected error rendering %q", content)
+		}
+	}
+}
+
+func TestControllerReloadConfigTemplate(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	template := testConfigTemplate(t, "global\n    maxconn {{ .MAXCONN }}\n")
+	defer os.Remove(template.path)
+	haproxy := &fakeHaproxy{running: true}
+	c := NewController("", config, haproxy, &fakeValidator{})
+	c.Template = template
+
+	outcome := c.ValidatedReload()
+	if outcome.Success || outcome.Phase != ReloadPhaseTemplate || outcome.httpStatus() != http.StatusBadRequest {
+		t.Fatalf("expected failed rendering, found %+v", outcome)
+	}
+	if haproxy.reloads != 0 {
+		t.Fatal("haproxy reloaded with template that couldn't be rendered")
+	}
+	if content, _ := ioutil.ReadFile(config); string(content) != "global\n" {
+		t.Fatalf("configuration changed after failed rendering: %q", content)
+	}
+
+	template.environ = func() []string { return []string{"MAXCONN=100"} }
+	if outcome := c.ValidatedReload(); !outcome.Success || haproxy.reloads != 1 {
+		t.Fatalf("expected successful reload, found %+v", outcome)
+	}
+	if content, _ := ioutil.ReadFile(config); string(content) != "global\n    maxconn 100\n" {
+		t.Fatalf("unexpected rendered configuration: %q", content)
+	}
+}
+
+func TestControllerReloadConfigTemplateChanges(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	template := testConfigTemplate(t, "global\n    {{ .DIRECTIVE }}\n", "DIRECTIVE=invalid")
+	defer os.Remove(template.path)
+	haproxy := &fakeHaproxy{running: true}
+	c := NewController("", config, haproxy, &fakeValidator{})
+	c.Template = template
+	c.NewValidator = func(configFile string) HaproxyConfigValidator {
+		return &contentValidator{path: configFile}
+	}
+
+	if outcome := c.ValidatedReload(); outcome.Success || outcome.Phase != ReloadPhaseTemplate {
+		t.Fatalf("expected invalid rendered configuration, found %+v", outcome)
+	}
+	if content, _ := ioutil.ReadFile(config); string(content) != "global\n" {
+		t.Fatalf("configuration changed with invalid rendered configuration: %q", content)
+	}
+
+	template.environ = func() []string { return []string{"DIRECTIVE=maxconn 100"} }
+	if outcome := c.ValidatedReload(); !outcome.Success {
+		t.Fatalf("expected successful reload, found %+v", outcome)
+	}
+
+	// Configurations applied by other means, as rollbacks, are kept
+	// while the template doesn't change
+	if err := ioutil.WriteFile(config, []byte("global\n    maxconn 10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if outcome := c.ValidatedReload(); !outcome.Success {
+		t.Fatalf("expected successful reload, found %+v", outcome)
+	}
+	if content, _ := ioutil.ReadFile(config); string(content) != "global\n    maxconn 10\n" {
+		t.Fatalf("configuration overwritten by unchanged template: %q", content)
+	}
+
+	template.environ = func() []string { return []string{"DIRECTIVE=maxconn 200"} }
+	if outcome := c.ValidatedReload(); !outcome.Success {
+		t.Fatalf("expected successful reload, found %+v", outcome)
+	}
+	if content, _ := ioutil.ReadFile(config); string(content) != "global\n    maxconn 200\n" {
+		t.Fatalf("changed template not rendered: %q", content)
+	}
+}
+
+func TestControllerUploadConfigTemplate(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	template := testConfigTemplate(t, "global\n")
+	defer os.Remove(template.path)
+	c := NewController("", config, &fakeHaproxy{running: true}, &fakeValidator{})
+	c.Template = template
+	c.NewValidator = func(configFile string) HaproxyConfigValidator {
+		return &contentValidator{path: configFile}
+	}
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("PUT", "/config", strings.NewReader("global\n    maxconn 10\n")))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("upload with template: %d", w.Code)
+	}
+	if content, _ := ioutil.ReadFile(config); string(content) != "global\n" {
+		t.Fatalf("configuration uploaded with template: %q", content)
+	}
+}
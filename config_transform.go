@@ -0,0 +1,207 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+const configIndent = "    "
+
+// A ConfigTransform modifies a configuration to enforce some invariant. It
+// must be idempotent, as it is applied on every reload.
+type ConfigTransform struct {
+	Name  string
+	Apply func(*haproxyConfig) error
+}
+
+// ConfigPipeline is an ordered list of transforms applied to configuration
+// before it is validated and applied.
+type ConfigPipeline []ConfigTransform
+
+// ConfigTransformOptions contains the parameters of the available transforms.
+type ConfigTransformOptions struct {
+	GlobalStanza    []byte
+	StatsSocket     string
+	DefaultTimeouts map[string]string
+	SyslogAddress   string
+}
+
+// NewConfigPipeline builds a pipeline with the transforms with the given
+// names, in the same order.
+func NewConfigPipeline(names []string, options ConfigTransformOptions) (ConfigPipeline, error) {
+	var pipeline ConfigPipeline
+	for _, name := range names {
+		var t ConfigTransform
+		switch name {
+		case "global":
+			if len(options.GlobalStanza) == 0 {
+				return nil, fmt.Errorf("global transform needs a global stanza")
+			}
+			t = globalTransform(options.GlobalStanza)
+		case "stats-socket":
+			if options.StatsSocket == "" {
+				return nil, fmt.Errorf("stats-socket transform needs a stats socket")
+			}
+			t = statsSocketTransform(options.StatsSocket)
+		case "default-timeouts":
+			if len(options.DefaultTimeouts) == 0 {
+				return nil, fmt.Errorf("default-timeouts transform needs some timeout")
+			}
+			t = defaultTimeoutsTransform(options.DefaultTimeouts)
+		case "syslog":
+			t = syslogTransform(options.SyslogAddress)
+		default:
+			return nil, fmt.Errorf("unknown config transform: %s", name)
+		}
+		pipeline = append(pipeline, t)
+	}
+	return pipeline, nil
+}
+
+// Transform applies the pipeline to the given configuration content.
+func (p ConfigPipeline) Transform(content []byte) ([]byte, error) {
+	if len(p) == 0 {
+		return content, nil
+	}
+	config := parseHaproxyConfig(content)
+	for _, t := range p {
+		if err := t.Apply(config); err != nil {
+			return nil, fmt.Errorf("%s transform failed: %v", t.Name, err)
+		}
+	}
+	return config.Bytes(), nil
+}
+
+// TransformFile applies the pipeline to a configuration file, it is only
+// rewritten if it changes.
+func (p ConfigPipeline) TransformFile(path string) error {
+	if len(p) == 0 {
+		return nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	transformed, err := p.Transform(content)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(content, transformed) {
+		return nil
+	}
+	log.Printf("Configuration modified by transforms, writing it to %s\n", path)
+	return writeFileAtomic(path, transformed)
+}
+
+// globalTransform replaces the global section with the given one.
+func globalTransform(stanza []byte) ConfigTransform {
+	return ConfigTransform{
+		Name: "global",
+		Apply: func(config *haproxyConfig) error {
+			global := parseHaproxyConfig(stanza).Sections("global")
+			if len(global) != 1 {
+				return fmt.Errorf("global stanza must contain exactly one global section")
+			}
+			var sections []*configSection
+			for _, s := range config.sections {
+				if s.Kind != "global" {
+					sections = append(sections, s)
+				}
+			}
+			config.sections = append(global, sections...)
+			return nil
+		},
+	}
+}
+
+// statsSocketTransform ensures that there is a stats socket in the given
+// path, line contains the path and the options of the socket.
+func statsSocketTransform(line string) ConfigTransform {
+	return ConfigTransform{
+		Name: "stats-socket",
+		Apply: func(config *haproxyConfig) error {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				return fmt.Errorf("empty stats socket")
+			}
+			global := config.Section("global")
+			if global.HasDirective("stats", "socket", fields[0]) {
+				return nil
+			}
+			global.AddLine(configIndent + "stats socket " + line)
+			return nil
+		},
+	}
+}
+
+// defaultTimeoutsTransform adds timeouts to the defaults section if they are
+// not set.
+func defaultTimeoutsTransform(timeouts map[string]string) ConfigTransform {
+	return ConfigTransform{
+		Name: "default-timeouts",
+		Apply: func(config *haproxyConfig) error {
+			defaults := config.Section("defaults")
+			for _, name := range sortedKeys(timeouts) {
+				if !defaults.HasDirective("timeout", name) {
+					defaults.AddLine(configIndent + "timeout " + name + " " + timeouts[name])
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// syslogTransform rewrites log targets to send logs to the embedded syslog
+// server.
+func syslogTransform(address string) ConfigTransform {
+	return ConfigTransform{
+		Name: "syslog",
+		Apply: func(config *haproxyConfig) error {
+			for _, s := range config.sections {
+				for i, line := range s.Lines {
+					fields := configFields(line)
+					if len(fields) < 2 || fields[0] != "log" || fields[1] == "global" || fields[1] == address {
+						continue
+					}
+					indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+					fields[1] = address
+					s.Lines[i] = indent + strings.Join(fields, " ")
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// parseKeyValues parses a comma-separated list of key=value pairs.
+func parseKeyValues(arg string) (map[string]string, error) {
+	values := make(map[string]string)
+	if len(arg) == 0 {
+		return values, nil
+	}
+	for _, pair := range strings.Split(arg, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("expected key=value, found: %s", pair)
+		}
+		values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return values, nil
+}
@@ -0,0 +1,156 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const testConfig = `global
+    log 10.0.0.1:514 local0
+    maxconn 1000
+
+defaults
+    mode http
+    timeout client 10s
+
+frontend web
+    bind :80
+    log global
+    default_backend app
+
+backend app
+    server app1 10.0.0.2:8080
+`
+
+func applyTransform(t *testing.T, transform ConfigTransform, content string) string {
+	config := parseHaproxyConfig([]byte(content))
+	if err := transform.Apply(config); err != nil {
+		t.Fatal(err)
+	}
+	return string(config.Bytes())
+}
+
+func TestParseHaproxyConfigRoundtrip(t *testing.T) {
+	config := parseHaproxyConfig([]byte(testConfig))
+	if found := string(config.Bytes()); found != testConfig {
+		t.Fatalf("configuration changed after parsing:\n%s", found)
+	}
+	if n := len(config.sections); n != 4 {
+		t.Fatalf("found %d sections, expected 4", n)
+	}
+	if s := config.Sections("backend"); len(s) != 1 || s[0].Name != "app" {
+		t.Fatalf("backend not found")
+	}
+}
+
+func TestGlobalTransform(t *testing.T) {
+	stanza := "global\n    maxconn 5000\n"
+	found := applyTransform(t, globalTransform([]byte(stanza)), testConfig)
+	config := parseHaproxyConfig([]byte(found))
+	global := config.Sections("global")
+	if len(global) != 1 || !global[0].HasDirective("maxconn", "5000") || global[0].HasDirective("log") {
+		t.Fatalf("global section not replaced:\n%s", found)
+	}
+	if config.sections[0].Kind != "global" || len(config.sections) != 4 {
+		t.Fatalf("unexpected sections:\n%s", found)
+	}
+
+	transform := globalTransform([]byte("defaults\n"))
+	if err := transform.Apply(parseHaproxyConfig([]byte(testConfig))); err == nil {
+		t.Fatal("expected error with stanza without global section")
+	}
+}
+
+func TestStatsSocketTransform(t *testing.T) {
+	transform := statsSocketTransform("/var/run/haproxy.sock mode 600 level admin")
+	found := applyTransform(t, transform, testConfig)
+	global := parseHaproxyConfig([]byte(found)).Section("global")
+	if !global.HasDirective("stats", "socket", "/var/run/haproxy.sock", "mode", "600") {
+		t.Fatalf("stats socket not added:\n%s", found)
+	}
+
+	if again := applyTransform(t, transform, found); again != found {
+		t.Fatalf("transform is not idempotent:\n%s", again)
+	}
+
+	found = applyTransform(t, transform, "defaults\n    mode tcp\n")
+	config := parseHaproxyConfig([]byte(found))
+	if config.sections[0].Kind != "global" || !config.sections[0].HasDirective("stats", "socket") {
+		t.Fatalf("global section not created:\n%s", found)
+	}
+}
+
+func TestDefaultTimeoutsTransform(t *testing.T) {
+	transform := defaultTimeoutsTransform(map[string]string{
+		"client":  "1m",
+		"connect": "5s",
+	})
+	found := applyTransform(t, transform, testConfig)
+	defaults := parseHaproxyConfig([]byte(found)).Section("defaults")
+	if !defaults.HasDirective("timeout", "client", "10s") {
+		t.Errorf("existing timeout modified:\n%s", found)
+	}
+	if defaults.HasDirective("timeout", "client", "1m") {
+		t.Errorf("existing timeout duplicated:\n%s", found)
+	}
+	if !defaults.HasDirective("timeout", "connect", "5s") {
+		t.Errorf("missing timeout not added:\n%s", found)
+	}
+}
+
+func TestSyslogTransform(t *testing.T) {
+	found := applyTransform(t, syslogTransform("127.0.0.1:514"), testConfig)
+	config := parseHaproxyConfig([]byte(found))
+	if !config.Section("global").HasDirective("log", "127.0.0.1:514", "local0") {
+		t.Errorf("log target not rewritten:\n%s", found)
+	}
+	if !config.Sections("frontend")[0].HasDirective("log", "global") {
+		t.Errorf("log global shouldn't be modified:\n%s", found)
+	}
+}
+
+func TestConfigPipeline(t *testing.T) {
+	if _, err := NewConfigPipeline([]string{"unknown"}, ConfigTransformOptions{}); err == nil {
+		t.Fatal("expected error with unknown transform")
+	}
+	if _, err := NewConfigPipeline([]string{"stats-socket"}, ConfigTransformOptions{}); err == nil {
+		t.Fatal("expected error with unconfigured transform")
+	}
+
+	pipeline, err := NewConfigPipeline([]string{"stats-socket", "syslog"}, ConfigTransformOptions{
+		StatsSocket:   "/var/run/haproxy.sock",
+		SyslogAddress: "127.0.0.1:514",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := tempConfig(t, testConfig)
+	defer os.Remove(path)
+	if err := pipeline.TransformFile(path); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	global := parseHaproxyConfig(content).Section("global")
+	if !global.HasDirective("stats", "socket") || !global.HasDirective("log", "127.0.0.1:514") {
+		t.Fatalf("pipeline not applied:\n%s", content)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Prefix of warnings in the output of haproxy, with the date and pid in
+// older versions, e.g. "[WARNING] 215/131413 (19205) : "
+var haproxyWarningRegexp = regexp.MustCompile(`^\[WARNING\][^:]*\(\d+\)\s*:\s*`)
+
+var warningCategoryRegexp = regexp.MustCompile(`^([a-z]+)(?:\s+\[[^\]]*\])?\s+:\s+`)
+
+// parseHaproxyWarnings returns the warnings in the output of haproxy, without
+// their prefix.
+func parseHaproxyWarnings(out []byte) []string {
+	var warnings []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if loc := haproxyWarningRegexp.FindStringIndex(line); loc != nil {
+			warnings = append(warnings, strings.TrimSpace(line[loc[1]:]))
+		}
+	}
+	return warnings
+}
+
+// warningCategory classifies a warning by the part of the configuration
+// processing reporting it, as "parsing" or "config". Warnings about
+// deprecated features have their own category, as they signal changes
+// needed before upgrading haproxy.
+func warningCategory(warning string) string {
+	if strings.Contains(strings.ToLower(warning), "deprecated") {
+		return "deprecated"
+	}
+	if m := warningCategoryRegexp.FindStringSubmatch(warning); m != nil {
+		return m[1]
+	}
+	return "other"
+}
+
+// validateWithWarnings validates the configuration, obtaining its warnings
+// if the validator reports them.
+func validateWithWarnings(validator HaproxyConfigValidator) ([]string, error) {
+	if v, ok := validator.(HaproxyWarningsValidator); ok {
+		return v.ValidateWithWarnings()
+	}
+	return nil, validator.Validate()
+}
+
+// validateConfig validates the configuration, updating the metrics of its
+// warnings if it is valid.
+func (c *Controller) validateConfig() ([]string, error) {
+	warnings, err := validateWithWarnings(c.validator)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, warning := range warnings {
+		counts[warningCategory(warning)]++
+	}
+	c.configWarnings.reset()
+	for category, count := range counts {
+		c.configWarnings.Set(float64(count), category)
+	}
+	return warnings, nil
+}
@@ -0,0 +1,157 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// warningsValidator reports warnings of valid configurations.
+type warningsValidator struct {
+	countingValidator
+	warnings []string
+}
+
+func (v *warningsValidator) ValidateWithWarnings() ([]string, error) {
+	return v.warnings, v.Validate()
+}
+
+func TestParseHaproxyWarnings(t *testing.T) {
+	out := `[WARNING] 215/131413 (19205) : parsing [/etc/haproxy/haproxy.cfg:12] : 'option httplog' not usable with proxy 'tcp' (needs 'mode http'). Falling back to 'option tcplog'.
+[WARNING] 215/131413 (19205) : config : missing timeouts for frontend 'http'.
+[WARNING]  (123) : parsing [/etc/haproxy/haproxy.cfg:20] : The 'reqadd' directive is deprecated in favor of 'http-request add-header'.
+[WARNING]  (123) : Setting tune.ssl.default-dh-param to 1024 by default.
+[NOTICE]   (123) : haproxy version is 2.4.0
+Configuration file is valid
+`
+	expected := []string{
+		"parsing [/etc/haproxy/haproxy.cfg:12] : 'option httplog' not usable with proxy 'tcp' (needs 'mode http'). Falling back to 'option tcplog'.",
+		"config : missing timeouts for frontend 'http'.",
+		"parsing [/etc/haproxy/haproxy.cfg:20] : The 'reqadd' directive is deprecated in favor of 'http-request add-header'.",
+		"Setting tune.ssl.default-dh-param to 1024 by default.",
+	}
+	warnings := parseHaproxyWarnings([]byte(out))
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Fatalf("unexpected warnings: %q", warnings)
+	}
+
+	categories := []string{"parsing", "config", "deprecated", "other"}
+	for i, warning := range warnings {
+		if category := warningCategory(warning); category != categories[i] {
+			t.Errorf("%q: expected category %s, found %s", warning, categories[i], category)
+		}
+	}
+
+	if warnings := parseHaproxyWarnings([]byte("Configuration file is valid\n")); len(warnings) != 0 {
+		t.Fatalf("unexpected warnings: %q", warnings)
+	}
+}
+
+func TestHaproxyDashCWarnings(t *testing.T) {
+	dir, path := fakeHaproxyBinary(t, `echo "[WARNING] 215/131413 (1) : config : missing timeouts for frontend 'http'."
+echo "Configuration file is valid"`)
+	defer os.RemoveAll(dir)
+
+	warnings, err := NewHaproxyDashC(path, "haproxy.cfg").ValidateWithWarnings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0] != "config : missing timeouts for frontend 'http'." {
+		t.Fatalf("unexpected warnings: %q", warnings)
+	}
+}
+
+func TestValidationCacheWarnings(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	validator := &warningsValidator{warnings: []string{"config : missing timeouts"}}
+	cache, _ := newTestValidationCache(t, validator, path)
+	defer os.Remove(cache.path)
+
+	for i := 0; i < 2; i++ {
+		warnings, err := cache.ValidateWithWarnings()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(warnings, validator.warnings) {
+			t.Fatalf("unexpected warnings: %q", warnings)
+		}
+	}
+	if validator.calls != 1 {
+		t.Fatalf("found %d validations, expected 1", validator.calls)
+	}
+}
+
+func TestControllerConfigWarningsMetric(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	validator := &warningsValidator{warnings: []string{
+		"config : missing timeouts for frontend 'http'.",
+		"config : missing timeouts for backend 'app'.",
+		"parsing [haproxy.cfg:20] : The 'reqadd' directive is deprecated.",
+	}}
+	c := NewController("", config, &fakeHaproxy{}, validator)
+	registry, _ := NewRegistry(nil)
+	registry.Register(c)
+
+	metrics := func() string {
+		var buf bytes.Buffer
+		registry.WriteText(&buf)
+		return buf.String()
+	}
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/validate", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Warning: config : missing timeouts for backend 'app'.\n") {
+		t.Fatalf("unexpected response %d: %q", w.Code, w.Body.String())
+	}
+	for _, expected := range []string{
+		`haproxy_wrapper_config_warnings{category="config"} 2`,
+		`haproxy_wrapper_config_warnings{category="deprecated"} 1`,
+	} {
+		if !strings.Contains(metrics(), expected+"\n") {
+			t.Errorf("expected %s in metrics:\n%s", expected, metrics())
+		}
+	}
+
+	validator.warnings = []string{"config : missing timeouts for frontend 'http'."}
+	if outcome := c.ValidatedReload(); !outcome.Success {
+		t.Fatalf("reload failed: %+v", outcome)
+	}
+	for _, expected := range []string{
+		`haproxy_wrapper_config_warnings{category="config"} 1`,
+		`haproxy_wrapper_config_warnings{category="deprecated"} 0`,
+	} {
+		if !strings.Contains(metrics(), expected+"\n") {
+			t.Errorf("expected %s in metrics:\n%s", expected, metrics())
+		}
+	}
+
+	// Invalid configurations don't update the warnings
+	validator.err = errors.New("invalid")
+	validator.warnings = nil
+	c.ValidatedReload()
+	if !strings.Contains(metrics(), `haproxy_wrapper_config_warnings{category="config"} 1`+"\n") {
+		t.Errorf("warnings updated by invalid configuration:\n%s", metrics())
+	}
+}
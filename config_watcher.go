@@ -0,0 +1,170 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Name of the symlink Kubernetes swaps to update files of mounted ConfigMaps
+const kubernetesDataLink = "..data"
+
+// ConfigWatcher checks periodically if the configuration files change, the
+// path can be a comma-separated list of files and directories.
+//
+// By default changes are detected in the file the path resolves to, what also
+// detects replacements of symlinks. In Kubernetes mode, the configuration is
+// expected to be in a mounted ConfigMap, whose files are symlinks to a
+// "..data" symlink that Kubernetes swaps atomically to a directory with the
+// new content. Only this swap is watched then, so partial updates are
+// never seen.
+type ConfigWatcher struct {
+	path       string
+	interval   time.Duration
+	kubernetes bool
+
+	// Time the configuration has to stay unchanged before reporting a
+	// change, so rapid successive writes are reported once
+	Settle time.Duration
+
+	// Last state and content seen
+	state, hash string
+
+	stop chan struct{}
+}
+
+// NewConfigWatcher creates a watcher of changes done in the configuration
+// after calling it.
+func NewConfigWatcher(path string, interval time.Duration, kubernetes bool) *ConfigWatcher {
+	w := &ConfigWatcher{
+		path:       path,
+		interval:   interval,
+		kubernetes: kubernetes,
+		stop:       make(chan struct{}),
+	}
+	w.snapshot()
+	return w
+}
+
+// Watch calls onChange when the configuration changes, until the watcher is
+// stopped. The content of the configuration is compared too, so onChange is
+// not called if only metadata changes, or if it is modified by onChange
+// itself.
+func (w *ConfigWatcher) Watch(onChange func()) {
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(w.interval):
+		}
+
+		current, err := w.currentState()
+		if err != nil {
+			log.Printf("Couldn't check configuration changes: %v\n", err)
+			continue
+		}
+		if current == w.state {
+			continue
+		}
+		if current = w.settle(current); current == "" {
+			return
+		}
+		w.state = current
+		hash, err := configFilesHash(w.path)
+		if err != nil {
+			log.Printf("Couldn't read changed configuration: %v\n", err)
+			continue
+		}
+		if hash == w.hash {
+			continue
+		}
+		log.Printf("Configuration changed, new hash is %s\n", hash)
+		onChange()
+
+		// Don't trigger another change for modifications done by onChange
+		w.snapshot()
+	}
+}
+
+// settle waits for the configuration to stay unchanged during the settle
+// time, and returns its state then. It returns an empty state if the watcher
+// is stopped meanwhile.
+func (w *ConfigWatcher) settle(state string) string {
+	for w.Settle > 0 {
+		select {
+		case <-w.stop:
+			return ""
+		case <-time.After(w.Settle):
+		}
+		current, err := w.currentState()
+		if err != nil || current == state {
+			break
+		}
+		state = current
+	}
+	return state
+}
+
+func (w *ConfigWatcher) snapshot() {
+	w.state, _ = w.currentState()
+	w.hash, _ = configFilesHash(w.path)
+}
+
+func (w *ConfigWatcher) Stop() {
+	close(w.stop)
+}
+
+// currentState returns a value that changes when any configuration file
+// changes, or when files are added to or removed from the directories.
+func (w *ConfigWatcher) currentState() (string, error) {
+	files, err := expandConfigFiles(w.path)
+	if err != nil {
+		return "", err
+	}
+	var states []string
+	seen := make(map[string]bool)
+	for _, f := range files {
+		var state string
+		if w.kubernetes {
+			link := filepath.Join(filepath.Dir(f), kubernetesDataLink)
+			if seen[link] {
+				continue
+			}
+			seen[link] = true
+			target, err := os.Readlink(link)
+			if err != nil {
+				return "", fmt.Errorf("couldn't read ConfigMap data link: %v", err)
+			}
+			state = target
+		} else {
+			info, err := os.Stat(f)
+			if err != nil {
+				return "", err
+			}
+			state = fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size())
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+				state = fmt.Sprintf("%d:%d:%s", stat.Dev, stat.Ino, state)
+			}
+		}
+		states = append(states, f+"="+state)
+	}
+	return strings.Join(states, ","), nil
+}
@@ -0,0 +1,181 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func watchChanges(w *ConfigWatcher) <-chan struct{} {
+	changes := make(chan struct{}, 10)
+	go w.Watch(func() { changes <- struct{}{} })
+	return changes
+}
+
+func expectChange(t *testing.T, changes <-chan struct{}, expected bool) {
+	select {
+	case <-changes:
+		if !expected {
+			t.Fatal("unexpected change detected")
+		}
+	case <-time.After(300 * time.Millisecond):
+		if expected {
+			t.Fatal("change not detected")
+		}
+	}
+}
+
+func TestConfigWatcherFile(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+
+	w := NewConfigWatcher(config, 20*time.Millisecond, false)
+	defer w.Stop()
+	changes := watchChanges(w)
+
+	if err := ioutil.WriteFile(config, []byte("global\n    maxconn 100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, changes, true)
+
+	// Same content is not a change
+	now := time.Now().Add(time.Second)
+	os.Chtimes(config, now, now)
+	expectChange(t, changes, false)
+}
+
+func TestConfigWatcherDirectory(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	dir := configDir(t, "a.cfg")
+	defer os.RemoveAll(dir)
+
+	w := NewConfigWatcher(config+","+dir, 20*time.Millisecond, false)
+	defer w.Stop()
+	changes := watchChanges(w)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.cfg"), []byte("backend a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, changes, true)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.cfg"), []byte("backend b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, changes, true)
+
+	// Files not loaded by haproxy are ignored
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, changes, false)
+}
+
+func TestConfigWatcherSettle(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+
+	w := NewConfigWatcher(config, 10*time.Millisecond, false)
+	w.Settle = 100 * time.Millisecond
+	defer w.Stop()
+	changes := watchChanges(w)
+
+	for i := 0; i < 5; i++ {
+		content := fmt.Sprintf("global\n    maxconn %d\n", i)
+		if err := ioutil.WriteFile(config, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+	expectChange(t, changes, true)
+	expectChange(t, changes, false)
+}
+
+// writeConfigMap writes the configuration as Kubernetes does in mounted
+// ConfigMaps: in a new directory pointed by the ..data symlink, that is
+// atomically replaced.
+func writeConfigMap(t *testing.T, dir, version, content string) {
+	data := filepath.Join(dir, "..2018_"+version)
+	if err := os.Mkdir(data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(data, "haproxy.cfg"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(filepath.Base(data), tmp); err != nil {
+		t.Fatal(err)
+	}
+	previous, _ := os.Readlink(filepath.Join(dir, kubernetesDataLink))
+	if err := os.Rename(tmp, filepath.Join(dir, kubernetesDataLink)); err != nil {
+		t.Fatal(err)
+	}
+	if previous != "" {
+		os.RemoveAll(filepath.Join(dir, previous))
+	}
+}
+
+func TestConfigWatcherKubernetesConfigMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeConfigMap(t, dir, "1", "global\n")
+	config := filepath.Join(dir, "haproxy.cfg")
+	if err := os.Symlink(filepath.Join(kubernetesDataLink, "haproxy.cfg"), config); err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewConfigWatcher(config, 20*time.Millisecond, true)
+	defer w.Stop()
+	changes := watchChanges(w)
+
+	writeConfigMap(t, dir, "2", "global\n    maxconn 100\n")
+	expectChange(t, changes, true)
+	if content, _ := ioutil.ReadFile(config); string(content) != "global\n    maxconn 100\n" {
+		t.Fatalf("unexpected content after swap: %q", content)
+	}
+
+	// Swap with the same content
+	writeConfigMap(t, dir, "3", "global\n    maxconn 100\n")
+	expectChange(t, changes, false)
+}
+
+func TestControllerValidatedReload(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	haproxy := &fakeHaproxy{}
+	validator := &fakeValidator{err: os.ErrInvalid}
+	c := NewController("", config, haproxy, validator)
+
+	outcome := c.ValidatedReload()
+	if outcome.Success || outcome.Phase != ReloadPhaseValidate {
+		t.Fatalf("expected failed validation, found %+v", outcome)
+	}
+	if haproxy.reloads != 0 {
+		t.Fatal("haproxy reloaded with invalid configuration")
+	}
+
+	validator.err = nil
+	if outcome := c.ValidatedReload(); !outcome.Success || haproxy.reloads != 1 {
+		t.Fatalf("valid configuration not reloaded: %+v", outcome)
+	}
+}
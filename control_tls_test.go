@@ -0,0 +1,167 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testTLSFiles writes a self-signed certificate for localhost, usable by
+// servers and clients, and its key, returning the paths of both files.
+func testTLSFiles(t *testing.T, dir, name string) (certFile, keyFile string, certificate tls.Certificate) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	certificate, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, certificate
+}
+
+func TestControlTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key, _ := testTLSFiles(t, dir, "server")
+
+	if config, err := controlTLSConfig("", "", ""); config != nil || err != nil {
+		t.Errorf("unexpected configuration without TLS: %v, %v", config, err)
+	}
+	for _, files := range [][]string{{cert, "", ""}, {"", key, ""}, {"", "", cert}, {cert, key, key}, {cert, filepath.Join(dir, "missing"), ""}} {
+		if _, err := controlTLSConfig(files[0], files[1], files[2]); err == nil {
+			t.Errorf("%v: expected error", files)
+		}
+	}
+	config, err := controlTLSConfig(cert, key, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Certificates) != 1 || config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("unexpected configuration: %+v", config)
+	}
+}
+
+func TestControllerMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverCert, serverKey, _ := testTLSFiles(t, dir, "server")
+	clientCert, _, client := testTLSFiles(t, dir, "client")
+	_, _, other := testTLSFiles(t, dir, "other")
+
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("127.0.0.1:0", config, &fakeHaproxy{}, &fakeValidator{})
+	if c.TLS, err = controlTLSConfig(serverCert, serverKey, clientCert); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- c.Run() }()
+	defer func() {
+		c.Stop()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+	var address string
+	for retries := 100; retries > 0 && address == ""; retries-- {
+		c.Lock()
+		if c.listener != nil {
+			address = c.listener.Addr().String()
+		}
+		c.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	serverCA, _ := ioutil.ReadFile(serverCert)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverCA)
+	get := func(certificates []tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: certificates,
+		}}}
+		return client.Get("https://" + address + "/config")
+	}
+
+	resp, err := get([]tls.Certificate{client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	for name, certificates := range map[string][]tls.Certificate{"without certificate": nil, "unknown certificate": {other}} {
+		if resp, err := get(certificates); err == nil {
+			resp.Body.Close()
+			t.Errorf("%s: request accepted", name)
+		}
+	}
+	if resp, err := http.Get("http://" + address + "/config"); err == nil && resp.StatusCode == http.StatusOK {
+		resp.Body.Close()
+		t.Error("plain HTTP request accepted")
+	}
+}
@@ -15,65 +15,890 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Controller struct {
-	address   string
-	haproxy   HaproxyServer
-	validator HaproxyConfigValidator
+	address    string
+	configFile string
+	haproxy    HaproxyServer
+	validator  HaproxyConfigValidator
+
+	// Comma-separated list of configuration files loaded by haproxy,
+	// hashed as a whole in ETags, only the configuration file is hashed if
+	// not set
+	ConfigFiles string
+
+	// Template rendered into the configuration before reloading, if
+	// enabled
+	Template *ConfigTemplate
+
+	// Transforms applied to the configuration before reloading
+	Pipeline ConfigPipeline
+
+	// Redactor used to mask secrets in configuration content
+	Redactor *ConfigRedactor
+
+	// Cache of validations, if enabled
+	ValidationCache *ValidationCache
+
+	// Token required in protected endpoints, if set
+	Token string
+
+	// TLS configuration of the control entry point, served in plain HTTP
+	// if not set
+	TLS *tls.Config
+
+	// Client of the haproxy runtime API, if available
+	StatsSocket *StatsSocket
+
+	// Allow commands that modify haproxy in /stats-socket, only read-only
+	// commands are allowed by default
+	AllowSocketAdmin bool
+
+	// Time to wait for changed backends to be healthy after reloads, zero
+	// to don't wait
+	WaitHealthyTimeout time.Duration
+
+	// Socket where events are emitted, if configured
+	EventSocket *EventSocket
+
+	// Check of files referenced in the configuration before reloads, if
+	// enabled
+	Preflight *Preflight
+
+	// Assertions the configuration must satisfy to be applied, if any
+	Policy *Policy
+
+	// Alternate configuration kept validated to be promoted, if enabled
+	Standby *StandbyConfig
+
+	// Gate holding validated configurations until their reload is
+	// approved, if enabled
+	Approval *ApprovalGate
+
+	// Checker of compatibility of the configuration with the haproxy
+	// version, if enabled
+	Compatibility *CompatibilityChecker
+
+	// Versions of the haproxy binary running and used to validate, if
+	// tracked
+	Binary *BinaryVersions
+
+	// Duration and number of steps of drains reducing maxconn
+	DrainRamp  time.Duration
+	DrainSteps int
+
+	// Netfilter queues used to retain connections, reported in /status
+	NetQueues []uint
+
+	// Reason connections are not retained during reloads when they should
+	// be, if the process is missing the capabilities needed
+	CaptureDisabled string
+
+	// Limits of the kernel to retain connections checked at startup, if
+	// connections are retained
+	KernelLimits *KernelLimits
+
+	// Sysctls raised during reloads retaining connections, if any
+	ReloadSysctls ReloadSysctls
+
+	// Registry of metrics exposed in /metrics, if enabled
+	Metrics *Registry
+
+	// Probe of connection setup latencies during reloads, if available
+	LatencyProbe LatencyProbe
+
+	// Report of the environment collected at startup
+	Diagnostics *Diagnostics
+
+	// Version of the wrapper and build information of haproxy, captured
+	// at startup
+	VersionInfo *VersionInfo
+
+	// Mode haproxy is run in, reported in /health
+	Mode string
+
+	// Haproxy couldn't be started with the configuration found at startup,
+	// it is not ready until a valid configuration is reloaded
+	StartFailed bool
+
+	// Time readiness is kept after a failed reload while haproxy is still
+	// running with the previous configuration
+	ReloadFailureGrace time.Duration
+
+	// Coordinator of reloads with other nodes, if any, and maximum time
+	// reloads wait for a slot
+	Coordinator         ReloadCoordinator
+	CoordinationTimeout time.Duration
+
+	// Last configurations applied, if enabled
+	History *ConfigHistory
+
+	// Window used to report the success rate of the last reloads
+	ReloadSuccessWindow time.Duration
+
+	// Freeze windows of automatic reloads, if any
+	Freeze *ReloadFreeze
+
+	// Load of the frontends reported for autoscalers, if enabled
+	Load *LoadCache
+
+	// Creates validators of configurations in other files, needed to
+	// upload configurations with PUT /config and to roll back
+	NewValidator func(configFile string) HaproxyConfigValidator
+
+	// Reloads taking longer are logged with the time spent in each phase,
+	// disabled if zero
+	SlowReloadThreshold time.Duration
+
+	// Maximum time Stop waits for reloads in progress before cancelling
+	// them
+	StopTimeout time.Duration
+
+	// Requests to /reload received sooner than this after the previous one
+	// are coalesced in a single reload run when no more requests are
+	// received in this time, zero to reload on every request
+	ReloadDebounce time.Duration
+
+	// Debug source of stats of netfilter queues, replacing the ones of the
+	// kernel in /status and /metrics, if enabled
+	SyntheticNetfilter *SyntheticNetfilter
+
+	sync.Mutex
+	reloading     sync.Mutex
+	applied       []byte
+	lastReload    *ReloadOutcome
+	reloads       *CounterVec
+	reloadHistory *ReloadHistory
+	slowReloads   *CounterVec
+
+	// Durations of reloads and of their phases, captures of connections
+	// are timed from their events, by the ID of their reload
+	reloadDurations *HistogramVec
+	phaseDurations  *HistogramVec
+	captureStarts   map[uint64]time.Time
+
+	currentDrain *maxconnDrain
+
+	captureChecks map[uint64]chan frontendSessions
+	lastCapture   *CaptureSummary
+	emptyCaptures *CounterVec
+	captureDrops  *CounterVec
+
+	// Last configuration previewed, to be committed
+	preview *configPreview
+
+	// Reload coalescing the requests received during the debounce time
+	lastReloadRequest time.Time
+	pendingReload     *pendingReload
+	coalescedReloads  *CounterVec
+
+	// Result of the last validation requested in /validate, if any
+	lastValidation *validationResult
+
+	// Warnings of the last valid configuration, by category
+	configWarnings *GaugeVec
+
+	// Reloads in progress, Stop waits for them, cancelling them after its
+	// timeout
+	inflight      sync.WaitGroup
+	cancelReloads chan struct{}
 
 	done     bool
+	stopped  chan struct{}
 	listener net.Listener
 }
 
-func NewController(address string, haproxy HaproxyServer, validator HaproxyConfigValidator) *Controller {
+func NewController(address, configFile string, haproxy HaproxyServer, validator HaproxyConfigValidator) *Controller {
+	// Configuration haproxy has been started with
+	applied, _ := ioutil.ReadFile(configFile)
 	return &Controller{
-		address:   address,
-		haproxy:   haproxy,
-		validator: validator,
+		address:             address,
+		configFile:          configFile,
+		haproxy:             haproxy,
+		validator:           validator,
+		applied:             applied,
+		DrainRamp:           defaultDrainRamp,
+		DrainSteps:          defaultDrainSteps,
+		StopTimeout:         defaultStopTimeout,
+		ReloadSuccessWindow: defaultReloadSuccessWindow,
+		reloadHistory:       NewReloadHistory(reloadHistorySize),
+		slowReloads:         NewCounterVec("slow_reloads_total", "Number of reloads taking longer than the slow reload threshold"),
+		coalescedReloads:    NewCounterVec("reloads_coalesced_total", "Number of reload requests coalesced in a pending reload"),
+		cancelReloads:       make(chan struct{}),
+		stopped:             make(chan struct{}),
+		reloads:             NewCounterVec("reloads_total", "Number of reloads by result and failed phase", "result", "phase"),
+		reloadDurations:     NewHistogramVec("reload_duration_seconds", "Duration of reloads by result", reloadDurationBuckets, "result"),
+		phaseDurations:      NewHistogramVec("reload_phase_duration_seconds", "Duration of the phases of reloads", reloadDurationBuckets, "phase"),
+		captureStarts:       make(map[uint64]time.Time),
+		captureDrops:        NewCounterVec("capture_queue_dropped_total", "Number of packets dropped by the kernel during captures because the queue was full"),
+		emptyCaptures:       NewCounterVec("captures_without_packets_total", "Number of captures during reloads that didn't retain packets, by diagnosis", "diagnosis"),
+		configWarnings:      NewGaugeVec("config_warnings", "Number of warnings reported by haproxy in the last valid configuration, by category", "category"),
+	}
+}
+
+// controlListener listens in the address of the controller, addresses
+// starting with @ are abstract unix sockets, only available in Linux.
+func controlListener(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "@") {
+		return net.Listen("unix", address)
 	}
+	return net.Listen("tcp", address)
 }
 
 func (c *Controller) Run() error {
-	listener, err := net.Listen("tcp", c.address)
+	listener, err := controlListener(c.address)
 	if err != nil {
 		return err
 	}
+	if c.TLS != nil {
+		listener = tls.NewListener(listener, c.TLS)
+	}
+	c.Lock()
 	c.listener = listener
+	c.Unlock()
 	log.Printf("Controller listening on '%s'\n", c.address)
 
+	err = http.Serve(listener, c.handler())
+	c.Lock()
+	done := c.done
+	c.Unlock()
+	if err != nil && !done {
+		return fmt.Errorf("Controller error: %v", err)
+	}
+	if done {
+		<-c.stopped
+	}
+	return nil
+}
+
+func (c *Controller) handler() http.Handler {
 	handler := http.NewServeMux()
-	handler.HandleFunc("/reload", func(w http.ResponseWriter, req *http.Request) {
-		if err := c.haproxy.Reload(); err != nil {
-			msg := fmt.Sprintf("Couldn't reload: %v\n", err)
+	handler.HandleFunc("/reload", c.reload)
+	handler.HandleFunc("/validate", c.validate)
+	handler.HandleFunc("/validate/cache", c.validationCache)
+	handler.HandleFunc("/config", c.config)
+	handler.HandleFunc("/config/blame", c.configBlame)
+	handler.HandleFunc("/config/history", c.configHistory)
+	handler.HandleFunc("/rollback", c.rollback)
+	handler.HandleFunc("/status", c.status)
+	handler.HandleFunc("/ready", c.ready)
+	handler.HandleFunc("/live", c.live)
+	handler.HandleFunc("/health", c.health)
+	handler.HandleFunc("/drain", c.drain)
+	handler.HandleFunc("/diagnostics", c.diagnostics)
+	handler.HandleFunc("/version", c.versionInfo)
+	handler.HandleFunc("/capabilities", c.capabilities)
+	handler.HandleFunc("/ssl/cert", c.sslCert)
+	handler.HandleFunc("/errors", c.haproxyErrors)
+	handler.HandleFunc("/stats-socket", c.statsSocketCommand)
+	handler.HandleFunc("/queues", c.queues)
+	if c.Metrics != nil {
+		handler.Handle("/metrics", c.Metrics)
+	}
+	if c.SyntheticNetfilter != nil {
+		handler.HandleFunc("/debug/netfilter", c.syntheticNetfilter)
+	}
+	if c.Approval != nil {
+		handler.HandleFunc("/approval", c.approval)
+	}
+	if c.Load != nil {
+		handler.HandleFunc("/load", c.load)
+	}
+	if _, ok := c.haproxy.(CaptureIPsUpdater); ok {
+		handler.HandleFunc("/capture-ips", c.captureIPs)
+	}
+	handler.HandleFunc("/config/preview", c.configPreviewHandler)
+	handler.HandleFunc("/config/diff", c.configDiff)
+	handler.HandleFunc("/config/commit", c.configCommit)
+	if c.Standby != nil {
+		handler.HandleFunc("/config/standby", c.standbyConfig)
+		handler.HandleFunc("/config/promote-standby", c.promoteStandby)
+	}
+	return handler
+}
+
+func (c *Controller) reload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorize(w, req) {
+		return
+	}
+	// Checked early to reply without waiting for other reloads, and again
+	// against the configuration read by the reload
+	ifMatch := req.Header.Get("If-Match")
+	if ifMatch != "" {
+		hash, err := c.configETag()
+		if err != nil {
+			msg := fmt.Sprintf("Couldn't read configuration: %v\n", err)
 			log.Println(msg)
 			http.Error(w, msg, http.StatusInternalServerError)
 			return
 		}
-		fmt.Fprintf(w, "OK\n")
-	})
-	handler.HandleFunc("/validate", func(w http.ResponseWriter, req *http.Request) {
-		if err := c.validator.Validate(); err != nil {
-			msg := fmt.Sprintf("Invalid configuration: %v\n", err)
-			log.Println(msg)
-			http.Error(w, msg, http.StatusInternalServerError)
+		if !etagMatches(ifMatch, hash) {
+			msg := fmt.Sprintf("Configuration changed, current hash is %s\n", hash)
+			http.Error(w, msg, http.StatusPreconditionFailed)
+			return
+		}
+	}
+	async := false
+	if value := req.URL.Query().Get("async"); value != "" {
+		var err error
+		if async, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid async parameter: %s\n", value), http.StatusBadRequest)
 			return
 		}
+	}
+	// Configurations are validated unless explicitly disabled
+	validate := true
+	if value := req.URL.Query().Get("validate"); value != "" {
+		var err error
+		if validate, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid validate parameter: %s\n", value), http.StatusBadRequest)
+			return
+		}
+	}
+	options, err := parseReloadRequestBody(http.MaxBytesReader(w, req.Body, maxReloadBodySize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid reload options: %v\n", err), http.StatusBadRequest)
+		return
+	}
+	r := reloadRequest{validate: validate, actor: requestActor(req), capture: options.Capture, ifMatch: ifMatch}
+	if r.ifMatch == "" && c.coalesceReload(r) {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Reload coalesced into pending reload\n")
+		return
+	}
+	if async {
+		if !c.trackReload() {
+			http.Error(w, "Couldn't reload: controller stopping\n", http.StatusServiceUnavailable)
+			return
+		}
+		go func() {
+			defer c.inflight.Done()
+			if outcome := c.runReload(r); !outcome.Success {
+				log.Printf("Couldn't reload: %v\n", outcome.Error)
+			}
+		}()
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Reload started\n")
+		return
+	}
+
+	outcome := c.doReload(r)
+	if !outcome.Success {
+		msg := fmt.Sprintf("Couldn't reload: %v\n", outcome.Error)
+		log.Println(msg)
+		http.Error(w, msg, outcome.httpStatus())
+		return
+	}
+	fmt.Fprintf(w, "OK\n")
+	if outcome.Settings != nil {
+		for _, annotation := range outcome.Settings.Annotations {
+			fmt.Fprintf(w, "Annotation: %s\n", annotation)
+		}
+	}
+	if outcome.Changes != nil && !outcome.Changes.empty() {
+		fmt.Fprintf(w, "Changes: %s\n", outcome.Changes)
+	}
+}
+
+// validate validates the configuration file, or a candidate configuration if
+// posted in the body of the request.
+func (c *Controller) validate(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost && req.ContentLength != 0 {
+		c.validateCandidate(w, req)
+		return
+	}
+	warnings := c.compatibilityWarnings()
+	if err := c.checkPolicy(); err != nil {
+		c.recordValidation(err)
+		msg := c.Redactor.RedactString(fmt.Sprintf("Invalid configuration: %v\n", err))
+		log.Println(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	haproxyWarnings, err := c.validateConfig()
+	c.recordValidation(err)
+	if err != nil {
+		msg := c.Redactor.RedactString(fmt.Sprintf("Invalid configuration: %v\n", err))
+		log.Println(msg)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, msg)
+		writeWarnings(w, warnings)
+		return
+	}
+	fmt.Fprintf(w, "OK\n")
+	writeWarnings(w, warnings)
+	for _, warning := range haproxyWarnings {
+		fmt.Fprintf(w, "Warning: %s\n", c.Redactor.RedactString(warning))
+	}
+}
+
+// validateCandidate validates the configuration in the body of the request in
+// a temporary file, without applying it nor affecting the running haproxy.
+// The response is empty if it is valid, and contains the output of the
+// validation otherwise.
+func (c *Controller) validateCandidate(w http.ResponseWriter, req *http.Request) {
+	if !c.authorize(w, req) {
+		return
+	}
+	if c.NewValidator == nil {
+		http.Error(w, "Validation of new configurations not enabled\n", http.StatusNotFound)
+		return
+	}
+	content, ok := readConfigBody(w, req)
+	if !ok {
+		return
+	}
+	temp, err := writeTempFile(c.configFile, content)
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't write configuration: %v\n", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	// Deferred so it is also removed if the validator panics
+	defer os.Remove(temp)
+	if err := c.NewValidator(temp).Validate(); err != nil {
+		http.Error(w, c.Redactor.RedactString(fmt.Sprintf("Invalid configuration: %v\n", err)), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// checkPolicy checks the configuration file against the policy, if any.
+func (c *Controller) checkPolicy() error {
+	if c.Policy == nil {
+		return nil
+	}
+	content, err := ioutil.ReadFile(c.configFile)
+	if err != nil {
+		return fmt.Errorf("couldn't read configuration: %v", err)
+	}
+	return c.Policy.Check(content)
+}
+
+// compatibilityWarnings checks if the configuration uses directives not
+// supported by the running haproxy version.
+func (c *Controller) compatibilityWarnings() []string {
+	if c.Compatibility == nil {
+		return nil
+	}
+	content, err := ioutil.ReadFile(c.configFile)
+	if err != nil {
+		return nil
+	}
+	warnings, err := c.Compatibility.Check(content)
+	if err != nil {
+		log.Printf("Couldn't check compatibility of configuration: %v\n", err)
+		return nil
+	}
+	for _, warning := range warnings {
+		log.Printf("Warning: %s\n", warning)
+	}
+	return warnings
+}
+
+func writeWarnings(w io.Writer, warnings []string) {
+	for _, warning := range warnings {
+		fmt.Fprintf(w, "Warning: %s\n", warning)
+	}
+}
+
+// config returns the current configuration, its hash is sent as ETag so it
+// can be used in If-Match headers on reloads. Sensitive values are masked
+// unless the request is authenticated with the token.
+func (c *Controller) config(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPut {
+		c.uploadConfig(w, req)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	// The ETag covers all the files loaded by haproxy
+	var hash string
+	content, err := ioutil.ReadFile(c.configFile)
+	if err == nil {
+		hash, err = c.configETag()
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't read configuration: %v\n", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("ETag", `"`+hash+`"`)
+	// Callers with the token get the content as is, so they can upload
+	// it back after editing it
+	if c.authenticated(req) {
+		w.Write(content)
+		return
+	}
+	w.Write(c.Redactor.Redact(content))
+}
+
+// uploadConfig replaces the configuration with the body of the request and
+// reloads haproxy.
+func (c *Controller) uploadConfig(w http.ResponseWriter, req *http.Request) {
+	if !c.authorize(w, req) {
+		return
+	}
+	if c.refuseTemplated(w) {
+		return
+	}
+	content, ok := readConfigBody(w, req)
+	if !ok {
+		return
+	}
+	if !c.replaceConfig(w, content) {
+		return
+	}
+	log.Printf("Configuration %s uploaded\n", configHash(content))
+	outcome := c.doReload(reloadRequest{actor: requestActor(req)})
+	if !outcome.Success {
+		msg := fmt.Sprintf("Couldn't reload: %v\n", outcome.Error)
+		log.Println(msg)
+		http.Error(w, msg, outcome.httpStatus())
+		return
+	}
+	fmt.Fprintf(w, "OK\n")
+}
+
+// replaceConfig applies the transforms to the content and validates the
+// result in a temporary file, so what haproxy loads is what is validated. It
+// only renames it to the configuration file if it is valid. It replies to the
+// request and returns false if the configuration is not replaced.
+func (c *Controller) replaceConfig(w http.ResponseWriter, content []byte) bool {
+	if c.NewValidator == nil {
+		http.Error(w, "Validation of new configurations not enabled\n", http.StatusNotFound)
+		return false
+	}
+	content, err := c.Pipeline.Transform(content)
+	if err != nil {
+		msg := c.Redactor.RedactString(fmt.Sprintf("Couldn't transform configuration: %v\n", err))
+		log.Println(msg)
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return false
+	}
+	temp, err := writeTempFile(c.configFile, content)
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't write configuration: %v\n", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return false
+	}
+	defer os.Remove(temp)
+	if err := c.NewValidator(temp).Validate(); err != nil {
+		msg := c.Redactor.RedactString(fmt.Sprintf("Invalid configuration: %v\n", err))
+		log.Println(msg)
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return false
+	}
+	if err := os.Rename(temp, c.configFile); err != nil {
+		msg := fmt.Sprintf("Couldn't write configuration: %v\n", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// validationCache shows the content of the validation cache, or clears it
+// on DELETE requests.
+func (c *Controller) validationCache(w http.ResponseWriter, req *http.Request) {
+	if c.ValidationCache == nil {
+		http.Error(w, "Validation cache not enabled\n", http.StatusNotFound)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, c.ValidationCache.Status())
+	case http.MethodDelete:
+		if !c.authorize(w, req) {
+			return
+		}
+		c.ValidationCache.Clear()
+		log.Println("Validation cache cleared")
 		fmt.Fprintf(w, "OK\n")
-	})
+	default:
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+	}
+}
 
-	err = http.Serve(c.listener, handler)
-	if err != nil && !c.done {
-		return fmt.Errorf("Controller error: %v", err)
+// authorize checks that the request has the bearer token, if one is
+// configured. If it doesn't, it replies with an error and returns false.
+func (c *Controller) authorize(w http.ResponseWriter, req *http.Request) bool {
+	if c.Token == "" || c.authenticated(req) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "Unauthorized\n", http.StatusUnauthorized)
+	return false
+}
+
+// authenticated returns true if the request carries the token, it is false
+// when no token is configured.
+func (c *Controller) authenticated(req *http.Request) bool {
+	if c.Token == "" {
+		return false
+	}
+	const prefix = "Bearer "
+	auth := req.Header.Get("Authorization")
+	return strings.HasPrefix(auth, prefix) && subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(c.Token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Couldn't encode response: %v\n", err)
 	}
-	return nil
+}
+
+// controllerStatus is the response of /status, sections whose source is
+// not available include an error, but don't prevent reporting the others.
+type controllerStatus struct {
+	Haproxy    haproxyStatusSection `json:"haproxy"`
+	LastReload *ReloadOutcome       `json:"last_reload,omitempty"`
+	Backends   *backendsSection     `json:"backends,omitempty"`
+	NetQueues  *netQueuesSection    `json:"net_queues,omitempty"`
+
+	PendingApproval *PendingApproval `json:"pending_approval,omitempty"`
+	Freeze          *FreezeStatus    `json:"freeze,omitempty"`
+
+	// Resources used by the wrapper itself
+	Wrapper ResourceUsage `json:"wrapper"`
+}
+
+type haproxyStatusSection struct {
+	HaproxyStatus
+	Error string `json:"error,omitempty"`
+}
+
+type backendsSection struct {
+	Healthy   []string `json:"healthy"`
+	Unhealthy []string `json:"unhealthy"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type netQueuesSection struct {
+	Disabled    string               `json:"disabled,omitempty"`
+	Queues      []ProcNetfilterQueue `json:"queues,omitempty"`
+	LastCapture *CaptureSummary      `json:"last_capture,omitempty"`
+	Error       string               `json:"error,omitempty"`
+}
+
+func (c *Controller) status(w http.ResponseWriter, req *http.Request) {
+	c.Lock()
+	lastReload := c.lastReload
+	c.Unlock()
+	status := controllerStatus{
+		Haproxy:         c.haproxyStatus(),
+		LastReload:      lastReload,
+		PendingApproval: c.Approval.Pending(),
+		Freeze:          c.Freeze.Status(),
+		Wrapper:         readResourceUsage(),
+	}
+	if c.StatsSocket != nil {
+		status.Backends = c.backendsStatus()
+	}
+	if len(c.NetQueues) > 0 {
+		status.NetQueues = c.netQueuesStatus()
+	}
+	writeJSON(w, status)
+}
+
+func (c *Controller) haproxyStatus() (section haproxyStatusSection) {
+	defer func() {
+		if r := recover(); r != nil {
+			section.Error = fmt.Sprintf("couldn't obtain status: %v", r)
+		}
+	}()
+	section.HaproxyStatus = c.haproxy.Status()
+	return
+}
+
+func (c *Controller) backendsStatus() *backendsSection {
+	section := &backendsSection{Healthy: []string{}, Unhealthy: []string{}}
+	records, err := c.StatsSocket.ShowStat()
+	if err != nil {
+		section.Error = err.Error()
+		return section
+	}
+	healthy := healthyBackends(records)
+	seen := make(map[string]bool)
+	for _, r := range records {
+		if r.Server != "BACKEND" || seen[r.Proxy] {
+			continue
+		}
+		seen[r.Proxy] = true
+		if healthy[r.Proxy] {
+			section.Healthy = append(section.Healthy, r.Proxy)
+		} else {
+			section.Unhealthy = append(section.Unhealthy, r.Proxy)
+		}
+	}
+	return section
+}
+
+func (c *Controller) netQueuesStatus() *netQueuesSection {
+	c.Lock()
+	section := &netQueuesSection{LastCapture: c.lastCapture}
+	c.Unlock()
+	if c.CaptureDisabled != "" {
+		section.Disabled = c.CaptureDisabled
+		return section
+	}
+	procNf, err := c.readNetfilter()
+	if err != nil {
+		section.Error = fmt.Sprintf("couldn't read netfilter queues: %v", err)
+		return section
+	}
+	var missing []string
+	for _, id := range c.NetQueues {
+		if q, found := procNf.Get(id); found {
+			section.Queues = append(section.Queues, q)
+		} else {
+			missing = append(missing, fmt.Sprintf("%d", id))
+		}
+	}
+	if len(missing) > 0 {
+		section.Error = fmt.Sprintf("queues not found: %s", strings.Join(missing, ", "))
+	}
+	return section
+}
+
+// CaptureEvent logs a transition of a capture of connections and sends it
+// to the event socket.
+func (c *Controller) CaptureEvent(e CaptureEvent) {
+	switch e.State {
+	case ReleaseRequested:
+		c.startCaptureCheck(e.ReloadID)
+	case CaptureSummarized:
+		c.diagnoseCapture(e.ReloadID, e.Summary)
+	case PacketsDropped:
+		c.captureDrops.Add(float64(e.Summary.QueueDropped))
+	}
+	c.timeCapture(e)
+	logWithFields(LogFields{"reload_id": e.ReloadID, "capture_state": e.State}, "Capture of reload %d: %s\n", e.ReloadID, e.State)
+	c.EventSocket.Emit(e)
+}
+
+// timeCapture observes the time needed to start retaining connections, from
+// the request of the capture, and to release them, from the request of the
+// release to the acceptance of the retained packets.
+func (c *Controller) timeCapture(e CaptureEvent) {
+	c.Lock()
+	defer c.Unlock()
+	switch e.State {
+	case CaptureRequested, ReleaseRequested:
+		c.captureStarts[e.ReloadID] = e.Time
+		return
+	case CapturingActive, CaptureFailed:
+		if start, found := c.captureStarts[e.ReloadID]; found {
+			c.phaseDurations.Observe(e.Time.Sub(start).Seconds(), ReloadPhaseCapture)
+		}
+		if e.State == CaptureFailed {
+			// Overlapping captures fail with the first one, without
+			// their own events
+			for id := range c.captureStarts {
+				if id > e.ReloadID {
+					delete(c.captureStarts, id)
+				}
+			}
+		}
+	case CaptureSummarized:
+		if start, found := c.captureStarts[e.ReloadID]; found {
+			c.phaseDurations.Observe(e.Time.Sub(start).Seconds(), ReloadPhaseRelease)
+		}
+	default:
+		return
+	}
+	delete(c.captureStarts, e.ReloadID)
+}
+
+// Collect provides the metrics of the controller and haproxy.
+func (c *Controller) Collect() []MetricFamily {
+	status := c.haproxy.Status()
+	families := append(c.reloads.Collect(), c.emptyCaptures.Collect()...)
+	families = append(families, c.slowReloads.Collect()...)
+	families = append(families, c.captureDrops.Collect()...)
+	families = append(families, c.reloadDurations.Collect()...)
+	families = append(families, c.phaseDurations.Collect()...)
+	families = append(families, c.coalescedReloads.Collect()...)
+	families = append(families, c.configWarnings.Collect()...)
+	families = append(families, c.reloadHistory.collect(c.ReloadSuccessWindow)...)
+	families = append(families, readResourceUsage().collect()...)
+	families = append(families,
+		gaugeFamily("haproxy_up", "Whether haproxy is running", boolValue(status.Running)),
+		gaugeFamily("haproxy_crashes", "Number of unexpected exits of haproxy", float64(status.Crashes)),
+		gaugeFamily("haproxy_restarts", "Number of restarts of haproxy after crashes", float64(status.Restarts)),
+		gaugeFamily("haproxy_old_workers", "Number of old haproxy processes draining connections after reloads", float64(status.OldWorkers)),
+		gaugeFamily("haproxy_old_workers_killed", "Number of old haproxy processes killed after the maximum lifetime", float64(status.OldWorkersKilled)),
+	)
+	if c.Load != nil {
+		families = append(families, c.Load.collect()...)
+	}
+	return append(families, c.netQueuesMetrics()...)
 }
 
 func (c *Controller) Stop() error {
+	c.Lock()
+	stopping := c.done
 	c.done = true
-	return c.listener.Close()
+	listener := c.listener
+	c.Unlock()
+	if stopping {
+		return fmt.Errorf("controller already stopping")
+	}
+
+	var err error
+	if listener != nil {
+		err = listener.Close()
+	}
+	c.waitReloads()
+	close(c.stopped)
+	return err
+}
+
+// waitReloads waits for the reloads in progress, cancelling them if they
+// don't finish before the stop timeout.
+func (c *Controller) waitReloads() {
+	finished := make(chan struct{})
+	go func() {
+		c.inflight.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return
+	case <-time.After(c.StopTimeout):
+	}
+	log.Printf("Reloads still in progress after %s, cancelling them\n", c.StopTimeout)
+	close(c.cancelReloads)
+	select {
+	case <-finished:
+	case <-time.After(reloadCancelTimeout):
+		log.Println("Stopping with reloads in progress")
+	}
 }
@@ -0,0 +1,823 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeHaproxy struct {
+	sync.Mutex
+	running bool
+	reloads int
+	err     error
+}
+
+func (h *fakeHaproxy) Start() error {
+	h.Lock()
+	defer h.Unlock()
+	h.running = true
+	return h.err
+}
+
+func (h *fakeHaproxy) Stop() error {
+	h.Lock()
+	defer h.Unlock()
+	h.running = false
+	return nil
+}
+
+func (h *fakeHaproxy) Reload() error {
+	h.Lock()
+	defer h.Unlock()
+	h.reloads++
+	return h.err
+}
+
+func (h *fakeHaproxy) IsRunning() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.running
+}
+
+func (h *fakeHaproxy) Status() HaproxyStatus {
+	h.Lock()
+	defer h.Unlock()
+	return HaproxyStatus{Running: h.running}
+}
+
+type fakeValidator struct {
+	err error
+}
+
+func (v *fakeValidator) Validate() error {
+	return v.err
+}
+
+func tempConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "haproxy-cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestControllerConfigETag(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	c := NewController("", path, &fakeHaproxy{}, &fakeValidator{})
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/config", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if w.Body.String() != "global\n" {
+		t.Fatalf("unexpected config: %q", w.Body.String())
+	}
+	expected := `"` + configHash([]byte("global\n")) + `"`
+	if etag := w.Header().Get("ETag"); etag != expected {
+		t.Fatalf("found ETag %s, expected %s", etag, expected)
+	}
+}
+
+func TestControllerReloadIfMatch(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	etag := `"` + configHash([]byte("global\n")) + `"`
+	cases := []struct {
+		ifMatch string
+		status  int
+		reloads int
+	}{
+		{"", http.StatusOK, 1},
+		{etag, http.StatusOK, 1},
+		{"*", http.StatusOK, 1},
+		{`"other", ` + etag, http.StatusOK, 1},
+		{`"other"`, http.StatusPreconditionFailed, 0},
+		{"W/" + etag, http.StatusPreconditionFailed, 0},
+	}
+
+	for _, tc := range cases {
+		haproxy := &fakeHaproxy{}
+		c := NewController("", path, haproxy, &fakeValidator{})
+		req := httptest.NewRequest("POST", "/reload", nil)
+		if tc.ifMatch != "" {
+			req.Header.Set("If-Match", tc.ifMatch)
+		}
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("If-Match %q: found status %d, expected %d", tc.ifMatch, w.Code, tc.status)
+		}
+		if haproxy.reloads != tc.reloads {
+			t.Errorf("If-Match %q: found %d reloads, expected %d", tc.ifMatch, haproxy.reloads, tc.reloads)
+		}
+	}
+}
+
+func TestControllerReloadIfMatchApplied(t *testing.T) {
+	dir := configDir(t, "a.cfg", "b.cfg")
+	defer os.RemoveAll(dir)
+
+	haproxy := &fakeHaproxy{}
+	c := NewController("", filepath.Join(dir, "a.cfg"), haproxy, &fakeValidator{})
+	c.ConfigFiles = dir
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/config", nil))
+	etag := w.Header().Get("ETag")
+	if expected := `"` + configHash([]byte("a.cfg\nb.cfg\n")) + `"`; etag != expected {
+		t.Fatalf("found ETag %s, expected %s", etag, expected)
+	}
+
+	// Changes of any file loaded by haproxy after the request is accepted
+	// are detected by the reload
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.cfg"), []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outcome := c.doReload(reloadRequest{ifMatch: etag})
+	if outcome.Success || outcome.Phase != ReloadPhasePrecondition || outcome.httpStatus() != http.StatusPreconditionFailed {
+		t.Fatalf("expected failed precondition, found %+v", outcome)
+	}
+	if haproxy.reloads != 0 {
+		t.Fatal("haproxy reloaded with changed configuration")
+	}
+	c.Lock()
+	lastReload := c.lastReload
+	c.Unlock()
+	if lastReload != nil {
+		t.Fatalf("failed precondition recorded as reload: %+v", lastReload)
+	}
+
+	// Failures reading the configuration are reported in the same phase
+	c.ConfigFiles = filepath.Join(dir, "missing.cfg")
+	if outcome := c.doReload(reloadRequest{ifMatch: etag}); outcome.Success || outcome.Phase != ReloadPhasePrecondition {
+		t.Fatalf("expected failed precondition reading configuration, found %+v", outcome)
+	}
+}
+
+func TestControllerReloadValidate(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	haproxy := &fakeHaproxy{}
+	validator := &countingValidator{err: errors.New("exit status 1:\n[ALERT] parsing [haproxy.cfg:2] : unknown keyword 'foo'")}
+	c := NewController("", path, haproxy, validator)
+
+	// Configurations are validated by default
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/reload", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unknown keyword 'foo'") {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	if haproxy.reloads != 0 || validator.calls != 1 {
+		t.Fatalf("unexpected reloads %d and validations %d", haproxy.reloads, validator.calls)
+	}
+
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/reload?validate=true", nil))
+	if w.Code != http.StatusBadRequest || haproxy.reloads != 0 || validator.calls != 2 {
+		t.Fatalf("unexpected response %d with %d reloads: %s", w.Code, haproxy.reloads, w.Body.String())
+	}
+
+	// Validation can be explicitly skipped
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/reload?validate=false", nil))
+	if w.Code != http.StatusOK || haproxy.reloads != 1 || validator.calls != 2 {
+		t.Fatalf("unexpected response %d with %d reloads: %s", w.Code, haproxy.reloads, w.Body.String())
+	}
+
+	validator.err = nil
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/reload", nil))
+	if w.Code != http.StatusOK || haproxy.reloads != 2 || validator.calls != 3 {
+		t.Fatalf("unexpected response %d with %d reloads: %s", w.Code, haproxy.reloads, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/reload?validate=maybe", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status with invalid parameter: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("PUT", "/reload", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status with PUT: %d", w.Code)
+	}
+	if haproxy.reloads != 2 {
+		t.Fatalf("unexpected reloads: %d", haproxy.reloads)
+	}
+}
+
+// serialHaproxy fails reloads that overlap with others.
+type serialHaproxy struct {
+	fakeHaproxy
+	active  int32
+	overlap int32
+}
+
+func (h *serialHaproxy) Reload() error {
+	if atomic.AddInt32(&h.active, 1) > 1 {
+		atomic.StoreInt32(&h.overlap, 1)
+	}
+	time.Sleep(10 * time.Millisecond)
+	atomic.AddInt32(&h.active, -1)
+	return h.fakeHaproxy.Reload()
+}
+
+func TestControllerReloadSerialized(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	haproxy := &serialHaproxy{}
+	c := NewController("", path, haproxy, &fakeValidator{})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/reload?validate=true", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("unexpected status %d: %s", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&haproxy.overlap) != 0 || haproxy.reloads != 5 {
+		t.Fatalf("reloads not serialized: %d reloads", haproxy.reloads)
+	}
+}
+
+// slowHaproxy takes some time to reload.
+type slowHaproxy struct {
+	fakeHaproxy
+	delay time.Duration
+}
+
+func (h *slowHaproxy) Reload() error {
+	time.Sleep(h.delay)
+	return h.fakeHaproxy.Reload()
+}
+
+func TestControllerSlowReload(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	haproxy := &slowHaproxy{delay: 50 * time.Millisecond}
+	c := NewController("", path, haproxy, &fakeValidator{})
+	c.SlowReloadThreshold = 20 * time.Millisecond
+	outcome := c.ValidatedReload()
+	if !outcome.Success {
+		t.Fatalf("unexpected outcome: %+v", outcome)
+	}
+
+	var phases []string
+	for _, p := range outcome.Phases {
+		phases = append(phases, p.Phase)
+		if p.Phase == ReloadPhaseReload && p.Duration < haproxy.delay {
+			t.Errorf("unexpected duration of reload phase: %s", p.Duration)
+		}
+	}
+	expected := []string{ReloadPhaseCoordinate, ReloadPhaseTransform, ReloadPhaseValidate, ReloadPhaseReload}
+	if !reflect.DeepEqual(phases, expected) {
+		t.Errorf("found phases %v, expected %v", phases, expected)
+	}
+	if !strings.Contains(logs.String(), "Warning: slow reload took") || !strings.Contains(logs.String(), " validate=") || !strings.Contains(logs.String(), " reload=") {
+		t.Errorf("slow reload not logged:\n%s", logs.String())
+	}
+	if families := c.slowReloads.Collect(); families[0].Samples[0].Value != 1 {
+		t.Errorf("slow reload not counted: %+v", families)
+	}
+
+	// Fast reloads are not reported
+	haproxy.delay = 0
+	c.SlowReloadThreshold = time.Second
+	logs.Reset()
+	c.Reload()
+	if strings.Contains(logs.String(), "slow reload") {
+		t.Errorf("fast reload logged as slow:\n%s", logs.String())
+	}
+}
+
+func TestControllerUploadConfig(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	haproxy := &fakeHaproxy{}
+	var validated []string
+	c := NewController("", path, haproxy, &fakeValidator{})
+	c.Token = "secret"
+	upload := func(content string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/config", strings.NewReader(content))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, req)
+		return w
+	}
+	if w := upload("global\n    maxconn 10\n"); w.Code != http.StatusNotFound {
+		t.Fatalf("upload without validator: %d", w.Code)
+	}
+
+	c.NewValidator = func(configFile string) HaproxyConfigValidator {
+		validated = append(validated, configFile)
+		return &contentValidator{path: configFile}
+	}
+	w := upload("global\n    invalid\n")
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "invalid directive") {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "global\n" || haproxy.reloads != 0 {
+		t.Fatalf("invalid configuration applied: %q", content)
+	}
+	if len(validated) != 1 || validated[0] == path || filepath.Dir(validated[0]) != filepath.Dir(path) {
+		t.Fatalf("unexpected files validated: %v", validated)
+	}
+	if _, err := os.Stat(validated[0]); !os.IsNotExist(err) {
+		t.Fatalf("temporary file not removed: %v", err)
+	}
+
+	w = upload("global\n    maxconn 10\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "global\n    maxconn 10\n" || haproxy.reloads != 1 {
+		t.Fatalf("configuration not applied: %q, %d reloads", content, haproxy.reloads)
+	}
+
+	req := httptest.NewRequest("PUT", "/config", strings.NewReader("global\n"))
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status without token: %d", w.Code)
+	}
+}
+
+func TestControllerUploadConfigTransformed(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	haproxy := &fakeHaproxy{}
+	c := NewController("", path, haproxy, &fakeValidator{})
+	c.NewValidator = func(configFile string) HaproxyConfigValidator {
+		return &contentValidator{path: configFile}
+	}
+	// The transform makes valid uploads invalid when they set maxconn
+	c.Pipeline = ConfigPipeline{{Name: "test", Apply: func(config *haproxyConfig) error {
+		global := config.Section("global")
+		for i, line := range global.Lines {
+			if strings.Contains(line, "maxconn") {
+				global.Lines[i] = "    invalid"
+			}
+		}
+		return nil
+	}}}
+	upload := func(content string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, httptest.NewRequest("PUT", "/config", strings.NewReader(content)))
+		return w
+	}
+
+	if w := upload("global\n    maxconn 10\n"); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "global\n" || haproxy.reloads != 0 {
+		t.Fatalf("configuration invalid after transforms applied: %q", content)
+	}
+	if w := upload("global\n    nbthread 2\n"); w.Code != http.StatusOK || haproxy.reloads != 1 {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+}
+
+type panicValidator struct{}
+
+func (v *panicValidator) Validate() error {
+	panic("validator failed")
+}
+
+func TestControllerValidateCandidate(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	haproxy := &fakeHaproxy{}
+	var validated []string
+	c := NewController("", path, haproxy, &fakeValidator{err: errors.New("live configuration validated")})
+	c.NewValidator = func(configFile string) HaproxyConfigValidator {
+		validated = append(validated, configFile)
+		return &contentValidator{path: configFile}
+	}
+	post := func(content string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/validate", strings.NewReader(content)))
+		return w
+	}
+
+	if w := post("global\n    maxconn 10\n"); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("unexpected response %d: %q", w.Code, w.Body.String())
+	}
+	w := post("global\n    invalid\n")
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "invalid directive") {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "global\n" || haproxy.reloads != 0 {
+		t.Fatalf("candidate configuration applied: %q", content)
+	}
+
+	// Temporary files are removed also if the validator panics
+	c.NewValidator = func(configFile string) HaproxyConfigValidator {
+		validated = append(validated, configFile)
+		return &panicValidator{}
+	}
+	func() {
+		defer func() { recover() }()
+		post("global\n")
+	}()
+	if len(validated) != 3 {
+		t.Fatalf("unexpected files validated: %v", validated)
+	}
+	for _, f := range validated {
+		if f == path {
+			t.Fatalf("live configuration validated instead of candidate")
+		}
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Fatalf("temporary file not removed: %v", err)
+		}
+	}
+
+	// Without body the live configuration is validated
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/validate", nil))
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "live configuration validated") {
+		t.Fatalf("unexpected response without body %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestControllerToken(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	haproxy := &fakeHaproxy{running: true}
+	c := NewController("", path, haproxy, &fakeValidator{})
+	c.NewValidator = func(string) HaproxyConfigValidator { return &fakeValidator{} }
+	c.Token = "secret"
+	request := func(method, target, auth string) int {
+		var body io.Reader
+		if method == "PUT" {
+			body = strings.NewReader("global\n")
+		}
+		req := httptest.NewRequest(method, target, body)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, auth := range []string{"", "Bearer other", "secret", "Basic c2VjcmV0"} {
+		for _, target := range []string{"/reload", "/config", "/rollback"} {
+			method := "POST"
+			if target == "/config" {
+				method = "PUT"
+			}
+			if code := request(method, target, auth); code != http.StatusUnauthorized {
+				t.Errorf("%s %s with authorization %q: found %d, expected 401", method, target, auth, code)
+			}
+		}
+	}
+	if haproxy.reloads != 0 {
+		t.Fatalf("haproxy reloaded %d times without token", haproxy.reloads)
+	}
+	for _, target := range []string{"/status", "/config", "/ready"} {
+		if code := request("GET", target, ""); code == http.StatusUnauthorized {
+			t.Errorf("GET %s requires token", target)
+		}
+	}
+
+	if code := request("POST", "/reload", "Bearer secret"); code != http.StatusOK {
+		t.Fatalf("reload with token: found %d", code)
+	}
+	if code := request("PUT", "/config", "Bearer secret"); code != http.StatusOK {
+		t.Fatalf("upload with token: found %d", code)
+	}
+
+	c.Token = ""
+	if code := request("POST", "/reload", ""); code != http.StatusOK {
+		t.Fatalf("reload without token configured: found %d", code)
+	}
+}
+
+func TestControllerAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract unix sockets are only available in Linux")
+	}
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	address := fmt.Sprintf("@haproxy-wrapper-test-%d", os.Getpid())
+	c := NewController(address, path, &fakeHaproxy{}, &fakeValidator{})
+	done := make(chan error)
+	go func() { done <- c.Run() }()
+	defer func() {
+		c.Stop()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", address)
+		},
+	}}
+	var resp *http.Response
+	var err error
+	for retries := 50; retries > 0; retries-- {
+		if resp, err = client.Get("http://wrapper/config"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "global\n" {
+		t.Fatalf("unexpected response %d: %q", resp.StatusCode, body)
+	}
+}
+
+// brokenHaproxy is a server whose status cannot be obtained.
+type brokenHaproxy struct {
+	fakeHaproxy
+}
+
+func (h *brokenHaproxy) Status() HaproxyStatus {
+	panic("broken")
+}
+
+func getStatus(t *testing.T, c *Controller) map[string]map[string]interface{} {
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	var status map[string]map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestControllerStatusPartial(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	defer func(path string) { procNetfilterQueuePath = path }(procNetfilterQueuePath)
+	procNetfilterQueuePath = config + ".missing"
+
+	c := NewController("", config, &fakeHaproxy{running: true}, &fakeValidator{})
+	c.StatsSocket = NewStatsSocket(config + ".sock")
+	c.NetQueues = []uint{0}
+	c.Reload()
+
+	status := getStatus(t, c)
+	if status["haproxy"]["running"] != true || status["haproxy"]["error"] != nil {
+		t.Errorf("unexpected haproxy section: %v", status["haproxy"])
+	}
+	if status["last_reload"]["success"] != true {
+		t.Errorf("unexpected last reload section: %v", status["last_reload"])
+	}
+	if status["backends"]["error"] == nil {
+		t.Errorf("error expected in backends section: %v", status["backends"])
+	}
+	if status["net_queues"]["error"] == nil {
+		t.Errorf("error expected in net queues section: %v", status["net_queues"])
+	}
+}
+
+func TestControllerStatusBrokenHaproxy(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	socket := newFakeStatsSocket(t, func(string) string {
+		return statHeader + statLine("web", "s1", "UP") + statLine("web", "BACKEND", "UP") +
+			statLine("api", "s1", "DOWN") + statLine("api", "BACKEND", "DOWN")
+	})
+	defer socket.Close()
+
+	c := NewController("", config, &brokenHaproxy{}, &fakeValidator{})
+	c.StatsSocket = NewStatsSocket(socket.Path())
+
+	status := getStatus(t, c)
+	if status["haproxy"]["error"] == nil {
+		t.Errorf("error expected in haproxy section: %v", status["haproxy"])
+	}
+	backends := status["backends"]
+	if backends["error"] != nil || len(backends["healthy"].([]interface{})) != 1 || len(backends["unhealthy"].([]interface{})) != 1 {
+		t.Errorf("unexpected backends section: %v", backends)
+	}
+}
+
+func TestControllerCaptureEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "event-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.sock")
+	conn := listenEvents(t, path)
+	defer conn.Close()
+
+	c := NewController("", "", &fakeHaproxy{}, &fakeValidator{})
+	c.EventSocket = NewEventSocket(path, 0)
+	c.CaptureEvent(CaptureEvent{Event: "capture", State: RulesInstalled, Time: time.Now(), ReloadID: 3})
+
+	event := readEvent(t, conn)
+	if event["event"] != "capture" || event["state"] != RulesInstalled || event["reload_id"] != 3.0 {
+		t.Fatalf("unexpected event: %v", event)
+	}
+}
+
+// blockingHaproxy blocks reloads until unblocked.
+type blockingHaproxy struct {
+	fakeHaproxy
+	reloading chan struct{}
+	unblock   chan struct{}
+}
+
+func (h *blockingHaproxy) Reload() error {
+	h.reloading <- struct{}{}
+	<-h.unblock
+	return h.fakeHaproxy.Reload()
+}
+
+func runController(t *testing.T, c *Controller) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- c.Run()
+	}()
+	for retries := 100; ; retries-- {
+		c.Lock()
+		listening := c.listener != nil
+		c.Unlock()
+		if listening {
+			return result
+		}
+		if retries == 0 {
+			t.Fatal("controller not listening")
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+}
+
+func TestControllerStopWaitsAsyncReload(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &blockingHaproxy{reloading: make(chan struct{}), unblock: make(chan struct{})}
+	c := NewController("127.0.0.1:0", config, h, &fakeValidator{})
+	run := runController(t, c)
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/reload?async=true", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	<-h.reloading
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- c.Stop()
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("controller stopped during reload")
+	case <-run:
+		t.Fatal("controller finished during reload")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/reload?async=true", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected reloads rejected while stopping, found %d", w.Code)
+	}
+
+	close(h.unblock)
+	if err := <-stopped; err != nil {
+		t.Errorf("unexpected error stopping controller: %v", err)
+	}
+	if err := <-run; err != nil {
+		t.Errorf("unexpected error running controller: %v", err)
+	}
+	c.Lock()
+	outcome := c.lastReload
+	c.Unlock()
+	if outcome == nil || !outcome.Success || h.reloads != 1 {
+		t.Errorf("expected completed reload, found %+v", outcome)
+	}
+	if err := c.Stop(); err == nil {
+		t.Error("expected error stopping controller twice")
+	}
+}
+
+func TestControllerStopCancelsReloads(t *testing.T) {
+	defer func(interval time.Duration) { healthCheckInterval = interval }(healthCheckInterval)
+	healthCheckInterval = 10 * time.Millisecond
+
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	socket := newFakeStatsSocket(t, func(string) string {
+		return statHeader + statLine("app", "app1", "DOWN")
+	})
+	defer socket.Close()
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+	c.StatsSocket = NewStatsSocket(socket.Path())
+	c.WaitHealthyTimeout = time.Minute
+	c.StopTimeout = 50 * time.Millisecond
+	ioutil.WriteFile(config, []byte("backend app\n    server app1 10.0.0.1:80\n"), 0644)
+
+	outcomes := make(chan *ReloadOutcome, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			outcomes <- c.Reload()
+		}()
+	}
+	for retries := 100; ; retries-- {
+		if retries == 0 {
+			t.Fatal("reloads not started")
+		}
+		c.Lock()
+		applied := string(c.applied)
+		c.Unlock()
+		if strings.Contains(applied, "backend app") {
+			break
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("stop took %s", elapsed)
+	}
+	phases := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case outcome := <-outcomes:
+			if outcome.Success {
+				t.Errorf("unexpected successful reload: %+v", outcome)
+			}
+			phases[outcome.Phase] = true
+		case <-time.After(time.Second):
+			t.Fatal("reload not finished after stop")
+		}
+	}
+	if !phases[ReloadPhaseHealth] || !phases[ReloadPhaseShutdown] {
+		t.Errorf("expected cancelled reload and reload rejected on shutdown, found %v", phases)
+	}
+	if outcome := c.Reload(); outcome.Phase != ReloadPhaseShutdown || outcome.httpStatus() != http.StatusServiceUnavailable {
+		t.Errorf("expected reload rejected after stop, found %+v", outcome)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interval between requests of reload slots when the coordinator doesn't
+// suggest one
+var coordinatorRetryInterval = time.Second
+
+// A ReloadCoordinator limits the number of nodes of a cluster reloading at
+// the same time.
+type ReloadCoordinator interface {
+	// Acquire blocks until a reload slot is granted to the node, or the
+	// timeout expires.
+	Acquire(reload string, timeout time.Duration) error
+	// Release reports the end of a reload, freeing its slot.
+	Release(reload string, outcome *ReloadOutcome) error
+}
+
+// HTTPReloadCoordinator requests reload slots to an HTTP endpoint. Slots are
+// requested with a POST to /acquire, that replies 200 if granted, or 409,
+// 429 or 503 if the node has to retry later, optionally with a Retry-After
+// header. The end of reloads is reported with a POST to /release.
+type HTTPReloadCoordinator struct {
+	url    string
+	node   string
+	client *http.Client
+}
+
+func NewHTTPReloadCoordinator(url, node string) *HTTPReloadCoordinator {
+	return &HTTPReloadCoordinator{
+		url:    strings.TrimSuffix(url, "/"),
+		node:   node,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type coordinatorRequest struct {
+	Node    string `json:"node"`
+	Reload  string `json:"reload"`
+	Success *bool  `json:"success,omitempty"`
+	Phase   string `json:"phase,omitempty"`
+}
+
+func (c *HTTPReloadCoordinator) post(path string, r coordinatorRequest) (*http.Response, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.Post(c.url+path, "application/json", bytes.NewReader(body))
+}
+
+func (c *HTTPReloadCoordinator) Acquire(reload string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := c.post("/acquire", coordinatorRequest{Node: c.node, Reload: reload})
+		if err != nil {
+			return fmt.Errorf("couldn't request reload slot: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return nil
+		case http.StatusConflict, http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		default:
+			return fmt.Errorf("reload slot denied with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		}
+
+		wait := coordinatorRetryInterval
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			wait = time.Duration(seconds) * time.Second
+		}
+		if remaining := time.Until(deadline); remaining <= 0 {
+			return fmt.Errorf("timeout waiting for a reload slot")
+		} else if wait > remaining {
+			wait = remaining
+		}
+		<-time.After(wait)
+	}
+}
+
+func (c *HTTPReloadCoordinator) Release(reload string, outcome *ReloadOutcome) error {
+	success := outcome.Success
+	resp, err := c.post("/release", coordinatorRequest{Node: c.node, Reload: reload, Success: &success, Phase: outcome.Phase})
+	if err != nil {
+		return fmt.Errorf("couldn't release reload slot: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("reload slot release failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
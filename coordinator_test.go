@@ -0,0 +1,144 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCoordinator grants a slot after denying it a number of times, and
+// records the requests received.
+type fakeCoordinator struct {
+	sync.Mutex
+	denials  int
+	status   int
+	requests []string
+	released []coordinatorRequest
+}
+
+func (f *fakeCoordinator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	var r coordinatorRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.requests = append(f.requests, req.URL.Path)
+	switch req.URL.Path {
+	case "/acquire":
+		if f.status != 0 {
+			w.WriteHeader(f.status)
+			return
+		}
+		if f.denials > 0 {
+			f.denials--
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+	case "/release":
+		f.released = append(f.released, r)
+	}
+}
+
+func (f *fakeCoordinator) Requests() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string{}, f.requests...)
+}
+
+func TestControllerReloadCoordinated(t *testing.T) {
+	defer func(interval time.Duration) { coordinatorRetryInterval = interval }(coordinatorRetryInterval)
+	coordinatorRetryInterval = 10 * time.Millisecond
+
+	fake := &fakeCoordinator{denials: 2}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+	c.Coordinator = NewHTTPReloadCoordinator(server.URL, "lb1")
+	c.CoordinationTimeout = time.Second
+
+	if outcome := c.Reload(); !outcome.Success {
+		t.Fatalf("reload failed: %+v", outcome)
+	}
+	if h.reloads != 1 {
+		t.Fatalf("expected 1 reload, found %d", h.reloads)
+	}
+	requests := fake.Requests()
+	expected := []string{"/acquire", "/acquire", "/acquire", "/release"}
+	if len(requests) != len(expected) {
+		t.Fatalf("expected requests %v, found %v", expected, requests)
+	}
+	for i := range expected {
+		if requests[i] != expected[i] {
+			t.Fatalf("expected requests %v, found %v", expected, requests)
+		}
+	}
+	if r := fake.released[0]; r.Node != "lb1" || r.Success == nil || !*r.Success {
+		t.Fatalf("unexpected release: %+v", r)
+	}
+}
+
+func TestControllerReloadCoordinationTimeout(t *testing.T) {
+	defer func(interval time.Duration) { coordinatorRetryInterval = interval }(coordinatorRetryInterval)
+	coordinatorRetryInterval = 10 * time.Millisecond
+
+	fake := &fakeCoordinator{denials: 1000}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+	c.Coordinator = NewHTTPReloadCoordinator(server.URL, "lb1")
+	c.CoordinationTimeout = 50 * time.Millisecond
+
+	outcome := c.Reload()
+	if outcome.Success || outcome.Phase != ReloadPhaseCoordinate || outcome.httpStatus() != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected outcome: %+v", outcome)
+	}
+	if h.reloads != 0 {
+		t.Fatalf("haproxy reloaded without a slot")
+	}
+	for _, r := range fake.Requests() {
+		if r == "/release" {
+			t.Fatal("slot released without being acquired")
+		}
+	}
+}
+
+func TestHTTPReloadCoordinatorDenied(t *testing.T) {
+	fake := &fakeCoordinator{status: http.StatusForbidden}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	if err := NewHTTPReloadCoordinator(server.URL, "lb1").Acquire("1", time.Second); err == nil {
+		t.Fatal("expected error when the slot is denied")
+	}
+	if requests := fake.Requests(); len(requests) != 1 {
+		t.Fatalf("denied requests shouldn't be retried: %v", requests)
+	}
+}
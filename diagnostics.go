@@ -0,0 +1,199 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flags whose values are never included in diagnostics
+var sensitiveFlagRegexp = regexp.MustCompile(`(?i)(token|password|secret|key)$`)
+
+var procSelfStatusPath = "/proc/self/status"
+
+// Capabilities used by some features of the wrapper
+var diagnosticsCapabilities = []struct {
+	name string
+	bit  uint
+}{
+	{"CAP_KILL", 5},
+	{"CAP_NET_ADMIN", 12},
+	{"CAP_SYS_NICE", 23},
+	{"CAP_SYS_RESOURCE", 24},
+}
+
+// Diagnostics is a report of the environment of the wrapper collected at
+// startup, to be attached to support requests.
+type Diagnostics struct {
+	Time           time.Time               `json:"time"`
+	Version        string                  `json:"version"`
+	Flags          map[string]string       `json:"flags"`
+	HaproxyVersion DiagnosticsValue        `json:"haproxy_version"`
+	Validation     DiagnosticsCheck        `json:"validation"`
+	Compatibility  []string                `json:"compatibility_warnings,omitempty"`
+	Preflight      *DiagnosticsCheck       `json:"preflight,omitempty"`
+	Capabilities   DiagnosticsCapabilities `json:"capabilities"`
+	NetQueueChains *DiagnosticsChains      `json:"net_queue_chains,omitempty"`
+	KernelLimits   *KernelLimits           `json:"kernel_limits,omitempty"`
+}
+
+type DiagnosticsValue struct {
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type DiagnosticsCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type DiagnosticsCapabilities struct {
+	Effective map[string]bool `json:"effective,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+type DiagnosticsChains struct {
+	Chains map[string]string `json:"chains,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+func newDiagnosticsCheck(err error, redactor *ConfigRedactor) DiagnosticsCheck {
+	if err != nil {
+		return DiagnosticsCheck{Error: redactor.RedactString(err.Error())}
+	}
+	return DiagnosticsCheck{OK: true}
+}
+
+// CollectDiagnostics checks the configuration and the environment, the
+// netfilter chains used to retain connections to ips are included if any.
+func (c *Controller) CollectDiagnostics(flags *flag.FlagSet, ips []net.IP, options NetQueueOptions) *Diagnostics {
+	d := &Diagnostics{
+		Time:         time.Now(),
+		Version:      version,
+		Flags:        diagnosticsFlags(flags, c.Redactor),
+		KernelLimits: c.KernelLimits,
+	}
+
+	if c.Compatibility != nil {
+		if v, err := c.Compatibility.versionFunc(c.Compatibility.path); err != nil {
+			d.HaproxyVersion.Error = err.Error()
+		} else {
+			d.HaproxyVersion.Value = v
+		}
+	}
+
+	d.Validation = newDiagnosticsCheck(c.validator.Validate(), c.Redactor)
+	d.Compatibility = c.compatibilityWarnings()
+	if c.Preflight != nil {
+		content, err := ioutil.ReadFile(c.configFile)
+		if err == nil {
+			err = c.Preflight.Check(content)
+		}
+		check := newDiagnosticsCheck(err, c.Redactor)
+		d.Preflight = &check
+	}
+
+	capabilities, err := effectiveCapabilities()
+	if err != nil {
+		d.Capabilities.Error = err.Error()
+	} else {
+		d.Capabilities.Effective = capabilities
+	}
+
+	if len(ips) > 0 {
+		d.NetQueueChains = &DiagnosticsChains{}
+		if len(options.Chains) > 0 {
+			d.NetQueueChains.Chains = make(map[string]string)
+			for _, ip := range ips {
+				d.NetQueueChains.Chains[ip.String()] = strings.Join(options.Chains, ",")
+			}
+		} else if chains, err := captureChains(ips, options.Networking); err != nil {
+			d.NetQueueChains.Error = err.Error()
+		} else {
+			d.NetQueueChains.Chains = chains
+		}
+	}
+	return d
+}
+
+// diagnosticsFlags returns the values of all flags, masking sensitive ones.
+func diagnosticsFlags(flags *flag.FlagSet, redactor *ConfigRedactor) map[string]string {
+	values := make(map[string]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value != "" && sensitiveFlagRegexp.MatchString(f.Name) {
+			value = redactedValue
+		}
+		values[f.Name] = redactor.RedactString(value)
+	})
+	return values
+}
+
+// effectiveCapabilities reads the effective capabilities of the process.
+func effectiveCapabilities() (map[string]bool, error) {
+	f, err := os.Open(procSelfStatusPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "CapEff:" {
+			continue
+		}
+		mask, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse capabilities %q: %v", fields[1], err)
+		}
+		capabilities := make(map[string]bool)
+		for _, c := range diagnosticsCapabilities {
+			capabilities[c.name] = mask&(1<<c.bit) != 0
+		}
+		return capabilities, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("capabilities not found in %s", procSelfStatusPath)
+}
+
+// WriteFile writes the diagnostics as JSON to a file.
+func (d *Diagnostics) WriteFile(path string) error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0600)
+}
+
+func (c *Controller) diagnostics(w http.ResponseWriter, req *http.Request) {
+	if c.Diagnostics == nil {
+		http.Error(w, "Diagnostics not available\n", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, c.Diagnostics)
+}
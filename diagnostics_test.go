@@ -0,0 +1,121 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEffectiveCapabilities(t *testing.T) {
+	status := tempConfig(t, "Name:\thaproxy-docker-wrapper\nCapInh:\t0000000000000000\nCapEff:\t0000000000001020\n")
+	defer os.Remove(status)
+	defer func(path string) { procSelfStatusPath = path }(procSelfStatusPath)
+	procSelfStatusPath = status
+
+	capabilities, err := effectiveCapabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{"CAP_KILL": true, "CAP_NET_ADMIN": true, "CAP_SYS_NICE": false, "CAP_SYS_RESOURCE": false}
+	for name, value := range expected {
+		if capabilities[name] != value {
+			t.Errorf("%s: expected %v, found %v", name, value, capabilities[name])
+		}
+	}
+}
+
+func TestCollectDiagnostics(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	redactor, err := NewConfigRedactor(defaultRedactPatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.String("control-token", "", "")
+	flags.String("haproxy-config", "", "")
+	flags.Parse([]string{"-control-token", "s3cr3t", "-haproxy-config", config})
+
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{err: errors.New("parsing: password s3cr3t")})
+	c.Redactor = redactor
+	c.Compatibility = NewCompatibilityChecker("haproxy", CompatibilityTable)
+	c.Compatibility.versionFunc = func(string) (string, error) { return "1.8.14", nil }
+	d := c.CollectDiagnostics(flags, []net.IP{net.ParseIP("10.0.0.1")}, NetQueueOptions{Networking: NetworkingHost})
+
+	if d.Flags["control-token"] != redactedValue || d.Flags["haproxy-config"] != config {
+		t.Errorf("unexpected flags: %v", d.Flags)
+	}
+	if d.HaproxyVersion.Value != "1.8.14" {
+		t.Errorf("unexpected haproxy version: %+v", d.HaproxyVersion)
+	}
+	if d.Validation.OK || strings.Contains(d.Validation.Error, "s3cr3t") {
+		t.Errorf("unexpected validation: %+v", d.Validation)
+	}
+	if d.NetQueueChains == nil || d.NetQueueChains.Chains["10.0.0.1"] != "INPUT" {
+		t.Errorf("unexpected chains: %+v", d.NetQueueChains)
+	}
+
+	path := config + ".diagnostics"
+	defer os.Remove(path)
+	if err := d.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "s3cr3t") {
+		t.Fatalf("secret found in diagnostics: %s", data)
+	}
+}
+
+func TestControllerDiagnostics(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/diagnostics", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without diagnostics, found %d", w.Code)
+	}
+
+	c.Diagnostics = c.CollectDiagnostics(flag.NewFlagSet("test", flag.ContinueOnError), nil, NetQueueOptions{})
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/diagnostics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	var d map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+		t.Fatal(err)
+	}
+	if validation, _ := d["validation"].(map[string]interface{}); validation["ok"] != true {
+		t.Fatalf("unexpected diagnostics: %v", d)
+	}
+	if _, found := d["net_queue_chains"]; found {
+		t.Fatalf("chains reported without netfilter queues: %v", d)
+	}
+}
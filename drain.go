@@ -0,0 +1,228 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Drain modes
+const (
+	DrainModeMaxconn = "maxconn"
+)
+
+const (
+	defaultDrainRamp  = 30 * time.Second
+	defaultDrainSteps = 10
+)
+
+// maxconnDrain reduces gradually the maxconn of all frontends to zero using
+// the runtime API, so established connections can finish while new ones are
+// refused by haproxy.
+type maxconnDrain struct {
+	sync.Mutex
+
+	socket   *StatsSocket
+	ramp     time.Duration
+	steps    int
+	initial  map[string]int
+	maxconns map[string]int
+	started  time.Time
+	finished bool
+	err      error
+}
+
+// DrainStatus reports the progress of a drain.
+type DrainStatus struct {
+	Mode      string         `json:"mode"`
+	Started   time.Time      `json:"started"`
+	Ramp      time.Duration  `json:"ramp_ns"`
+	Finished  bool           `json:"finished"`
+	Maxconn   map[string]int `json:"maxconn"`
+	LastError string         `json:"last_error,omitempty"`
+}
+
+// newMaxconnDrain prepares a drain of the frontends reported by the stats
+// socket, using their current session limits as initial values.
+func newMaxconnDrain(socket *StatsSocket, ramp time.Duration, steps int) (*maxconnDrain, error) {
+	if steps < 1 {
+		return nil, fmt.Errorf("at least one step is needed")
+	}
+	records, err := socket.ShowStat()
+	if err != nil {
+		return nil, err
+	}
+	initial := make(map[string]int)
+	for _, r := range records {
+		if r.Server != "FRONTEND" {
+			continue
+		}
+		maxconn, err := strconv.Atoi(r.Fields["slim"])
+		if err != nil {
+			return nil, fmt.Errorf("couldn't obtain maxconn of frontend %s: %v", r.Proxy, err)
+		}
+		initial[r.Proxy] = maxconn
+	}
+	if len(initial) == 0 {
+		return nil, fmt.Errorf("no frontends found")
+	}
+	maxconns := make(map[string]int)
+	for frontend, maxconn := range initial {
+		maxconns[frontend] = maxconn
+	}
+	return &maxconnDrain{
+		socket:   socket,
+		ramp:     ramp,
+		steps:    steps,
+		initial:  initial,
+		maxconns: maxconns,
+		started:  time.Now(),
+	}, nil
+}
+
+// run applies the steps of the ramp, the last one sets maxconn to zero.
+func (d *maxconnDrain) run() {
+	interval := d.ramp / time.Duration(d.steps)
+	for step := 1; step <= d.steps; step++ {
+		<-time.After(interval)
+		for _, frontend := range d.frontends() {
+			maxconn := d.initial[frontend] * (d.steps - step) / d.steps
+			d.setMaxconn(frontend, maxconn)
+		}
+	}
+	d.Lock()
+	d.finished = true
+	d.Unlock()
+	log.Println("Drain finished")
+}
+
+// frontends returns the names of the drained frontends, sorted.
+func (d *maxconnDrain) frontends() []string {
+	frontends := make([]string, 0, len(d.initial))
+	for frontend := range d.initial {
+		frontends = append(frontends, frontend)
+	}
+	sort.Strings(frontends)
+	return frontends
+}
+
+func (d *maxconnDrain) setMaxconn(frontend string, maxconn int) {
+	command := fmt.Sprintf("set maxconn frontend %s %d", frontend, maxconn)
+	response, err := d.socket.Command(command)
+	if err == nil && response != "" && response != "\n" {
+		err = fmt.Errorf("unexpected response to %q: %s", command, response)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if err != nil {
+		log.Printf("Couldn't set maxconn of frontend %s: %v\n", frontend, err)
+		d.err = err
+		return
+	}
+	d.maxconns[frontend] = maxconn
+}
+
+func (d *maxconnDrain) Status() DrainStatus {
+	d.Lock()
+	defer d.Unlock()
+	status := DrainStatus{
+		Mode:     DrainModeMaxconn,
+		Started:  d.started,
+		Ramp:     d.ramp,
+		Finished: d.finished,
+		Maxconn:  make(map[string]int),
+	}
+	for frontend, maxconn := range d.maxconns {
+		status.Maxconn[frontend] = maxconn
+	}
+	if d.err != nil {
+		status.LastError = d.err.Error()
+	}
+	return status
+}
+
+// drain starts draining haproxy on POST requests, and reports the progress
+// of the current drain on GET requests.
+func (c *Controller) drain(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		c.Lock()
+		drain := c.currentDrain
+		c.Unlock()
+		if drain == nil {
+			http.Error(w, "Not draining\n", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, drain.Status())
+	case http.MethodPost:
+		if !c.authorize(w, req) {
+			return
+		}
+		c.startDrain(w, req)
+	default:
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *Controller) startDrain(w http.ResponseWriter, req *http.Request) {
+	mode := req.URL.Query().Get("mode")
+	if mode == "" {
+		mode = DrainModeMaxconn
+	}
+	if mode != DrainModeMaxconn {
+		http.Error(w, fmt.Sprintf("Unknown drain mode: %s\n", mode), http.StatusBadRequest)
+		return
+	}
+	if c.StatsSocket == nil {
+		http.Error(w, "Draining with maxconn requires the stats socket\n", http.StatusServiceUnavailable)
+		return
+	}
+	ramp := c.DrainRamp
+	if v := req.URL.Query().Get("ramp"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, fmt.Sprintf("Invalid ramp: %s\n", v), http.StatusBadRequest)
+			return
+		}
+		ramp = d
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.currentDrain != nil && !c.currentDrain.Status().Finished {
+		http.Error(w, "Already draining\n", http.StatusConflict)
+		return
+	}
+	drain, err := newMaxconnDrain(c.StatsSocket, ramp, c.DrainSteps)
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't start drain: %v\n", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	c.currentDrain = drain
+	log.Printf("Draining frontends with maxconn in %v\n", ramp)
+	go drain.run()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, drain.Status())
+}
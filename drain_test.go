@@ -0,0 +1,114 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func frontendStatLine(name string, maxconn string) string {
+	return name + ",FRONTEND,,,0,0," + maxconn + ",0,0,0,0,0,,,,,,OPEN,\n"
+}
+
+func TestDrainMaxconnRamp(t *testing.T) {
+	var lock sync.Mutex
+	var commands []string
+	socket := newFakeStatsSocket(t, func(command string) string {
+		if command == "show stat" {
+			return statHeader + frontendStatLine("web", "100") + frontendStatLine("api", "40") + statLine("app", "app1", "UP")
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		commands = append(commands, command)
+		return "\n"
+	})
+	defer socket.Close()
+
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+	c.StatsSocket = NewStatsSocket(socket.Path())
+	c.DrainSteps = 4
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/drain?mode=maxconn&ramp=40ms", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+
+	var status DrainStatus
+	for retries := 100; retries > 0; retries-- {
+		w = httptest.NewRecorder()
+		c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/drain", nil))
+		status = DrainStatus{}
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if status.Finished {
+			break
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+	if !status.Finished {
+		t.Fatal("drain not finished")
+	}
+	if status.Maxconn["web"] != 0 || status.Maxconn["api"] != 0 || status.LastError != "" {
+		t.Errorf("unexpected final status: %+v", status)
+	}
+
+	expected := []string{}
+	for _, step := range []string{"30 75", "20 50", "10 25", "0 0"} {
+		values := strings.Fields(step)
+		expected = append(expected,
+			"set maxconn frontend api "+values[0],
+			"set maxconn frontend web "+values[1],
+		)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("found commands %v, expected %v", commands, expected)
+	}
+}
+
+func TestDrainErrors(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+
+	cases := []struct {
+		method, url string
+		status      int
+	}{
+		{"GET", "/drain", http.StatusNotFound},
+		{"POST", "/drain?mode=iptables", http.StatusBadRequest},
+		{"POST", "/drain?mode=maxconn", http.StatusServiceUnavailable},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, httptest.NewRequest(tc.method, tc.url, nil))
+		if w.Code != tc.status {
+			t.Errorf("%s %s: found status %d, expected %d", tc.method, tc.url, w.Code, tc.status)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+)
+
+// EventSocket sends events as one-line JSON messages to a unix datagram
+// socket, so local agents can consume them. If the socket is not available,
+// events are dropped, or the last ones are kept to be sent later if a
+// buffer is configured.
+type EventSocket struct {
+	// Static labels included in all events
+	Labels map[string]string
+
+	sync.Mutex
+	path    string
+	buffer  int
+	pending [][]byte
+}
+
+func NewEventSocket(path string, buffer int) *EventSocket {
+	return &EventSocket{path: path, buffer: buffer}
+}
+
+// Emit sends an event, it is safe to call it on a nil EventSocket.
+func (s *EventSocket) Emit(event interface{}) {
+	if s == nil {
+		return
+	}
+	d, err := s.encode(event)
+	if err != nil {
+		log.Printf("Couldn't encode event: %v\n", err)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.pending = append(s.pending, append(d, '\n'))
+	if err := s.flush(); err != nil {
+		if len(s.pending) > s.buffer {
+			s.pending = s.pending[len(s.pending)-s.buffer:]
+		}
+	}
+}
+
+// encode encodes the event as JSON, adding the static labels if any.
+func (s *EventSocket) encode(event interface{}) ([]byte, error) {
+	d, err := json.Marshal(event)
+	if err != nil || len(s.Labels) == 0 {
+		return d, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(d, &fields); err != nil {
+		return nil, err
+	}
+	fields["labels"] = s.Labels
+	return json.Marshal(fields)
+}
+
+// flush sends the pending events, keeping the ones that couldn't be sent.
+func (s *EventSocket) flush() error {
+	conn, err := net.Dial("unixgram", s.path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for len(s.pending) > 0 {
+		if _, err := conn.Write(s.pending[0]); err != nil {
+			return err
+		}
+		s.pending = s.pending[1:]
+	}
+	return nil
+}
+
+// reloadEvent is the event emitted after reloads.
+type reloadEvent struct {
+	Event string `json:"event"`
+	*ReloadOutcome
+}
@@ -0,0 +1,127 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func listenEvents(t *testing.T, path string) *net.UnixConn {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func readEvent(t *testing.T, conn *net.UnixConn) map[string]interface{} {
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf[n-1] != '\n' {
+		t.Fatalf("event is not a line: %q", buf[:n])
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(buf[:n], &event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestEventSocketReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "event-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.sock")
+	conn := listenEvents(t, path)
+	defer conn.Close()
+
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+	c.EventSocket = NewEventSocket(path, 0)
+	c.Reload()
+
+	event := readEvent(t, conn)
+	if event["event"] != "reload" || event["success"] != true || event["hash"] != configHash([]byte("global\n")) {
+		t.Fatalf("unexpected event: %v", event)
+	}
+	if _, found := event["duration_ns"]; !found {
+		t.Fatalf("duration not included in event: %v", event)
+	}
+}
+
+func TestEventSocketAbsent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "event-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.sock")
+
+	dropping := NewEventSocket(path, 0)
+	buffering := NewEventSocket(path, 2)
+	for i := 0; i < 3; i++ {
+		dropping.Emit(map[string]int{"n": i})
+		buffering.Emit(map[string]int{"n": i})
+	}
+
+	conn := listenEvents(t, path)
+	defer conn.Close()
+
+	dropping.Emit(map[string]int{"n": 3})
+	if event := readEvent(t, conn); event["n"] != 3.0 {
+		t.Fatalf("expected only last event, found %v", event)
+	}
+
+	buffering.Emit(map[string]int{"n": 3})
+	for _, expected := range []float64{1, 2, 3} {
+		if event := readEvent(t, conn); event["n"] != expected {
+			t.Fatalf("found event %v, expected %v", event, expected)
+		}
+	}
+}
+
+func TestEventSocketLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "event-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.sock")
+	conn := listenEvents(t, path)
+	defer conn.Close()
+
+	s := NewEventSocket(path, 0)
+	s.Labels = map[string]string{"region": "eu"}
+	s.Emit(map[string]string{"event": "test"})
+
+	event := readEvent(t, conn)
+	labels, _ := event["labels"].(map[string]interface{})
+	if event["event"] != "test" || labels["region"] != "eu" {
+		t.Fatalf("unexpected event: %v", event)
+	}
+}
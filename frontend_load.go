@@ -0,0 +1,172 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FrontendLoad is the load of a frontend reported by the stats socket.
+type FrontendLoad struct {
+	Frontend string `json:"frontend"`
+
+	// Current sessions, and their limit, if any
+	Sessions     int `json:"sessions"`
+	SessionLimit int `json:"session_limit,omitempty"`
+
+	// Sessions and HTTP requests per second during the last second, only
+	// HTTP frontends report requests
+	SessionRate int `json:"session_rate"`
+	RequestRate int `json:"request_rate,omitempty"`
+
+	// Sessions accepted since haproxy started
+	TotalSessions int64 `json:"total_sessions"`
+}
+
+// LoadReport is the load of all the frontends at a given time, with the
+// totals of all of them.
+type LoadReport struct {
+	Time        time.Time      `json:"time"`
+	Sessions    int            `json:"sessions"`
+	SessionRate int            `json:"session_rate"`
+	RequestRate int            `json:"request_rate"`
+	Frontends   []FrontendLoad `json:"frontends"`
+}
+
+func newLoadReport(records []StatRecord, t time.Time) (*LoadReport, error) {
+	report := &LoadReport{Time: t, Frontends: []FrontendLoad{}}
+	for _, r := range records {
+		if r.Server != "FRONTEND" {
+			continue
+		}
+		load := FrontendLoad{Frontend: r.Proxy}
+		ints := map[string]*int{
+			"scur":     &load.Sessions,
+			"slim":     &load.SessionLimit,
+			"rate":     &load.SessionRate,
+			"req_rate": &load.RequestRate,
+		}
+		for field, value := range ints {
+			n, err := statInt(r, field)
+			if err != nil {
+				return nil, err
+			}
+			*value = int(n)
+		}
+		var err error
+		if load.TotalSessions, err = statInt(r, "stot"); err != nil {
+			return nil, err
+		}
+		report.Sessions += load.Sessions
+		report.SessionRate += load.SessionRate
+		report.RequestRate += load.RequestRate
+		report.Frontends = append(report.Frontends, load)
+	}
+	return report, nil
+}
+
+// statInt parses a numeric field of a record, empty fields are zero.
+func statInt(r StatRecord, field string) (int64, error) {
+	value := r.Fields[field]
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s of frontend %s: %q", field, r.Proxy, value)
+	}
+	return n, nil
+}
+
+// LoadCache keeps the load of the frontends read from the stats socket, so
+// frequent requests of autoscalers and scrapes don't query haproxy each time.
+// Reports are read again when they are older than the maximum age.
+type LoadCache struct {
+	sync.Mutex
+	maxAge time.Duration
+	read   func() ([]StatRecord, error)
+	now    func() time.Time
+
+	report *LoadReport
+	err    error
+	readAt time.Time
+}
+
+func NewLoadCache(socket *StatsSocket, maxAge time.Duration) *LoadCache {
+	return &LoadCache{maxAge: maxAge, read: socket.ShowStat, now: time.Now}
+}
+
+// Get returns the last report, reading it again if it is too old. Errors are
+// also kept, so an unavailable socket is not queried on each request.
+func (c *LoadCache) Get() (*LoadReport, error) {
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	if !c.readAt.IsZero() && now.Sub(c.readAt) < c.maxAge {
+		return c.report, c.err
+	}
+	c.readAt = now
+	records, err := c.read()
+	if err != nil {
+		c.report, c.err = nil, err
+	} else {
+		c.report, c.err = newLoadReport(records, now)
+	}
+	return c.report, c.err
+}
+
+func (c *LoadCache) collect() []MetricFamily {
+	report, err := c.Get()
+	if err != nil {
+		log.Printf("Couldn't read load of frontends: %v\n", err)
+		return nil
+	}
+	sessions := NewGaugeVec("frontend_sessions", "Current sessions in the frontend", "frontend")
+	limits := NewGaugeVec("frontend_session_limit", "Maximum sessions in the frontend, zero if unlimited", "frontend")
+	sessionRates := NewGaugeVec("frontend_session_rate", "Sessions per second accepted by the frontend during the last second", "frontend")
+	requestRates := NewGaugeVec("frontend_request_rate", "HTTP requests per second received by the frontend during the last second", "frontend")
+	for _, load := range report.Frontends {
+		sessions.Set(float64(load.Sessions), load.Frontend)
+		limits.Set(float64(load.SessionLimit), load.Frontend)
+		sessionRates.Set(float64(load.SessionRate), load.Frontend)
+		requestRates.Set(float64(load.RequestRate), load.Frontend)
+	}
+	var families []MetricFamily
+	for _, vec := range []*GaugeVec{sessions, limits, sessionRates, requestRates} {
+		families = append(families, vec.Collect()...)
+	}
+	return append(families, gaugeFamily("frontend_load_age_seconds", "Age of the load of the frontends reported", c.now().Sub(report.Time).Seconds()))
+}
+
+// load reports the load of the frontends, to be used by autoscalers.
+func (c *Controller) load(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := c.Load.Get()
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't read load of frontends: %v\n", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, report)
+}
@@ -0,0 +1,120 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const loadStatHeader = "# pxname,svname,scur,slim,stot,status,rate,req_rate,\n"
+
+func TestControllerLoad(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+
+	var queries int32
+	socket := newFakeStatsSocket(t, func(string) string {
+		atomic.AddInt32(&queries, 1)
+		return loadStatHeader +
+			"web,FRONTEND,12,100,3400,OPEN,5,20,\n" +
+			"web,web1,12,,3400,UP,5,,\n" +
+			"tcp,FRONTEND,3,,80,OPEN,1,,\n"
+	})
+	defer socket.Close()
+
+	c := NewController("", config, &fakeHaproxy{running: true}, &fakeValidator{})
+	c.Load = NewLoadCache(NewStatsSocket(socket.Path()), time.Hour)
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/load", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var report LoadReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Sessions != 15 || report.SessionRate != 6 || report.RequestRate != 20 {
+		t.Fatalf("unexpected totals: %+v", report)
+	}
+	expected := []FrontendLoad{
+		{Frontend: "web", Sessions: 12, SessionLimit: 100, SessionRate: 5, RequestRate: 20, TotalSessions: 3400},
+		{Frontend: "tcp", Sessions: 3, SessionRate: 1, TotalSessions: 80},
+	}
+	if len(report.Frontends) != len(expected) {
+		t.Fatalf("found frontends %+v, expected %+v", report.Frontends, expected)
+	}
+	for i := range expected {
+		if report.Frontends[i] != expected[i] {
+			t.Errorf("found frontend %+v, expected %+v", report.Frontends[i], expected[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	registry, _ := NewRegistry(nil)
+	registry.Register(c)
+	if err := registry.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`haproxy_wrapper_frontend_sessions{frontend="web"} 12`,
+		`haproxy_wrapper_frontend_session_limit{frontend="web"} 100`,
+		`haproxy_wrapper_frontend_session_rate{frontend="tcp"} 1`,
+		`haproxy_wrapper_frontend_request_rate{frontend="web"} 20`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("metric %q not found in:\n%s", line, buf.String())
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Fatalf("stats socket queried %d times, expected cached report", n)
+	}
+
+	c.Load.maxAge = 0
+	if _, err := c.Load.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Fatalf("stats socket queried %d times, expected report read again", n)
+	}
+}
+
+func TestLoadCacheError(t *testing.T) {
+	c := NewLoadCache(NewStatsSocket("/nonexistent/haproxy.sock"), time.Hour)
+	if _, err := c.Get(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	records := []StatRecord{{Proxy: "web", Server: "FRONTEND", Fields: map[string]string{"scur": "many"}}}
+	if _, err := newLoadReport(records, time.Now()); err == nil || !strings.Contains(err.Error(), "scur") {
+		t.Fatalf("expected error of invalid field, found %v", err)
+	}
+
+	controller := NewController("", "", &fakeHaproxy{}, &fakeValidator{})
+	controller.Load = c
+	w := httptest.NewRecorder()
+	controller.handler().ServeHTTP(w, httptest.NewRequest("GET", "/load", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+}
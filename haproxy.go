@@ -16,7 +16,12 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os/exec"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const (
@@ -30,21 +35,140 @@ type HaproxyServer interface {
 	Stop() error
 	Reload() error
 	IsRunning() bool
+	Status() HaproxyStatus
 }
 
-func NewHaproxyServer(path, pidFile, configFile, mode string) (HaproxyServer, error) {
+// HaproxyStatus describes the state of the managed haproxy process.
+type HaproxyStatus struct {
+	Running   bool          `json:"running"`
+	PID       int           `json:"pid,omitempty"`
+	Crashes   int           `json:"crashes"`
+	LastCrash *HaproxyCrash `json:"last_crash,omitempty"`
+	Restarts  int           `json:"restarts,omitempty"`
+	CrashLoop bool          `json:"crash_loop,omitempty"`
+
+	// Old processes draining connections after reloads, and the ones
+	// killed after the maximum lifetime, in daemon mode
+	OldWorkers       int `json:"old_workers,omitempty"`
+	OldWorkersKilled int `json:"old_workers_killed,omitempty"`
+
+	// Command line used the last time haproxy was run by the wrapper, or
+	// the one that would be used if it wasn't run yet
+	Command []string `json:"command,omitempty"`
+}
+
+// A HaproxyCrashNotifier sends the unexpected exits of haproxy to a channel.
+type HaproxyCrashNotifier interface {
+	NotifyCrash(chan<- *HaproxyCrash)
+}
+
+// A CaptureEventNotifier reports the transitions of the captures of
+// connections done during reloads.
+type CaptureEventNotifier interface {
+	NotifyCaptureEvents(func(CaptureEvent))
+}
+
+// A ConnectionRetainer can retain new connections to haproxy, as done during
+// reloads. RetainConnections returns false if connections cannot be retained.
+type ConnectionRetainer interface {
+	RetainConnections() bool
+	ReleaseConnections()
+}
+
+// A CaptureIPsUpdater can replace at runtime the addresses whose connections
+// are retained during reloads.
+type CaptureIPsUpdater interface {
+	SetCaptureIPs([]net.IP) error
+}
+
+// ReloadOptions are settings of a single reload.
+type ReloadOptions struct {
+	// Retain new connections during the reload
+	Capture bool
+}
+
+// A HaproxyOptionsReloader can reload haproxy with settings specific to a
+// reload.
+type HaproxyOptionsReloader interface {
+	ReloadWithOptions(ReloadOptions) error
+}
+
+// HaproxyCrash contains the details of an unexpected exit of haproxy.
+type HaproxyCrash struct {
+	Time     time.Time `json:"time"`
+	ExitCode int       `json:"exit_code"`
+	Signal   string    `json:"signal,omitempty"`
+	Stderr   string    `json:"stderr,omitempty"`
+}
+
+func newHaproxyCrash(err error, stderr string) *HaproxyCrash {
+	crash := &HaproxyCrash{Time: time.Now(), Stderr: stderr}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			crash.ExitCode = ws.ExitStatus()
+			if ws.Signaled() {
+				crash.Signal = ws.Signal().String()
+			}
+		}
+	}
+	return crash
+}
+
+// tailBuffer is a writer that keeps the last bytes written to it, it is used
+// to keep the last output of haproxy to report it on crashes.
+type tailBuffer struct {
+	sync.Mutex
+	size int
+	data []byte
+}
+
+func newTailBuffer(size int) *tailBuffer {
+	return &tailBuffer{size: size}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.data = append(b.data, p...)
+	if len(b.data) > b.size {
+		b.data = b.data[len(b.data)-b.size:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return string(b.data)
+}
+
+// NewHaproxyServer creates a manager of haproxy in the given mode. If
+// transferSocket is set, in master-worker mode it is passed to haproxy with -x
+// so new processes take the listening sockets from the old ones on reloads.
+// configFile can be a comma-separated list of configuration files.
+func NewHaproxyServer(path, pidFile, configFile, mode, transferSocket string) (HaproxyServer, error) {
+	if err := haproxyPriority.validate(); err != nil {
+		return nil, err
+	}
 	switch mode {
 	case "daemon":
 		return &HaproxyServerDaemon{
+			priority:   haproxyPriority,
+			workers:    newOldWorkers(maxWorkerLifetime),
 			path:       path,
 			pidFile:    pidFile,
 			configFile: configFile,
 		}, nil
 	case "master-worker":
 		return &HaproxyServerMasterWorker{
-			path:       path,
-			pidFile:    pidFile,
-			configFile: configFile,
+			priority:      haproxyPriority,
+			reloadTimeout: masterReloadTimeout,
+			reloadRestart: masterReloadRestart,
+			masterSocket:  masterSocket,
+			transfer:      transferSocket,
+			path:          path,
+			pidFile:       pidFile,
+			configFile:    configFile,
 		}, nil
 	default:
 		return nil, fmt.Errorf("unknown haproxy mode: %s", mode)
@@ -58,6 +182,16 @@ type HaproxyConfigValidator interface {
 	Validate() error
 }
 
+// A HaproxyWarningsValidator also reports the warnings of valid
+// configurations.
+type HaproxyWarningsValidator interface {
+	HaproxyConfigValidator
+
+	// ValidateWithWarnings is like Validate, but also returns the warnings
+	// found in the configuration.
+	ValidateWithWarnings() ([]string, error)
+}
+
 // HaproxyDashC validates haproxy configuration by running haproxy -c.
 type HaproxyDashC struct {
 	path       string
@@ -65,17 +199,45 @@ type HaproxyDashC struct {
 }
 
 // NewHaproxyDashC implements HaproxyConfigValidator by running haproxy -c to
-// to validate haproxy config.
+// to validate haproxy config. configFile can be a comma-separated list of
+// configuration files.
 func NewHaproxyDashC(path, configFile string) *HaproxyDashC {
 	return &HaproxyDashC{path: path, configFile: configFile}
 }
 
 // Validate returns an error if haproxy has an unusable configuration.
 func (v *HaproxyDashC) Validate() error {
-	args := []string{"-c", "-q", "-f", v.configFile}
+	args := append([]string{"-c", "-q"}, configFileArgs(v.configFile)...)
 	command := exec.Command(v.path, args...)
 	if out, err := command.CombinedOutput(); err != nil {
 		return fmt.Errorf("%v:\n%s", err, out)
 	}
 	return nil
 }
+
+// ValidateWithWarnings runs haproxy -c without quiet mode, so warnings are
+// printed.
+func (v *HaproxyDashC) ValidateWithWarnings() ([]string, error) {
+	args := append([]string{"-c"}, configFileArgs(v.configFile)...)
+	command := exec.Command(v.path, args...)
+	out, err := command.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v:\n%s", err, out)
+	}
+	return parseHaproxyWarnings(out), nil
+}
+
+var haproxyVersionRegexp = regexp.MustCompile(`(?:HA-Proxy|HAProxy) version (\S+)`)
+
+// haproxyVersion returns the version of the haproxy binary in path.
+func haproxyVersion(path string) (string, error) {
+	out, err := exec.Command(path, "-v").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v:\n%s", err, out)
+	}
+	m := haproxyVersionRegexp.FindSubmatch(out)
+	if m == nil {
+		return "", fmt.Errorf("couldn't find version in output: %s", out)
+	}
+	return string(m[1]), nil
+}
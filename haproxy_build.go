@@ -0,0 +1,144 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// HaproxyBuild is the build information of an haproxy binary, as reported by
+// haproxy -vv.
+type HaproxyBuild struct {
+	Version string `json:"version"`
+
+	// Options the binary was built with, as TARGET, CPU or OPTIONS
+	BuildOptions map[string]string `json:"build_options,omitempty"`
+
+	// Features enabled and disabled, as +EPOLL or -KQUEUE, only reported
+	// by recent versions
+	Features []string `json:"features,omitempty"`
+
+	// TLS library, if built with it
+	TLS *HaproxyBuildTLS `json:"tls,omitempty"`
+}
+
+type HaproxyBuildTLS struct {
+	BuiltWith string   `json:"built_with,omitempty"`
+	RunningOn string   `json:"running_on,omitempty"`
+	SNI       bool     `json:"sni"`
+	Versions  []string `json:"versions,omitempty"`
+}
+
+// haproxyBuild returns the build information of the haproxy binary in path.
+func haproxyBuild(path string) (*HaproxyBuild, error) {
+	out, err := exec.Command(path, "-vv").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v:\n%s", err, out)
+	}
+	return parseHaproxyBuild(out)
+}
+
+func parseHaproxyBuild(out []byte) (*HaproxyBuild, error) {
+	m := haproxyVersionRegexp.FindSubmatch(out)
+	if m == nil {
+		return nil, fmt.Errorf("couldn't find version in output: %s", out)
+	}
+	build := &HaproxyBuild{Version: string(m[1])}
+
+	inBuildOptions := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			inBuildOptions = false
+			continue
+		}
+		if inBuildOptions {
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) == 2 {
+				build.BuildOptions[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+			}
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch key {
+		case "Build options":
+			inBuildOptions = true
+			build.BuildOptions = make(map[string]string)
+		case "Feature list":
+			build.Features = strings.Fields(value)
+		case "Built with OpenSSL version":
+			build.tls().BuiltWith = value
+		case "Running on OpenSSL version":
+			build.tls().RunningOn = value
+		case "OpenSSL library supports SNI":
+			build.tls().SNI = value == "yes"
+		case "OpenSSL library supports":
+			build.tls().Versions = strings.Fields(value)
+		}
+	}
+	return build, scanner.Err()
+}
+
+func (b *HaproxyBuild) tls() *HaproxyBuildTLS {
+	if b.TLS == nil {
+		b.TLS = &HaproxyBuildTLS{}
+	}
+	return b.TLS
+}
+
+// VersionInfo is the response of /version, with the version of the wrapper
+// and the build information of haproxy, captured at startup.
+type VersionInfo struct {
+	Version     string        `json:"version"`
+	HaproxyPath string        `json:"haproxy_path"`
+	Haproxy     *HaproxyBuild `json:"haproxy,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// CollectVersionInfo obtains the build information of the haproxy binary in
+// path, errors are reported in the result.
+func CollectVersionInfo(path string) *VersionInfo {
+	info := &VersionInfo{Version: version, HaproxyPath: path}
+	build, err := haproxyBuild(path)
+	if err != nil {
+		info.Error = err.Error()
+	} else {
+		info.Haproxy = build
+	}
+	return info
+}
+
+func (c *Controller) versionInfo(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	if c.VersionInfo == nil {
+		http.Error(w, "Version not available\n", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, c.VersionInfo)
+}
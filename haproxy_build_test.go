@@ -0,0 +1,100 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const testHaproxyBuild = `HA-Proxy version 1.8.14-52e4d43 2018/09/20
+Copyright 2000-2018 Willy Tarreau <willy@haproxy.org>
+
+Build options :
+  TARGET  = linux2628
+  CPU     = generic
+  CC      = gcc
+  OPTIONS = USE_ZLIB=1 USE_OPENSSL=1 USE_LUA=1 USE_PCRE=1
+
+Default settings :
+  maxconn = 2000, bufsize = 16384, maxrewrite = 1024, maxpollevents = 200
+
+Built with OpenSSL version : OpenSSL 1.1.0f  25 May 2017
+Running on OpenSSL version : OpenSSL 1.1.0f  25 May 2017
+OpenSSL library supports TLS extensions : yes
+OpenSSL library supports SNI : yes
+OpenSSL library supports : TLSv1.0 TLSv1.1 TLSv1.2
+Built with Lua version : Lua 5.3.3
+`
+
+func TestParseHaproxyBuild(t *testing.T) {
+	build, err := parseHaproxyBuild([]byte(testHaproxyBuild))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &HaproxyBuild{
+		Version: "1.8.14-52e4d43",
+		BuildOptions: map[string]string{
+			"TARGET":  "linux2628",
+			"CPU":     "generic",
+			"CC":      "gcc",
+			"OPTIONS": "USE_ZLIB=1 USE_OPENSSL=1 USE_LUA=1 USE_PCRE=1",
+		},
+		TLS: &HaproxyBuildTLS{
+			BuiltWith: "OpenSSL 1.1.0f  25 May 2017",
+			RunningOn: "OpenSSL 1.1.0f  25 May 2017",
+			SNI:       true,
+			Versions:  []string{"TLSv1.0", "TLSv1.1", "TLSv1.2"},
+		},
+	}
+	if !reflect.DeepEqual(build, expected) {
+		t.Fatalf("found %+v, expected %+v", build, expected)
+	}
+
+	build, err = parseHaproxyBuild([]byte("HAProxy version 2.0.0 2019/06/16\nFeature list : +EPOLL -KQUEUE\n"))
+	if err != nil || build.TLS != nil || !reflect.DeepEqual(build.Features, []string{"+EPOLL", "-KQUEUE"}) {
+		t.Fatalf("unexpected build %+v (%v)", build, err)
+	}
+
+	if _, err := parseHaproxyBuild([]byte("unknown\n")); err == nil {
+		t.Fatal("expected error without version")
+	}
+}
+
+func TestControllerVersion(t *testing.T) {
+	c := NewController("", "", &fakeHaproxy{}, &fakeValidator{})
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected not found without version info, found %d", w.Code)
+	}
+
+	dir, path := fakeHaproxyBinary(t, "cat <<'EOF'\n"+testHaproxyBuild+"EOF")
+	defer os.RemoveAll(dir)
+	c.VersionInfo = CollectVersionInfo(path)
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	var info VersionInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != version || info.HaproxyPath != path || info.Haproxy == nil || info.Haproxy.Version != "1.8.14-52e4d43" || info.Error != "" {
+		t.Fatalf("unexpected version info: %+v", info)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+var configSectionKeywords = map[string]bool{
+	"global":      true,
+	"defaults":    true,
+	"frontend":    true,
+	"backend":     true,
+	"listen":      true,
+	"userlist":    true,
+	"peers":       true,
+	"resolvers":   true,
+	"mailers":     true,
+	"program":     true,
+	"cache":       true,
+	"http-errors": true,
+	"ring":        true,
+	"fcgi-app":    true,
+}
+
+// haproxyConfig is a minimal representation of a haproxy configuration. It
+// only knows about sections and keeps the original lines, so it can be
+// written back without changes in the parts that are not modified.
+type haproxyConfig struct {
+	// Lines before the first section
+	preamble []string
+	sections []*configSection
+}
+
+type configSection struct {
+	Kind   string
+	Name   string
+	Header string
+	Lines  []string
+}
+
+// configFields splits a configuration line in its fields, ignoring comments.
+func configFields(line string) []string {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	return strings.Fields(line)
+}
+
+func parseHaproxyConfig(content []byte) *haproxyConfig {
+	config := &haproxyConfig{}
+	var current *configSection
+	text := strings.TrimSuffix(string(content), "\n")
+	if len(text) == 0 {
+		return config
+	}
+	for _, line := range strings.Split(text, "\n") {
+		fields := configFields(line)
+		if len(fields) > 0 && configSectionKeywords[fields[0]] {
+			current = &configSection{Kind: fields[0], Header: line}
+			if len(fields) > 1 {
+				current.Name = fields[1]
+			}
+			config.sections = append(config.sections, current)
+			continue
+		}
+		if current == nil {
+			config.preamble = append(config.preamble, line)
+		} else {
+			current.Lines = append(current.Lines, line)
+		}
+	}
+	return config
+}
+
+func (c *haproxyConfig) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, line := range c.preamble {
+		buf.WriteString(line + "\n")
+	}
+	for _, s := range c.sections {
+		buf.WriteString(s.Header + "\n")
+		for _, line := range s.Lines {
+			buf.WriteString(line + "\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+// Sections returns the sections of the given kind.
+func (c *haproxyConfig) Sections(kind string) []*configSection {
+	var sections []*configSection
+	for _, s := range c.sections {
+		if s.Kind == kind {
+			sections = append(sections, s)
+		}
+	}
+	return sections
+}
+
+// Section returns the first section of the given kind, creating it if it
+// doesn't exist. New sections are added after the global ones.
+func (c *haproxyConfig) Section(kind string) *configSection {
+	if sections := c.Sections(kind); len(sections) > 0 {
+		return sections[0]
+	}
+	s := &configSection{Kind: kind, Header: kind}
+	i := 0
+	if kind != "global" {
+		for i < len(c.sections) && c.sections[i].Kind == "global" {
+			i++
+		}
+	}
+	sections := append([]*configSection{}, c.sections[:i]...)
+	sections = append(sections, s)
+	c.sections = append(sections, c.sections[i:]...)
+	return s
+}
+
+// Directives returns the fields of the non-empty lines of the section.
+func (s *configSection) Directives() [][]string {
+	var directives [][]string
+	for _, line := range s.Lines {
+		if fields := configFields(line); len(fields) > 0 {
+			directives = append(directives, fields)
+		}
+	}
+	return directives
+}
+
+// HasDirective checks if the section contains a directive starting with the
+// given keywords.
+func (s *configSection) HasDirective(keywords ...string) bool {
+	for _, fields := range s.Directives() {
+		if hasPrefixFields(fields, keywords) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddLine adds a line to the section, after the last non-empty line.
+func (s *configSection) AddLine(line string) {
+	i := len(s.Lines)
+	for i > 0 && strings.TrimSpace(s.Lines[i-1]) == "" {
+		i--
+	}
+	lines := append([]string{}, s.Lines[:i]...)
+	lines = append(lines, line)
+	s.Lines = append(lines, s.Lines[i:]...)
+}
+
+func hasPrefixFields(fields, prefix []string) bool {
+	if len(fields) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if fields[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// changedBackends returns the names of the backends (and listen sections)
+// that are new or different in the new configuration.
+func changedBackends(old, new []byte) []string {
+	oldBackends := make(map[string]string)
+	for _, s := range parseHaproxyConfig(old).sections {
+		if s.Kind == "backend" || s.Kind == "listen" {
+			oldBackends[s.Name] = strings.Join(s.Lines, "\n")
+		}
+	}
+	var changed []string
+	for _, s := range parseHaproxyConfig(new).sections {
+		if s.Kind != "backend" && s.Kind != "listen" {
+			continue
+		}
+		if content, found := oldBackends[s.Name]; !found || content != strings.Join(s.Lines, "\n") {
+			changed = append(changed, s.Name)
+		}
+	}
+	return changed
+}
@@ -19,9 +19,11 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -29,10 +31,20 @@ import (
 
 var nfQueueNumber uint
 var netQueueIps string
+var maxWorkerLifetime time.Duration
+
+// Time to wait for haproxy to write the pids of its new processes after
+// starting it in daemon mode
+var daemonStartTimeout = 5 * time.Second
+
+// Interval between checks of the processes of haproxy, they are not children
+// of the wrapper unless it is the init process of the container
+var daemonPollInterval = 100 * time.Millisecond
 
 func init() {
 	flag.UintVar(&nfQueueNumber, "nf-queue-number", 0, "Netfilter queue number to retain connections during reload in daemon mode")
 	flag.StringVar(&netQueueIps, "net-queue-ips", "", "Comma-separated list of IPs where connections will be retained during reload in daemon mode")
+	flag.DurationVar(&maxWorkerLifetime, "max-worker-lifetime", 0, "Maximum time old haproxy processes can drain connections after a reload in daemon mode before being killed (default unlimited)")
 }
 
 type HaproxyServerDaemon struct {
@@ -40,12 +52,26 @@ type HaproxyServerDaemon struct {
 	reloading sync.Mutex
 	state     int
 	netQueue  NetQueue
+	priority  ProcessPriority
+
+	// Processes replaced in reloads that may be draining connections
+	workers *oldWorkers
+
+	captureEvents func(CaptureEvent)
+
+	// Addresses whose connections are retained, if updated at runtime,
+	// kept for next starts
+	captureIPs []net.IP
+
+	// Command line of the last run of haproxy
+	command []string
 
 	path, pidFile, configFile string
 }
 
 func (s *HaproxyServerDaemon) buildCommand(reload bool) *exec.Cmd {
-	args := []string{"-D", "-f", s.configFile, "-p", s.pidFile}
+	args := append([]string{"-D"}, configFileArgs(s.configFile)...)
+	args = append(args, "-p", s.pidFile)
 
 	if reload && s.IsRunning() {
 		pids, _ := s.Pids()
@@ -62,6 +88,15 @@ func (s *HaproxyServerDaemon) buildCommand(reload bool) *exec.Cmd {
 	return cmd
 }
 
+// recordCommand keeps the command line used to run haproxy to report it, as
+// it changes on each reload.
+func (s *HaproxyServerDaemon) recordCommand(cmd *exec.Cmd) {
+	log.Printf("Running haproxy: %s\n", strings.Join(cmd.Args, " "))
+	s.Lock()
+	defer s.Unlock()
+	s.command = cmd.Args
+}
+
 func (s *HaproxyServerDaemon) Pids() ([]int, error) {
 	var pids []int
 
@@ -108,6 +143,25 @@ func (s *HaproxyServerDaemon) IsRunning() bool {
 	return err == nil
 }
 
+// Status reports the state of haproxy, in daemon mode haproxy is not a child
+// of the wrapper, so crashes cannot be tracked.
+func (s *HaproxyServerDaemon) Status() HaproxyStatus {
+	status := HaproxyStatus{Running: s.IsRunning()}
+	if status.Running {
+		status.PID = s.Pid()
+	}
+	if s.workers != nil {
+		status.OldWorkers, status.OldWorkersKilled = s.workers.Count()
+	}
+	s.Lock()
+	status.Command = s.command
+	s.Unlock()
+	if status.Command == nil {
+		status.Command = s.buildCommand(false).Args
+	}
+	return status
+}
+
 func (s *HaproxyServerDaemon) Kill() error {
 	p, err := os.FindProcess(s.Pid())
 	if err != nil {
@@ -125,13 +179,118 @@ func (s *HaproxyServerDaemon) Start() error {
 	if err != nil {
 		log.Fatalf("Expected comma-separated list of IPs: %v", err)
 	}
-	s.netQueue = NewNetQueue(nfQueueNumber, ips)
+	s.Lock()
+	if s.captureIPs != nil {
+		ips = s.captureIPs
+	}
+	s.Unlock()
+	options := netQueueOptionsFromFlags()
+	options.Events = s.captureEvent
+	netQueue, err := NewNetQueueWithOptions(nfQueueNumber, ips, options)
+	if err != nil {
+		return fmt.Errorf("couldn't configure netfilter queue: %v", err)
+	}
+	s.netQueue = netQueue
 
+	// The pidfile can contain processes of previous runs
+	previousPids, _ := s.Pids()
 	cmd := s.buildCommand(false)
+	s.recordCommand(cmd)
 	if err := cmd.Start(); err != nil {
 		return err
 	}
-	return cmd.Wait()
+	if err := cmd.Wait(); err != nil {
+		return err
+	}
+	if err := s.waitNewProcesses(previousPids); err != nil {
+		return err
+	}
+	s.applyPriority()
+	return nil
+}
+
+// waitNewProcesses waits till the pidfile contains only running processes
+// not in the given list, so haproxy is known to be up. The parent process
+// started with -D exits before its children are running.
+func (s *HaproxyServerDaemon) waitNewProcesses(previous []int) error {
+	deadline := time.Now().Add(daemonStartTimeout)
+	for {
+		pids, _ := s.Pids()
+		if newProcessesRunning(pids, previous) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no new haproxy processes running after %s, found %v in pidfile", daemonStartTimeout, pids)
+		}
+		time.Sleep(daemonPollInterval)
+	}
+}
+
+func newProcessesRunning(pids, previous []int) bool {
+	if len(pids) == 0 {
+		return false
+	}
+	for _, pid := range pids {
+		for _, old := range previous {
+			if pid == old {
+				return false
+			}
+		}
+		if !processRunning(pid) {
+			return false
+		}
+	}
+	return true
+}
+
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+// waitOldProcess waits for a process replaced in a reload to finish. If it is
+// not a child of the wrapper, it is polled till it is not running.
+func (s *HaproxyServerDaemon) waitOldProcess(pid int) {
+	p, err := os.FindProcess(pid)
+	if err == nil {
+		_, err = p.Wait()
+	}
+	if err != nil {
+		for processRunning(pid) {
+			time.Sleep(daemonPollInterval)
+		}
+	}
+	if s.workers != nil {
+		s.workers.Finished(pid)
+	}
+	log.Printf("Old process with pid %d finished\n", pid)
+}
+
+// applyPriority sets the priority to the processes in the pidfile.
+func (s *HaproxyServerDaemon) applyPriority() {
+	pids, _ := s.Pids()
+	for _, pid := range pids {
+		if err := s.priority.Apply(pid); err != nil {
+			log.Printf("ERROR: Couldn't set priority of haproxy: %v\n", err)
+		}
+	}
+}
+
+// NotifyCaptureEvents configures a function called on transitions of the
+// captures of connections.
+func (s *HaproxyServerDaemon) NotifyCaptureEvents(f func(CaptureEvent)) {
+	s.Lock()
+	defer s.Unlock()
+	s.captureEvents = f
+}
+
+func (s *HaproxyServerDaemon) captureEvent(e CaptureEvent) {
+	s.Lock()
+	f := s.captureEvents
+	s.Unlock()
+	if f != nil {
+		f(e)
+	}
 }
 
 func (s *HaproxyServerDaemon) Stop() error {
@@ -146,6 +305,50 @@ func (s *HaproxyServerDaemon) Stop() error {
 	return nil
 }
 
+// RetainConnections captures new connections until they are released, if
+// there are addresses configured to retain them.
+func (s *HaproxyServerDaemon) RetainConnections() bool {
+	if _, ok := s.netQueue.(*dummyNetQueue); ok {
+		return false
+	}
+	if err := s.netQueue.Capture(); err != nil {
+		log.Printf("Couldn't retain connections: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// SetCaptureIPs replaces the addresses whose connections are retained during
+// reloads. Connections are only retained if there were addresses at start.
+func (s *HaproxyServerDaemon) SetCaptureIPs(ips []net.IP) error {
+	if s.netQueue == nil {
+		return errCaptureDisabled
+	}
+	if err := s.netQueue.SetIPs(ips); err != nil {
+		return err
+	}
+	s.Lock()
+	s.captureIPs = ips
+	s.Unlock()
+	return nil
+}
+
+// captureError is returned by reloads aborted because connections couldn't be
+// retained.
+type captureError struct {
+	err error
+}
+
+func (e *captureError) Error() string {
+	return fmt.Sprintf("couldn't retain connections, reload aborted: %v", e.err)
+}
+
+func (s *HaproxyServerDaemon) ReleaseConnections() {
+	if err := s.netQueue.Release(); err != nil {
+		log.Printf("Couldn't release connections: %v\n", err)
+	}
+}
+
 func (s *HaproxyServerDaemon) requestReload() bool {
 	s.Lock()
 	defer s.Unlock()
@@ -173,6 +376,16 @@ func (s *HaproxyServerDaemon) finishReload() {
 }
 
 func (s *HaproxyServerDaemon) Reload() error {
+	return s.reload(ReloadOptions{Capture: true})
+}
+
+// ReloadWithOptions reloads haproxy, retaining new connections only if
+// requested in the options.
+func (s *HaproxyServerDaemon) ReloadWithOptions(options ReloadOptions) error {
+	return s.reload(options)
+}
+
+func (s *HaproxyServerDaemon) reload(options ReloadOptions) error {
 	if !s.requestReload() {
 		return nil
 	}
@@ -187,35 +400,37 @@ func (s *HaproxyServerDaemon) Reload() error {
 	err := func() error {
 		cmd := s.buildCommand(s.IsRunning())
 
-		netQueue.Capture()
-		defer netQueue.Release()
+		if options.Capture {
+			if err := s.netQueue.Capture(); err != nil {
+				return &captureError{err}
+			}
+			defer s.ReleaseConnections()
+		}
 
+		s.recordCommand(cmd)
 		if err := cmd.Start(); err != nil {
 			return err
 		}
 		if err := cmd.Wait(); err != nil {
 			return fmt.Errorf("Haproxy couldn't reload configuration: %v", err)
 		}
+		// Connections are retained till the new processes are running
+		if err := s.waitNewProcesses(currentPids); err != nil {
+			return fmt.Errorf("Haproxy couldn't reload configuration: %v", err)
+		}
 		return nil
 	}()
 	if err != nil {
 		return err
 	}
 	log.Printf("Reload took %s", time.Since(start))
+	s.applyPriority()
 
+	if s.workers != nil {
+		s.workers.Add(currentPids)
+	}
 	for _, pid := range currentPids {
-		p, err := os.FindProcess(pid)
-		if err != nil {
-			// This shouldn't happen in UNIX systems
-			log.Printf("os.FindProcess(%d) failed, this shouldn't happen: %v\n", pid, err)
-			continue
-		}
-		go func() {
-			if _, err := p.Wait(); err != nil {
-				log.Printf("Cannot wait for old haproxy: %v\n", err)
-			}
-			log.Printf("Old process with pid %d finished\n", p.Pid)
-		}()
+		go s.waitOldProcess(pid)
 	}
 
 	log.Println("Haproxy reloaded with pid", s.Pid())
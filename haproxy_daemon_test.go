@@ -0,0 +1,109 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Fake haproxy that records its command line and leaves a process running as
+// daemon, with its pid in the pidfile
+const fakeDaemonHaproxy = `echo "$0 $@" >> "$(dirname "$0")/args"
+sleep 30 >/dev/null 2>&1 &
+echo $! > "$5"`
+
+func lastCommand(t *testing.T, dir string) string {
+	content, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	return lines[len(lines)-1]
+}
+
+func TestDaemonCommand(t *testing.T) {
+	dir, path := fakeHaproxyBinary(t, fakeDaemonHaproxy)
+	defer os.RemoveAll(dir)
+
+	s := &HaproxyServerDaemon{
+		path:       path,
+		pidFile:    filepath.Join(dir, "haproxy.pid"),
+		configFile: filepath.Join(dir, "haproxy.cfg"),
+	}
+	expected := []string{path, "-D", "-f", s.configFile, "-p", s.pidFile}
+	if command := s.Status().Command; !reflect.DeepEqual(command, expected) {
+		t.Fatalf("found command %v before start, expected %v", command, expected)
+	}
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	first := s.Pid()
+	defer syscall.Kill(first, syscall.SIGKILL)
+	if command := s.Status().Command; strings.Join(command, " ") != lastCommand(t, dir) {
+		t.Fatalf("reported command %v, found %q", command, lastCommand(t, dir))
+	}
+
+	if err := s.ReloadWithOptions(ReloadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Kill(s.Pid(), syscall.SIGKILL)
+	expected = append(expected, "-sf", strconv.Itoa(first))
+	command := s.Status().Command
+	if !reflect.DeepEqual(command, expected) {
+		t.Fatalf("found command %v after reload, expected %v", command, expected)
+	}
+	if strings.Join(command, " ") != lastCommand(t, dir) {
+		t.Fatalf("reported command %v, found %q", command, lastCommand(t, dir))
+	}
+}
+
+func TestDaemonReloadWithoutNewProcess(t *testing.T) {
+	// Fake haproxy that only starts a process if there is no pidfile
+	dir, path := fakeHaproxyBinary(t, `test -f "$5" && exit 0
+sleep 30 >/dev/null 2>&1 &
+echo $! > "$5"`)
+	defer os.RemoveAll(dir)
+
+	timeout := daemonStartTimeout
+	daemonStartTimeout = 500 * time.Millisecond
+	defer func() { daemonStartTimeout = timeout }()
+
+	s := &HaproxyServerDaemon{
+		path:       path,
+		pidFile:    filepath.Join(dir, "haproxy.pid"),
+		configFile: filepath.Join(dir, "haproxy.cfg"),
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	first := s.Pid()
+	defer syscall.Kill(first, syscall.SIGKILL)
+
+	if err := s.ReloadWithOptions(ReloadOptions{}); err == nil {
+		t.Fatal("reload expected to fail if no new process is started")
+	}
+	if pid := s.Pid(); pid != first {
+		t.Fatalf("found pid %d after failed reload, expected %d", pid, first)
+	}
+}
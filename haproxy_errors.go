@@ -0,0 +1,235 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format of the dates in the output of show errors
+const showErrorsTimeFormat = "02/Jan/2006:15:04:05.000"
+
+var (
+	showErrorsHeaderRegexp   = regexp.MustCompile(`^\[([^\]]+)\] (frontend|backend) (\S+) \(#-?\d+\): invalid (request|response)`)
+	showErrorsPeerRegexp     = regexp.MustCompile(`^\s+(?:frontend|backend) (\S+) \(#-?\d+\), server (\S+) \(#-?\d+\), event #(\d+)`)
+	showErrorsSourceRegexp   = regexp.MustCompile(`^\s+src (\S+),`)
+	showErrorsPositionRegexp = regexp.MustCompile(`error at position (\d+)`)
+	showErrorsCaptureRegexp  = regexp.MustCompile(`^\s+\d{5}[+ ] `)
+)
+
+// HaproxyError is an invalid request or response captured by haproxy.
+type HaproxyError struct {
+	Time time.Time `json:"time"`
+
+	// Direction of the message, request or response
+	Kind string `json:"kind"`
+
+	// Proxy reporting the error, and the one on the other side
+	ProxyKind string `json:"proxy_kind"`
+	Proxy     string `json:"proxy"`
+	PeerProxy string `json:"peer_proxy,omitempty"`
+	Server    string `json:"server,omitempty"`
+
+	Event    int    `json:"event"`
+	Source   string `json:"source,omitempty"`
+	Position int    `json:"error_position"`
+
+	// Dump of the captured message, as printed by haproxy
+	Capture []string `json:"capture,omitempty"`
+}
+
+// readShowErrors parses the output of show errors, calling emit with each
+// error as soon as it is complete.
+func readShowErrors(r io.Reader, emit func(*HaproxyError) error) error {
+	var current *HaproxyError
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := showErrorsHeaderRegexp.FindStringSubmatch(line); m != nil {
+			if current != nil {
+				if err := emit(current); err != nil {
+					return err
+				}
+			}
+			t, err := time.ParseInLocation(showErrorsTimeFormat, m[1], time.Local)
+			if err != nil {
+				return fmt.Errorf("couldn't parse time of error: %v", err)
+			}
+			current = &HaproxyError{Time: t, ProxyKind: m[2], Proxy: m[3], Kind: m[4]}
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		if m := showErrorsPeerRegexp.FindStringSubmatch(line); m != nil {
+			current.PeerProxy = showErrorsName(m[1])
+			current.Server = showErrorsName(m[2])
+			current.Event, _ = strconv.Atoi(m[3])
+		}
+		if m := showErrorsSourceRegexp.FindStringSubmatch(line); m != nil {
+			current.Source = m[1]
+		}
+		if m := showErrorsPositionRegexp.FindStringSubmatch(line); m != nil {
+			current.Position, _ = strconv.Atoi(m[1])
+		}
+		if showErrorsCaptureRegexp.MatchString(line) {
+			current.Capture = append(current.Capture, strings.TrimSpace(line))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("couldn't read errors: %v", err)
+	}
+	if current != nil {
+		return emit(current)
+	}
+	return nil
+}
+
+// showErrorsName returns the name of a proxy or server, empty if there is
+// none.
+func showErrorsName(name string) string {
+	if name == "<NONE>" {
+		return ""
+	}
+	return name
+}
+
+// deadlineConn extends the deadline of a connection on each read, so long
+// responses can be read as long as haproxy keeps sending them.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	c.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+// Stream sends a command to haproxy and returns a reader of its response,
+// that must be closed after reading it.
+func (s *StatsSocket) Stream(command string) (io.ReadCloser, error) {
+	conn, err := net.DialTimeout("unix", s.path, statsSocketTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to stats socket: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(statsSocketTimeout))
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("couldn't send command: %v", err)
+	}
+	return &deadlineConn{Conn: conn, timeout: statsSocketTimeout}, nil
+}
+
+// errorsFilter selects the errors returned by /errors.
+type errorsFilter struct {
+	proxy string
+	since time.Time
+}
+
+// parseErrorsFilter reads the filter from the proxy and since parameters,
+// since can be a time in RFC 3339 format or a duration before now.
+func parseErrorsFilter(req *http.Request) (*errorsFilter, error) {
+	query := req.URL.Query()
+	f := &errorsFilter{proxy: query.Get("proxy")}
+	if since := query.Get("since"); since != "" {
+		if d, err := time.ParseDuration(since); err == nil {
+			f.since = time.Now().Add(-d)
+		} else if f.since, err = time.Parse(time.RFC3339, since); err != nil {
+			return nil, fmt.Errorf("invalid since parameter, expected duration or RFC 3339 time: %s", since)
+		}
+	}
+	return f, nil
+}
+
+func (f *errorsFilter) match(e *HaproxyError) bool {
+	if f.proxy != "" && e.Proxy != f.proxy && e.PeerProxy != f.proxy {
+		return false
+	}
+	return f.since.IsZero() || !e.Time.Before(f.since)
+}
+
+// haproxyErrors streams the errors captured by haproxy as a JSON array. Captures
+// contain data of clients, so they require authorization.
+func (c *Controller) haproxyErrors(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorize(w, req) {
+		return
+	}
+	if c.StatsSocket == nil {
+		http.Error(w, "Stats socket not configured\n", http.StatusServiceUnavailable)
+		return
+	}
+	filter, err := parseErrorsFilter(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s\n", err), http.StatusBadRequest)
+		return
+	}
+	response, err := c.StatsSocket.Stream("show errors")
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't obtain errors: %v\n", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusServiceUnavailable)
+		return
+	}
+	defer response.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	flusher, _ := w.(http.Flusher)
+	separator := "["
+	err = readShowErrors(response, func(e *HaproxyError) error {
+		if !filter.match(e) {
+			return nil
+		}
+		d, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, separator); err != nil {
+			return err
+		}
+		separator = ",\n"
+		if _, err := w.Write(d); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// Headers are already sent, the response is left truncated
+		log.Printf("Couldn't stream errors: %v\n", err)
+		return
+	}
+	if separator == "[" {
+		io.WriteString(w, "[")
+	}
+	io.WriteString(w, "]\n")
+}
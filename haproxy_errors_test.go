@@ -0,0 +1,183 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const showErrorsOutput = `Total events captured on [13/Oct/2026:10:00:00.123] : 3
+
+[13/Oct/2026:09:58:12.456] frontend http (#2): invalid request
+  backend <NONE> (#-1), server <NONE> (#-1), event #0
+  src 10.0.0.10:50000, session #12, session flags 0x00000080
+  HTTP msg state 26, msg flags 0x00000000, tx flags 0x00000000
+  HTTP chunk len 0 bytes, HTTP body len 0 bytes
+  buffer flags 0x00808002, out 0 bytes, total 28 bytes
+  pending 28 bytes, wrapping at 16384, error at position 5:
+
+  00000  GET /\x01 HTTP/1.1\r\n
+  00021  Host: example.com\r\n
+  00040  \r\n
+
+[13/Oct/2026:09:59:30.000] backend app (#3): invalid response
+  frontend http (#2), server app1 (#1), event #1
+  src 10.0.0.11:50001, session #13, session flags 0x000004ce
+  HTTP msg state 26, msg flags 0x00000000, tx flags 0x08300000
+  buffer flags 0x00008002, out 0 bytes, total 40 bytes
+  pending 40 bytes, wrapping at 16384, error at position 9:
+
+  00000  HTTP/1.1 2OO OK\r\n
+
+[13/Oct/2026:09:59:55.000] frontend admin (#4): invalid request
+  backend <NONE> (#-1), server <NONE> (#-1), event #2
+  src 10.0.0.12:50002, session #14, session flags 0x00000080
+  pending 10 bytes, wrapping at 16384, error at position 0:
+
+  00000  \x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03
+`
+
+func showErrorsTime(t *testing.T, value string) time.Time {
+	parsed, err := time.ParseInLocation(showErrorsTimeFormat, value, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestReadShowErrors(t *testing.T) {
+	var found []*HaproxyError
+	err := readShowErrors(strings.NewReader(showErrorsOutput), func(e *HaproxyError) error {
+		found = append(found, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 3 {
+		t.Fatalf("found %d errors, expected 3", len(found))
+	}
+
+	request := found[0]
+	if !request.Time.Equal(showErrorsTime(t, "13/Oct/2026:09:58:12.456")) {
+		t.Errorf("unexpected time: %v", request.Time)
+	}
+	if request.Kind != "request" || request.ProxyKind != "frontend" || request.Proxy != "http" {
+		t.Errorf("unexpected request error: %+v", request)
+	}
+	if request.PeerProxy != "" || request.Server != "" || request.Source != "10.0.0.10:50000" || request.Position != 5 {
+		t.Errorf("unexpected request error: %+v", request)
+	}
+	if len(request.Capture) != 3 || request.Capture[1] != `00021  Host: example.com\r\n` {
+		t.Errorf("unexpected capture: %q", request.Capture)
+	}
+
+	response := found[1]
+	if response.Kind != "response" || response.ProxyKind != "backend" || response.Proxy != "app" {
+		t.Errorf("unexpected response error: %+v", response)
+	}
+	if response.PeerProxy != "http" || response.Server != "app1" || response.Event != 1 || response.Position != 9 {
+		t.Errorf("unexpected response error: %+v", response)
+	}
+}
+
+func TestReadShowErrorsEmpty(t *testing.T) {
+	err := readShowErrors(strings.NewReader("Total events captured on [13/Oct/2026:10:00:00.123] : 0\n\n"), func(e *HaproxyError) error {
+		t.Fatalf("unexpected error: %+v", e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getErrors(t *testing.T, c *Controller, query string) []HaproxyError {
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/errors"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %q", w.Code, w.Body.String())
+	}
+	var errors []HaproxyError
+	if err := json.Unmarshal(w.Body.Bytes(), &errors); err != nil {
+		t.Fatalf("couldn't decode %q: %v", w.Body.String(), err)
+	}
+	return errors
+}
+
+func TestControllerErrors(t *testing.T) {
+	var commands []string
+	socket := newFakeStatsSocket(t, func(command string) string {
+		commands = append(commands, command)
+		return showErrorsOutput
+	})
+	defer socket.Close()
+	c := NewController("", "", &fakeHaproxy{}, &fakeValidator{})
+	c.StatsSocket = NewStatsSocket(socket.Path())
+
+	if errors := getErrors(t, c, ""); len(errors) != 3 {
+		t.Fatalf("unexpected errors: %+v", errors)
+	}
+	if len(commands) != 1 || commands[0] != "show errors" {
+		t.Fatalf("unexpected commands: %q", commands)
+	}
+
+	// Proxies match on both sides of the error
+	errors := getErrors(t, c, "?proxy=http")
+	if len(errors) != 2 || errors[0].Proxy != "http" || errors[1].PeerProxy != "http" {
+		t.Fatalf("unexpected errors for proxy: %+v", errors)
+	}
+
+	since := showErrorsTime(t, "13/Oct/2026:09:59:30.000").Format(time.RFC3339)
+	errors = getErrors(t, c, "?since="+since)
+	if len(errors) != 2 || errors[0].Proxy != "app" || errors[1].Proxy != "admin" {
+		t.Fatalf("unexpected errors since %s: %+v", since, errors)
+	}
+
+	if errors := getErrors(t, c, "?proxy=other"); len(errors) != 0 {
+		t.Fatalf("unexpected errors for unknown proxy: %+v", errors)
+	}
+	if errors := getErrors(t, c, "?since=1h&proxy=http"); len(errors) != 0 {
+		t.Fatalf("unexpected recent errors: %+v", errors)
+	}
+}
+
+func TestControllerErrorsRequests(t *testing.T) {
+	c := NewController("", "", &fakeHaproxy{}, &fakeValidator{})
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/errors", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected response without stats socket %d", w.Code)
+	}
+
+	c.StatsSocket = NewStatsSocket("/nonexistent")
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/errors?since=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected response with invalid filter %d", w.Code)
+	}
+
+	c.Token = "secret"
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/errors", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected response without token %d", w.Code)
+	}
+}
@@ -15,20 +15,70 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
+// Size of the tail of haproxy output kept to report crashes
+const haproxyStderrTail = 4096
+
+// Interval between checks of the workers of the master during reloads
+var masterReloadPollInterval = 100 * time.Millisecond
+
+var masterReloadTimeout time.Duration
+var masterReloadRestart bool
+var masterSocket string
+
+func init() {
+	flag.DurationVar(&masterReloadTimeout, "master-reload-timeout", 30*time.Second, "Time to wait for the master to start new workers on reloads in master-worker mode, zero to don't wait")
+	flag.BoolVar(&masterReloadRestart, "master-reload-restart", false, "Restart haproxy if the master doesn't respond to a reload in master-worker mode")
+	flag.StringVar(&masterSocket, "master-socket", "", "Path to the master CLI socket, used to check if the master is responsive in master-worker mode")
+}
+
 type HaproxyServerMasterWorker struct {
-	command *exec.Cmd
+	sync.Mutex
+
+	command  *exec.Cmd
+	stderr   *tailBuffer
+	stopping bool
+
+	crashes   int
+	lastCrash *HaproxyCrash
+	notify    chan<- *HaproxyCrash
+
+	// Time to wait for new workers after reloads, zero to don't wait
+	reloadTimeout time.Duration
+	// Restart haproxy if the master is not responsive on reloads
+	reloadRestart bool
+	// Master CLI socket, if available
+	masterSocket string
+	// Stats socket used to transfer listening sockets on reloads, if any
+	transfer string
+
+	priority ProcessPriority
 
 	path, pidFile, configFile string
 }
 
 func (s *HaproxyServerMasterWorker) IsRunning() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.isRunning()
+}
+
+func (s *HaproxyServerMasterWorker) isRunning() bool {
 	if s.command == nil || s.command.Process == nil {
 		return false
 	}
@@ -40,43 +90,297 @@ func (s *HaproxyServerMasterWorker) Reload() error {
 	if !s.IsRunning() {
 		return s.Start()
 	}
-	err := s.command.Process.Signal(syscall.SIGUSR2)
+	s.Lock()
+	pid := s.command.Process.Pid
+	workers, _ := processChildren(pid)
+	s.Unlock()
+
+	// The signal is only sent if the reload command couldn't be sent, if
+	// it was sent but the result is not reported, the reload is confirmed
+	// by waiting for the new workers, sending the signal would reload
+	// haproxy twice
+	signal := true
+	if s.masterSocket != "" {
+		sent, handled, err := s.masterReload()
+		if handled {
+			return err
+		}
+		signal = !sent
+	}
+	if signal {
+		s.Lock()
+		err := s.command.Process.Signal(syscall.SIGUSR2)
+		s.Unlock()
+		if err != nil {
+			return fmt.Errorf("couldn't kill process: %v", err)
+		}
+	}
+	if s.reloadTimeout == 0 {
+		return nil
+	}
+
+	if s.waitNewWorker(pid, workers) {
+		return nil
+	}
+	if s.masterSocket != "" {
+		if _, err := NewStatsSocket(s.masterSocket).Command("show proc"); err == nil {
+			return fmt.Errorf("master didn't start new workers after %v, check the configuration", s.reloadTimeout)
+		}
+	}
+	if !s.reloadRestart {
+		return fmt.Errorf("master didn't respond to reload after %v", s.reloadTimeout)
+	}
+	log.Printf("ERROR: Master didn't respond to reload after %v, restarting haproxy\n", s.reloadTimeout)
+	return s.restart()
+}
+
+// MasterReloadError is a reload rejected by the master, it contains the
+// output of the master during the reload, that includes the errors found.
+type MasterReloadError struct {
+	Output string
+}
+
+func (e *MasterReloadError) Error() string {
+	return fmt.Sprintf("haproxy failed to reload:\n%s", e.Output)
+}
+
+// masterReload reloads haproxy with the reload command of the master CLI,
+// that reports the result of the reload in recent versions. It returns if the
+// command could be sent, and if the result was reported, if not, the reload
+// has to be confirmed by other methods.
+func (s *HaproxyServerMasterWorker) masterReload() (sent, handled bool, err error) {
+	response, err := NewStatsSocket(s.masterSocket).Command("reload")
 	if err != nil {
-		return fmt.Errorf("couldn't kill process: %v", err)
+		log.Printf("Couldn't reload using master socket: %v\n", err)
+		return false, false, nil
+	}
+	success, output, ok := parseMasterReload(response)
+	if !ok {
+		return true, false, nil
+	}
+	if !success {
+		return true, true, &MasterReloadError{Output: output}
+	}
+	return true, true, nil
+}
+
+// parseMasterReload parses the response of the reload command, with a
+// Success line and the output of the reload after a "--" line.
+func parseMasterReload(response string) (success bool, output string, ok bool) {
+	lines := strings.Split(strings.TrimRight(response, "\n"), "\n")
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "Success=") {
+		return false, "", false
+	}
+	switch strings.TrimSpace(strings.TrimPrefix(lines[0], "Success=")) {
+	case "1":
+		success = true
+	case "0":
+		success = false
+	default:
+		return false, "", false
+	}
+	lines = lines[1:]
+	if len(lines) > 0 && strings.TrimSpace(lines[0]) == "--" {
+		lines = lines[1:]
+	}
+	return success, strings.Join(lines, "\n"), true
+}
+
+// waitNewWorker waits for the master to have a child not included in the
+// given workers, what happens when it starts the workers of a reload.
+func (s *HaproxyServerMasterWorker) waitNewWorker(pid int, workers []int) bool {
+	previous := make(map[int]bool)
+	for _, worker := range workers {
+		previous[worker] = true
+	}
+	deadline := time.Now().Add(s.reloadTimeout)
+	for {
+		children, err := processChildren(pid)
+		if err != nil {
+			log.Printf("Couldn't check haproxy workers: %v\n", err)
+		}
+		for _, child := range children {
+			if !previous[child] {
+				return true
+			}
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		<-time.After(masterReloadPollInterval)
 	}
-	return nil
+}
+
+// restart kills the master and starts it again.
+func (s *HaproxyServerMasterWorker) restart() error {
+	s.Lock()
+	if s.isRunning() {
+		s.stopping = true
+		if err := s.command.Process.Kill(); err != nil {
+			s.Unlock()
+			return fmt.Errorf("couldn't kill haproxy: %v", err)
+		}
+	}
+	command := s.command
+	s.Unlock()
+	// Wait for the process to be reaped by wait()
+	for command != nil && command.Process.Signal(syscall.Signal(0)) == nil {
+		<-time.After(masterReloadPollInterval)
+	}
+	return s.Start()
 }
 
 func (s *HaproxyServerMasterWorker) Start() error {
-	if s.IsRunning() {
+	s.Lock()
+	defer s.Unlock()
+	if s.isRunning() {
 		return fmt.Errorf("server already started")
 	}
-	args := []string{"-W", "-f", s.configFile, "-p", s.pidFile}
-	s.command = exec.Command(s.path, args...)
-	s.command.Stdout = os.Stdout
-	s.command.Stderr = os.Stdout
-	if err := s.command.Start(); err != nil {
+	command := exec.Command(s.path, s.args()...)
+	log.Printf("Running haproxy: %s\n", strings.Join(command.Args, " "))
+	stderr := newTailBuffer(haproxyStderrTail)
+	command.Stdout = os.Stdout
+	command.Stderr = io.MultiWriter(os.Stdout, stderr)
+	if err := command.Start(); err != nil {
 		return err
 	}
+	s.command = command
+	s.stderr = stderr
+	s.stopping = false
 
-	go func() {
-		err := s.command.Wait()
-		if err != nil {
-			log.Printf("Haproxy finished with error: %v", err)
-		} else {
-			log.Println("Haproxy finished")
+	if err := s.applyPriority(command.Process.Pid); err != nil {
+		log.Printf("ERROR: Couldn't set priority of haproxy: %v\n", err)
+	}
+
+	go s.wait(command, stderr)
+	return nil
+}
+
+// args returns the arguments of the master, it runs new processes on reloads
+// with the same arguments, so -x is also used by them.
+func (s *HaproxyServerMasterWorker) args() []string {
+	args := append([]string{"-W"}, configFileArgs(s.configFile)...)
+	args = append(args, "-p", s.pidFile)
+	if s.transfer != "" {
+		args = append(args, "-x", s.transfer)
+	}
+	return args
+}
+
+// applyPriority sets the priority to the master, workers forked after that
+// inherit it, and to the workers it could have already forked.
+func (s *HaproxyServerMasterWorker) applyPriority(pid int) error {
+	if s.priority.Nice == nil && s.priority.OOMScoreAdj == nil {
+		return nil
+	}
+	if err := s.priority.Apply(pid); err != nil {
+		return err
+	}
+	workers, _ := processChildren(pid)
+	for _, worker := range workers {
+		if err := s.priority.Apply(worker); err != nil {
+			return err
 		}
-	}()
+	}
 	return nil
 }
 
+// wait waits for haproxy to finish, if it wasn't stopped by the wrapper
+// it is reported as a crash.
+func (s *HaproxyServerMasterWorker) wait(command *exec.Cmd, stderr *tailBuffer) {
+	err := command.Wait()
+
+	s.Lock()
+	defer s.Unlock()
+	if s.command != command {
+		return
+	}
+	if s.stopping {
+		log.Println("Haproxy finished")
+		return
+	}
+	crash := newHaproxyCrash(err, stderr.String())
+	s.crashes++
+	s.lastCrash = crash
+	log.Printf("ERROR: Haproxy exited unexpectedly (exit code: %d, error: %v), last output:\n%s", crash.ExitCode, err, crash.Stderr)
+	if s.notify != nil {
+		select {
+		case s.notify <- crash:
+		default:
+			log.Println("Crash notification dropped")
+		}
+	}
+}
+
+// NotifyCrash configures a channel where unexpected exits are sent.
+func (s *HaproxyServerMasterWorker) NotifyCrash(c chan<- *HaproxyCrash) {
+	s.Lock()
+	defer s.Unlock()
+	s.notify = c
+}
+
 func (s *HaproxyServerMasterWorker) Stop() error {
-	if !s.IsRunning() {
+	s.Lock()
+	defer s.Unlock()
+	if !s.isRunning() {
 		return fmt.Errorf("server is not running")
 	}
+	s.stopping = true
 	err := s.command.Process.Kill()
 	if err != nil {
 		return fmt.Errorf("couldn't kill server")
 	}
 	return nil
 }
+
+func (s *HaproxyServerMasterWorker) Status() HaproxyStatus {
+	s.Lock()
+	defer s.Unlock()
+	status := HaproxyStatus{
+		Running:   s.isRunning(),
+		Crashes:   s.crashes,
+		LastCrash: s.lastCrash,
+	}
+	if status.Running {
+		status.PID = s.command.Process.Pid
+	}
+	if s.command != nil {
+		status.Command = s.command.Args
+	} else {
+		status.Command = append([]string{s.path}, s.args()...)
+	}
+	return status
+}
+
+// processChildren returns the pids of the processes whose parent is pid.
+func processChildren(pid int) ([]int, error) {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return nil, err
+	}
+	var children []int
+	for _, stat := range stats {
+		content, err := ioutil.ReadFile(stat)
+		if err != nil {
+			// Process finished
+			continue
+		}
+		// Command name can contain spaces, fields are after the last ')'
+		i := bytes.LastIndexByte(content, ')')
+		if i < 0 {
+			continue
+		}
+		fields := bytes.Fields(content[i+1:])
+		if len(fields) < 2 {
+			continue
+		}
+		if ppid, err := strconv.Atoi(string(fields[1])); err != nil || ppid != pid {
+			continue
+		}
+		child, err := strconv.Atoi(filepath.Base(filepath.Dir(stat)))
+		if err == nil {
+			children = append(children, child)
+		}
+	}
+	return children, nil
+}
@@ -0,0 +1,358 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeHaproxyBinary creates an executable script that can be used in place
+// of haproxy, it returns the directory containing it to be removed later.
+func fakeHaproxyBinary(t *testing.T, script string) (string, string) {
+	dir, err := ioutil.TempDir("", "fake-haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "haproxy")
+	err = ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, path
+}
+
+func waitForStatus(s HaproxyServer, f func(HaproxyStatus) bool) (HaproxyStatus, bool) {
+	var status HaproxyStatus
+	for retries := 100; retries > 0; retries-- {
+		status = s.Status()
+		if f(status) {
+			return status, true
+		}
+		<-time.After(20 * time.Millisecond)
+	}
+	return status, false
+}
+
+func TestMasterWorkerCrashReported(t *testing.T) {
+	dir, path := fakeHaproxyBinary(t, "echo 'fatal error' >&2\nexit 3")
+	defer os.RemoveAll(dir)
+
+	s := &HaproxyServerMasterWorker{path: path}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	status, ok := waitForStatus(s, func(status HaproxyStatus) bool {
+		return status.Crashes > 0
+	})
+	if !ok {
+		t.Fatal("crash not reported")
+	}
+	if status.Running {
+		t.Error("haproxy reported as running after crash")
+	}
+	if status.LastCrash.ExitCode != 3 {
+		t.Errorf("found exit code %d, expected 3", status.LastCrash.ExitCode)
+	}
+	if !strings.Contains(status.LastCrash.Stderr, "fatal error") {
+		t.Errorf("stderr not captured: %q", status.LastCrash.Stderr)
+	}
+}
+
+func TestMasterWorkerStopIsNotCrash(t *testing.T) {
+	dir, path := fakeHaproxyBinary(t, "exec sleep 10")
+	defer os.RemoveAll(dir)
+
+	s := &HaproxyServerMasterWorker{path: path}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	status, ok := waitForStatus(s, func(status HaproxyStatus) bool {
+		return !status.Running
+	})
+	if !ok {
+		t.Fatal("haproxy still running after stop")
+	}
+	<-time.After(50 * time.Millisecond)
+	if status = s.Status(); status.Crashes != 0 {
+		t.Errorf("commanded stop reported as crash: %+v", status.LastCrash)
+	}
+}
+
+func TestMasterWorkerCommand(t *testing.T) {
+	dir, path := fakeHaproxyBinary(t, `echo "$0 $@" > "$(dirname "$0")/args"
+exec sleep 10`)
+	defer os.RemoveAll(dir)
+
+	s := &HaproxyServerMasterWorker{path: path, configFile: "haproxy.cfg", pidFile: "haproxy.pid"}
+	expected := []string{path, "-W", "-f", "haproxy.cfg", "-p", "haproxy.pid"}
+	if command := s.Status().Command; !reflect.DeepEqual(command, expected) {
+		t.Fatalf("found command %v before start, expected %v", command, expected)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	var content []byte
+	for retries := 100; len(content) == 0 && retries > 0; retries-- {
+		<-time.After(20 * time.Millisecond)
+		content, _ = ioutil.ReadFile(filepath.Join(dir, "args"))
+	}
+	command := s.Status().Command
+	if !reflect.DeepEqual(command, expected) || strings.Join(command, " ") != strings.TrimSpace(string(content)) {
+		t.Fatalf("reported command %v, found %q", command, content)
+	}
+}
+
+func TestMasterWorkerTransferSockets(t *testing.T) {
+	s, err := NewHaproxyServer("haproxy", "haproxy.pid", "haproxy.cfg", "master-worker", "/run/haproxy.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"haproxy", "-W", "-f", "haproxy.cfg", "-p", "haproxy.pid", "-x", "/run/haproxy.sock"}
+	if command := s.Status().Command; !reflect.DeepEqual(command, expected) {
+		t.Fatalf("found command %v, expected %v", command, expected)
+	}
+
+	s, err = NewHaproxyServer("haproxy", "haproxy.pid", "haproxy.cfg", "master-worker", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command := s.Status().Command; !reflect.DeepEqual(command, expected[:6]) {
+		t.Fatalf("found command %v without transfer socket, expected %v", command, expected[:6])
+	}
+}
+
+// Fake masters start a new child on reload, unless they are unresponsive
+const (
+	fakeResponsiveMaster   = "trap 'sleep 30 >/dev/null 2>&1 &' USR2\nsleep 30 >/dev/null 2>&1 &\nwhile :; do wait; done"
+	fakeUnresponsiveMaster = "trap '' USR2\nsleep 30 >/dev/null 2>&1 &\nwhile :; do wait; done"
+)
+
+func TestMasterWorkerReloadConfirmed(t *testing.T) {
+	dir, path := fakeHaproxyBinary(t, fakeResponsiveMaster)
+	defer os.RemoveAll(dir)
+
+	s := &HaproxyServerMasterWorker{path: path, reloadTimeout: 2 * time.Second}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	<-time.After(100 * time.Millisecond)
+
+	if err := s.Reload(); err != nil {
+		t.Fatalf("reload not confirmed: %v", err)
+	}
+}
+
+func TestMasterWorkerReloadUnresponsive(t *testing.T) {
+	dir, path := fakeHaproxyBinary(t, fakeUnresponsiveMaster)
+	defer os.RemoveAll(dir)
+
+	s := &HaproxyServerMasterWorker{path: path, reloadTimeout: 300 * time.Millisecond}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	<-time.After(100 * time.Millisecond)
+
+	done := make(chan error)
+	go func() { done <- s.Reload() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("reload of unresponsive master should fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload hanged with unresponsive master")
+	}
+}
+
+func TestMasterWorkerReloadUnresponsiveRestart(t *testing.T) {
+	dir, path := fakeHaproxyBinary(t, fakeUnresponsiveMaster)
+	defer os.RemoveAll(dir)
+
+	s := &HaproxyServerMasterWorker{path: path, reloadTimeout: 300 * time.Millisecond, reloadRestart: true}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	pid := s.Status().PID
+	<-time.After(100 * time.Millisecond)
+
+	if err := s.Reload(); err != nil {
+		t.Fatalf("restart after unresponsive reload failed: %v", err)
+	}
+	status := s.Status()
+	if !status.Running || status.PID == pid {
+		t.Fatalf("haproxy not restarted: %+v", status)
+	}
+	if status.Crashes != 0 {
+		t.Errorf("restart reported as crash")
+	}
+}
+
+func TestMasterWorkerPriority(t *testing.T) {
+	dir, path := fakeHaproxyBinary(t, "exec sleep 10")
+	defer os.RemoveAll(dir)
+
+	nice, oomScoreAdj := 5, 200
+	s := &HaproxyServerMasterWorker{path: path, priority: ProcessPriority{Nice: &nice, OOMScoreAdj: &oomScoreAdj}}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	pid := s.Status().PID
+
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	// Niceness is the 19th field, the 17th after the command name
+	if fields[16] != "5" {
+		t.Errorf("found niceness %s, expected 5", fields[16])
+	}
+	score, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/oom_score_adj", pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(score)) != "200" {
+		t.Errorf("found OOM score adjustment %s, expected 200", score)
+	}
+}
+
+func TestProcessPriorityValidation(t *testing.T) {
+	valid, tooNice, tooLow := 10, 20, -1001
+	cases := []struct {
+		priority ProcessPriority
+		valid    bool
+	}{
+		{ProcessPriority{}, true},
+		{ProcessPriority{Nice: &valid, OOMScoreAdj: &valid}, true},
+		{ProcessPriority{Nice: &tooNice}, false},
+		{ProcessPriority{OOMScoreAdj: &tooLow}, false},
+	}
+	for _, c := range cases {
+		if err := c.priority.validate(); (err == nil) != c.valid {
+			t.Errorf("unexpected validation result for %+v: %v", c.priority, err)
+		}
+	}
+}
+
+func TestParseMasterReload(t *testing.T) {
+	cases := []struct {
+		response string
+		success  bool
+		output   string
+		ok       bool
+	}{
+		{"Success=1\n--\n[NOTICE] (1) : Loading success.\n", true, "[NOTICE] (1) : Loading success.", true},
+		{"Success=0\n--\n[ALERT] (1) : config : parsing [haproxy.cfg:3] : unknown keyword 'bogus'\n[ALERT] (1) : Fatal errors found\n", false, "[ALERT] (1) : config : parsing [haproxy.cfg:3] : unknown keyword 'bogus'\n[ALERT] (1) : Fatal errors found", true},
+		{"Success=0\n", false, "", true},
+		{"", false, "", false},
+		{"Unknown command: 'reload'\n", false, "", false},
+		{"Success=maybe\n", false, "", false},
+	}
+	for _, c := range cases {
+		success, output, ok := parseMasterReload(c.response)
+		if success != c.success || output != c.output || ok != c.ok {
+			t.Errorf("%q: found (%v, %q, %v), expected (%v, %q, %v)", c.response, success, output, ok, c.success, c.output, c.ok)
+		}
+	}
+}
+
+func TestMasterWorkerReloadMasterSocket(t *testing.T) {
+	dir, path := fakeHaproxyBinary(t, fakeUnresponsiveMaster)
+	defer os.RemoveAll(dir)
+
+	var response atomic.Value
+	response.Store("Success=1\n--\n")
+	socket := newFakeStatsSocket(t, func(command string) string {
+		if command != "reload" {
+			return "Unknown command\n"
+		}
+		return response.Load().(string)
+	})
+	defer socket.Close()
+
+	s := &HaproxyServerMasterWorker{path: path, reloadTimeout: time.Second, masterSocket: socket.Path()}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// The fake master doesn't start new workers, the reload command is
+	// authoritative
+	if err := s.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	response.Store("Success=0\n--\n[ALERT] (1) : Fatal errors found in configuration.\n")
+	err := s.Reload()
+	reloadErr, ok := err.(*MasterReloadError)
+	if !ok || !strings.Contains(reloadErr.Output, "Fatal errors") {
+		t.Fatalf("expected reload error with output, found %v", err)
+	}
+}
+
+func TestMasterWorkerReloadMasterSocketUnreported(t *testing.T) {
+	// The fake master starts a new child when the reload command is
+	// received, and records if it receives the reload signal
+	signals := filepath.Join(os.TempDir(), fmt.Sprintf("fake-haproxy-signals-%d", time.Now().UnixNano()))
+	defer os.Remove(signals)
+	dir, path := fakeHaproxyBinary(t, fmt.Sprintf("trap 'sleep 30 >/dev/null 2>&1 &' USR1\ntrap 'echo USR2 >> %s' USR2\nsleep 30 >/dev/null 2>&1 &\nwhile :; do wait; done", signals))
+	defer os.RemoveAll(dir)
+
+	var pid atomic.Value
+	socket := newFakeStatsSocket(t, func(command string) string {
+		if command != "reload" {
+			return "Unknown command\n"
+		}
+		syscall.Kill(pid.Load().(int), syscall.SIGUSR1)
+		return ""
+	})
+	defer socket.Close()
+
+	s := &HaproxyServerMasterWorker{path: path, reloadTimeout: 2 * time.Second, masterSocket: socket.Path()}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	pid.Store(s.Status().PID)
+	<-time.After(100 * time.Millisecond)
+
+	if err := s.Reload(); err != nil {
+		t.Fatalf("reload not confirmed: %v", err)
+	}
+	if _, err := os.Stat(signals); err == nil {
+		t.Fatal("reload signal sent after sending the reload command")
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"syscall"
+)
+
+var haproxyPriority ProcessPriority
+
+func init() {
+	flag.Var(optionalInt{&haproxyPriority.Nice}, "haproxy-nice", "Niceness of haproxy processes, from -20 to 19 (default: inherited from the wrapper)")
+	flag.Var(optionalInt{&haproxyPriority.OOMScoreAdj}, "haproxy-oom-score-adj", "OOM score adjustment of haproxy processes, from -1000 to 1000 (default: inherited from the wrapper)")
+}
+
+// ProcessPriority is the scheduling priority and OOM score adjustment set to
+// haproxy processes, nil values are not changed.
+type ProcessPriority struct {
+	Nice        *int
+	OOMScoreAdj *int
+}
+
+func (p ProcessPriority) validate() error {
+	if p.Nice != nil && (*p.Nice < -20 || *p.Nice > 19) {
+		return fmt.Errorf("niceness must be between -20 and 19, found %d", *p.Nice)
+	}
+	if p.OOMScoreAdj != nil && (*p.OOMScoreAdj < -1000 || *p.OOMScoreAdj > 1000) {
+		return fmt.Errorf("OOM score adjustment must be between -1000 and 1000, found %d", *p.OOMScoreAdj)
+	}
+	return nil
+}
+
+// Apply sets the priority to a process, children forked later by the process
+// inherit it.
+func (p ProcessPriority) Apply(pid int) error {
+	if p.Nice != nil {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, *p.Nice); err != nil {
+			return fmt.Errorf("couldn't set niceness of process %d: %v", pid, err)
+		}
+	}
+	if p.OOMScoreAdj != nil {
+		path := fmt.Sprintf("/proc/%d/oom_score_adj", pid)
+		if err := ioutil.WriteFile(path, []byte(strconv.Itoa(*p.OOMScoreAdj)), 0644); err != nil {
+			return fmt.Errorf("couldn't set OOM score adjustment of process %d: %v", pid, err)
+		}
+	}
+	return nil
+}
+
+// optionalInt is a flag for an int that is nil if not set.
+type optionalInt struct {
+	value **int
+}
+
+func (f optionalInt) String() string {
+	if f.value == nil || *f.value == nil {
+		return ""
+	}
+	return strconv.Itoa(**f.value)
+}
+
+func (f optionalInt) Set(s string) error {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*f.value = &v
+	return nil
+}
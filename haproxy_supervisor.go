@@ -0,0 +1,249 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRestartMinBackoff = 1 * time.Second
+	defaultRestartMaxBackoff = 1 * time.Minute
+)
+
+// HaproxySupervisor restarts haproxy when it exits unexpectedly. It stops
+// retrying if haproxy crashes too many times in a time window, or if it
+// cannot be restarted after some attempts.
+type HaproxySupervisor struct {
+	HaproxyServer
+
+	// Consecutive failed restarts before giving up, zero for no limit
+	MaxRetries int
+
+	// Called before each restart, to ensure that haproxy is restarted with
+	// a valid configuration, errors are only logged
+	BeforeRestart func() error
+
+	sync.Mutex
+	maxCrashes     int
+	window         time.Duration
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	crashTimes     []time.Time
+	restarts       int
+	failedRestarts int
+	crashLoop      bool
+	stopped        bool
+	stopRestart    chan struct{}
+}
+
+// NewHaproxySupervisor wraps a haproxy server so it is restarted on crashes,
+// the server must be able to notify about them.
+func NewHaproxySupervisor(server HaproxyServer, maxCrashes int, window time.Duration) (*HaproxySupervisor, error) {
+	notifier, ok := server.(HaproxyCrashNotifier)
+	if !ok {
+		return nil, fmt.Errorf("haproxy server doesn't support crash notifications")
+	}
+	if maxCrashes <= 0 {
+		return nil, fmt.Errorf("maximum number of crashes must be positive")
+	}
+	s := &HaproxySupervisor{
+		HaproxyServer: server,
+		maxCrashes:    maxCrashes,
+		window:        window,
+		minBackoff:    defaultRestartMinBackoff,
+		maxBackoff:    defaultRestartMaxBackoff,
+		stopRestart:   make(chan struct{}),
+	}
+	crashes := make(chan *HaproxyCrash, 1)
+	notifier.NotifyCrash(crashes)
+	go s.loop(crashes)
+	return s, nil
+}
+
+func (s *HaproxySupervisor) loop(crashes <-chan *HaproxyCrash) {
+	for range crashes {
+		for s.restart() {
+		}
+	}
+}
+
+// restart waits for the backoff and starts haproxy again, it returns true
+// if the restart failed and should be retried.
+func (s *HaproxySupervisor) restart() bool {
+	backoff, stop, ok := s.recordCrash()
+	if !ok {
+		return false
+	}
+
+	s.Lock()
+	attempt := s.failedRestarts + 1
+	s.Unlock()
+	log.Printf("Restarting haproxy in %s (attempt %d)\n", backoff, attempt)
+	select {
+	case <-time.After(backoff):
+	case <-stop:
+		return false
+	}
+	if s.BeforeRestart != nil {
+		if err := s.BeforeRestart(); err != nil {
+			log.Printf("Couldn't prepare restart of haproxy: %v\n", err)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.restarts++
+	if err := s.HaproxyServer.Start(); err != nil {
+		s.failedRestarts++
+		log.Printf("Couldn't restart haproxy (attempt %d): %v\n", attempt, err)
+		if s.MaxRetries > 0 && s.failedRestarts >= s.MaxRetries {
+			log.Printf("ERROR: Couldn't restart haproxy after %d attempts, giving up restarting it\n", s.failedRestarts)
+			s.crashLoop = true
+			return false
+		}
+		return true
+	}
+	s.failedRestarts = 0
+	log.Printf("Haproxy restarted (attempt %d)\n", attempt)
+	return false
+}
+
+// recordCrash accounts a new crash and returns the time to wait before
+// restarting and a channel closed if the supervisor is stopped meanwhile,
+// or false if haproxy shouldn't be restarted.
+func (s *HaproxySupervisor) recordCrash() (time.Duration, <-chan struct{}, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if s.stopped || s.crashLoop {
+		return 0, nil, false
+	}
+
+	now := time.Now()
+	recent := s.crashTimes[:0]
+	for _, t := range s.crashTimes {
+		if now.Sub(t) < s.window {
+			recent = append(recent, t)
+		}
+	}
+	s.crashTimes = append(recent, now)
+
+	if len(s.crashTimes) >= s.maxCrashes {
+		log.Printf("ERROR: Haproxy crashed %d times in %s, giving up restarting it\n", len(s.crashTimes), s.window)
+		s.crashLoop = true
+		return 0, nil, false
+	}
+
+	backoff := s.minBackoff
+	for i := 1; i < len(s.crashTimes) && backoff < s.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.maxBackoff {
+		backoff = s.maxBackoff
+	}
+	return backoff, s.stopRestart, true
+}
+
+func (s *HaproxySupervisor) resetCrashes() {
+	s.crashTimes = nil
+	s.failedRestarts = 0
+	s.crashLoop = false
+}
+
+func (s *HaproxySupervisor) Start() error {
+	s.Lock()
+	defer s.Unlock()
+	s.stopped = false
+	if err := s.HaproxyServer.Start(); err != nil {
+		return err
+	}
+	s.resetCrashes()
+	return nil
+}
+
+// Reload reloads haproxy, if it starts haproxy after a crash loop, the
+// supervisor starts restarting it again.
+func (s *HaproxySupervisor) Reload() error {
+	if err := s.HaproxyServer.Reload(); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.crashLoop && s.HaproxyServer.IsRunning() {
+		log.Println("Haproxy running again after crash loop")
+		s.resetCrashes()
+	}
+	return nil
+}
+
+func (s *HaproxySupervisor) Stop() error {
+	s.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stopRestart)
+		s.stopRestart = make(chan struct{})
+	}
+	s.Unlock()
+	return s.HaproxyServer.Stop()
+}
+
+func (s *HaproxySupervisor) Status() HaproxyStatus {
+	status := s.HaproxyServer.Status()
+	s.Lock()
+	defer s.Unlock()
+	status.Restarts = s.restarts
+	status.CrashLoop = s.crashLoop
+	return status
+}
+
+// restoreAppliedConfig writes back the last configuration applied if the
+// configuration file changed since then and it is not valid, so haproxy is
+// restarted with a known good configuration.
+func (c *Controller) restoreAppliedConfig() error {
+	c.Lock()
+	applied := c.applied
+	c.Unlock()
+	if applied == nil {
+		return nil
+	}
+	current, err := ioutil.ReadFile(c.configFile)
+	if err == nil {
+		if bytes.Equal(current, applied) {
+			return nil
+		}
+		if err := c.validator.Validate(); err == nil {
+			return nil
+		}
+	}
+	log.Println("Warning: configuration changed since the last reload is not valid, restoring the last applied one")
+	temp, err := writeTempFile(c.configFile, applied)
+	if err != nil {
+		return fmt.Errorf("couldn't write configuration: %v", err)
+	}
+	if err := os.Rename(temp, c.configFile); err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("couldn't write configuration: %v", err)
+	}
+	return nil
+}
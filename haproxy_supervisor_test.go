@@ -0,0 +1,214 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+type fakeCrashingHaproxy struct {
+	fakeHaproxy
+	starts  chan struct{}
+	crashes chan<- *HaproxyCrash
+
+	// Starts failing before starting again
+	failStarts int
+}
+
+func newFakeCrashingHaproxy() *fakeCrashingHaproxy {
+	return &fakeCrashingHaproxy{starts: make(chan struct{}, 10)}
+}
+
+func (h *fakeCrashingHaproxy) Start() error {
+	defer func() { h.starts <- struct{}{} }()
+	h.Lock()
+	if h.failStarts > 0 {
+		h.failStarts--
+		h.Unlock()
+		return errors.New("invalid configuration")
+	}
+	h.Unlock()
+	return h.fakeHaproxy.Start()
+}
+
+func (h *fakeCrashingHaproxy) NotifyCrash(c chan<- *HaproxyCrash) {
+	h.crashes = c
+}
+
+func (h *fakeCrashingHaproxy) crash() {
+	h.Lock()
+	h.running = false
+	h.Unlock()
+	h.crashes <- &HaproxyCrash{Time: time.Now(), ExitCode: 1}
+}
+
+func newTestSupervisor(t *testing.T, h HaproxyServer, maxCrashes int) *HaproxySupervisor {
+	s, err := NewHaproxySupervisor(h, maxCrashes, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.minBackoff = time.Millisecond
+	s.maxBackoff = 10 * time.Millisecond
+	return s
+}
+
+func expectStart(t *testing.T, h *fakeCrashingHaproxy, expected bool) {
+	select {
+	case <-h.starts:
+		if !expected {
+			t.Fatal("haproxy started, but it shouldn't")
+		}
+	case <-time.After(200 * time.Millisecond):
+		if expected {
+			t.Fatal("haproxy not started")
+		}
+	}
+}
+
+func TestSupervisorRestartsOnCrash(t *testing.T) {
+	h := newFakeCrashingHaproxy()
+	s := newTestSupervisor(t, h, 3)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	expectStart(t, h, true)
+
+	h.crash()
+	expectStart(t, h, true)
+
+	status := s.Status()
+	if !status.Running || status.Restarts != 1 || status.CrashLoop {
+		t.Fatalf("unexpected status after restart: %+v", status)
+	}
+}
+
+func TestSupervisorCrashLoopGuard(t *testing.T) {
+	h := newFakeCrashingHaproxy()
+	s := newTestSupervisor(t, h, 3)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	expectStart(t, h, true)
+
+	for i := 0; i < 2; i++ {
+		h.crash()
+		expectStart(t, h, true)
+	}
+	h.crash()
+	expectStart(t, h, false)
+
+	status := s.Status()
+	if status.Running || !status.CrashLoop {
+		t.Fatalf("crash loop not reported: %+v", status)
+	}
+}
+
+func TestSupervisorDoesntRestartAfterStop(t *testing.T) {
+	h := newFakeCrashingHaproxy()
+	s := newTestSupervisor(t, h, 3)
+	s.minBackoff = 100 * time.Millisecond
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	expectStart(t, h, true)
+
+	h.crash()
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	expectStart(t, h, false)
+}
+
+func TestSupervisorRequiresCrashNotifications(t *testing.T) {
+	if _, err := NewHaproxySupervisor(&fakeHaproxy{}, 3, time.Minute); err == nil {
+		t.Fatal("supervisor created for a server without crash notifications")
+	}
+}
+
+func TestSupervisorMaxRetries(t *testing.T) {
+	h := newFakeCrashingHaproxy()
+	s := newTestSupervisor(t, h, 10)
+	s.MaxRetries = 2
+	var prepared int
+	s.BeforeRestart = func() error {
+		prepared++
+		return nil
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	expectStart(t, h, true)
+
+	// Restarts after failed attempts
+	h.Lock()
+	h.failStarts = 1
+	h.Unlock()
+	h.crash()
+	expectStart(t, h, true)
+	expectStart(t, h, true)
+	if status := s.Status(); !status.Running || status.CrashLoop {
+		t.Fatalf("unexpected status after restart: %+v", status)
+	}
+
+	// Gives up after too many failed attempts
+	h.Lock()
+	h.failStarts = 5
+	h.Unlock()
+	h.crash()
+	expectStart(t, h, true)
+	expectStart(t, h, true)
+	expectStart(t, h, false)
+	status := s.Status()
+	if status.Running || !status.CrashLoop || status.Restarts != 4 || prepared != 4 {
+		t.Fatalf("unexpected status after failed restarts: %+v, prepared %d times", status, prepared)
+	}
+
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, s, &fakeValidator{})
+	if code, r := getReady(t, c); code != http.StatusServiceUnavailable || r.Reason != "haproxy crashed and couldn't be restarted" {
+		t.Fatalf("unexpected readiness after failed restarts %d: %+v", code, r)
+	}
+}
+
+func TestControllerRestoreAppliedConfig(t *testing.T) {
+	config := tempConfig(t, "global\n    maxconn 10\n")
+	defer os.Remove(config)
+	validator := &fakeValidator{}
+	c := NewController("", config, &fakeHaproxy{}, validator)
+
+	// Valid changes not reloaded yet are kept
+	ioutil.WriteFile(config, []byte("global\n    maxconn 20\n"), 0644)
+	if err := c.restoreAppliedConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(config); string(content) != "global\n    maxconn 20\n" {
+		t.Fatalf("valid configuration replaced: %q", content)
+	}
+
+	validator.err = errors.New("invalid configuration")
+	ioutil.WriteFile(config, []byte("global\n    invalid\n"), 0644)
+	if err := c.restoreAppliedConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(config); string(content) != "global\n    maxconn 10\n" {
+		t.Fatalf("applied configuration not restored: %q", content)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var procSysPath = "/proc/sys"
+
+// Sysctls relevant to retain connections, the conntrack table is used by
+// the conntrack match strategy and it also keeps an entry for each retained
+// connection if conntrack is loaded, and released connections are queued in
+// the accept queues of haproxy, limited by somaxconn
+const (
+	sysctlConntrackMax   = "net.netfilter.nf_conntrack_max"
+	sysctlConntrackCount = "net.netfilter.nf_conntrack_count"
+	sysctlSomaxconn      = "net.core.somaxconn"
+)
+
+var kernelLimitSysctls = []string{sysctlConntrackMax, sysctlConntrackCount, sysctlSomaxconn}
+
+// Usage of the conntrack table considered close to its capacity
+const conntrackUsageWarning = 0.9
+
+// KernelLimits are the limits of the kernel relevant to retain connections,
+// with warnings about the settings of the wrapper not compatible with them.
+// Sysctls that cannot be read are reported with their errors.
+type KernelLimits struct {
+	QueueLength int               `json:"queue_length"`
+	Sysctls     map[string]int64  `json:"sysctls,omitempty"`
+	Unavailable map[string]string `json:"unavailable,omitempty"`
+	Warnings    []string          `json:"warnings,omitempty"`
+}
+
+// readSysctl reads the integer value of a sysctl from procfs.
+func readSysctl(name string) (int64, error) {
+	path := filepath.Join(procSysPath, strings.Replace(name, ".", "/", -1))
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't parse %s: %v", name, err)
+	}
+	return value, nil
+}
+
+// CheckKernelLimits reads the limits of the kernel and checks if they are
+// enough to retain up to queueLength connections with the match strategy.
+func CheckKernelLimits(queueLength int, match string) *KernelLimits {
+	limits := &KernelLimits{
+		QueueLength: queueLength,
+		Sysctls:     make(map[string]int64),
+		Unavailable: make(map[string]string),
+	}
+	for _, name := range kernelLimitSysctls {
+		if value, err := readSysctl(name); err != nil {
+			limits.Unavailable[name] = err.Error()
+		} else {
+			limits.Sysctls[name] = value
+		}
+	}
+
+	max, maxFound := limits.Sysctls[sysctlConntrackMax]
+	count, countFound := limits.Sysctls[sysctlConntrackCount]
+	switch {
+	case !maxFound || !countFound:
+		if match == NetQueueMatchConntrack {
+			limits.warn("conntrack limits not available, conntrack support is needed to match connections by their state")
+		}
+	case float64(count) >= conntrackUsageWarning*float64(max):
+		limits.warn("conntrack table is almost full (%d of %d entries), new connections may be dropped", count, max)
+	case max-count < int64(queueLength):
+		limits.warn("conntrack table has %d free entries (%s), less than the %d connections that can be retained during reloads", max-count, sysctlConntrackMax, queueLength)
+	}
+	return limits
+}
+
+func (l *KernelLimits) warn(format string, args ...interface{}) {
+	l.Warnings = append(l.Warnings, fmt.Sprintf(format, args...))
+}
+
+// capabilitiesReport is the response of /capabilities.
+type capabilitiesReport struct {
+	DiagnosticsCapabilities
+	KernelLimits *KernelLimits `json:"kernel_limits,omitempty"`
+
+	// Reason connections are not retained during reloads, if disabled
+	CaptureDisabled string `json:"capture_disabled,omitempty"`
+}
+
+// capabilities reports the effective capabilities of the process, and the
+// kernel limits checked at startup.
+func (c *Controller) capabilities(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	report := capabilitiesReport{KernelLimits: c.KernelLimits, CaptureDisabled: c.CaptureDisabled}
+	if capabilities, err := effectiveCapabilities(); err != nil {
+		report.Error = err.Error()
+	} else {
+		report.Effective = capabilities
+	}
+	writeJSON(w, report)
+}
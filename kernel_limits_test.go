@@ -0,0 +1,177 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeSysctls creates a fake proc sys directory with the given values, and
+// returns a function restoring the real one.
+func fakeSysctls(t *testing.T, values map[string]string) func() {
+	dir, err := ioutil.TempDir("", "sysctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range values {
+		path := filepath.Join(dir, strings.Replace(name, ".", "/", -1))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := procSysPath
+	procSysPath = dir
+	return func() {
+		procSysPath = previous
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCheckKernelLimits(t *testing.T) {
+	cases := []struct {
+		title    string
+		sysctls  map[string]string
+		match    string
+		warnings []string
+	}{
+		{
+			title: "enough capacity",
+			sysctls: map[string]string{
+				sysctlConntrackMax:   "262144",
+				sysctlConntrackCount: "1200",
+				sysctlSomaxconn:      "4096",
+			},
+			match: NetQueueMatchConntrack,
+		},
+		{
+			title: "conntrack almost full",
+			sysctls: map[string]string{
+				sysctlConntrackMax:   "262144",
+				sysctlConntrackCount: "250000",
+			},
+			match:    NetQueueMatchSyn,
+			warnings: []string{"conntrack table is almost full (250000 of 262144 entries), new connections may be dropped"},
+		},
+		{
+			title: "conntrack smaller than queue",
+			sysctls: map[string]string{
+				sysctlConntrackMax:   "65536",
+				sysctlConntrackCount: "100",
+			},
+			match:    NetQueueMatchSyn,
+			warnings: []string{"conntrack table has 65436 free entries (net.netfilter.nf_conntrack_max), less than the 65536 connections that can be retained during reloads"},
+		},
+		{
+			title:   "conntrack not loaded with syn match",
+			sysctls: map[string]string{sysctlSomaxconn: "128"},
+			match:   NetQueueMatchSyn,
+		},
+		{
+			title:    "conntrack not loaded with conntrack match",
+			sysctls:  map[string]string{sysctlSomaxconn: "128"},
+			match:    NetQueueMatchConntrack,
+			warnings: []string{"conntrack limits not available, conntrack support is needed to match connections by their state"},
+		},
+	}
+	for _, c := range cases {
+		restore := fakeSysctls(t, c.sysctls)
+		limits := CheckKernelLimits(65536, c.match)
+		restore()
+		if !reflect.DeepEqual(limits.Warnings, c.warnings) {
+			t.Errorf("%s: expected warnings %q, found %q", c.title, c.warnings, limits.Warnings)
+		}
+		if len(limits.Sysctls)+len(limits.Unavailable) != len(kernelLimitSysctls) {
+			t.Errorf("%s: expected all sysctls reported, found %+v", c.title, limits)
+		}
+	}
+}
+
+func TestCheckKernelLimitsInvalidValues(t *testing.T) {
+	defer fakeSysctls(t, map[string]string{
+		sysctlConntrackMax:   "lots",
+		sysctlConntrackCount: "10",
+		sysctlSomaxconn:      "4096",
+	})()
+
+	limits := CheckKernelLimits(65536, NetQueueMatchConntrack)
+	if !strings.Contains(limits.Unavailable[sysctlConntrackMax], "couldn't parse") {
+		t.Errorf("expected invalid value reported, found %+v", limits.Unavailable)
+	}
+	if limits.Sysctls[sysctlSomaxconn] != 4096 || limits.Sysctls[sysctlConntrackCount] != 10 {
+		t.Errorf("unexpected values: %+v", limits.Sysctls)
+	}
+	if len(limits.Warnings) != 1 {
+		t.Errorf("expected warning about unavailable conntrack limits, found %q", limits.Warnings)
+	}
+}
+
+func TestControllerCapabilities(t *testing.T) {
+	status := tempConfig(t, "CapEff:\t0000000000001000\n")
+	defer os.Remove(status)
+	defer func(path string) { procSelfStatusPath = path }(procSelfStatusPath)
+	procSelfStatusPath = status
+	defer fakeSysctls(t, map[string]string{sysctlConntrackMax: "1000", sysctlConntrackCount: "950"})()
+
+	c := NewController("", "", &fakeHaproxy{}, &fakeValidator{})
+	c.KernelLimits = CheckKernelLimits(100, NetQueueMatchSyn)
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/capabilities", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var report capabilitiesReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Effective["CAP_NET_ADMIN"] || report.Effective["CAP_KILL"] {
+		t.Errorf("unexpected capabilities: %+v", report.Effective)
+	}
+	if report.KernelLimits == nil || report.KernelLimits.Sysctls[sysctlConntrackMax] != 1000 || len(report.KernelLimits.Warnings) != 1 {
+		t.Errorf("unexpected kernel limits: %+v", report.KernelLimits)
+	}
+}
+
+func TestControllerCaptureDisabled(t *testing.T) {
+	c := NewController("", "", &fakeHaproxy{}, &fakeValidator{})
+	c.NetQueues = []uint{0}
+	c.CaptureDisabled = "CAP_NET_ADMIN capability not available"
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/capabilities", nil))
+	var report capabilitiesReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.CaptureDisabled != c.CaptureDisabled {
+		t.Errorf("capture disabled not reported in capabilities: %s", w.Body.String())
+	}
+
+	queues := getStatus(t, c)["net_queues"]
+	if queues["disabled"] != c.CaptureDisabled || queues["error"] != nil {
+		t.Errorf("unexpected net queues status: %v", queues)
+	}
+}
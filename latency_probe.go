@@ -0,0 +1,154 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// Number of buckets of latency histograms, bucket i counts latencies lower
+// than 2^(i+1) microseconds
+const latencyBuckets = 32
+
+var errLatencyProbeUnavailable = errors.New("eBPF support not included in this build")
+
+// LatencyHistogram counts connection setup latencies in buckets of powers of
+// two microseconds.
+type LatencyHistogram struct {
+	Buckets [latencyBuckets]uint64
+	Sum     time.Duration
+}
+
+func latencyBucketBound(i int) time.Duration {
+	return time.Duration(uint64(1)<<uint(i+1)) * time.Microsecond
+}
+
+// Sub returns the latencies counted in h but not in o.
+func (h LatencyHistogram) Sub(o LatencyHistogram) LatencyHistogram {
+	for i := range h.Buckets {
+		h.Buckets[i] -= o.Buckets[i]
+	}
+	h.Sum -= o.Sum
+	return h
+}
+
+func (h LatencyHistogram) Count() uint64 {
+	var count uint64
+	for _, n := range h.Buckets {
+		count += n
+	}
+	return count
+}
+
+// Quantile returns the upper bound of the bucket including the quantile q.
+func (h LatencyHistogram) Quantile(q float64) time.Duration {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(count) + 0.5)
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range h.Buckets {
+		seen += n
+		if seen >= rank {
+			return latencyBucketBound(i)
+		}
+	}
+	return latencyBucketBound(latencyBuckets - 1)
+}
+
+// LatencySummary summarizes the setup latencies of the connections received
+// during a reload.
+type LatencySummary struct {
+	Connections uint64        `json:"connections"`
+	P50         time.Duration `json:"p50_ns"`
+	P99         time.Duration `json:"p99_ns"`
+	Max         time.Duration `json:"max_ns"`
+}
+
+func (h LatencyHistogram) Summary() *LatencySummary {
+	return &LatencySummary{
+		Connections: h.Count(),
+		P50:         h.Quantile(0.5),
+		P99:         h.Quantile(0.99),
+		Max:         h.Quantile(1),
+	}
+}
+
+// LatencyProbe measures in the kernel the time from the arrival of the first
+// SYN of a connection to its establishment, including the time the SYN is
+// retained in netfilter queues.
+type LatencyProbe interface {
+	Histogram() (LatencyHistogram, error)
+	Close() error
+}
+
+// latencyProbeCollector exposes the histogram of the probe as a metric.
+type latencyProbeCollector struct {
+	probe LatencyProbe
+}
+
+func (c *latencyProbeCollector) Collect() []MetricFamily {
+	h, err := c.probe.Histogram()
+	if err != nil {
+		return nil
+	}
+	f := MetricFamily{
+		Name: metricsNamespace + "_connection_setup_seconds",
+		Help: "Time from the first SYN of connections to their establishment, measured in the kernel",
+		Type: "histogram",
+	}
+	var cumulative uint64
+	for i, n := range h.Buckets {
+		cumulative += n
+		f.Samples = append(f.Samples, Sample{
+			Suffix: "_bucket",
+			Labels: []LabelPair{{Name: "le", Value: formatMetricValue(latencyBucketBound(i).Seconds())}},
+			Value:  float64(cumulative),
+		})
+	}
+	f.Samples = append(f.Samples,
+		Sample{Suffix: "_bucket", Labels: []LabelPair{{Name: "le", Value: "+Inf"}}, Value: float64(cumulative)},
+		Sample{Suffix: "_sum", Value: h.Sum.Seconds()},
+		Sample{Suffix: "_count", Value: float64(cumulative)},
+	)
+	return []MetricFamily{f}
+}
+
+// measureLatency starts measuring the latencies of the connections received
+// during a reload, the returned function summarizes them.
+func (c *Controller) measureLatency() func() *LatencySummary {
+	if c.LatencyProbe == nil {
+		return func() *LatencySummary { return nil }
+	}
+	before, err := c.LatencyProbe.Histogram()
+	if err != nil {
+		log.Printf("Couldn't read latency probe: %v\n", err)
+		return func() *LatencySummary { return nil }
+	}
+	return func() *LatencySummary {
+		after, err := c.LatencyProbe.Histogram()
+		if err != nil {
+			log.Printf("Couldn't read latency probe: %v\n", err)
+			return nil
+		}
+		return after.Sub(before).Summary()
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build ebpf
+// +build ebpf
+
+package main
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+
+	"github.com/iovisor/gobpf/elf"
+)
+
+// Sections of the programs in bpf/reload_latency.c
+const (
+	latencyProbeSynSection         = "kprobe/ip_rcv"
+	latencyProbeEstablishedSection = "tracepoint/sock/inet_sock_set_state"
+	latencyProbeMap                = "latency"
+)
+
+// ebpfLatencyProbe reads the histogram kept by the programs of an eBPF
+// object loaded in the kernel.
+type ebpfLatencyProbe struct {
+	module  *elf.Module
+	latency *elf.Map
+}
+
+// NewLatencyProbe loads the compiled eBPF object and attaches its programs.
+func NewLatencyProbe(object string) (LatencyProbe, error) {
+	module := elf.NewModule(object)
+	if err := module.Load(nil); err != nil {
+		return nil, fmt.Errorf("couldn't load eBPF object %s: %v", object, err)
+	}
+	p := &ebpfLatencyProbe{module: module, latency: module.Map(latencyProbeMap)}
+	if p.latency == nil {
+		module.Close()
+		return nil, fmt.Errorf("map %s not found in eBPF object %s", latencyProbeMap, object)
+	}
+	if err := module.EnableKprobe(latencyProbeSynSection, 0); err != nil {
+		module.Close()
+		return nil, fmt.Errorf("couldn't attach %s: %v", latencyProbeSynSection, err)
+	}
+	if err := module.EnableTracepoint(latencyProbeEstablishedSection); err != nil {
+		module.Close()
+		return nil, fmt.Errorf("couldn't attach %s: %v", latencyProbeEstablishedSection, err)
+	}
+	return p, nil
+}
+
+// Histogram reads the buckets of the histogram, the entry after the last
+// bucket keeps the sum of latencies in nanoseconds.
+func (p *ebpfLatencyProbe) Histogram() (LatencyHistogram, error) {
+	var h LatencyHistogram
+	for i := uint32(0); i <= latencyBuckets; i++ {
+		var value uint64
+		if err := p.module.LookupElement(p.latency, unsafe.Pointer(&i), unsafe.Pointer(&value)); err != nil {
+			return h, fmt.Errorf("couldn't read latency bucket %d: %v", i, err)
+		}
+		if i == latencyBuckets {
+			h.Sum = time.Duration(value)
+		} else {
+			h.Buckets[i] = value
+		}
+	}
+	return h, nil
+}
+
+func (p *ebpfLatencyProbe) Close() error {
+	return p.module.Close()
+}
@@ -0,0 +1,139 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeLatencyProbe returns its histograms in order, keeping the last one.
+type fakeLatencyProbe struct {
+	histograms []LatencyHistogram
+	err        error
+}
+
+func (p *fakeLatencyProbe) Histogram() (LatencyHistogram, error) {
+	if p.err != nil {
+		return LatencyHistogram{}, p.err
+	}
+	h := p.histograms[0]
+	if len(p.histograms) > 1 {
+		p.histograms = p.histograms[1:]
+	}
+	return h, nil
+}
+
+func (p *fakeLatencyProbe) Close() error {
+	return nil
+}
+
+func TestLatencyHistogramQuantile(t *testing.T) {
+	var h LatencyHistogram
+	h.Buckets[3] = 50 // < 16us
+	h.Buckets[9] = 49 // < 1.024ms
+	h.Buckets[20] = 1 // < 2.097152s
+
+	cases := []struct {
+		q        float64
+		expected time.Duration
+	}{
+		{0, 16 * time.Microsecond},
+		{0.5, 16 * time.Microsecond},
+		{0.6, 1024 * time.Microsecond},
+		{0.99, 1024 * time.Microsecond},
+		{1, 2097152 * time.Microsecond},
+	}
+	for _, c := range cases {
+		if found := h.Quantile(c.q); found != c.expected {
+			t.Errorf("quantile %v: expected %s, found %s", c.q, c.expected, found)
+		}
+	}
+	if q := (LatencyHistogram{}).Quantile(0.5); q != 0 {
+		t.Errorf("expected zero quantile of empty histogram, found %s", q)
+	}
+}
+
+func TestControllerReloadLatency(t *testing.T) {
+	var before, after LatencyHistogram
+	before.Buckets[3] = 10
+	after.Buckets[3] = 12
+	after.Buckets[12] = 1
+
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+	c.LatencyProbe = &fakeLatencyProbe{histograms: []LatencyHistogram{before, after}}
+
+	latency := c.Reload().ConnectLatency
+	if latency == nil {
+		t.Fatal("latency not included in outcome")
+	}
+	expected := LatencySummary{Connections: 3, P50: 16 * time.Microsecond, P99: 8192 * time.Microsecond, Max: 8192 * time.Microsecond}
+	if *latency != expected {
+		t.Fatalf("expected %+v, found %+v", expected, *latency)
+	}
+}
+
+func TestControllerReloadLatencyUnavailable(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+	c.LatencyProbe = &fakeLatencyProbe{err: errors.New("map not available")}
+
+	outcome := c.Reload()
+	if !outcome.Success || outcome.ConnectLatency != nil {
+		t.Fatalf("unexpected outcome: %+v", outcome)
+	}
+}
+
+func TestLatencyProbeMetrics(t *testing.T) {
+	var h LatencyHistogram
+	h.Buckets[0] = 2
+	h.Buckets[1] = 1
+	h.Sum = 5 * time.Microsecond
+
+	r, err := NewRegistry(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Register(&latencyProbeCollector{&fakeLatencyProbe{histograms: []LatencyHistogram{h}}})
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE haproxy_wrapper_connection_setup_seconds histogram",
+		`haproxy_wrapper_connection_setup_seconds_bucket{le="2e-06"} 2`,
+		`haproxy_wrapper_connection_setup_seconds_bucket{le="4e-06"} 3`,
+		`haproxy_wrapper_connection_setup_seconds_bucket{le="+Inf"} 3`,
+		"haproxy_wrapper_connection_setup_seconds_sum 5e-06",
+		"haproxy_wrapper_connection_setup_seconds_count 3",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("line %q not found in metrics:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestNewLatencyProbeUnavailable(t *testing.T) {
+	if _, err := NewLatencyProbe("reload_latency.o"); err != errLatencyProbeUnavailable {
+		t.Fatalf("expected probe to be unavailable, found %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of the logs of the wrapper
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+var logFormat string
+
+func init() {
+	flag.StringVar(&logFormat, "log-format", LogFormatText, "Format of the logs of the wrapper (one of: text, json)")
+}
+
+// LogFields are contextual keys added to messages logged in JSON.
+type LogFields map[string]interface{}
+
+// jsonLogWriter writes each message logged as a JSON object in one line, with
+// its time, level and contextual fields. It is used as output of the standard
+// logger, so all the messages logged are formatted.
+type jsonLogWriter struct {
+	sync.Mutex
+	out io.Writer
+	now func() time.Time
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	if err := w.write(string(p), nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *jsonLogWriter) write(msg string, fields LogFields) error {
+	level, msg := logLevel(strings.TrimRight(msg, "\n"))
+	entry := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["ts"] = w.now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["msg"] = msg
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	w.Lock()
+	defer w.Unlock()
+	_, err = w.out.Write(append(line, '\n'))
+	return err
+}
+
+// logLevel obtains the level of a message from the conventions used in the
+// messages, warnings start with "Warning: " and errors with "Couldn't".
+func logLevel(msg string) (string, string) {
+	switch {
+	case strings.HasPrefix(msg, "Warning: "):
+		return "warning", strings.TrimPrefix(msg, "Warning: ")
+	case strings.HasPrefix(msg, "Couldn't"), strings.HasPrefix(msg, "Invalid"):
+		return "error", msg
+	}
+	return "info", msg
+}
+
+// JSON writer of logs, if enabled
+var jsonLog *jsonLogWriter
+
+// setLogFormat configures the standard logger to write messages in the given
+// format to out.
+func setLogFormat(format string, out io.Writer) error {
+	switch format {
+	case LogFormatText:
+		jsonLog = nil
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(out)
+	case LogFormatJSON:
+		jsonLog = &jsonLogWriter{out: out, now: time.Now}
+		log.SetFlags(0)
+		log.SetOutput(jsonLog)
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+	return nil
+}
+
+// logWithFields logs a message with contextual fields, that are only included
+// in JSON logs. Text logs keep only the message.
+func logWithFields(fields LogFields, format string, args ...interface{}) {
+	if jsonLog != nil {
+		if err := jsonLog.write(fmt.Sprintf(format, args...), fields); err == nil {
+			return
+		}
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,82 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLogs(t *testing.T) {
+	var logs bytes.Buffer
+	if err := setLogFormat(LogFormatJSON, &logs); err != nil {
+		t.Fatal(err)
+	}
+	defer setLogFormat(LogFormatText, os.Stderr)
+	jsonLog.now = func() time.Time { return time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC) }
+
+	log.Printf("Warning: slow reload took %s\n", time.Second)
+	msg := "Couldn't reload: exit status 1\n"
+	log.Println(msg)
+	logWithFields(LogFields{"queue": 3, "delayed_packets": 20}, "Delayed %d packages during reloads\n", 20)
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	expected := []map[string]interface{}{
+		{"ts": "2018-03-01T10:00:00Z", "level": "warning", "msg": "slow reload took 1s"},
+		{"ts": "2018-03-01T10:00:00Z", "level": "error", "msg": "Couldn't reload: exit status 1"},
+		{"ts": "2018-03-01T10:00:00Z", "level": "info", "msg": "Delayed 20 packages during reloads", "queue": 3.0, "delayed_packets": 20.0},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, found: %q", len(expected), logs.String())
+	}
+	for i, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("couldn't parse line %q: %v", line, err)
+		}
+		if len(entry) != len(expected[i]) {
+			t.Errorf("found entry %v, expected %v", entry, expected[i])
+			continue
+		}
+		for k, v := range expected[i] {
+			if entry[k] != v {
+				t.Errorf("found entry %v, expected %v", entry, expected[i])
+				break
+			}
+		}
+	}
+}
+
+func TestTextLogs(t *testing.T) {
+	var logs bytes.Buffer
+	if err := setLogFormat(LogFormatText, &logs); err != nil {
+		t.Fatal(err)
+	}
+	defer log.SetOutput(os.Stderr)
+
+	logWithFields(LogFields{"queue": 3}, "Delayed %d packages during reloads\n", 20)
+	if out := logs.String(); !strings.HasSuffix(out, " Delayed 20 packages during reloads\n") || strings.Contains(out, "queue") {
+		t.Fatalf("unexpected text log: %q", out)
+	}
+
+	if err := setLogFormat("xml", &logs); err == nil {
+		t.Fatal("expected error with unknown format")
+	}
+}
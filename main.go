@@ -17,9 +17,12 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -27,6 +30,18 @@ import (
 var version = "dev"
 var configTimeout = 5 * time.Minute
 
+// stringsFlag is a flag that can be set multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func watchHaproxyStart(haproxy HaproxyServer) chan bool {
 	started := make(chan bool)
 	go func() {
@@ -41,35 +56,308 @@ func watchHaproxyStart(haproxy HaproxyServer) chan bool {
 	return started
 }
 
+func newConfigPipelineFromFlags(transforms, globalFile, statsSocket, defaultTimeouts string, syslogPort uint) (ConfigPipeline, error) {
+	if transforms == "" {
+		return nil, nil
+	}
+	options := ConfigTransformOptions{
+		StatsSocket:   statsSocket,
+		SyslogAddress: fmt.Sprintf("127.0.0.1:%d", syslogPort),
+	}
+	if globalFile != "" {
+		stanza, err := ioutil.ReadFile(globalFile)
+		if err != nil {
+			return nil, err
+		}
+		options.GlobalStanza = stanza
+	}
+	timeouts, err := parseKeyValues(defaultTimeouts)
+	if err != nil {
+		return nil, err
+	}
+	options.DefaultTimeouts = timeouts
+	return NewConfigPipeline(strings.Split(transforms, ","), options)
+}
+
 func main() {
-	var haproxyPath, haproxyPIDFile, haproxyConfigFile, controlAddress, haproxyMode string
+	var haproxyPath, haproxyPIDFile, haproxyConfigFiles, controlAddress, haproxyMode string
 	var syslogPort uint
-	var showVersion bool
+	var controlToken, statsSocket, eventSocket string
+	var controlTLSCert, controlTLSKey, controlTLSCA string
+	var eventSocketBuffer int
+	var reloadWaitHealthy time.Duration
+	var showVersion, restartOnCrash, validationCache bool
+	var printQueueRules, allowSocketAdmin bool
+	var restartMaxCrashes, restartMaxRetries int
+	var restartCrashWindow time.Duration
+	var configTemplate string
+	var binaryMismatch string
+	var configTransforms, transformGlobalFile, transformStatsSocket, transformDefaultTimeouts string
+	var redactPatterns stringsFlag
+	var staticLabels string
+	var watchConfig, watchConfigKubernetes bool
+	var watchConfigInterval, watchConfigSettle time.Duration
+	var drainRamp time.Duration
+	var drainSteps int
+	var drainTimeout time.Duration
+	var configHistory int
+	var configHistoryPath string
+	var reloadSuccessWindow time.Duration
+	var slowReloadThreshold, reloadDebounce time.Duration
+	var reloadFreeze string
+	var transferSockets bool
+	var loadMaxAge time.Duration
+	var debugSyntheticNetfilter bool
+	var configPolicy string
+	var stopTimeout time.Duration
+	var approvalTTL time.Duration
+	var standbyConfig string
+	var standbyCheckInterval time.Duration
+	var approvalURL string
+	var reloadSysctls string
+	var reloadPreflight bool
+	var preflightReferences string
+	var syslogForward string
+	var syslogForwardTransport string
+	var syslogTransport string
+	var syslogTriggers string
+	var syslogTriggersInterval time.Duration
+	var accessLogFormat, accessLogFile string
+	var accessLogReferer, accessLogUserAgent int
+	var diagnosticsFile string
+	var reloadFailureGrace time.Duration
+	var coordinatorURL, coordinatorNode string
+	var coordinatorTimeout time.Duration
+	var latencyProbe bool
+	var latencyProbeObject string
+	var syslogForwardLimit SyslogForwardLimit
 	flag.UintVar(&syslogPort, "syslog-port", 514, "Port for embedded syslog server")
+	flag.StringVar(&syslogTransport, "syslog-transport", SyslogTransportUDP, "Transport where the embedded syslog server listens (one of: udp, tcp, both)")
+	flag.StringVar(&syslogForward, "syslog-forward", "", "Address of an upstream collector where syslog messages are forwarded")
+	flag.StringVar(&syslogForwardTransport, "syslog-forward-transport", SyslogForwardUDP, "Transport used to forward syslog messages to the upstream collector (one of: udp, tcp)")
+	flag.StringVar(&syslogTriggers, "syslog-triggers", "", "File with rules running an action when a received syslog message matches a pattern, as an action (one of: reload, alert) and a regular expression per line")
+	flag.DurationVar(&syslogTriggersInterval, "syslog-triggers-interval", time.Minute, "Minimum time between actions run by the same syslog trigger rule")
+	flag.Float64Var(&syslogForwardLimit.Rate, "syslog-forward-rate", 0, "Maximum number of syslog messages forwarded per second (default no limit)")
+	flag.IntVar(&syslogForwardLimit.Burst, "syslog-forward-burst", 100, "Burst of syslog messages forwarded over the rate limit")
+	flag.StringVar(&syslogForwardLimit.Policy, "syslog-forward-policy", SyslogForwardDrop, "What to do with syslog messages over the forwarding rate limit (one of: drop, buffer)")
+	flag.IntVar(&syslogForwardLimit.Buffer, "syslog-forward-buffer", 1000, "Number of syslog messages buffered to be forwarded, over the rate limit or while reconnecting to the collector")
+	flag.StringVar(&accessLogFormat, "access-log-format", "", "Export HTTP logs of haproxy in this format (one of: common, combined), other logs are written unchanged")
+	flag.StringVar(&accessLogFile, "access-log-file", "", "File where exported logs are appended (default standard output)")
+	flag.IntVar(&accessLogReferer, "access-log-referer-capture", 1, "Position of the captured request header with the referer, for the combined format")
+	flag.IntVar(&accessLogUserAgent, "access-log-user-agent-capture", 2, "Position of the captured request header with the user agent, for the combined format")
 	flag.StringVar(&haproxyPath, "haproxy", "/usr/local/sbin/haproxy", "Path to haproxy binary")
+	flag.StringVar(&binaryMismatch, "haproxy-binary-mismatch", BinaryMismatchWarn, "What to do on reloads when the version of the haproxy binary differs from the one that started the running haproxy (one of: warn, refuse), refused reloads are accepted again once the wrapper is restarted")
 	flag.StringVar(&haproxyPIDFile, "haproxy-pidfile", "/var/run/haproxy.pid", "Pidfile for haproxy")
-	flag.StringVar(&controlAddress, "control-address", "127.0.0.1:15000", "HTTP port for controller commands")
-	flag.StringVar(&haproxyConfigFile, "haproxy-config", "/usr/local/etc/haproxy/haproxy.cfg", "Path to configuration file for haproxy")
+	flag.StringVar(&controlAddress, "control-address", "127.0.0.1:15000", "HTTP port for controller commands, or abstract unix socket if it starts with @ (only in Linux)")
+	flag.StringVar(&controlToken, "control-token", "", "Bearer token required in protected controller endpoints")
+	flag.StringVar(&controlTLSCert, "control-tls-cert", "", "Certificate file to serve the controller with HTTPS, requires -control-tls-key")
+	flag.StringVar(&controlTLSKey, "control-tls-key", "", "Key file of the certificate to serve the controller with HTTPS, requires -control-tls-cert")
+	flag.StringVar(&controlTLSCA, "control-tls-ca", "", "CA file used to require and verify client certificates in the controller")
+	flag.StringVar(&haproxyConfigFiles, "haproxy-config", "/usr/local/etc/haproxy/haproxy.cfg", "Path to configuration file for haproxy, or comma-separated list of files and directories loaded in order, the first file loaded is the one managed by the controller")
 	flag.StringVar(&haproxyMode, "haproxy-mode", "master-worker", "Mode haproxy is expected to be running (one of: daemon, master-worker)")
+	flag.BoolVar(&restartOnCrash, "restart-on-crash", false, "Restart haproxy if it exits unexpectedly (only in master-worker mode)")
+	flag.IntVar(&restartMaxCrashes, "restart-max-crashes", 5, "Stop restarting haproxy after this number of crashes in the crash window")
+	flag.DurationVar(&restartCrashWindow, "restart-crash-window", 10*time.Minute, "Time window used to account crashes when restarting haproxy")
+	flag.IntVar(&restartMaxRetries, "restart-max-retries", 3, "Stop restarting haproxy after this number of consecutive failed restart attempts (0 for no limit)")
+	flag.StringVar(&configTemplate, "config-template", "", "Go template rendered with the environment variables into the configuration file at startup and before reloads when it changes, invalid results are not applied and uploads of configurations are refused")
+	flag.StringVar(&configTransforms, "config-transforms", "", "Comma-separated list of transforms applied in order to the configuration before reloads (available: global, stats-socket, default-timeouts, syslog)")
+	flag.StringVar(&transformGlobalFile, "transform-global-file", "", "File with the global section used by the global transform")
+	flag.StringVar(&transformStatsSocket, "transform-stats-socket", "", "Stats socket path and options enforced by the stats-socket transform")
+	flag.StringVar(&transformDefaultTimeouts, "transform-default-timeouts", "connect=5s,client=1m,server=1m", "Timeouts added to defaults if missing by the default-timeouts transform")
+	flag.StringVar(&statsSocket, "stats-socket", "", "Path to the haproxy stats socket, used by features requiring the runtime API")
+	flag.BoolVar(&allowSocketAdmin, "allow-socket-admin", false, "Allow commands that modify haproxy through the stats socket endpoint")
+	flag.DurationVar(&loadMaxAge, "frontend-load-max-age", 0, "Report the load of the frontends in /load and /metrics for autoscalers, reading it from the stats socket when older than this (default disabled)")
+	flag.BoolVar(&transferSockets, "transfer-sockets", false, "Transfer the listening sockets to new processes on reloads in master-worker mode with -x, using the stats socket, that needs to be declared with expose-fd listeners")
+	flag.DurationVar(&reloadWaitHealthy, "reload-wait-healthy", 0, "Time to wait after reloads for new and changed backends to have healthy servers (requires stats socket)")
+	flag.DurationVar(&reloadFailureGrace, "reload-failure-grace", 0, "Time /ready keeps reporting ready after a failed reload while haproxy is still running")
+	flag.StringVar(&eventSocket, "event-socket", "", "Unix datagram socket where events are sent as JSON lines after reloads")
+	flag.IntVar(&eventSocketBuffer, "event-socket-buffer", 0, "Number of events kept while the event socket is not available, older ones are dropped")
+	flag.BoolVar(&validationCache, "validation-cache", false, "Cache successful validations of configurations")
+	flag.Var(&redactPatterns, "redact-pattern", "Regular expression matching sensitive configuration values to mask in logs and responses, can be repeated (default: common secrets like passwords and keys)")
+	flag.BoolVar(&watchConfig, "watch-config", false, "Reload haproxy when the configuration file changes, if the new configuration is valid")
+	flag.DurationVar(&watchConfigInterval, "watch-config-interval", time.Second, "Interval between checks of changes in the configuration file")
+	flag.DurationVar(&watchConfigSettle, "watch-config-settle", 500*time.Millisecond, "Time the configuration files have to stay unchanged before reloading, so rapid successive writes cause a single reload")
+	flag.BoolVar(&watchConfigKubernetes, "watch-config-kubernetes", false, "Watch the configuration as a file of a mounted Kubernetes ConfigMap")
+	flag.StringVar(&reloadFreeze, "reload-freeze", "", "Comma-separated list of windows when automatic reloads are deferred until the window ends, as optional days and time range, e.g. \"mon-fri 18:00-08:00,sat,sun\"")
+	flag.DurationVar(&slowReloadThreshold, "slow-reload-threshold", 0, "Log reloads taking longer than this time with the time spent in each phase (default disabled)")
+	flag.DurationVar(&reloadDebounce, "reload-debounce", 0, "Coalesce reload requests received within this time of the previous one in a single reload, run once no more requests are received in this time (default disabled)")
+	flag.DurationVar(&reloadSuccessWindow, "reload-success-window", defaultReloadSuccessWindow, "Sliding window used to report the success rate of reloads in /metrics")
+	flag.IntVar(&configHistory, "config-history", 5, "Number of applied configurations kept in memory to annotate the lines of the configuration with the reloads that changed them and to roll back, zero to disable")
+	flag.StringVar(&configHistoryPath, "config-history-path", "", "Prefix of the files where applied configurations are kept, numbered from 1 for the newest one, so they survive restarts (default only kept in memory)")
+	flag.BoolVar(&debugSyntheticNetfilter, "debug-synthetic-netfilter", false, "Debug mode reporting stats of netfilter queues set in /debug/netfilter instead of the ones of the kernel, to test dashboards and alerts")
+	flag.StringVar(&configPolicy, "config-policy", "", "File with assertions the configuration must satisfy to be validated and applied")
+	flag.DurationVar(&approvalTTL, "reload-approval-ttl", 0, "Time validated configurations wait for their reload to be approved in /approval or by -reload-approval-url before being rejected, zero to reload without approval")
+	flag.StringVar(&approvalURL, "reload-approval-url", "", "URL receiving a POST request with the configuration pending approval, 2xx responses approve the reload and any other reject it")
+	flag.StringVar(&standbyConfig, "standby-config", "", "File where an alternate configuration uploaded to /config/standby is kept validated, to be promoted with /config/promote-standby")
+	flag.DurationVar(&standbyCheckInterval, "standby-check-interval", time.Minute, "Interval to check if the haproxy binary changed, to validate the standby configuration again")
+	flag.DurationVar(&stopTimeout, "stop-reload-timeout", defaultStopTimeout, "Time to wait on shutdown for reloads in progress before cancelling them")
+	flag.StringVar(&reloadSysctls, "reload-sysctls", "", "Comma-separated list of sysctls raised during reloads retaining connections, as name=value, e.g. net.core.somaxconn=65535 (one of: net.core.somaxconn, net.ipv4.tcp_max_syn_backlog, net.core.netdev_max_backlog)")
+	flag.BoolVar(&reloadPreflight, "reload-preflight", false, "Check that files referenced in the configuration can be read before reloading")
+	flag.StringVar(&preflightReferences, "preflight-directives", defaultPreflightReferences, "Comma-separated list of keywords followed by files checked by the reload preflight, as keyword[:position]")
+	flag.DurationVar(&drainRamp, "drain-ramp", defaultDrainRamp, "Time used by drains to reduce maxconn of frontends to zero")
+	flag.IntVar(&drainSteps, "drain-steps", defaultDrainSteps, "Number of steps used by drains to reduce maxconn of frontends")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 0, "Time to wait on shutdown for established connections to finish before stopping haproxy, new connections are retained or refused meanwhile")
+	flag.BoolVar(&latencyProbe, "reload-latency-probe", false, "Measure connection setup latency during reloads with an eBPF probe (requires a build with the ebpf tag)")
+	flag.StringVar(&latencyProbeObject, "reload-latency-probe-object", "/usr/local/lib/haproxy-docker-wrapper/reload_latency.o", "Compiled eBPF object used by the reload latency probe")
+	flag.StringVar(&diagnosticsFile, "diagnostics-file", "", "File where the diagnostics collected at startup are written as JSON")
+	flag.StringVar(&coordinatorURL, "reload-coordinator", "", "URL of an HTTP endpoint granting reload slots, to limit the number of nodes reloading at the same time")
+	flag.StringVar(&coordinatorNode, "reload-coordinator-node", "", "Name of the node sent to the reload coordinator (default hostname)")
+	flag.DurationVar(&coordinatorTimeout, "reload-coordinator-timeout", time.Minute, "Maximum time reloads wait for a slot from the reload coordinator")
+	flag.StringVar(&staticLabels, "labels", "", "Comma-separated list of static key=value labels added to all metrics and events")
 	flag.BoolVar(&showVersion, "version", false, "Show version")
+	flag.BoolVar(&printQueueRules, "queue-print-rules", false, "Print the iptables rules sending connections to the netfilter queue for -net-queue-ips, to manage them externally with -queue-external-rules, and exit")
 	flag.Parse()
+	if err := setLogFormat(logFormat, os.Stderr); err != nil {
+		log.Fatalf("Couldn't configure logs: %v", err)
+	}
 
 	if showVersion {
 		fmt.Println(version)
 		os.Exit(0)
 	}
+	if printQueueRules {
+		ips, err := ipArgs(netQueueIps)
+		if err != nil {
+			log.Fatalf("Expected comma-separated list of IPs: %v", err)
+		}
+		if err := PrintNetQueueRules(os.Stdout, nfQueueNumber, ips, netQueueOptionsFromFlags()); err != nil {
+			log.Fatalf("Couldn't print netfilter queue rules: %v", err)
+		}
+		os.Exit(0)
+	}
+	if err := validateQueueSize(netQueueMaxQueuedPackets); err != nil {
+		log.Fatalf("Couldn't configure netfilter queue: %v", err)
+	}
+	if netQueuePacketTimeout <= 0 {
+		log.Fatalf("Couldn't configure netfilter queue: packet timeout must be positive")
+	}
+	if err := validateQueueRange(nfQueueNumber, netQueueCount); err != nil {
+		log.Fatalf("Couldn't configure netfilter queue: %v", err)
+	}
+	if err := netQueueLimit.validate(); err != nil {
+		log.Fatalf("Couldn't configure netfilter queue: %v", err)
+	}
+	if err := validateMatch(netQueueMatch); err != nil {
+		log.Fatalf("Couldn't configure netfilter queue: %v", err)
+	}
+	if err := validateChains(chainArgs(netQueueChains)); err != nil {
+		log.Fatalf("Couldn't configure netfilter queue: %v", err)
+	}
+	if err := validateExtraMatch(strings.Fields(netQueueExtraMatch)); err != nil {
+		log.Fatalf("Couldn't configure netfilter queue: %v", err)
+	}
 
+	labels, err := parseKeyValues(staticLabels)
+	if err != nil {
+		log.Fatalf("Couldn't parse labels: %v", err)
+	}
+	metrics, err := NewRegistry(labels)
+	if err != nil {
+		log.Fatalf("Couldn't configure labels: %v", err)
+	}
+
+	if err := validateSyslogTransport(syslogTransport); err != nil {
+		log.Fatalf("Couldn't configure syslog server: %v", err)
+	}
 	syslog := NewSyslogServer(syslogPort)
+	syslog.Transport = syslogTransport
+	if syslogForward != "" {
+		forwarder, err := NewSyslogForwarder(syslogForward, syslogForwardLimit)
+		if err != nil {
+			log.Fatalf("Couldn't configure syslog forwarding: %v", err)
+		}
+		forwarder.Transport = syslogForwardTransport
+		syslog.Forwarder = forwarder
+		metrics.Register(forwarder)
+	}
+	if syslogTriggers != "" {
+		if syslogTriggersInterval <= 0 {
+			log.Fatalf("Couldn't configure syslog triggers: interval must be positive")
+		}
+		rules, err := LoadSyslogTriggers(syslogTriggers)
+		if err != nil {
+			log.Fatalf("Couldn't load syslog triggers: %v", err)
+		}
+		syslog.Triggers = NewSyslogTriggers(rules, syslogTriggersInterval)
+		metrics.Register(syslog.Triggers)
+	}
+	if accessLogFormat != "" {
+		out := os.Stdout
+		if accessLogFile != "" {
+			if out, err = os.OpenFile(accessLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+				log.Fatalf("Couldn't open access log file: %v", err)
+			}
+			defer out.Close()
+		}
+		if syslog.AccessLog, err = NewAccessLogExporter(accessLogFormat, accessLogReferer, accessLogUserAgent, out); err != nil {
+			log.Fatalf("Couldn't configure access log: %v", err)
+		}
+	}
 	if err := syslog.Start(); err != nil {
 		log.Fatalf("Couldn't start embedded syslog: %v\n", err)
 	}
 	defer syslog.Stop()
 
-	haproxy, err := NewHaproxyServer(haproxyPath, haproxyPIDFile, haproxyConfigFile, haproxyMode)
+	haproxyConfigFile, err := mainConfigFile(haproxyConfigFiles)
+	if err != nil {
+		log.Fatalf("Couldn't find configuration file: %v", err)
+	}
+
+	if len(redactPatterns) == 0 {
+		redactPatterns = defaultRedactPatterns
+	}
+	redactor, err := NewConfigRedactor(redactPatterns)
+	if err != nil {
+		log.Fatalf("Couldn't configure redaction: %v", err)
+	}
+
+	newValidator := func(configFile string) HaproxyConfigValidator {
+		return newMainValidator(haproxyPath, haproxyConfigFiles, haproxyConfigFile, configFile)
+	}
+
+	var template *ConfigTemplate
+	if configTemplate != "" {
+		template = NewConfigTemplate(configTemplate)
+		if err := template.RenderFile(haproxyConfigFile, newValidator); err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+
+	pipeline, err := newConfigPipelineFromFlags(configTransforms, transformGlobalFile, transformStatsSocket, transformDefaultTimeouts, syslogPort)
+	if err != nil {
+		log.Fatalf("Couldn't configure transforms: %v", err)
+	}
+	if err := pipeline.TransformFile(haproxyConfigFile); err != nil {
+		log.Printf("Couldn't transform configuration: %v\n", err)
+	}
+
+	transferSocket := ""
+	if transferSockets {
+		if statsSocket == "" {
+			log.Fatalf("Couldn't configure socket transfer: -transfer-sockets needs -stats-socket")
+		}
+		transferSocket = statsSocket
+	}
+	haproxy, err := NewHaproxyServer(haproxyPath, haproxyPIDFile, haproxyConfigFiles, haproxyMode, transferSocket)
 	if err != nil {
 		log.Fatalf("Couldn't start haproxy manager: %v", err)
 	}
+	var supervisor *HaproxySupervisor
+	if restartOnCrash {
+		supervisor, err = NewHaproxySupervisor(haproxy, restartMaxCrashes, restartCrashWindow)
+		if err != nil {
+			log.Fatalf("Couldn't start haproxy supervisor: %v", err)
+		}
+		supervisor.MaxRetries = restartMaxRetries
+		haproxy = supervisor
+	}
+	if err := validateBinaryMismatch(binaryMismatch); err != nil {
+		log.Fatalf("Couldn't configure haproxy: %v", err)
+	}
+	binaryVersions := NewBinaryVersions(haproxyPath, binaryMismatch)
+	startFailed := false
 	if err := haproxy.Start(); err != nil {
+		startFailed = true
 		log.Println("Couldn't start haproxy: ", err)
 		log.Println("Will wait for valid configuration")
 		go func() {
@@ -82,20 +370,201 @@ func main() {
 	}
 	defer haproxy.Stop()
 
-	done := make(chan os.Signal)
+	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGTERM, syscall.SIGINT)
 
-	validator := NewHaproxyDashC(haproxyPath, haproxyConfigFile)
-	controller := NewController(controlAddress, haproxy, validator)
+	var validator HaproxyConfigValidator = NewHaproxyDashC(haproxyPath, haproxyConfigFiles)
+	var cache *ValidationCache
+	if validationCache {
+		cache = NewValidationCache(validator, haproxyPath, haproxyConfigFiles)
+		validator = cache
+	}
+	controller := NewController(controlAddress, haproxyConfigFile, haproxy, validator)
+	controller.ValidationCache = cache
+	if supervisor != nil {
+		supervisor.BeforeRestart = func() error {
+			binaryVersions.Started()
+			return controller.restoreAppliedConfig()
+		}
+	}
+	controller.Token = controlToken
+	if controller.TLS, err = controlTLSConfig(controlTLSCert, controlTLSKey, controlTLSCA); err != nil {
+		log.Fatalf("Couldn't configure controller TLS: %v", err)
+	}
+	if loadMaxAge > 0 {
+		if statsSocket == "" {
+			log.Fatalf("Couldn't configure load of frontends: -frontend-load-max-age needs -stats-socket")
+		}
+		controller.Load = NewLoadCache(NewStatsSocket(statsSocket), loadMaxAge)
+	}
+	if statsSocket != "" {
+		controller.StatsSocket = NewStatsSocket(statsSocket)
+		controller.AllowSocketAdmin = allowSocketAdmin
+	}
+	controller.WaitHealthyTimeout = reloadWaitHealthy
+	controller.ReloadFailureGrace = reloadFailureGrace
+	controller.Mode = haproxyMode
+	controller.StartFailed = startFailed
+	controller.Binary = binaryVersions
+	if !startFailed {
+		binaryVersions.Started()
+	}
+	if reloadPreflight {
+		references, err := parseFileReferences(preflightReferences)
+		if err != nil {
+			log.Fatalf("Couldn't configure preflight: %v", err)
+		}
+		controller.Preflight = NewPreflight(references)
+	}
+	if configPolicy != "" {
+		if controller.Policy, err = LoadPolicy(configPolicy); err != nil {
+			log.Fatalf("Couldn't load configuration policy: %v", err)
+		}
+	}
+	if approvalTTL > 0 {
+		controller.Approval = NewApprovalGate(approvalTTL, approvalURL)
+	} else if approvalURL != "" {
+		log.Fatalf("Couldn't configure reload approval: -reload-approval-url requires -reload-approval-ttl")
+	}
+	if standbyConfig != "" {
+		controller.Standby = NewStandbyConfig(standbyConfig, haproxyPath, newMainValidator(haproxyPath, haproxyConfigFiles, haproxyConfigFile, standbyConfig))
+		go controller.Standby.Run(standbyCheckInterval)
+		defer controller.Standby.Stop()
+	}
+	controller.StopTimeout = stopTimeout
+	controller.ReloadSuccessWindow = reloadSuccessWindow
+	controller.SlowReloadThreshold = slowReloadThreshold
+	controller.ReloadDebounce = reloadDebounce
+	if reloadFreeze != "" {
+		windows, err := ParseFreezeSchedule(reloadFreeze)
+		if err != nil {
+			log.Fatalf("Couldn't configure reload freeze: %v", err)
+		}
+		controller.Freeze = NewReloadFreeze(windows)
+		defer controller.Freeze.Stop()
+	}
+	controller.NewValidator = newValidator
+	if controller.ReloadSysctls, err = parseReloadSysctls(reloadSysctls); err != nil {
+		log.Fatalf("Couldn't configure reload sysctls: %v", err)
+	}
+	controller.DrainRamp = drainRamp
+	controller.DrainSteps = drainSteps
+	if eventSocket != "" {
+		controller.EventSocket = NewEventSocket(eventSocket, eventSocketBuffer)
+		controller.EventSocket.Labels = labels
+	}
+	controller.ConfigFiles = haproxyConfigFiles
+	controller.Template = template
+	controller.Pipeline = pipeline
+	if configHistory > 0 {
+		controller.History = NewConfigHistory(configHistory)
+		if configHistoryPath != "" {
+			if err := controller.History.Persist(configHistoryPath); err != nil {
+				log.Fatalf("Couldn't load configuration history: %v", err)
+			}
+		}
+		if content, err := ioutil.ReadFile(haproxyConfigFile); err == nil {
+			controller.History.Add(content, "startup")
+		}
+	}
+	controller.Redactor = redactor
+	if haproxyMode == "daemon" && netQueueIps != "" {
+		controller.NetQueues = queueNumbers(nfQueueNumber, netQueueCount)
+		if err := checkNetAdmin(); err != nil {
+			controller.CaptureDisabled = err.Error()
+		}
+		controller.KernelLimits = CheckKernelLimits(int(netQueueMaxQueuedPackets), netQueueMatch)
+		for name, err := range controller.KernelLimits.Unavailable {
+			log.Printf("Couldn't read %s: %s\n", name, err)
+		}
+		for _, warning := range controller.KernelLimits.Warnings {
+			log.Printf("Warning: %s\n", warning)
+		}
+	}
+	if debugSyntheticNetfilter {
+		log.Println("Warning: reporting synthetic stats of netfilter queues, this mode is only meant for debugging")
+		controller.SyntheticNetfilter = NewSyntheticNetfilter()
+		controller.NetQueues = queueNumbers(nfQueueNumber, netQueueCount)
+	}
+	if coordinatorURL != "" {
+		if coordinatorNode == "" {
+			if coordinatorNode, err = os.Hostname(); err != nil {
+				log.Fatalf("Couldn't obtain node name for reload coordinator: %v", err)
+			}
+		}
+		controller.Coordinator = NewHTTPReloadCoordinator(coordinatorURL, coordinatorNode)
+		controller.CoordinationTimeout = coordinatorTimeout
+	}
+	controller.Compatibility = NewCompatibilityChecker(haproxyPath, CompatibilityTable)
+	controller.Metrics = metrics
+	if notifier, ok := haproxy.(CaptureEventNotifier); ok {
+		notifier.NotifyCaptureEvents(controller.CaptureEvent)
+	}
+	metrics.Register(controller)
+	if syslog.Triggers != nil {
+		syslog.Triggers.Handle(SyslogActionReload, func(string) {
+			if outcome := controller.autoReload(reloadRequest{validate: true, actor: "syslog-trigger"}); outcome != nil && !outcome.Success {
+				log.Printf("Couldn't reload: %v\n", outcome.Error)
+			}
+		})
+		syslog.Triggers.Handle(SyslogActionAlert, func(message string) {
+			log.Printf("Alert: %s\n", message)
+			controller.EventSocket.Emit(syslogTriggerEvent{Event: "syslog-alert", Message: message})
+		})
+	}
+	if latencyProbe {
+		probe, err := NewLatencyProbe(latencyProbeObject)
+		if err != nil {
+			log.Printf("Reload latency probe not available: %v\n", err)
+		} else {
+			controller.LatencyProbe = probe
+			metrics.Register(&latencyProbeCollector{probe})
+			defer probe.Close()
+		}
+	}
 
-	go func() {
-		for {
-			log.Printf("Signal received: %v\n", <-done)
-			if err := controller.Stop(); err != nil {
-				log.Fatalf("Couldn't cleanly stop controller: %v", err)
+	var diagnosticsIPs []net.IP
+	if haproxyMode == "daemon" {
+		if diagnosticsIPs, err = ipArgs(netQueueIps); err != nil {
+			log.Printf("Couldn't parse net queue IPs for diagnostics: %v\n", err)
+		}
+	}
+	controller.VersionInfo = CollectVersionInfo(haproxyPath)
+	controller.Diagnostics = controller.CollectDiagnostics(flag.CommandLine, diagnosticsIPs, netQueueOptionsFromFlags())
+	if diagnosticsFile != "" {
+		if err := controller.Diagnostics.WriteFile(diagnosticsFile); err != nil {
+			log.Printf("Couldn't write diagnostics: %v\n", err)
+		}
+	}
+
+	if watchConfig {
+		watcher := NewConfigWatcher(haproxyConfigFiles, watchConfigInterval, watchConfigKubernetes)
+		watcher.Settle = watchConfigSettle
+		go watcher.Watch(func() {
+			if outcome := controller.autoReload(reloadRequest{validate: true, actor: "watch-config"}); outcome != nil && !outcome.Success {
+				log.Printf("Couldn't reload changed configuration: %v\n", outcome.Error)
+			}
+		})
+		defer watcher.Stop()
+	}
+
+	if drainTimeout > 0 && statsSocket == "" {
+		log.Println("Warning: -drain-timeout without -stats-socket, established connections cannot be checked on shutdown")
+	}
+
+	go handleTermination(done, func() {
+		if drainTimeout > 0 {
+			if err := controller.Shutdown(drainTimeout); err != nil {
+				log.Printf("Couldn't cleanly shutdown haproxy: %v\n", err)
 			}
 		}
-	}()
+		if err := controller.Stop(); err != nil {
+			log.Fatalf("Couldn't cleanly stop controller: %v", err)
+		}
+	}, func() {
+		CleanupNetQueues()
+		os.Exit(1)
+	})
 
 	if err := controller.Run(); err != nil {
 		log.Fatalf("Controller failed: %v\n", err)
@@ -0,0 +1,390 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const metricsNamespace = "haproxy_wrapper"
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// LabelPair is a label of a metric sample.
+type LabelPair struct {
+	Name, Value string
+}
+
+// Sample is a value of a metric, suffix is used by metrics exposed with
+// multiple series, as histograms.
+type Sample struct {
+	Suffix string
+	Labels []LabelPair
+	Value  float64
+}
+
+// MetricFamily is a metric with all its samples.
+type MetricFamily struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+// A Collector provides metrics when they are requested.
+type Collector interface {
+	Collect() []MetricFamily
+}
+
+// CollectorFunc is a function used as Collector.
+type CollectorFunc func() []MetricFamily
+
+func (f CollectorFunc) Collect() []MetricFamily {
+	return f()
+}
+
+// Registry keeps collectors of metrics and exposes them in the Prometheus
+// text format. Static labels are added to all the metrics exposed.
+type Registry struct {
+	sync.Mutex
+	labels     []LabelPair
+	collectors []Collector
+}
+
+// NewRegistry creates a registry that adds the given labels to all metrics.
+func NewRegistry(labels map[string]string) (*Registry, error) {
+	r := &Registry{}
+	for _, name := range sortedKeys(labels) {
+		if err := validateLabelName(name); err != nil {
+			return nil, err
+		}
+		r.labels = append(r.labels, LabelPair{Name: name, Value: labels[name]})
+	}
+	return r, nil
+}
+
+func validateLabelName(name string) error {
+	if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid label name: %q", name)
+	}
+	return nil
+}
+
+// Labels returns the static labels of the registry.
+func (r *Registry) Labels() map[string]string {
+	if r == nil {
+		return nil
+	}
+	labels := make(map[string]string)
+	for _, l := range r.labels {
+		labels[l.Name] = l.Value
+	}
+	return labels
+}
+
+func (r *Registry) Register(c Collector) {
+	r.Lock()
+	defer r.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Gather collects all the metrics, sorted by name.
+func (r *Registry) Gather() []MetricFamily {
+	r.Lock()
+	collectors := append([]Collector{}, r.collectors...)
+	r.Unlock()
+
+	var families []MetricFamily
+	for _, c := range collectors {
+		for _, f := range c.Collect() {
+			for i := range f.Samples {
+				f.Samples[i].Labels = append(append([]LabelPair{}, r.labels...), f.Samples[i].Labels...)
+			}
+			families = append(families, f)
+		}
+	}
+	sort.SliceStable(families, func(i, j int) bool {
+		return families[i].Name < families[j].Name
+	})
+	return families
+}
+
+// WriteText writes the metrics in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	var buf bytes.Buffer
+	for _, f := range r.Gather() {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", f.Name, escapeHelp(f.Help))
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", f.Name, f.Type)
+		for _, s := range f.Samples {
+			buf.WriteString(f.Name + s.Suffix)
+			if len(s.Labels) > 0 {
+				pairs := make([]string, len(s.Labels))
+				for i, l := range s.Labels {
+					pairs[i] = l.Name + `="` + escapeLabelValue(l.Value) + `"`
+				}
+				buf.WriteString("{" + strings.Join(pairs, ",") + "}")
+			}
+			buf.WriteString(" " + formatMetricValue(s.Value) + "\n")
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := r.WriteText(w); err != nil {
+		log.Printf("Couldn't write metrics: %v\n", err)
+	}
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricVec keeps samples of a metric with a value per combination of labels.
+type metricVec struct {
+	sync.Mutex
+	name, help, typ string
+	labelNames      []string
+	values          map[string]*Sample
+}
+
+func newMetricVec(typ, name, help string, labelNames []string) *metricVec {
+	return &metricVec{
+		name:       metricsNamespace + "_" + name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		values:     make(map[string]*Sample),
+	}
+}
+
+func (v *metricVec) sample(labelValues []string) *Sample {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("%s: expected %d label values, found %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, found := v.values[key]
+	if !found {
+		s = &Sample{}
+		for i, name := range v.labelNames {
+			s.Labels = append(s.Labels, LabelPair{Name: name, Value: labelValues[i]})
+		}
+		v.values[key] = s
+	}
+	return s
+}
+
+func (v *metricVec) add(delta float64, labelValues []string) {
+	v.Lock()
+	defer v.Unlock()
+	v.sample(labelValues).Value += delta
+}
+
+func (v *metricVec) set(value float64, labelValues []string) {
+	v.Lock()
+	defer v.Unlock()
+	v.sample(labelValues).Value = value
+}
+
+// reset sets all the values to zero, keeping the label combinations seen.
+func (v *metricVec) reset() {
+	v.Lock()
+	defer v.Unlock()
+	for _, s := range v.values {
+		s.Value = 0
+	}
+}
+
+func (v *metricVec) Collect() []MetricFamily {
+	v.Lock()
+	defer v.Unlock()
+	f := MetricFamily{Name: v.name, Help: v.help, Type: v.typ}
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := *v.values[k]
+		s.Labels = append([]LabelPair{}, s.Labels...)
+		f.Samples = append(f.Samples, s)
+	}
+	return []MetricFamily{f}
+}
+
+// CounterVec is a counter with a value per combination of labels.
+type CounterVec struct {
+	*metricVec
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{newMetricVec("counter", name, help, labelNames)}
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("counters cannot decrease")
+	}
+	c.add(delta, labelValues)
+}
+
+// GaugeVec is a gauge with a value per combination of labels.
+type GaugeVec struct {
+	*metricVec
+}
+
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{newMetricVec("gauge", name, help, labelNames)}
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.set(value, labelValues)
+}
+
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.add(delta, labelValues)
+}
+
+// Upper bounds of the buckets of histograms of durations of reloads, in
+// seconds
+var reloadDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// HistogramVec is an histogram with a series per combination of labels.
+type HistogramVec struct {
+	sync.Mutex
+	name, help string
+	buckets    []float64
+	labelNames []string
+	values     map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []LabelPair
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec creates an histogram with the given upper bounds of its
+// buckets, in increasing order.
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{
+		name:       metricsNamespace + "_" + name,
+		help:       help,
+		buckets:    buckets,
+		labelNames: labelNames,
+		values:     make(map[string]*histogramValue),
+	}
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	if len(labelValues) != len(h.labelNames) {
+		panic(fmt.Sprintf("%s: expected %d label values, found %d", h.name, len(h.labelNames), len(labelValues)))
+	}
+	h.Lock()
+	defer h.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	v, found := h.values[key]
+	if !found {
+		v = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		for i, name := range h.labelNames {
+			v.labels = append(v.labels, LabelPair{Name: name, Value: labelValues[i]})
+		}
+		h.values[key] = v
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+	v.sum += value
+	v.count++
+}
+
+func (h *HistogramVec) Collect() []MetricFamily {
+	h.Lock()
+	defer h.Unlock()
+	f := MetricFamily{Name: h.name, Help: h.help, Type: "histogram"}
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := h.values[k]
+		bucket := func(le string, n uint64) Sample {
+			labels := append(append([]LabelPair{}, v.labels...), LabelPair{Name: "le", Value: le})
+			return Sample{Suffix: "_bucket", Labels: labels, Value: float64(n)}
+		}
+		for i, bound := range h.buckets {
+			f.Samples = append(f.Samples, bucket(formatMetricValue(bound), v.counts[i]))
+		}
+		f.Samples = append(f.Samples,
+			bucket("+Inf", v.count),
+			Sample{Suffix: "_sum", Labels: append([]LabelPair{}, v.labels...), Value: v.sum},
+			Sample{Suffix: "_count", Labels: append([]LabelPair{}, v.labels...), Value: float64(v.count)},
+		)
+	}
+	return []MetricFamily{f}
+}
+
+// gaugeFamily builds a family for a gauge with a single sample.
+func gaugeFamily(name, help string, value float64) MetricFamily {
+	return MetricFamily{
+		Name:    metricsNamespace + "_" + name,
+		Help:    help,
+		Type:    "gauge",
+		Samples: []Sample{{Value: value}},
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,158 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryLabelValidation(t *testing.T) {
+	cases := map[string]bool{
+		"region":   true,
+		"_cluster": true,
+		"zone_2":   true,
+		"2zone":    false,
+		"__name":   false,
+		"re-gion":  false,
+		"":         false,
+	}
+	for name, valid := range cases {
+		_, err := NewRegistry(map[string]string{name: "value"})
+		if valid && err != nil {
+			t.Errorf("label %q should be valid: %v", name, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("label %q should be invalid", name)
+		}
+	}
+}
+
+func TestRegistryStaticLabels(t *testing.T) {
+	r, err := NewRegistry(map[string]string{"region": "eu", "cluster": "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := NewCounterVec("things_total", "Number of things", "kind")
+	counter.Inc("a")
+	counter.Add(2, "b\"")
+	r.Register(counter)
+	r.Register(CollectorFunc(func() []MetricFamily {
+		return []MetricFamily{gaugeFamily("up", "Whether it is up", 1)}
+	}))
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP haproxy_wrapper_things_total Number of things
+# TYPE haproxy_wrapper_things_total counter
+haproxy_wrapper_things_total{cluster="prod",region="eu",kind="a"} 1
+haproxy_wrapper_things_total{cluster="prod",region="eu",kind="b\""} 2
+# HELP haproxy_wrapper_up Whether it is up
+# TYPE haproxy_wrapper_up gauge
+haproxy_wrapper_up{cluster="prod",region="eu"} 1
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected metrics:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestControllerMetrics(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	haproxy := &fakeHaproxy{running: true}
+	c := NewController("", config, haproxy, &fakeValidator{})
+	c.Metrics, _ = NewRegistry(map[string]string{"region": "eu"})
+	c.Metrics.Register(c)
+	c.Reload()
+
+	rec := httptest.NewRecorder()
+	c.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`haproxy_wrapper_reloads_total{region="eu",result="success",phase=""} 1`,
+		`haproxy_wrapper_haproxy_up{region="eu"} 1`,
+		`haproxy_wrapper_reload_success_rate{region="eu"} 1`,
+		`haproxy_wrapper_reload_window_successes{region="eu"} 1`,
+		`haproxy_wrapper_reload_window_failures{region="eu"} 0`,
+		`haproxy_wrapper_reload_duration_seconds_count{region="eu",result="success"} 1`,
+		`haproxy_wrapper_reload_phase_duration_seconds_count{region="eu",phase="reload"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("metric %q not found in:\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("duration_seconds", "Duration of things", []float64{0.5, 1}, "result")
+	h.Observe(0.2, "success")
+	h.Observe(0.7, "success")
+	h.Observe(3, "failure")
+
+	r, _ := NewRegistry(nil)
+	r.Register(h)
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP haproxy_wrapper_duration_seconds Duration of things
+# TYPE haproxy_wrapper_duration_seconds histogram
+haproxy_wrapper_duration_seconds_bucket{result="failure",le="0.5"} 0
+haproxy_wrapper_duration_seconds_bucket{result="failure",le="1"} 0
+haproxy_wrapper_duration_seconds_bucket{result="failure",le="+Inf"} 1
+haproxy_wrapper_duration_seconds_sum{result="failure"} 3
+haproxy_wrapper_duration_seconds_count{result="failure"} 1
+haproxy_wrapper_duration_seconds_bucket{result="success",le="0.5"} 1
+haproxy_wrapper_duration_seconds_bucket{result="success",le="1"} 2
+haproxy_wrapper_duration_seconds_bucket{result="success",le="+Inf"} 2
+haproxy_wrapper_duration_seconds_sum{result="success"} 0.8999999999999999
+haproxy_wrapper_duration_seconds_count{result="success"} 2
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected metrics:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestControllerCaptureDurations(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{running: true}, &fakeValidator{})
+
+	start := time.Now()
+	c.CaptureEvent(CaptureEvent{Event: "capture", State: CaptureRequested, Time: start, ReloadID: 1})
+	c.CaptureEvent(CaptureEvent{Event: "capture", State: CapturingActive, Time: start.Add(time.Second), ReloadID: 1})
+	c.CaptureEvent(CaptureEvent{Event: "capture", State: CaptureRequested, Time: start, ReloadID: 2})
+	c.CaptureEvent(CaptureEvent{Event: "capture", State: CaptureRequested, Time: start, ReloadID: 3})
+	c.CaptureEvent(CaptureEvent{Event: "capture", State: CaptureFailed, Time: start.Add(time.Second), ReloadID: 2})
+
+	var counts []string
+	for _, s := range c.phaseDurations.Collect()[0].Samples {
+		if s.Suffix == "_count" {
+			counts = append(counts, fmt.Sprintf("%s=%v", s.Labels[0].Value, s.Value))
+		}
+	}
+	if strings.Join(counts, ",") != "capture=2" {
+		t.Fatalf("found phase durations %v, expected 2 captures", counts)
+	}
+	if len(c.captureStarts) != 0 {
+		t.Fatalf("found %d captures still timed", len(c.captureStarts))
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// SyntheticNetfilter provides stats of netfilter queues set through the
+// controller instead of the ones reported by the kernel, so dashboards and
+// alerts can be tested with simulated drops. It is only meant for debugging,
+// stats are only replaced in /status and /metrics, captures keep using the
+// real ones.
+type SyntheticNetfilter struct {
+	sync.Mutex
+	queues map[uint]ProcNetfilterQueue
+}
+
+func NewSyntheticNetfilter() *SyntheticNetfilter {
+	return &SyntheticNetfilter{queues: make(map[uint]ProcNetfilterQueue)}
+}
+
+// Set replaces the stats of all queues.
+func (s *SyntheticNetfilter) Set(queues []ProcNetfilterQueue) {
+	s.Lock()
+	defer s.Unlock()
+	s.queues = make(map[uint]ProcNetfilterQueue)
+	for _, q := range queues {
+		s.queues[q.ID] = q
+	}
+}
+
+// Queues returns the stats of the queues, sorted by ID.
+func (s *SyntheticNetfilter) Queues() []ProcNetfilterQueue {
+	s.Lock()
+	defer s.Unlock()
+	queues := make([]ProcNetfilterQueue, 0, len(s.queues))
+	for _, q := range s.queues {
+		queues = append(queues, q)
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].ID < queues[j].ID })
+	return queues
+}
+
+// Read parses the stats as if they were read from the proc file, so they
+// are reported the same way as the real ones.
+func (s *SyntheticNetfilter) Read() (*ProcNetfilter, error) {
+	var buf bytes.Buffer
+	for _, q := range s.Queues() {
+		fmt.Fprintf(&buf, "%d %d %d %d %d %d %d %d %d\n",
+			q.ID, q.PortID, q.Waiting, q.CopyMode, q.CopyRange, q.QueueDropped, q.UserDropped, q.LastSeq, q.One)
+	}
+	pn := &ProcNetfilter{queues: make(map[uint]ProcNetfilterQueue)}
+	if buf.Len() == 0 {
+		return pn, nil
+	}
+	if err := pn.read(&buf); err != nil {
+		return nil, err
+	}
+	return pn, nil
+}
+
+// readNetfilter reads the stats of the netfilter queues, synthetic ones if
+// enabled.
+func (c *Controller) readNetfilter() (*ProcNetfilter, error) {
+	if c.SyntheticNetfilter != nil {
+		return c.SyntheticNetfilter.Read()
+	}
+	return ReadProcNetfilter()
+}
+
+// syntheticNetfilter shows the synthetic stats of netfilter queues, or
+// replaces them on PUT requests with the queues in the body.
+func (c *Controller) syntheticNetfilter(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !c.authorize(w, req) {
+			return
+		}
+		var queues []ProcNetfilterQueue
+		if err := json.NewDecoder(req.Body).Decode(&queues); err != nil {
+			http.Error(w, fmt.Sprintf("Couldn't parse queues: %v\n", err), http.StatusBadRequest)
+			return
+		}
+		c.SyntheticNetfilter.Set(queues)
+	default:
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, c.SyntheticNetfilter.Queues())
+}
+
+// netfilterQueuesReport contains the stats of all the netfilter queues in
+// the kernel, and the ones configured to retain connections.
+type netfilterQueuesReport struct {
+	Configured []uint                      `json:"configured"`
+	Missing    []uint                      `json:"missing,omitempty"`
+	Queues     map[uint]ProcNetfilterQueue `json:"queues"`
+}
+
+// queues shows the stats of the netfilter queues, read again on each request.
+func (c *Controller) queues(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	procNf, err := c.readNetfilter()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Couldn't read netfilter queues: %v\n", err), http.StatusServiceUnavailable)
+		return
+	}
+	report := netfilterQueuesReport{Configured: c.NetQueues, Queues: procNf.Queues()}
+	if report.Configured == nil {
+		report.Configured = []uint{}
+	}
+	for _, id := range c.NetQueues {
+		if _, found := report.Queues[id]; !found {
+			report.Missing = append(report.Missing, id)
+		}
+	}
+	writeJSON(w, report)
+}
+
+// netQueuesMetrics exposes the stats of the netfilter queues used to retain
+// connections, queues not found are not reported.
+func (c *Controller) netQueuesMetrics() []MetricFamily {
+	if len(c.NetQueues) == 0 {
+		return nil
+	}
+	procNf, err := c.readNetfilter()
+	if err != nil {
+		log.Printf("Couldn't read netfilter queue stats: %v\n", err)
+		return nil
+	}
+	waiting := NewGaugeVec("netfilter_queue_waiting", "Number of packets waiting in the netfilter queue", "queue")
+	dropped := NewGaugeVec("netfilter_queue_dropped", "Number of packets dropped by the kernel because the netfilter queue was full", "queue")
+	userDropped := NewGaugeVec("netfilter_queue_user_dropped", "Number of packets dropped by the kernel before reaching user space", "queue")
+	copyMode := NewGaugeVec("netfilter_queue_copy_mode", "Copy mode of the netfilter queue, 0 for none, 1 for metadata and 2 for packets", "queue")
+	for _, id := range c.NetQueues {
+		q, found := procNf.Get(id)
+		if !found {
+			continue
+		}
+		queue := fmt.Sprintf("%d", id)
+		waiting.Set(float64(q.Waiting), queue)
+		dropped.Set(float64(q.QueueDropped), queue)
+		userDropped.Set(float64(q.UserDropped), queue)
+		copyMode.Set(float64(q.CopyMode), queue)
+	}
+	families := append(waiting.Collect(), dropped.Collect()...)
+	families = append(families, userDropped.Collect()...)
+	return append(families, copyMode.Collect()...)
+}
@@ -0,0 +1,139 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSyntheticNetfilterMetrics(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{running: true}, &fakeValidator{})
+	c.Metrics, _ = NewRegistry(nil)
+	c.Metrics.Register(c)
+	c.NetQueues = []uint{3}
+	c.SyntheticNetfilter = NewSyntheticNetfilter()
+	c.Token = "secret"
+
+	body := `[{"ID": 3, "Waiting": 12, "QueueDropped": 150, "UserDropped": 7, "CopyMode": 2}, {"ID": 4, "QueueDropped": 1}]`
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("PUT", "/debug/netfilter", strings.NewReader(body)))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized request, found %d", w.Code)
+	}
+	req := httptest.NewRequest("PUT", "/debug/netfilter", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := w.Body.String()
+	for _, line := range []string{
+		`haproxy_wrapper_netfilter_queue_waiting{queue="3"} 12`,
+		`haproxy_wrapper_netfilter_queue_dropped{queue="3"} 150`,
+		`haproxy_wrapper_netfilter_queue_user_dropped{queue="3"} 7`,
+		`haproxy_wrapper_netfilter_queue_copy_mode{queue="3"} 2`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("metric %q not found in:\n%s", line, metrics)
+		}
+	}
+	if strings.Contains(metrics, `queue="4"`) {
+		t.Errorf("queue not used by the wrapper found in:\n%s", metrics)
+	}
+
+	status := getStatus(t, c)
+	queues, _ := status["net_queues"]["queues"].([]interface{})
+	if len(queues) != 1 || queues[0].(map[string]interface{})["QueueDropped"] != float64(150) {
+		t.Errorf("synthetic queues not found in status: %v", status["net_queues"])
+	}
+
+	// Missing queues disappear
+	req = httptest.NewRequest("PUT", "/debug/netfilter", strings.NewReader("[]"))
+	req.Header.Set("Authorization", "Bearer secret")
+	c.handler().ServeHTTP(httptest.NewRecorder(), req)
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(w.Body.String(), `queue="3"`) {
+		t.Errorf("removed queue found in:\n%s", w.Body.String())
+	}
+}
+
+func TestNetfilterQueuesEndpoint(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{running: true}, &fakeValidator{})
+	c.NetQueues = []uint{3, 5}
+	c.SyntheticNetfilter = NewSyntheticNetfilter()
+	c.SyntheticNetfilter.Set([]ProcNetfilterQueue{{ID: 3, Waiting: 12, QueueDropped: 150}, {ID: 4}})
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/queues", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var report netfilterQueuesReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Configured, []uint{3, 5}) || !reflect.DeepEqual(report.Missing, []uint{5}) {
+		t.Errorf("unexpected configured queues %v, missing %v", report.Configured, report.Missing)
+	}
+	if len(report.Queues) != 2 || report.Queues[3].Waiting != 12 || report.Queues[3].QueueDropped != 150 {
+		t.Errorf("unexpected queues: %+v", report.Queues)
+	}
+
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/queues", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected method not allowed, found %d", w.Code)
+	}
+}
+
+func TestSyntheticNetfilterDisabled(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("PUT", "/debug/netfilter", strings.NewReader("[]")))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected debug endpoint not available, found %d", w.Code)
+	}
+}
+
+func TestSyntheticNetfilterInvalidBody(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+	c.SyntheticNetfilter = NewSyntheticNetfilter()
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("PUT", "/debug/netfilter", strings.NewReader("{")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected bad request, found %d", w.Code)
+	}
+}
@@ -15,13 +15,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"os"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -31,16 +37,130 @@ import (
 	nfqueue "github.com/tuenti/go-netfilter-queue"
 )
 
+var netQueueLimit NetQueueLimit
+var netQueueNetworking string
+var netQueueChains string
+var netQueueExtraMatch string
+var netQueueMatch string
+var netQueueWorkers int
+var netQueueCount int
+var netQueueHold NetQueueHold
+var netQueueExternalRules bool
+
+var netQueueMaxQueuedPackets uint
+var netQueuePacketTimeout time.Duration
+var netQueueMaxDrops uint
+var iptablesTimeout time.Duration
+
 func init() {
-	nfqueue.PacketReceiveTimeout = 10 * time.Millisecond
+	flag.UintVar(&netQueueMaxQueuedPackets, "max-queued-packets", defaultMaxQueuedPackets, "Maximum number of packets retained in the netfilter queue during reloads, packets over this size are dropped by the kernel")
+	flag.UintVar(&netQueueMaxDrops, "max-queue-drops", 0, "Maximum number of packets dropped by the kernel during a capture because the queue is full, over it new connections stop being retained until the end of the reload (default unlimited)")
+	flag.DurationVar(&netQueuePacketTimeout, "packet-timeout", defaultPacketTimeout, "Time packets received in the netfilter queue wait to be read by the wrapper before being dropped")
+	flag.StringVar(&netQueueLimit.Rate, "net-queue-limit", "", "Maximum rate of new connections retained during reloads, e.g. 100/second (default no limit)")
+	flag.UintVar(&netQueueLimit.Burst, "net-queue-limit-burst", 5, "Burst of new connections allowed over the retention rate limit")
+	flag.BoolVar(&netQueueLimit.PerSource, "net-queue-limit-per-source", false, "Apply the retention rate limit per source address")
+	flag.BoolVar(&netQueueLimit.Drop, "net-queue-limit-drop", false, "Drop new connections over the retention rate limit instead of accepting them")
+	flag.IntVar(&netQueueCount, "num-queues", 1, "Number of consecutive netfilter queues, starting at -nf-queue-number, new connections are balanced across them with --queue-balance")
+	flag.IntVar(&netQueueWorkers, "net-queue-workers", 1, "Number of goroutines accepting retained connections on release")
+	flag.DurationVar(&netQueueHold.Min, "net-queue-hold-min", 100*time.Millisecond, "Minimum time connections are retained during reloads before being accepted, when -net-queue-hold-max is set")
+	flag.DurationVar(&netQueueHold.Max, "net-queue-hold-max", 0, "Maximum time connections are retained during reloads before being accepted, the timeout adapts to the duration of reloads and all the connections retained are accepted each time it passes (default retained until the end of the reload)")
+	flag.StringVar(&netQueueMatch, "net-queue-match", NetQueueMatchSyn, "Strategy to match new connections to retain (one of: syn, conntrack)")
+	flag.StringVar(&netQueueNetworking, "net-queue-networking", NetworkingAuto, "Networking of haproxy, defining the chain where connections are retained (one of: auto, host, bridge)")
+	flag.StringVar(&netQueueExtraMatch, "capture-match", "", "Additional iptables match arguments of the rules retaining connections, e.g. \"--dport 443\"")
+	flag.StringVar(&netQueueChains, "iptables-chain", "", "Comma-separated list of chains where connections are retained, e.g. INPUT,FORWARD (default selected by -net-queue-networking)")
+	flag.DurationVar(&iptablesTimeout, "iptables-timeout", 5*time.Second, "Maximum time iptables commands can run before being killed, so a held xtables lock cannot block reloads")
+	flag.BoolVar(&netQueueExternalRules, "queue-external-rules", false, "Assume the rules sending connections to the netfilter queue are managed externally, connections are only retained during reloads and accepted otherwise (see -queue-print-rules)")
 }
 
-const maxPacketsInQueue = 65536
+// netQueueOptionsFromFlags returns the options of netfilter queues set in
+// the command line.
+func netQueueOptionsFromFlags() NetQueueOptions {
+	return NetQueueOptions{
+		Limit:         &netQueueLimit,
+		Networking:    netQueueNetworking,
+		Chains:        chainArgs(netQueueChains),
+		ExtraMatch:    strings.Fields(netQueueExtraMatch),
+		Match:         netQueueMatch,
+		Workers:       netQueueWorkers,
+		Queues:        netQueueCount,
+		Hold:          netQueueHold,
+		ExternalRules: netQueueExternalRules,
+
+		MaxQueuedPackets: netQueueMaxQueuedPackets,
+		PacketTimeout:    netQueuePacketTimeout,
+		MaxQueueDrops:    netQueueMaxDrops,
+	}
+}
+
+// validateQueueRange checks that the queues starting at n fit in the 16 bits
+// of queue numbers.
+func validateQueueRange(n uint, queues int) error {
+	if queues < 1 {
+		return fmt.Errorf("invalid number of queues %d, it must be positive", queues)
+	}
+	if last := uint64(n) + uint64(queues) - 1; last > math.MaxUint16 {
+		return fmt.Errorf("invalid queue range %d:%d, queue numbers must be lower than %d", n, last, math.MaxUint16+1)
+	}
+	return nil
+}
+
+// queueNumbers returns the numbers of the given number of queues starting at n.
+func queueNumbers(n uint, queues int) []uint {
+	numbers := make([]uint, queues)
+	for i := range numbers {
+		numbers[i] = n + uint(i)
+	}
+	return numbers
+}
+
+// Defaults of the size of the netfilter queue and of the time packets wait to
+// be read from it
+const (
+	defaultMaxQueuedPackets = 65536
+	defaultPacketTimeout    = 10 * time.Millisecond
+)
+
+// validateQueueSize checks that the size of the queue is in the range accepted
+// by the kernel, that keeps it in 32 bits.
+func validateQueueSize(n uint) error {
+	if n == 0 || uint64(n) > math.MaxUint32 {
+		return fmt.Errorf("invalid queue size %d, it must be between 1 and %d", n, uint64(math.MaxUint32))
+	}
+	return nil
+}
 
 const iptablesAddFlag = "-A"
+const iptablesInsertFlag = "-I"
 const iptablesDeleteFlag = "-D"
 
-const procNetfilterQueuePath = "/proc/net/netfilter/nfnetlink_queue"
+// Networking modes, connections are captured in the INPUT chain with host
+// networking, and in the chain for forwarded packets with bridge networking,
+// where they are sent to an IP of another network namespace. With auto, the
+// mode is chosen depending on the IPs being local or not.
+const (
+	NetworkingAuto   = "auto"
+	NetworkingHost   = "host"
+	NetworkingBridge = "bridge"
+)
+
+// Strategies to match new connections, by their SYN flag or by the state
+// of their flow in conntrack
+const (
+	NetQueueMatchSyn       = "syn"
+	NetQueueMatchConntrack = "conntrack"
+)
+
+// File that exists if conntrack is available in the kernel
+var conntrackCheckPath = "/proc/sys/net/netfilter/nf_conntrack_max"
+
+// Chains used for forwarded packets, DOCKER-USER is evaluated before the
+// rules docker adds to FORWARD, if it exists
+const (
+	forwardChain    = "FORWARD"
+	dockerUserChain = "DOCKER-USER"
+)
+
+var procNetfilterQueuePath = "/proc/net/netfilter/nfnetlink_queue"
 
 var netQueue NetQueue
 
@@ -60,181 +180,975 @@ func ipArgs(arg string) ([]net.IP, error) {
 	return ips, nil
 }
 
-// A NetQueue retains new connections while haproxy is reloaded
+// unusableIPReason returns why connections to the IP cannot be retained, or
+// an empty string if they can. Both IPv4 and IPv6 addresses are supported.
+func unusableIPReason(ip net.IP) string {
+	switch {
+	case ip.IsUnspecified():
+		return "unspecified address, connections are never destined to it"
+	case ip.IsMulticast():
+		return "multicast address, TCP connections cannot be destined to it"
+	case ip.Equal(net.IPv4bcast):
+		return "broadcast address, TCP connections cannot be destined to it"
+	}
+	return ""
+}
+
+// warnUnusableIPs logs the addresses whose connections cannot be retained.
+func warnUnusableIPs(ips []net.IP) {
+	for _, ip := range ips {
+		if reason := unusableIPReason(ip); reason != "" {
+			log.Printf("Warning: connections to %s won't be retained: %s\n", ip, reason)
+		}
+	}
+}
+
+// A NetQueue retains new connections while haproxy is reloaded. Captures
+// that fail don't need to be released. SetIPs replaces the addresses whose
+// connections are retained, from the next capture.
 type NetQueue interface {
-	Capture()
-	Release()
+	Capture() error
+	Release() error
+	SetIPs([]net.IP) error
 	Stop()
 }
 
+// errCaptureDisabled is returned when updating the addresses of a queue that
+// doesn't retain connections.
+var errCaptureDisabled = errors.New("connections are not retained during reloads")
+
 type dummyNetQueue struct{}
 
-func (*dummyNetQueue) Capture() {}
-func (*dummyNetQueue) Release() {}
-func (*dummyNetQueue) Stop()    {}
+func (*dummyNetQueue) Capture() error        { return nil }
+func (*dummyNetQueue) Release() error        { return nil }
+func (*dummyNetQueue) SetIPs([]net.IP) error { return errCaptureDisabled }
+func (*dummyNetQueue) Stop()                 {}
+
+// NetQueueLimit configures a rate limit of the connections retained, so
+// the queue is not filled by floods during reloads.
+type NetQueueLimit struct {
+	// Rate in the format understood by iptables, e.g. 100/second, empty
+	// to disable the limit
+	Rate      string
+	Burst     uint
+	PerSource bool
+	// Drop connections over the limit, they are accepted otherwise
+	Drop bool
+}
+
+var netQueueLimitRate = regexp.MustCompile(`^[0-9]+/(s|sec|second|m|min|minute|h|hour|d|day)$`)
+
+func (l *NetQueueLimit) enabled() bool {
+	return l != nil && l.Rate != ""
+}
+
+func (l *NetQueueLimit) validate() error {
+	if !l.enabled() {
+		return nil
+	}
+	if !netQueueLimitRate.MatchString(l.Rate) {
+		return fmt.Errorf("invalid rate limit %q, expected something like 100/second", l.Rate)
+	}
+	if l.Burst == 0 {
+		return fmt.Errorf("rate limit burst must be positive")
+	}
+	return nil
+}
+
+// NetQueueOptions contains optional settings for netfilter queues
+type NetQueueOptions struct {
+	Limit *NetQueueLimit
+
+	// Networking mode, auto if empty
+	Networking string
+
+	// Chains where connections are retained, replacing the one selected
+	// by the networking mode if set
+	Chains []string
+
+	// Strategy to match new connections, syn if empty
+	Match string
+
+	// Arguments added to the match of the rules, as "--dport 443", the
+	// target is always controlled by the queue
+	ExtraMatch []string
+
+	// Function called on transitions of captures, if set
+	Events func(CaptureEvent)
+
+	// Number of goroutines setting verdicts of retained packets on
+	// release, one if not set
+	Workers int
+
+	// Number of queues new connections are balanced across, starting at
+	// the number of the queue, one if not set
+	Queues int
+
+	// Time packets are held before being accepted during captures
+	Hold NetQueueHold
+
+	// Rules are managed externally and always send new connections to the
+	// queue, packets are only retained during captures
+	ExternalRules bool
+
+	// Maximum number of packets in the queue, and time packets wait to be
+	// read from it before being dropped, defaults if not set
+	MaxQueuedPackets uint
+	PacketTimeout    time.Duration
+
+	// Packets dropped by the kernel during a capture over which the
+	// capture is aborted, never aborted if zero
+	MaxQueueDrops uint
+}
+
+// chainArgs parses a comma-separated list of chains.
+func chainArgs(arg string) []string {
+	if len(arg) == 0 {
+		return nil
+	}
+	chains := strings.Split(arg, ",")
+	for i := range chains {
+		chains[i] = strings.TrimSpace(chains[i])
+	}
+	return chains
+}
+
+// validateExtraMatch checks that the additional match arguments don't change
+// the target of the rules.
+func validateExtraMatch(args []string) error {
+	for _, arg := range args {
+		switch {
+		case arg == "-j", arg == "--jump", arg == "-g", arg == "--goto", strings.HasPrefix(arg, "--queue-"):
+			return fmt.Errorf("invalid capture match argument %q, the target of the rules cannot be changed", arg)
+		}
+	}
+	return nil
+}
+
+// validateChains checks that the chains can be used in iptables arguments.
+func validateChains(chains []string) error {
+	for _, chain := range chains {
+		if chain == "" || strings.ContainsAny(chain, " \t") || strings.HasPrefix(chain, "-") {
+			return fmt.Errorf("invalid chain %q", chain)
+		}
+	}
+	return nil
+}
+
+func (o NetQueueOptions) queueSize() uint {
+	if o.MaxQueuedPackets == 0 {
+		return defaultMaxQueuedPackets
+	}
+	return o.MaxQueuedPackets
+}
+
+func (o NetQueueOptions) queueCount() int {
+	if o.Queues == 0 {
+		return 1
+	}
+	return o.Queues
+}
+
+func (o NetQueueOptions) packetTimeout() time.Duration {
+	if o.PacketTimeout == 0 {
+		return defaultPacketTimeout
+	}
+	return o.PacketTimeout
+}
+
+// validateQueue checks the size of the queue and the packet timeout.
+func (o NetQueueOptions) validateQueue() error {
+	if err := validateQueueSize(o.queueSize()); err != nil {
+		return err
+	}
+	if o.PacketTimeout < 0 {
+		return fmt.Errorf("invalid packet timeout %s", o.PacketTimeout)
+	}
+	return nil
+}
+
+// Capture states, reported in events in this order on each capture
+const (
+	CaptureRequested = "capture-requested"
+	RulesInstalled   = "rules-installed"
+	// Sent instead of the rest if the rules cannot be installed
+	CaptureFailed    = "capture-failed"
+	CapturingActive  = "capturing-active"
+	ReleaseRequested = "release-requested"
+	RulesRemoved     = "rules-removed"
+	// Sent after the retained packets are accepted, with a summary
+	CaptureSummarized = "capture-summary"
+	// Sent while capturing if the kernel drops packets because the queue
+	// is full, with the packets dropped in the summary
+	PacketsDropped = "packets-dropped"
+)
+
+// CaptureEvent is a transition of a capture of connections during a reload,
+// captures are identified by the ID of their reload.
+type CaptureEvent struct {
+	Event    string    `json:"event"`
+	State    string    `json:"state"`
+	Time     time.Time `json:"time"`
+	ReloadID uint64    `json:"reload_id"`
+
+	Summary *CaptureSummary `json:"summary,omitempty"`
+}
+
+// CaptureSummary describes the packets retained by a capture.
+type CaptureSummary struct {
+	Packets      int64 `json:"packets"`
+	QueueDropped uint  `json:"queue_dropped"`
+	UserDropped  uint  `json:"user_dropped"`
+
+	// Possible cause of captures without packets
+	Diagnosis string `json:"diagnosis,omitempty"`
+}
+
+// validateMatch checks that the match strategy is known and can be used.
+func validateMatch(match string) error {
+	switch match {
+	case "", NetQueueMatchSyn:
+		return nil
+	case NetQueueMatchConntrack:
+		if _, err := os.Stat(conntrackCheckPath); err != nil {
+			return fmt.Errorf("conntrack match requires conntrack support in the kernel: %v", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown match strategy: %s", match)
+	}
+}
 
 type netfilterQueue struct {
 	Number uint
+
+	// Addresses whose connections are captured, and chains where they
+	// are captured, INPUT if not set. They can be replaced with SetIPs,
+	// so they are protected by the lock.
 	IPs    []net.IP
+	chains map[string]string
+
+	options NetQueueOptions
+
+	// Number of captures requested, used as reload ID
+	captures uint64
 
-	capture, capturing, release chan struct{}
+	capture             chan uint64
+	capturing, released chan error
+	release             chan struct{}
+
+	// Captures requested while the rules are installed share the window of
+	// the first one, rules are removed when all of them are released
+	// The lock also protects the addresses.
+	sync.Mutex
+	refs     int
+	window   *captureWindow
+	windowID uint64
+
+	hold *holdEstimator
+
+	// Rules added to capture connections, only used from loop
+	installed []installedRule
 
 	cancel context.CancelFunc
 }
 
 // Factory method to obtain a netqueue depending on IP configuration
-func NewNetQueue(n uint, ips []net.IP) NetQueue {
+func NewNetQueue(n uint, ips []net.IP) (NetQueue, error) {
+	return NewNetQueueWithOptions(n, ips, NetQueueOptions{})
+}
+
+// NewNetQueueWithOptions obtains a netqueue with additional settings
+func NewNetQueueWithOptions(n uint, ips []net.IP, options NetQueueOptions) (NetQueue, error) {
 	if len(ips) == 0 {
-		return &dummyNetQueue{}
+		return &dummyNetQueue{}, nil
+	}
+	if err := checkNetAdmin(); err != nil {
+		log.Printf("Warning: connections won't be retained during reloads: %v\n", err)
+		return &dummyNetQueue{}, nil
+	}
+	q, err := newNetfilterQueue(n, ips, options)
+	if err != nil {
+		return nil, err
+	}
+	q.removeStaleRules()
+	procNf, err := ReadProcNetfilter()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read netfilter queue stats: %v", err)
+	}
+	nfqueue.PacketReceiveTimeout = options.packetTimeout()
+	var queues []*nfqueue.NFQueue
+	for _, n := range q.numbers() {
+		queue, err := nfqueue.NewNFQueue(uint16(n), uint32(options.queueSize()), nfqueue.NF_DEFAULT_PACKET_SIZE)
+		if err != nil {
+			for _, queue := range queues {
+				queue.Close()
+			}
+			return nil, fmt.Errorf("couldn't open netfilter queue %d: %v", n, err)
+		}
+		queues = append(queues, queue)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	registerQueue(q)
+	go q.loop(queues, procNf, ctx)
+	return q, nil
+}
+
+// checkNetAdmin returns an error if the process doesn't have the CAP_NET_ADMIN
+// capability, needed to open netfilter queues and to run iptables. If the
+// capabilities cannot be read, they are assumed to be available.
+func checkNetAdmin() error {
+	capabilities, err := effectiveCapabilities()
+	if err != nil {
+		return nil
+	}
+	if !capabilities["CAP_NET_ADMIN"] {
+		return fmt.Errorf("CAP_NET_ADMIN capability not available")
+	}
+	return nil
+}
+
+// newNetfilterQueue validates the options and selects the chains of a queue,
+// without opening it.
+func newNetfilterQueue(n uint, ips []net.IP, options NetQueueOptions) (*netfilterQueue, error) {
+	if err := options.Limit.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateMatch(options.Match); err != nil {
+		return nil, err
+	}
+	if options.Workers < 0 {
+		return nil, fmt.Errorf("invalid number of workers: %d", options.Workers)
+	}
+	if err := options.Hold.validate(); err != nil {
+		return nil, err
+	}
+	if err := options.validateQueue(); err != nil {
+		return nil, err
+	}
+	if err := validateQueueRange(n, options.queueCount()); err != nil {
+		return nil, err
+	}
+	if err := validateChains(options.Chains); err != nil {
+		return nil, err
+	}
+	if err := validateExtraMatch(options.ExtraMatch); err != nil {
+		return nil, err
 	}
-	q := netfilterQueue{
+	chains, err := captureChains(ips, options.Networking)
+	if err != nil {
+		return nil, err
+	}
+	warnUnusableIPs(ips)
+	return &netfilterQueue{
 		Number:    n,
 		IPs:       ips,
-		capture:   make(chan struct{}),
-		capturing: make(chan struct{}),
+		options:   options,
+		chains:    chains,
+		capture:   make(chan uint64),
+		capturing: make(chan error),
 		release:   make(chan struct{}),
+		released:  make(chan error),
+		hold:      newHoldEstimator(options.Hold),
+	}, nil
+}
+
+// installedRule is a rule added by the queue, with the command used for its
+// address family.
+type installedRule struct {
+	command string
+	rule    []string
+}
+
+// installRules calls iptables and ip6tables to add the rules sending packets
+// to the queue, unless rules are managed externally. Rules are added for all
+// the IPs or for none of them: if a rule fails, the ones already added are
+// removed, so dual-stack addresses are never captured in only one family.
+func (q *netfilterQueue) installRules() error {
+	if q.options.ExternalRules {
+		return nil
+	}
+	var installed []installedRule
+	for _, ip := range q.ips() {
+		command := iptablesCommand(ip)
+		rules := q.rules(ip)
+		for i, args := range addRuleArgs(rules) {
+			if err := iptables(command, args...); err != nil {
+				removeRules(installed)
+				return fmt.Errorf("%s failed adding rule for %s: %v", command, ip, err)
+			}
+			installed = append(installed, installedRule{command: command, rule: rules[i]})
+		}
 	}
-	queue, err := nfqueue.NewNFQueue(uint16(q.Number), maxPacketsInQueue, nfqueue.NF_DEFAULT_PACKET_SIZE)
+	q.installed = installed
+	return nil
+}
+
+// ips returns the addresses whose connections are captured.
+func (q *netfilterQueue) ips() []net.IP {
+	q.Lock()
+	defer q.Unlock()
+	return q.IPs
+}
+
+// SetIPs replaces the addresses whose connections are captured. Captures in
+// progress keep the rules of the previous addresses until they are released,
+// next captures install rules only for the new ones.
+func (q *netfilterQueue) SetIPs(ips []net.IP) error {
+	if q.options.ExternalRules {
+		return fmt.Errorf("rules are managed externally, addresses cannot be updated")
+	}
+	chains, err := captureChains(ips, q.options.Networking)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	q.cancel = cancel
-	go q.loop(queue, ctx)
-	return &q
+	warnUnusableIPs(ips)
+	q.Lock()
+	defer q.Unlock()
+	q.IPs = ips
+	q.chains = chains
+	return nil
 }
 
-// Call to iptables to configure the rule to send packets
-// to the queue
-func (q *netfilterQueue) iptables(flag string) {
-	for _, ip := range q.IPs {
-		if ip.To4() == nil {
-			log.Printf("Only IPv4 addresses supported: %s found", ip.String())
-			continue
+// removeRules removes the rules added by installRules.
+func (q *netfilterQueue) removeRules() error {
+	err := removeRules(q.installed)
+	q.installed = nil
+	return err
+}
+
+// removeRules deletes the rules in reverse order, rules that cannot be deleted
+// are logged and the rest are still deleted. It returns the first error.
+func removeRules(rules []installedRule) error {
+	var first error
+	for i := len(rules) - 1; i >= 0; i-- {
+		r := rules[i]
+		if err := iptables(r.command, ruleArgs(iptablesDeleteFlag, 0, r.rule)...); err != nil {
+			log.Printf("Couldn't remove rule with %s: %v\n", r.command, err)
+			if first == nil {
+				first = fmt.Errorf("%s failed removing rule: %v", r.command, err)
+			}
 		}
-		args := []string{
-			flag,
-			"INPUT", "-j", "NFQUEUE", "-w",
-			"-p", "tcp", "--syn", "--destination", ip.String(),
-			"--queue-num", strconv.Itoa(int(q.Number)),
+	}
+	return first
+}
+
+// runIptables runs an iptables command, it can be replaced in tests.
+var runIptables = func(command string, args ...string) error {
+	return runCommandTimeout(iptablesTimeout, command, args...)
+}
+
+// runCommandTimeout runs a command, killing it if it doesn't finish before
+// the timeout. There is no timeout if it is zero.
+func runCommandTimeout(timeout time.Duration, command string, args ...string) error {
+	_, err := commandOutputTimeout(timeout, command, args...)
+	return err
+}
+
+// commandOutputTimeout runs a command like runCommandTimeout and returns its
+// output.
+func commandOutputTimeout(timeout time.Duration, command string, args ...string) ([]byte, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	out, err := exec.CommandContext(ctx, command, args...).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil && len(bytes.TrimSpace(out)) > 0 {
+		return nil, fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return out, err
+}
+
+// Attempts of iptables commands, and time to wait before retrying them,
+// doubled on each retry. Commands fail when other processes hold the xtables
+// lock for longer than iptables -w waits.
+var (
+	iptablesAttempts = 3
+	iptablesBackoff  = 100 * time.Millisecond
+)
+
+// iptables runs an iptables command, retrying it if it fails.
+func iptables(command string, args ...string) error {
+	backoff := iptablesBackoff
+	for attempt := 1; ; attempt++ {
+		err := runIptables(command, args...)
+		if err == nil {
+			return nil
+		}
+		if attempt >= iptablesAttempts {
+			log.Printf("%s %s failed: %v\n", command, strings.Join(args, " "), err)
+			return err
+		}
+		log.Printf("Warning: %s %s failed, retrying in %s: %v\n", command, strings.Join(args, " "), backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// iptablesCommand returns the command managing the rules for the family of
+// the IP, ip6tables for IPv6 addresses and iptables otherwise.
+func iptablesCommand(ip net.IP) string {
+	if ip.To4() == nil {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+// rules returns the iptables rules needed to capture new connections to
+// the given IP in all its chains, without the command flag
+func (q *netfilterQueue) rules(ip net.IP) [][]string {
+	var rules [][]string
+	for _, chain := range q.ruleChains(ip) {
+		rules = append(rules, q.chainRules(chain, ip)...)
+	}
+	return rules
+}
+
+// chainRules returns the rules capturing new connections to the IP in a
+// chain.
+func (q *netfilterQueue) chainRules(chain string, ip net.IP) [][]string {
+	match := []string{chain, "-w", "-p", "tcp"}
+	if q.options.Match == NetQueueMatchConntrack {
+		match = append(match, "-m", "conntrack", "--ctstate", "NEW")
+	} else {
+		match = append(match, "--syn")
+	}
+	match = append(match, "--destination", ip.String())
+	match = append(match, q.options.ExtraMatch...)
+	queue := append([]string{}, match...)
+	if limit := q.options.Limit; limit.enabled() {
+		burst := strconv.Itoa(int(limit.Burst))
+		if limit.PerSource {
+			queue = append(queue,
+				"-m", "hashlimit",
+				"--hashlimit-upto", limit.Rate,
+				"--hashlimit-burst", burst,
+				"--hashlimit-mode", "srcip",
+				"--hashlimit-name", fmt.Sprintf("haproxy-queue-%d", q.Number),
+			)
+		} else {
+			queue = append(queue, "-m", "limit", "--limit", limit.Rate, "--limit-burst", burst)
+		}
+	}
+	queue = append(queue, "-j", "NFQUEUE")
+	if count := q.options.queueCount(); count > 1 {
+		queue = append(queue, "--queue-balance", fmt.Sprintf("%d:%d", q.Number, q.Number+uint(count)-1))
+	} else {
+		queue = append(queue, "--queue-num", strconv.Itoa(int(q.Number)))
+	}
+	if q.options.ExternalRules {
+		// Permanent rules shouldn't drop connections while the
+		// wrapper is not running
+		queue = append(queue, "--queue-bypass")
+	}
+
+	rules := [][]string{queue}
+	if limit := q.options.Limit; limit.enabled() && limit.Drop {
+		drop := append(append([]string{}, match...), "-j", "DROP")
+		rules = append(rules, drop)
+	}
+	return rules
+}
+
+// PrintNetQueueRules writes the iptables commands installing the rules that
+// send new connections to the IPs to the queue, so they can be managed
+// externally with the ExternalRules option.
+func PrintNetQueueRules(w io.Writer, n uint, ips []net.IP, options NetQueueOptions) error {
+	if len(ips) == 0 {
+		return fmt.Errorf("no IPs to retain connections")
+	}
+	options.ExternalRules = true
+	q, err := newNetfilterQueue(n, ips, options)
+	if err != nil {
+		return err
+	}
+	for _, ip := range q.IPs {
+		for _, args := range addRuleArgs(q.rules(ip)) {
+			fmt.Fprintf(w, "%s %s\n", iptablesCommand(ip), strings.Join(args, " "))
 		}
+	}
+	return nil
+}
+
+// addRuleArgs returns the arguments for iptables to add the rules, with the
+// positions of the rules in each of their chains.
+func addRuleArgs(rules [][]string) [][]string {
+	positions := make(map[string]int)
+	args := make([][]string, len(rules))
+	for i, rule := range rules {
+		args[i] = ruleArgs(iptablesAddFlag, positions[rule[0]], rule)
+		positions[rule[0]]++
+	}
+	return args
+}
 
-		err := exec.Command("iptables", args...).Run()
+// ruleArgs returns the arguments for iptables to add or delete the rule in
+// the given position.
+func ruleArgs(flag string, position int, rule []string) []string {
+	if flag == iptablesAddFlag && rule[0] != "INPUT" {
+		// Forwarding chains usually accept packets in rules added by
+		// docker, capture rules must be before them
+		return append([]string{iptablesInsertFlag, rule[0], strconv.Itoa(position + 1)}, rule[1:]...)
+	}
+	return append([]string{flag}, rule...)
+}
+
+// numbers returns the numbers of the queues connections are balanced across.
+func (q *netfilterQueue) numbers() []uint {
+	return queueNumbers(q.Number, q.options.queueCount())
+}
+
+// ruleChains returns the chains where connections to the IP are captured,
+// the ones in the options or the one selected by the networking mode.
+func (q *netfilterQueue) ruleChains(ip net.IP) []string {
+	if len(q.options.Chains) > 0 {
+		return q.options.Chains
+	}
+	return []string{q.chain(ip)}
+}
+
+// chain returns the chain selected for the IP by the networking mode
+func (q *netfilterQueue) chain(ip net.IP) string {
+	q.Lock()
+	defer q.Unlock()
+	if chain, found := q.chains[ip.String()]; found {
+		return chain
+	}
+	return "INPUT"
+}
+
+// captureChains selects the chains where connections to the IPs are captured
+// depending on the networking mode.
+func captureChains(ips []net.IP, networking string) (map[string]string, error) {
+	var local []net.IP
+	if networking == NetworkingAuto || networking == "" {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't obtain local addresses: %v", err)
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				local = append(local, ipNet.IP)
+			}
+		}
+	}
+	// Each family has its own tables, DOCKER-USER may exist only in one
+	// of them
+	byCommand := make(map[string][]net.IP)
+	for _, ip := range ips {
+		command := iptablesCommand(ip)
+		byCommand[command] = append(byCommand[command], ip)
+	}
+	chains := make(map[string]string)
+	for command, ips := range byCommand {
+		forward := forwardChain
+		if networking != NetworkingHost && runIptables(command, "-w", "-n", "-L", dockerUserChain) == nil {
+			forward = dockerUserChain
+		}
+		selected, err := selectChains(ips, networking, local, forward)
 		if err != nil {
-			panic(fmt.Sprintf("iptables failed: %v", err))
+			return nil, err
+		}
+		for ip, chain := range selected {
+			chains[ip] = chain
+		}
+	}
+	return chains, nil
+}
+
+func selectChains(ips []net.IP, networking string, local []net.IP, forward string) (map[string]string, error) {
+	chains := make(map[string]string)
+	for _, ip := range ips {
+		switch networking {
+		case NetworkingHost:
+			chains[ip.String()] = "INPUT"
+		case NetworkingBridge:
+			chains[ip.String()] = forward
+		case NetworkingAuto, "":
+			chains[ip.String()] = forward
+			for _, l := range local {
+				if l.Equal(ip) {
+					chains[ip.String()] = "INPUT"
+					break
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown networking mode: %s", networking)
 		}
 	}
+	return chains, nil
 }
 
-func (q *netfilterQueue) loop(queue *nfqueue.NFQueue, ctx context.Context) {
-	defer queue.Close()
+// loop reads the packets of all the queues in the same channel, so captures
+// and releases apply to all of them at once, and a release only finishes
+// when no queue has packets waiting.
+func (q *netfilterQueue) loop(queues []*nfqueue.NFQueue, procNf *ProcNetfilter, ctx context.Context) {
+	for _, queue := range queues {
+		defer queue.Close()
+	}
 	defer close(q.capture)
 	defer close(q.capturing)
 	defer close(q.release)
+	defer close(q.released)
 
-	procNf, err := ReadProcNetfilter()
-	if err != nil {
-		panic(err)
-	}
-
-	lastQueueDropped := uint(0)
-	lastUserDropped := uint(0)
+	lastQueueDropped := make(map[uint]uint)
+	lastUserDropped := make(map[uint]uint)
 
 	// Buffered channel, we don't want to block writes on it
 	packets := make(chan nfqueue.NFPacket, nfqueue.NF_DEFAULT_PACKET_SIZE)
 	queuedPackets := int64(0)
-	go func() {
-		for {
-			// We have to be reading packets before start capturing,
-			// or they are lost
-			select {
-			case packet := <-queue.GetPackets():
-				packets <- packet
-				atomic.AddInt64(&queuedPackets, 1)
-			case <-ctx.Done():
-				return
+	// With external rules, packets are only retained while capturing
+	holding := int32(0)
+	for _, queue := range queues {
+		go func(queue *nfqueue.NFQueue) {
+			for {
+				// We have to be reading packets before start
+				// capturing, or they are lost
+				select {
+				case packet := <-queue.GetPackets():
+					if q.options.ExternalRules && atomic.LoadInt32(&holding) == 0 {
+						packet.SetVerdict(nfqueue.NF_ACCEPT)
+						continue
+					}
+					packets <- packet
+					atomic.AddInt64(&queuedPackets, 1)
+				case <-ctx.Done():
+					return
+				}
 			}
-		}
-	}()
+		}(queue)
+	}
 
 	for {
 		// Control locks
+		var id uint64
 		select {
-		case <-q.capture:
+		case id = <-q.capture:
 		case <-ctx.Done():
 			return
 		}
-		func() {
-			q.iptables(iptablesAddFlag)
-			defer q.iptables(iptablesDeleteFlag)
-			q.capturing <- struct{}{}
-			<-q.release
-		}()
-
-		err := procNf.Update()
-		if err != nil {
-			log.Printf("Couldn't update netfilter queue stats: %v\n", err)
+		// Packets accepted before the release, if held for too long
+		count := int64(0)
+		if err := q.installRules(); err != nil {
+			logWithFields(LogFields{"queue": q.Number, "reload_id": id}, "Couldn't install capture rules, connections won't be retained: %v\n", err)
+			q.event(CaptureFailed, id)
+			q.capturing <- err
 			continue
 		}
-
-		// Accept all waiting packets according to information in proc fs
-		count := int64(0)
-		for {
-			qData, found := procNf.Get(q.Number)
-			if !found || qData.Waiting == 0 {
-				break
+		q.released <- func() error {
+			atomic.StoreInt32(&holding, 1)
+			q.event(RulesInstalled, id)
+			defer q.event(RulesRemoved, id)
+			defer atomic.StoreInt32(&holding, 0)
+			q.capturing <- nil
+			acceptQueued := func() {
+				n := atomic.LoadInt64(&queuedPackets)
+				acceptPackets(packets, n, q.options.Workers, func(packet *nfqueue.NFPacket) {
+					packet.SetVerdict(nfqueue.NF_ACCEPT)
+				})
+				atomic.AddInt64(&queuedPackets, -n)
+				count += n
+			}
+			exceeded, stopWatch := q.watchDrops(id)
+			aborted := q.waitRelease(func(timeout time.Duration) {
+				q.acceptExpired(id, timeout, atomic.LoadInt64(&queuedPackets), acceptQueued)
+			}, exceeded)
+			stopWatch()
+			if aborted {
+				// New connections are not retained anymore, the
+				// release is still waited for
+				err := q.removeRules()
+				acceptQueued()
+				<-q.release
+				return err
 			}
-			// We only trust in the number of queued packets, as the last read
-			// value for waiting packets can be outdated and we'd get locked
-			// reading from the channel
+			return q.removeRules()
+		}()
+
+		summary := &CaptureSummary{}
+		// We only trust in the number of queued packets, as the last read
+		// value for waiting packets can be outdated and we'd get locked
+		// reading from the channel
+		acceptWaiting := func() {
 			n := atomic.LoadInt64(&queuedPackets)
-			for i := int64(0); i < n; i++ {
-				packet := <-packets
+			acceptPackets(packets, n, q.options.Workers, func(packet *nfqueue.NFPacket) {
 				packet.SetVerdict(nfqueue.NF_ACCEPT)
-			}
+			})
 			atomic.AddInt64(&queuedPackets, -n)
 			count += n
-			err := procNf.Update()
-			if err != nil {
-				log.Printf("Couldn't update netfilter queue stats: %v\n", err)
-				break
+		}
+
+		// Accept all waiting packets according to information in proc fs.
+		// If it cannot be read, the packets known to be queued are
+		// accepted, and the summary is emitted with the last stats read.
+		err := procNf.Update()
+		if err != nil {
+			logWithFields(LogFields{"queue": q.Number, "reload_id": id}, "Couldn't update netfilter queue stats: %v\n", err)
+			acceptWaiting()
+		}
+		for err == nil && procNf.waiting(q.numbers()) {
+			acceptWaiting()
+			if err = procNf.Update(); err != nil {
+				logWithFields(LogFields{"queue": q.Number, "reload_id": id}, "Couldn't update netfilter queue stats: %v\n", err)
 			}
 		}
 
 		// Show stats
 		if count > 0 {
-			log.Printf("Delayed %d packages during reloads\n", count)
+			logWithFields(LogFields{"queue": q.Number, "reload_id": id, "delayed_packets": count}, "Delayed %d packages during reloads\n", count)
 		}
 
-		if qData, found := procNf.Get(q.Number); found {
-			if qData.QueueDropped > lastQueueDropped {
-				log.Printf("Dropped %d packages due to full queue\n",
-					qData.QueueDropped-lastQueueDropped)
-				lastQueueDropped = qData.QueueDropped
+		for _, n := range q.numbers() {
+			qData, found := procNf.Get(n)
+			if !found {
+				continue
+			}
+			if qData.QueueDropped > lastQueueDropped[n] {
+				summary.QueueDropped += qData.QueueDropped - lastQueueDropped[n]
+				lastQueueDropped[n] = qData.QueueDropped
 			}
-			if qData.UserDropped > lastUserDropped {
-				log.Printf("Dropped %d packages before reaching user space\n",
-					qData.UserDropped-lastUserDropped)
-				lastUserDropped = qData.UserDropped
+			if qData.UserDropped > lastUserDropped[n] {
+				summary.UserDropped += qData.UserDropped - lastUserDropped[n]
+				lastUserDropped[n] = qData.UserDropped
 			}
 		}
+		if summary.QueueDropped > 0 {
+			logWithFields(LogFields{"queue": q.Number, "reload_id": id, "queue_dropped": summary.QueueDropped}, "Dropped %d packages due to full queue\n", summary.QueueDropped)
+		}
+		if summary.UserDropped > 0 {
+			logWithFields(LogFields{"queue": q.Number, "reload_id": id, "user_dropped": summary.UserDropped}, "Dropped %d packages before reaching user space\n", summary.UserDropped)
+		}
+		summary.Packets = count
+		q.summarize(id, summary)
 	}
 }
 
-func (q *netfilterQueue) Capture() {
-	q.capture <- struct{}{}
-	<-q.capturing
+// acceptPackets reads n packets and accepts them using the given number of
+// workers. Verdicts are only set here, after the capture is released, so
+// workers don't need to be paused while capturing.
+func acceptPackets(packets <-chan nfqueue.NFPacket, n int64, workers int, accept func(*nfqueue.NFPacket)) {
+	if workers < 1 {
+		workers = 1
+	}
+	if int64(workers) > n {
+		workers = int(n)
+	}
+	remaining := n
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&remaining, -1) >= 0 {
+				packet := <-packets
+				accept(&packet)
+			}
+		}()
+	}
+	wg.Wait()
 }
 
-func (q *netfilterQueue) Release() {
-	q.release <- struct{}{}
+// captureWindow is a period with the capture rules installed, shared by the
+// captures requested during it. It is closed when the rules are installed, or
+// when they couldn't be installed, with the error.
+type captureWindow struct {
+	ready chan struct{}
+	err   error
+
+	// Captures requested in the window
+	captures int
+}
+
+// Capture installs the rules to retain new connections, if they are not
+// already installed. If they cannot be installed, the capture is not
+// started and doesn't need to be released.
+func (q *netfilterQueue) Capture() error {
+	id := atomic.AddUint64(&q.captures, 1)
+	q.event(CaptureRequested, id)
+
+	q.Lock()
+	q.refs++
+	window := q.window
+	first := window == nil
+	if first {
+		window = &captureWindow{ready: make(chan struct{})}
+		q.window = window
+		q.windowID = id
+	}
+	window.captures++
+	q.Unlock()
+
+	if first {
+		q.capture <- id
+		if err := <-q.capturing; err != nil {
+			// Failed captures are not released
+			q.Lock()
+			window.err = err
+			q.refs -= window.captures
+			q.window = nil
+			q.Unlock()
+		}
+		close(window.ready)
+	} else {
+		<-window.ready
+	}
+	if window.err != nil {
+		return window.err
+	}
+	q.event(CapturingActive, id)
+	return nil
 }
 
-// Canceling the context will finish loop() and close
-// all queues and channels, after calling this method
-// this object shouldn't be used anymore
+// Release releases a capture, the rules are removed when all the captures of
+// the window are released. The last release returns the error removing them.
+func (q *netfilterQueue) Release() error {
+	q.Lock()
+	if q.refs == 0 {
+		q.Unlock()
+		log.Println("Release requested without capture, ignoring it")
+		return nil
+	}
+	q.refs--
+	last := q.refs == 0
+	if last {
+		q.window = nil
+	}
+	id := q.windowID
+	q.Unlock()
+
+	q.event(ReleaseRequested, id)
+	if last {
+		q.release <- struct{}{}
+		return <-q.released
+	}
+	return nil
+}
+
+func (q *netfilterQueue) summarize(id uint64, summary *CaptureSummary) {
+	if q.options.Events != nil {
+		q.options.Events(CaptureEvent{Event: "capture", State: CaptureSummarized, Time: time.Now(), ReloadID: id, Summary: summary})
+	}
+}
+
+func (q *netfilterQueue) event(state string, id uint64) {
+	if q.options.Events != nil {
+		q.options.Events(CaptureEvent{Event: "capture", State: state, Time: time.Now(), ReloadID: id})
+	}
+}
+
+// Stop stops the queue, removing the rules of captures in progress. It
+// cancels the context to finish loop() and close all queues and channels, so
+// the queue shouldn't be used anymore after calling it.
 func (q *netfilterQueue) Stop() {
 	q.cancel()
+	q.removeStaleRules()
+	unregisterQueue(q)
 }
 
 type ProcNetfilterQueue struct {
@@ -263,49 +1177,82 @@ func (pn *ProcNetfilter) Get(id uint) (ProcNetfilterQueue, bool) {
 	return q, found
 }
 
-func (pn *ProcNetfilter) Update() error {
-	pn.Lock()
-	defer pn.Unlock()
+// Queues returns the stats of all the queues, by ID.
+func (pn *ProcNetfilter) Queues() map[uint]ProcNetfilterQueue {
+	pn.RLock()
+	defer pn.RUnlock()
+	queues := make(map[uint]ProcNetfilterQueue, len(pn.queues))
+	for id, q := range pn.queues {
+		queues[id] = q
+	}
+	return queues
+}
+
+// waiting returns true if any of the queues has packets waiting.
+func (pn *ProcNetfilter) waiting(ids []uint) bool {
+	for _, id := range ids {
+		if q, found := pn.Get(id); found && q.Waiting > 0 {
+			return true
+		}
+	}
+	return false
+}
 
+func (pn *ProcNetfilter) Update() error {
 	f, err := os.Open(procNetfilterQueuePath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	return pn.read(f)
+}
 
-	seen := make(map[uint]bool)
-
-	var id, portID, waiting, copyMode, copyRange, queueDropped, userDropped, lastSeq, one uint
-	for {
-		_, err := fmt.Fscanf(f, "%d %d %d %d %d %d %d %d %d\n",
-			&id, &portID, &waiting, &copyMode, &copyRange, &queueDropped, &userDropped, &lastSeq, &one)
-		seen[id] = true
-		pn.queues[id] = ProcNetfilterQueue{
-			ID:           id,
-			PortID:       portID,
-			Waiting:      waiting,
-			CopyMode:     copyMode,
-			CopyRange:    copyRange,
-			QueueDropped: queueDropped,
-			UserDropped:  userDropped,
-			LastSeq:      lastSeq,
-			One:          one,
-		}
-		if err == io.EOF {
-			break
+// read updates the queues with the content of a reader in the format of
+// the proc file. Kernels have printed different numbers of columns, so the
+// known ones are read in order and missing or extra trailing columns are
+// ignored. Malformed lines are skipped.
+func (pn *ProcNetfilter) read(r io.Reader) error {
+	queues := make(map[uint]ProcNetfilterQueue)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
 		}
+		q, err := parseProcNetfilterQueue(scanner.Text())
 		if err != nil {
-			return err
+			log.Printf("Warning: skipping line of %s: %v\n", procNetfilterQueuePath, err)
+			continue
 		}
+		queues[q.ID] = q
 	}
-	for k := range pn.queues {
-		if _, found := seen[k]; !found {
-			delete(pn.queues, k)
-		}
+	if err := scanner.Err(); err != nil {
+		return err
 	}
+
+	pn.Lock()
+	defer pn.Unlock()
+	pn.queues = queues
 	return nil
 }
 
+// parseProcNetfilterQueue parses a line of the proc file, only the ID of the
+// queue is required.
+func parseProcNetfilterQueue(line string) (ProcNetfilterQueue, error) {
+	var q ProcNetfilterQueue
+	fields := []*uint{&q.ID, &q.PortID, &q.Waiting, &q.CopyMode, &q.CopyRange, &q.QueueDropped, &q.UserDropped, &q.LastSeq, &q.One}
+	for i, value := range strings.Fields(line) {
+		if i >= len(fields) {
+			break
+		}
+		n, err := strconv.ParseUint(value, 10, 0)
+		if err != nil {
+			return q, fmt.Errorf("invalid column %d in %q", i+1, line)
+		}
+		*fields[i] = uint(n)
+	}
+	return q, nil
+}
+
 func ReadProcNetfilter() (*ProcNetfilter, error) {
 	pn := &ProcNetfilter{queues: make(map[uint]ProcNetfilterQueue)}
 	err := pn.Update()
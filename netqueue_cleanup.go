@@ -0,0 +1,176 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Chains where capture rules can be installed, depending on the networking
+var captureRuleChains = []string{"INPUT", forwardChain, dockerUserChain}
+
+// listIptablesRules lists the rules of a chain in the format of iptables -S,
+// it can be replaced in tests.
+var listIptablesRules = func(command, chain string) ([]string, error) {
+	out, err := commandOutputTimeout(iptablesTimeout, command, "-w", "-S", chain)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSpace(string(out)), "\n"), nil
+}
+
+// removeStaleRules removes the rules sending packets of the addresses of q to
+// its queues left by previous runs, as when the wrapper is killed while
+// connections are retained. Nothing else reads from these queues, so these rules would
+// blackhole new connections. Rules managed externally are kept.
+func (q *netfilterQueue) removeStaleRules() {
+	if q.options.ExternalRules {
+		return
+	}
+	ips := q.ips()
+	commands := make(map[string]bool)
+	for _, ip := range ips {
+		commands[iptablesCommand(ip)] = true
+	}
+	chains := append([]string{}, captureRuleChains...)
+	seen := make(map[string]bool)
+	for _, chain := range chains {
+		seen[chain] = true
+	}
+	for _, chain := range q.options.Chains {
+		if !seen[chain] {
+			chains = append(chains, chain)
+			seen[chain] = true
+		}
+	}
+	for command := range commands {
+		for _, chain := range chains {
+			// Chains that don't exist cannot have rules
+			rules, err := listIptablesRules(command, chain)
+			if err != nil {
+				continue
+			}
+			for _, rule := range rules {
+				args := strings.Fields(rule)
+				if len(args) < 2 || args[0] != iptablesAddFlag || !queueRule(args, q.numbers(), ips) {
+					continue
+				}
+				args[0] = iptablesDeleteFlag
+				if err := iptables(command, append([]string{"-w"}, args...)...); err != nil {
+					log.Printf("Couldn't remove stale rule %q: %v\n", rule, err)
+					continue
+				}
+				log.Printf("Removed stale rule with %s: %s\n", command, rule)
+			}
+		}
+	}
+}
+
+// queueRule returns true if the rule sends packets to any of the given
+// addresses to any of the queues, so rules of other queues or addresses are
+// kept.
+func queueRule(args []string, numbers []uint, ips []net.IP) bool {
+	target := false
+	destination := false
+	var first, last uint64
+	for i := 0; i < len(args)-1; i++ {
+		switch args[i] {
+		case "-d", "--destination":
+			destination = ruleDestination(args[i+1], ips)
+		case "-j":
+			target = args[i+1] == "NFQUEUE"
+		case "--queue-num":
+			n, err := strconv.ParseUint(args[i+1], 10, 16)
+			if err != nil {
+				return false
+			}
+			first, last = n, n
+		case "--queue-balance":
+			parts := strings.SplitN(args[i+1], ":", 2)
+			if len(parts) != 2 {
+				return false
+			}
+			var err1, err2 error
+			first, err1 = strconv.ParseUint(parts[0], 10, 16)
+			last, err2 = strconv.ParseUint(parts[1], 10, 16)
+			if err1 != nil || err2 != nil {
+				return false
+			}
+		}
+	}
+	if !target || !destination {
+		return false
+	}
+	for _, n := range numbers {
+		if uint64(n) >= first && uint64(n) <= last {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleDestination returns true if the destination of a rule, as listed by
+// iptables -S with the prefix length, is one of the addresses.
+func ruleDestination(destination string, ips []net.IP) bool {
+	ip := net.ParseIP(destination)
+	if _, network, err := net.ParseCIDR(destination); err == nil {
+		ones, bits := network.Mask.Size()
+		if ones != bits {
+			return false
+		}
+		ip = network.IP
+	}
+	if ip == nil {
+		return false
+	}
+	for _, addr := range ips {
+		if ip.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Queues whose rules are removed if the wrapper exits without stopping them
+var activeQueues = struct {
+	sync.Mutex
+	queues map[*netfilterQueue]bool
+}{queues: make(map[*netfilterQueue]bool)}
+
+func registerQueue(q *netfilterQueue) {
+	activeQueues.Lock()
+	defer activeQueues.Unlock()
+	activeQueues.queues[q] = true
+}
+
+func unregisterQueue(q *netfilterQueue) {
+	activeQueues.Lock()
+	defer activeQueues.Unlock()
+	delete(activeQueues.queues, q)
+}
+
+// CleanupNetQueues removes the rules of the queues not stopped yet, it is
+// meant to be called before exiting abruptly.
+func CleanupNetQueues() {
+	activeQueues.Lock()
+	defer activeQueues.Unlock()
+	for q := range activeQueues.queues {
+		q.removeStaleRules()
+	}
+}
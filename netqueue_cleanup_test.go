@@ -0,0 +1,103 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestQueueRule(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}
+	cases := []struct {
+		rule    string
+		numbers []uint
+		match   bool
+	}{
+		{"-A INPUT -d 10.0.0.1/32 -p tcp -m tcp --tcp-flags FIN,SYN,RST,ACK SYN -j NFQUEUE --queue-num 4", []uint{4}, true},
+		{"-A INPUT -d 10.0.0.1/32 -p tcp -j NFQUEUE --queue-num 5", []uint{4}, false},
+		{"-A FORWARD -d 10.0.0.1/32 -p tcp -j NFQUEUE --queue-balance 2:5", []uint{4, 5, 6}, true},
+		{"-A FORWARD -d 10.0.0.1/32 -p tcp -j NFQUEUE --queue-balance 2:3", []uint{4, 5}, false},
+		{"-A FORWARD -d fd00::1/128 -p tcp -j NFQUEUE --queue-num 0", []uint{0}, true},
+		{"-A INPUT -d 10.0.0.2/32 -p tcp -j NFQUEUE --queue-num 0", []uint{0}, false},
+		{"-A INPUT -d 10.0.0.0/24 -p tcp -j NFQUEUE --queue-num 0", []uint{0}, false},
+		{"-A INPUT -p tcp -j NFQUEUE", []uint{0}, false},
+		{"-A INPUT -d 10.0.0.1/32 -p tcp -j DROP", []uint{0}, false},
+		{"-A INPUT -d 10.0.0.1/32 -p tcp -j NFQUEUE --queue-num invalid", []uint{0}, false},
+	}
+	for _, c := range cases {
+		if match := queueRule(strings.Fields(c.rule), c.numbers, ips); match != c.match {
+			t.Errorf("%q with queues %v: found %v, expected %v", c.rule, c.numbers, match, c.match)
+		}
+	}
+}
+
+func TestRemoveStaleRules(t *testing.T) {
+	defer func(list func(string, string) ([]string, error)) { listIptablesRules = list }(listIptablesRules)
+	defer func(run func(string, ...string) error) { runIptables = run }(runIptables)
+
+	chains := map[string][]string{
+		"iptables INPUT": {
+			"-P INPUT ACCEPT",
+			"-A INPUT -d 10.0.0.1/32 -p tcp -m tcp --tcp-flags FIN,SYN,RST,ACK SYN -j NFQUEUE --queue-num 4",
+			"-A INPUT -d 10.0.0.1/32 -p tcp -j NFQUEUE --queue-num 7",
+			"-A INPUT -d 10.0.0.2/32 -p tcp -j NFQUEUE --queue-num 4",
+		},
+		"ip6tables FORWARD": {
+			"-P FORWARD ACCEPT",
+			"-A FORWARD -d fd00::1/128 -p tcp -j NFQUEUE --queue-balance 4:5",
+		},
+	}
+	listIptablesRules = func(command, chain string) ([]string, error) {
+		rules, found := chains[command+" "+chain]
+		if !found {
+			return nil, errors.New("no chain/target/match by that name")
+		}
+		return rules, nil
+	}
+	var deleted []string
+	runIptables = func(command string, args ...string) error {
+		deleted = append(deleted, command+" "+strings.Join(args, " "))
+		return nil
+	}
+
+	q := &netfilterQueue{
+		Number:  4,
+		IPs:     []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")},
+		options: NetQueueOptions{Queues: 2},
+	}
+	q.removeStaleRules()
+	expected := map[string]bool{
+		"iptables -w -D INPUT -d 10.0.0.1/32 -p tcp -m tcp --tcp-flags FIN,SYN,RST,ACK SYN -j NFQUEUE --queue-num 4": true,
+		"ip6tables -w -D FORWARD -d fd00::1/128 -p tcp -j NFQUEUE --queue-balance 4:5":                               true,
+	}
+	found := make(map[string]bool)
+	for _, d := range deleted {
+		found[d] = true
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("deleted rules %v, expected %v", deleted, expected)
+	}
+
+	deleted = nil
+	q.options.ExternalRules = true
+	q.removeStaleRules()
+	if len(deleted) > 0 {
+		t.Fatalf("external rules deleted: %v", deleted)
+	}
+}
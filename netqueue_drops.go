@@ -0,0 +1,91 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Interval between checks of the packets dropped by the kernel during
+// captures
+var queueDropsPollInterval = 250 * time.Millisecond
+
+// queueDropped returns the packets dropped by the kernel in the queues
+// because they were full.
+func queueDropped(pn *ProcNetfilter, numbers []uint) uint {
+	var dropped uint
+	for _, n := range numbers {
+		if q, found := pn.Get(n); found {
+			dropped += q.QueueDropped
+		}
+	}
+	return dropped
+}
+
+// watchDrops polls the stats of the queues during a capture, and reports
+// packets dropped by the kernel because the queues are full. The returned
+// channel is closed if the drops exceed the maximum in the options, so the
+// capture can be aborted. The returned function stops watching.
+func (q *netfilterQueue) watchDrops(id uint64) (<-chan struct{}, func()) {
+	exceeded := make(chan struct{})
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	pn, err := ReadProcNetfilter()
+	if err != nil {
+		log.Printf("Couldn't read netfilter queue stats, drops won't be checked during capture: %v\n", err)
+		close(stopped)
+		return exceeded, func() {}
+	}
+	last := queueDropped(pn, q.numbers())
+	go func() {
+		defer close(stopped)
+		var total uint
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(queueDropsPollInterval):
+			}
+			if err := pn.Update(); err != nil {
+				continue
+			}
+			dropped := queueDropped(pn, q.numbers())
+			if dropped <= last {
+				last = dropped
+				continue
+			}
+			total += dropped - last
+			logWithFields(LogFields{"queue": q.Number, "reload_id": id, "queue_dropped": dropped - last}, "WARNING: kernel dropped %d new connections while retaining them, queue is full\n", dropped-last)
+			if q.options.Events != nil {
+				q.options.Events(CaptureEvent{Event: "capture", State: PacketsDropped, Time: time.Now(), ReloadID: id, Summary: &CaptureSummary{QueueDropped: dropped - last}})
+			}
+			last = dropped
+			if max := q.options.MaxQueueDrops; max > 0 && total > max {
+				logWithFields(LogFields{"queue": q.Number, "reload_id": id, "queue_dropped": total}, "WARNING: %d connections dropped during capture, over the maximum of %d, releasing connections\n", total, max)
+				close(exceeded)
+				return
+			}
+		}
+	}()
+	return exceeded, func() {
+		select {
+		case <-stopped:
+		default:
+			close(stop)
+			<-stopped
+		}
+	}
+}
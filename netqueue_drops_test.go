@@ -0,0 +1,80 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNetfilterQueueWatchDrops(t *testing.T) {
+	stats := tempConfig(t, "3 1 0 2 65531 10 0 20 1\n")
+	defer os.Remove(stats)
+	defer func(path string) { procNetfilterQueuePath = path }(procNetfilterQueuePath)
+	procNetfilterQueuePath = stats
+	defer func(interval time.Duration) { queueDropsPollInterval = interval }(queueDropsPollInterval)
+	queueDropsPollInterval = 10 * time.Millisecond
+
+	events := make(chan CaptureEvent, 10)
+	q := &netfilterQueue{
+		Number: 3,
+		options: NetQueueOptions{
+			MaxQueueDrops: 100,
+			Events:        func(e CaptureEvent) { events <- e },
+		},
+	}
+	exceeded, stop := q.watchDrops(1)
+	defer stop()
+
+	setDropped := func(n int) {
+		if err := ioutil.WriteFile(stats, []byte(fmt.Sprintf("3 1 0 2 65531 %d 0 20 1\n", n)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setDropped(60)
+	select {
+	case e := <-events:
+		if e.State != PacketsDropped || e.ReloadID != 1 || e.Summary.QueueDropped != 50 {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("drops not reported")
+	}
+	select {
+	case <-exceeded:
+		t.Fatal("capture aborted under the maximum drops")
+	default:
+	}
+
+	setDropped(200)
+	select {
+	case <-exceeded:
+	case <-time.After(time.Second):
+		t.Fatal("capture not aborted over the maximum drops")
+	}
+}
+
+func TestNetfilterQueueWaitReleaseAbort(t *testing.T) {
+	q := &netfilterQueue{release: make(chan struct{}), hold: newHoldEstimator(NetQueueHold{})}
+	abort := make(chan struct{})
+	close(abort)
+	if !q.waitRelease(func(time.Duration) {}, abort) {
+		t.Fatal("wait not aborted")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Weight of the last capture in the average duration of captures
+const holdSmoothing = 0.25
+
+// Ratio between the hold timeout and the average duration of captures, so
+// slower reloads than usual don't see their packets accepted too early
+const holdFactor = 2
+
+// NetQueueHold bounds the time packets are held during captures. The timeout
+// adapts to the measured duration of captures, between Min and Max, so
+// packets wait little more than the time haproxy usually needs to reload.
+// Each time the timeout passes, the packets held meanwhile are accepted without
+// waiting for the release. Arrival times are not tracked, so this includes
+// packets received just before, held for less than the timeout. Packets are
+// held until the release if Max is zero.
+type NetQueueHold struct {
+	Min, Max time.Duration
+}
+
+func (h NetQueueHold) validate() error {
+	if h.Min < 0 || h.Max < 0 {
+		return fmt.Errorf("hold timeouts cannot be negative")
+	}
+	if h.Max > 0 && h.Min > h.Max {
+		return fmt.Errorf("minimum hold timeout (%s) over the maximum (%s)", h.Min, h.Max)
+	}
+	return nil
+}
+
+// holdEstimator keeps the average duration of captures, to obtain the
+// timeout of the next one.
+type holdEstimator struct {
+	sync.Mutex
+	hold    NetQueueHold
+	average time.Duration
+
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+}
+
+func newHoldEstimator(hold NetQueueHold) *holdEstimator {
+	return &holdEstimator{hold: hold, now: time.Now, after: time.After}
+}
+
+// timeout returns the time packets can be held in the next capture, zero if
+// they are held until the release. The maximum is used until the first
+// capture is measured.
+func (e *holdEstimator) timeout() time.Duration {
+	e.Lock()
+	defer e.Unlock()
+	if e.hold.Max == 0 {
+		return 0
+	}
+	if e.average == 0 {
+		return e.hold.Max
+	}
+	timeout := holdFactor * e.average
+	if timeout < e.hold.Min {
+		return e.hold.Min
+	}
+	if timeout > e.hold.Max {
+		return e.hold.Max
+	}
+	return timeout
+}
+
+func (e *holdEstimator) observe(d time.Duration) {
+	e.Lock()
+	defer e.Unlock()
+	if e.average == 0 {
+		e.average = d
+		return
+	}
+	e.average = time.Duration(holdSmoothing*float64(d) + (1-holdSmoothing)*float64(e.average))
+}
+
+// measure starts measuring a capture, the returned function finishes it.
+func (e *holdEstimator) measure() func() {
+	start := e.now()
+	return func() {
+		e.observe(e.now().Sub(start))
+	}
+}
+
+// waitRelease waits for the release of the capture. If packets are held with
+// a timeout, expire is called each time it passes, to accept all the packets
+// retained meanwhile, regardless of when they were received. It returns true
+// if the capture is aborted before the release, then the release is still
+// pending.
+func (q *netfilterQueue) waitRelease(expire func(timeout time.Duration), abort <-chan struct{}) bool {
+	defer q.hold.measure()()
+	timeout := q.hold.timeout()
+	if timeout == 0 {
+		select {
+		case <-q.release:
+			return false
+		case <-abort:
+			return true
+		}
+	}
+	for {
+		select {
+		case <-q.release:
+			return false
+		case <-abort:
+			return true
+		case <-q.hold.after(timeout):
+			expire(timeout)
+		}
+	}
+}
+
+// acceptExpired accepts the queued packets when the hold timeout passes. They
+// are accepted before haproxy finishes reloading, so they may reach it in the
+// middle of the reload, it is logged as a warning with the packets accepted.
+func (q *netfilterQueue) acceptExpired(id uint64, timeout time.Duration, queued int64, accept func()) {
+	if queued == 0 {
+		return
+	}
+	logWithFields(LogFields{"queue": q.Number, "reload_id": id, "accepted_packets": queued}, "Warning: hold timeout of %s passed, accepting %d packages before the end of the reload\n", timeout, queued)
+	accept()
+}
@@ -0,0 +1,260 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock whose time only passes when advanced, timers fire
+// when the time passes their deadline.
+type fakeClock struct {
+	sync.Mutex
+	current time.Time
+	timers  []fakeTimer
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.current
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	t := fakeTimer{deadline: c.current.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	return t.c
+}
+
+func (c *fakeClock) timersPending() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.timers)
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.current = c.current.Add(d)
+	var pending []fakeTimer
+	for _, t := range c.timers {
+		if t.deadline.After(c.current) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- c.current
+	}
+	c.timers = pending
+}
+
+func newFakeHoldEstimator(hold NetQueueHold) (*holdEstimator, *fakeClock) {
+	clock := &fakeClock{current: time.Unix(1500000000, 0)}
+	e := newHoldEstimator(hold)
+	e.now = clock.now
+	e.after = clock.after
+	return e, clock
+}
+
+func TestHoldEstimatorAdapts(t *testing.T) {
+	e, clock := newFakeHoldEstimator(NetQueueHold{Min: 100 * time.Millisecond, Max: 2 * time.Second})
+	if timeout := e.timeout(); timeout != 2*time.Second {
+		t.Errorf("expected maximum timeout before measuring, found %s", timeout)
+	}
+
+	capture := func(d time.Duration) {
+		done := e.measure()
+		clock.advance(d)
+		done()
+	}
+	cases := []struct {
+		duration, expected time.Duration
+	}{
+		{200 * time.Millisecond, 400 * time.Millisecond},
+		// 0.25*600 + 0.75*200 = 300ms average
+		{600 * time.Millisecond, 600 * time.Millisecond},
+		// 0.75*300 = 225ms average
+		{0, 450 * time.Millisecond},
+		// 0.25*10 + 0.75*225 = 171.25ms average
+		{10 * time.Millisecond, 342500 * time.Microsecond},
+	}
+	for _, c := range cases {
+		capture(c.duration)
+		if timeout := e.timeout(); timeout != c.expected {
+			t.Errorf("after capture of %s, expected timeout %s, found %s", c.duration, c.expected, timeout)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		capture(time.Millisecond)
+	}
+	if timeout := e.timeout(); timeout != 100*time.Millisecond {
+		t.Errorf("expected minimum timeout, found %s", timeout)
+	}
+	for i := 0; i < 20; i++ {
+		capture(10 * time.Second)
+	}
+	if timeout := e.timeout(); timeout != 2*time.Second {
+		t.Errorf("expected maximum timeout, found %s", timeout)
+	}
+}
+
+func TestHoldEstimatorDisabled(t *testing.T) {
+	e, clock := newFakeHoldEstimator(NetQueueHold{Min: 100 * time.Millisecond})
+	done := e.measure()
+	clock.advance(time.Second)
+	done()
+	if timeout := e.timeout(); timeout != 0 {
+		t.Errorf("expected packets held until release, found timeout %s", timeout)
+	}
+}
+
+func TestNetQueueHoldValidation(t *testing.T) {
+	valid := []NetQueueHold{
+		{},
+		{Min: time.Second},
+		{Min: 100 * time.Millisecond, Max: time.Second},
+		{Min: time.Second, Max: time.Second},
+	}
+	for _, h := range valid {
+		if err := h.validate(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", h, err)
+		}
+	}
+	invalid := []NetQueueHold{
+		{Min: -time.Second},
+		{Max: -time.Second},
+		{Min: 2 * time.Second, Max: time.Second},
+	}
+	for _, h := range invalid {
+		if err := h.validate(); err == nil {
+			t.Errorf("%+v: expected error", h)
+		}
+	}
+}
+
+func TestNetfilterQueueWaitRelease(t *testing.T) {
+	e, clock := newFakeHoldEstimator(NetQueueHold{Min: 100 * time.Millisecond, Max: time.Second})
+	e.observe(200 * time.Millisecond)
+	q := &netfilterQueue{release: make(chan struct{}), hold: e}
+
+	expired := make(chan time.Duration)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.waitRelease(func(timeout time.Duration) {
+			expired <- timeout
+		}, nil)
+	}()
+
+	// Timers are only created by the waiting goroutine, wait for them
+	waitTimer := func() {
+		for retries := 100; ; retries-- {
+			if retries == 0 {
+				t.Fatal("timer not created")
+			}
+			if clock.timersPending() > 0 {
+				return
+			}
+			<-time.After(time.Millisecond)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		waitTimer()
+		clock.advance(400 * time.Millisecond)
+		if timeout := <-expired; timeout != 400*time.Millisecond {
+			t.Errorf("expected hold timeout of 400ms, found %s", timeout)
+		}
+	}
+
+	waitTimer()
+	clock.advance(100 * time.Millisecond)
+	q.release <- struct{}{}
+	<-done
+	select {
+	case timeout := <-expired:
+		t.Errorf("unexpected expiration after release: %s", timeout)
+	default:
+	}
+
+	// 0.25*900 + 0.75*200 = 375ms average
+	if timeout := e.timeout(); timeout != 750*time.Millisecond {
+		t.Errorf("expected timeout adapted to the capture, found %s", timeout)
+	}
+}
+
+func TestNetfilterQueueAcceptExpired(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(ioutil.Discard)
+
+	e, clock := newFakeHoldEstimator(NetQueueHold{Min: 100 * time.Millisecond, Max: time.Second})
+	e.observe(200 * time.Millisecond)
+	q := &netfilterQueue{Number: 3, release: make(chan struct{}), hold: e}
+
+	queued := int64(0)
+	accepted := make(chan int64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.waitRelease(func(timeout time.Duration) {
+			n := atomic.LoadInt64(&queued)
+			q.acceptExpired(7, timeout, n, func() { atomic.AddInt64(&queued, -n) })
+			accepted <- n
+		}, nil)
+	}()
+	waitTimer := func() {
+		for retries := 100; clock.timersPending() == 0; retries-- {
+			if retries == 0 {
+				t.Fatal("timer not created")
+			}
+			<-time.After(time.Millisecond)
+		}
+	}
+
+	// Nothing is logged if no packets are held
+	waitTimer()
+	clock.advance(400 * time.Millisecond)
+	if n := <-accepted; n != 0 || logged.Len() != 0 {
+		t.Fatalf("unexpected expiration without packets: %d accepted, logged %q", n, logged.String())
+	}
+
+	atomic.StoreInt64(&queued, 5)
+	waitTimer()
+	clock.advance(400 * time.Millisecond)
+	if n := <-accepted; n != 5 || atomic.LoadInt64(&queued) != 0 {
+		t.Fatalf("expected 5 packets accepted on expiration, found %d with %d queued", n, atomic.LoadInt64(&queued))
+	}
+	if line := logged.String(); !strings.Contains(line, "Warning") || !strings.Contains(line, "accepting 5 packages before the end of the reload") {
+		t.Fatalf("early accept not warned: %q", line)
+	}
+
+	waitTimer()
+	q.release <- struct{}{}
+	<-done
+}
@@ -15,16 +15,24 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"os"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	nfqueue "github.com/tuenti/go-netfilter-queue"
 	"github.com/vishvananda/netlink"
 )
 
@@ -115,7 +123,10 @@ func TestNetfilterQueue(t *testing.T) {
 	defer netlink.AddrDel(lo, addr)
 
 	queueId := newQueueId()
-	nfQueue := NewNetQueue(queueId, []net.IP{addr.IP})
+	nfQueue, err := NewNetQueue(queueId, []net.IP{addr.IP})
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer nfQueue.Stop()
 
 	port := 80
@@ -170,7 +181,10 @@ func TestNetfilterQueue(t *testing.T) {
 
 func TestNetfilterQueueNoIPs(t *testing.T) {
 	queueId := newQueueId()
-	nfQueue := NewNetQueue(queueId, nil)
+	nfQueue, err := NewNetQueue(queueId, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer nfQueue.Stop()
 
 	pn, err := ReadProcNetfilter()
@@ -195,7 +209,10 @@ func TestNetfilterQueueExists(t *testing.T) {
 	defer netlink.AddrDel(lo, addr)
 
 	queueId := newQueueId()
-	nfQueue := NewNetQueue(queueId, []net.IP{addr.IP})
+	nfQueue, err := NewNetQueue(queueId, []net.IP{addr.IP})
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer nfQueue.Stop()
 
 	pn, err := ReadProcNetfilter()
@@ -220,7 +237,10 @@ func TestNetfilterQueueStop(t *testing.T) {
 	defer netlink.AddrDel(lo, addr)
 
 	queueId := newQueueId()
-	nfQueue := NewNetQueue(queueId, []net.IP{addr.IP})
+	nfQueue, err := NewNetQueue(queueId, []net.IP{addr.IP})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	pn, err := ReadProcNetfilter()
 	if err != nil {
@@ -247,6 +267,528 @@ func TestNetfilterQueueStop(t *testing.T) {
 	}
 }
 
+func TestNetfilterQueueCaptureEvents(t *testing.T) {
+	lo, _ := netlink.LinkByName("lo")
+	addr, _ := netlink.ParseAddr("127.0.1.102/32")
+	err := netlink.AddrAdd(lo, addr)
+	if err != nil {
+		t.Fatal("couldn't change network configuration: ", err)
+	}
+	defer netlink.AddrDel(lo, addr)
+
+	events := make(chan CaptureEvent, 10)
+	queueId := newQueueId()
+	nfQueue, err := NewNetQueueWithOptions(queueId, []net.IP{addr.IP}, NetQueueOptions{
+		Events: func(e CaptureEvent) { events <- e },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nfQueue.Stop()
+
+	nfQueue.Capture()
+	nfQueue.Release()
+
+	expected := []string{CaptureRequested, RulesInstalled, CapturingActive, ReleaseRequested, RulesRemoved, CaptureSummarized}
+	var last time.Time
+	for _, state := range expected {
+		select {
+		case e := <-events:
+			if e.State != state || e.ReloadID != 1 {
+				t.Fatalf("found event %+v, expected state %s of reload 1", e, state)
+			}
+			if e.Time.Before(last) {
+				t.Fatalf("event %s before the previous one", e.State)
+			}
+			if (e.State == CaptureSummarized) != (e.Summary != nil) {
+				t.Fatalf("unexpected summary in event %+v", e)
+			}
+			last = e.Time
+		case <-time.After(time.Second):
+			t.Fatalf("event %s not received", state)
+		}
+	}
+}
+
+func TestNetfilterQueueRules(t *testing.T) {
+	ip := net.ParseIP("10.0.0.1")
+	cases := []struct {
+		limit    *NetQueueLimit
+		expected []string
+	}{
+		{
+			limit: nil,
+			expected: []string{
+				"INPUT -w -p tcp --syn --destination 10.0.0.1 -j NFQUEUE --queue-num 3",
+			},
+		},
+		{
+			limit: &NetQueueLimit{Rate: "100/second", Burst: 10},
+			expected: []string{
+				"INPUT -w -p tcp --syn --destination 10.0.0.1 -m limit --limit 100/second --limit-burst 10 -j NFQUEUE --queue-num 3",
+			},
+		},
+		{
+			limit: &NetQueueLimit{Rate: "10/s", Burst: 5, PerSource: true, Drop: true},
+			expected: []string{
+				"INPUT -w -p tcp --syn --destination 10.0.0.1 -m hashlimit --hashlimit-upto 10/s --hashlimit-burst 5 --hashlimit-mode srcip --hashlimit-name haproxy-queue-3 -j NFQUEUE --queue-num 3",
+				"INPUT -w -p tcp --syn --destination 10.0.0.1 -j DROP",
+			},
+		},
+	}
+	for _, c := range cases {
+		q := &netfilterQueue{Number: 3, options: NetQueueOptions{Limit: c.limit}}
+		var found []string
+		for _, rule := range q.rules(ip) {
+			found = append(found, strings.Join(rule, " "))
+		}
+		if !reflect.DeepEqual(found, c.expected) {
+			t.Errorf("found rules %v, expected %v", found, c.expected)
+		}
+	}
+}
+
+func TestNetfilterQueueIptablesDualStack(t *testing.T) {
+	var commands []string
+	defer func(run func(string, ...string) error) { runIptables = run }(runIptables)
+	runIptables = func(command string, args ...string) error {
+		commands = append(commands, command+" "+strings.Join(args, " "))
+		return nil
+	}
+
+	q := &netfilterQueue{
+		Number: 3,
+		IPs:    []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")},
+	}
+	if err := q.installRules(); err != nil {
+		t.Fatal(err)
+	}
+	q.removeRules()
+	expected := []string{
+		"iptables -A INPUT -w -p tcp --syn --destination 10.0.0.1 -j NFQUEUE --queue-num 3",
+		"ip6tables -A INPUT -w -p tcp --syn --destination fd00::1 -j NFQUEUE --queue-num 3",
+		"ip6tables -D INPUT -w -p tcp --syn --destination fd00::1 -j NFQUEUE --queue-num 3",
+		"iptables -D INPUT -w -p tcp --syn --destination 10.0.0.1 -j NFQUEUE --queue-num 3",
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("found commands %v, expected %v", commands, expected)
+	}
+}
+
+func TestNetfilterQueueIptablesRollback(t *testing.T) {
+	var commands []string
+	defer func(run func(string, ...string) error) { runIptables = run }(runIptables)
+	defer func(attempts int) { iptablesAttempts = attempts }(iptablesAttempts)
+	iptablesAttempts = 1
+	runIptables = func(command string, args ...string) error {
+		commands = append(commands, command+" "+strings.Join(args, " "))
+		if command == "ip6tables" && args[0] == iptablesAddFlag {
+			return errors.New("exit status 4")
+		}
+		return nil
+	}
+
+	q := &netfilterQueue{
+		Number:  3,
+		IPs:     []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")},
+		options: NetQueueOptions{Limit: &NetQueueLimit{Rate: "10/s", Burst: 5, Drop: true}},
+	}
+	if err := q.installRules(); err == nil {
+		t.Fatal("expected error installing rules")
+	}
+	expected := []string{
+		"iptables -A INPUT -w -p tcp --syn --destination 10.0.0.1 -m limit --limit 10/s --limit-burst 5 -j NFQUEUE --queue-num 3",
+		"iptables -A INPUT -w -p tcp --syn --destination 10.0.0.1 -j DROP",
+		"ip6tables -A INPUT -w -p tcp --syn --destination fd00::1 -m limit --limit 10/s --limit-burst 5 -j NFQUEUE --queue-num 3",
+		"iptables -D INPUT -w -p tcp --syn --destination 10.0.0.1 -j DROP",
+		"iptables -D INPUT -w -p tcp --syn --destination 10.0.0.1 -m limit --limit 10/s --limit-burst 5 -j NFQUEUE --queue-num 3",
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("found commands %v, expected %v", commands, expected)
+	}
+
+	// Nothing is left to remove on release
+	commands = nil
+	q.removeRules()
+	if len(commands) != 0 {
+		t.Fatalf("unexpected commands on release: %v", commands)
+	}
+}
+
+func TestNetfilterQueueRulesBridge(t *testing.T) {
+	ip := net.ParseIP("172.17.0.2")
+	q := &netfilterQueue{
+		Number:  3,
+		options: NetQueueOptions{Limit: &NetQueueLimit{Rate: "10/s", Burst: 5, Drop: true}},
+		chains:  map[string]string{ip.String(): dockerUserChain},
+	}
+	var added, deleted []string
+	for i, rule := range q.rules(ip) {
+		added = append(added, strings.Join(ruleArgs(iptablesAddFlag, i, rule), " "))
+		deleted = append(deleted, strings.Join(ruleArgs(iptablesDeleteFlag, i, rule), " "))
+	}
+	expectedAdded := []string{
+		"-I DOCKER-USER 1 -w -p tcp --syn --destination 172.17.0.2 -m limit --limit 10/s --limit-burst 5 -j NFQUEUE --queue-num 3",
+		"-I DOCKER-USER 2 -w -p tcp --syn --destination 172.17.0.2 -j DROP",
+	}
+	expectedDeleted := []string{
+		"-D DOCKER-USER -w -p tcp --syn --destination 172.17.0.2 -m limit --limit 10/s --limit-burst 5 -j NFQUEUE --queue-num 3",
+		"-D DOCKER-USER -w -p tcp --syn --destination 172.17.0.2 -j DROP",
+	}
+	if !reflect.DeepEqual(added, expectedAdded) {
+		t.Errorf("found rules %v, expected %v", added, expectedAdded)
+	}
+	if !reflect.DeepEqual(deleted, expectedDeleted) {
+		t.Errorf("found rules %v, expected %v", deleted, expectedDeleted)
+	}
+}
+
+func TestNetfilterQueueRulesChains(t *testing.T) {
+	ip := net.ParseIP("10.0.0.1")
+	q := &netfilterQueue{
+		Number:  3,
+		options: NetQueueOptions{Chains: chainArgs("OUTPUT, FORWARD"), Limit: &NetQueueLimit{Rate: "10/s", Burst: 5, Drop: true}},
+		chains:  map[string]string{ip.String(): "INPUT"},
+	}
+	var added []string
+	for _, args := range addRuleArgs(q.rules(ip)) {
+		added = append(added, strings.Join(args, " "))
+	}
+	expected := []string{
+		"-I OUTPUT 1 -w -p tcp --syn --destination 10.0.0.1 -m limit --limit 10/s --limit-burst 5 -j NFQUEUE --queue-num 3",
+		"-I OUTPUT 2 -w -p tcp --syn --destination 10.0.0.1 -j DROP",
+		"-I FORWARD 1 -w -p tcp --syn --destination 10.0.0.1 -m limit --limit 10/s --limit-burst 5 -j NFQUEUE --queue-num 3",
+		"-I FORWARD 2 -w -p tcp --syn --destination 10.0.0.1 -j DROP",
+	}
+	if !reflect.DeepEqual(added, expected) {
+		t.Errorf("found rules %v, expected %v", added, expected)
+	}
+
+	for _, chains := range []string{"INPUT,", "-j ACCEPT", "IN PUT"} {
+		if _, err := newNetfilterQueue(3, []net.IP{ip}, NetQueueOptions{Networking: NetworkingHost, Chains: chainArgs(chains)}); err == nil {
+			t.Errorf("%q: expected invalid chains", chains)
+		}
+	}
+}
+
+func TestNetfilterQueueRulesExtraMatch(t *testing.T) {
+	ip := net.ParseIP("10.0.0.1")
+	q := &netfilterQueue{Number: 3, options: NetQueueOptions{ExtraMatch: strings.Fields("-m multiport --dports 80,443")}}
+	rules := q.rules(ip)
+	expected := "INPUT -w -p tcp --syn --destination 10.0.0.1 -m multiport --dports 80,443 -j NFQUEUE --queue-num 3"
+	if len(rules) != 1 || strings.Join(rules[0], " ") != expected {
+		t.Errorf("found rules %v, expected %v", rules, expected)
+	}
+
+	for _, match := range []string{"--dport 443 -j ACCEPT", "--goto OTHER", "--queue-num 4"} {
+		if _, err := newNetfilterQueue(3, []net.IP{ip}, NetQueueOptions{Networking: NetworkingHost, ExtraMatch: strings.Fields(match)}); err == nil {
+			t.Errorf("%q: expected invalid match", match)
+		}
+	}
+}
+
+func TestNetfilterQueueRulesMatch(t *testing.T) {
+	ip := net.ParseIP("10.0.0.1")
+	cases := map[string]string{
+		"":                     "INPUT -w -p tcp --syn --destination 10.0.0.1 -j NFQUEUE --queue-num 3",
+		NetQueueMatchSyn:       "INPUT -w -p tcp --syn --destination 10.0.0.1 -j NFQUEUE --queue-num 3",
+		NetQueueMatchConntrack: "INPUT -w -p tcp -m conntrack --ctstate NEW --destination 10.0.0.1 -j NFQUEUE --queue-num 3",
+	}
+	for match, expected := range cases {
+		q := &netfilterQueue{Number: 3, options: NetQueueOptions{Match: match}}
+		rules := q.rules(ip)
+		if len(rules) != 1 || strings.Join(rules[0], " ") != expected {
+			t.Errorf("%q: found rules %v, expected %v", match, rules, expected)
+		}
+	}
+}
+
+func TestPrintNetQueueRules(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}
+	options := NetQueueOptions{
+		Networking: NetworkingHost,
+		Limit:      &NetQueueLimit{Rate: "10/s", Burst: 5, Drop: true},
+	}
+	var buf bytes.Buffer
+	if err := PrintNetQueueRules(&buf, 3, ips, options); err != nil {
+		t.Fatal(err)
+	}
+	expected := `iptables -A INPUT -w -p tcp --syn --destination 10.0.0.1 -m limit --limit 10/s --limit-burst 5 -j NFQUEUE --queue-num 3 --queue-bypass
+iptables -A INPUT -w -p tcp --syn --destination 10.0.0.1 -j DROP
+ip6tables -A INPUT -w -p tcp --syn --destination fd00::1 -m limit --limit 10/s --limit-burst 5 -j NFQUEUE --queue-num 3 --queue-bypass
+ip6tables -A INPUT -w -p tcp --syn --destination fd00::1 -j DROP
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected rules:\n%s", buf.String())
+	}
+
+	if err := PrintNetQueueRules(&buf, 3, nil, options); err == nil {
+		t.Error("expected error without IPs")
+	}
+	options.Match = "ack"
+	if err := PrintNetQueueRules(&buf, 3, ips, options); err == nil {
+		t.Error("expected error with invalid options")
+	}
+}
+
+func TestNetQueueMatchValidation(t *testing.T) {
+	defer func(path string) { conntrackCheckPath = path }(conntrackCheckPath)
+
+	conntrackCheckPath = "/nonexistent"
+	if err := validateMatch(NetQueueMatchConntrack); err == nil {
+		t.Error("expected error if conntrack is not available")
+	}
+	conntrackCheckPath = "/"
+	if err := validateMatch(NetQueueMatchConntrack); err != nil {
+		t.Errorf("unexpected error with conntrack available: %v", err)
+	}
+	if err := validateMatch("ack"); err == nil {
+		t.Error("expected error for unknown strategy")
+	}
+}
+
+func TestSelectChains(t *testing.T) {
+	local := net.ParseIP("10.0.0.1")
+	remote := net.ParseIP("172.17.0.2")
+	ips := []net.IP{local, remote}
+	cases := []struct {
+		networking string
+		expected   map[string]string
+	}{
+		{NetworkingHost, map[string]string{"10.0.0.1": "INPUT", "172.17.0.2": "INPUT"}},
+		{NetworkingBridge, map[string]string{"10.0.0.1": "FORWARD", "172.17.0.2": "FORWARD"}},
+		{NetworkingAuto, map[string]string{"10.0.0.1": "INPUT", "172.17.0.2": "FORWARD"}},
+	}
+	for _, c := range cases {
+		chains, err := selectChains(ips, c.networking, []net.IP{local}, forwardChain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(chains, c.expected) {
+			t.Errorf("%s: found chains %v, expected %v", c.networking, chains, c.expected)
+		}
+	}
+	if _, err := selectChains(ips, "overlay", nil, forwardChain); err == nil {
+		t.Error("expected error for unknown networking mode")
+	}
+}
+
+func TestNetQueueLimitValidation(t *testing.T) {
+	valid := []*NetQueueLimit{nil, {}, {Rate: "100/second", Burst: 1}, {Rate: "5/m", Burst: 2}}
+	for _, l := range valid {
+		if err := l.validate(); err != nil {
+			t.Errorf("unexpected error for %+v: %v", l, err)
+		}
+	}
+	invalid := []*NetQueueLimit{{Rate: "fast", Burst: 1}, {Rate: "100", Burst: 1}, {Rate: "100/second"}}
+	for _, l := range invalid {
+		if err := l.validate(); err == nil {
+			t.Errorf("expected error for %+v", l)
+		}
+	}
+}
+
+func TestNetQueueSizeValidation(t *testing.T) {
+	for _, n := range []uint{1, 1024, defaultMaxQueuedPackets, math.MaxUint32} {
+		if err := validateQueueSize(n); err != nil {
+			t.Errorf("unexpected error for size %d: %v", n, err)
+		}
+	}
+	for _, n := range []uint{0, math.MaxUint32 + 1} {
+		if err := validateQueueSize(n); err == nil {
+			t.Errorf("expected error for size %d", n)
+		}
+	}
+
+	options := NetQueueOptions{}
+	if options.queueSize() != defaultMaxQueuedPackets || options.packetTimeout() != defaultPacketTimeout {
+		t.Fatalf("unexpected defaults: %d, %s", options.queueSize(), options.packetTimeout())
+	}
+	options = NetQueueOptions{MaxQueuedPackets: 1000, PacketTimeout: time.Millisecond}
+	if options.queueSize() != 1000 || options.packetTimeout() != time.Millisecond {
+		t.Fatalf("unexpected settings: %d, %s", options.queueSize(), options.packetTimeout())
+	}
+	if err := (NetQueueOptions{PacketTimeout: -time.Second}).validateQueue(); err == nil {
+		t.Fatal("expected error for negative packet timeout")
+	}
+	if _, err := newNetfilterQueue(0, []net.IP{net.ParseIP("10.0.0.1")}, NetQueueOptions{MaxQueuedPackets: math.MaxUint32 + 1, Networking: NetworkingHost}); err == nil {
+		t.Fatal("expected error creating queue with invalid size")
+	}
+}
+
+func TestAcceptPackets(t *testing.T) {
+	for _, workers := range []int{0, 1, 4, 200} {
+		packets := make(chan nfqueue.NFPacket, 100)
+		for i := 0; i < 100; i++ {
+			packets <- nfqueue.NFPacket{}
+		}
+		accepted := int64(0)
+		acceptPackets(packets, 100, workers, func(*nfqueue.NFPacket) {
+			atomic.AddInt64(&accepted, 1)
+		})
+		if accepted != 100 || len(packets) != 0 {
+			t.Errorf("%d workers: accepted %d packets, %d left", workers, accepted, len(packets))
+		}
+	}
+}
+
+func TestIptablesRetry(t *testing.T) {
+	defer func(run func(string, ...string) error) { runIptables = run }(runIptables)
+	defer func(backoff time.Duration) { iptablesBackoff = backoff }(iptablesBackoff)
+	iptablesBackoff = time.Millisecond
+
+	failures := 0
+	calls := 0
+	runIptables = func(command string, args ...string) error {
+		calls++
+		if calls <= failures {
+			return errors.New("exit status 4: Another app is currently holding the xtables lock")
+		}
+		return nil
+	}
+
+	failures = iptablesAttempts - 1
+	if err := iptables("iptables", "-A", "INPUT"); err != nil {
+		t.Fatalf("command not retried: %v", err)
+	}
+	if calls != iptablesAttempts {
+		t.Fatalf("found %d calls, expected %d", calls, iptablesAttempts)
+	}
+
+	calls = 0
+	failures = iptablesAttempts
+	if err := iptables("iptables", "-A", "INPUT"); err == nil || !strings.Contains(err.Error(), "xtables lock") {
+		t.Fatalf("expected error after %d attempts, found %v", iptablesAttempts, err)
+	}
+	if calls != iptablesAttempts {
+		t.Fatalf("found %d calls, expected %d", calls, iptablesAttempts)
+	}
+}
+
+// TestNetfilterQueueCaptureFailure checks that captures fail when the rules
+// cannot be installed, and that later captures can still be done.
+func TestNetfilterQueueCaptureFailure(t *testing.T) {
+	q := &netfilterQueue{
+		capture:   make(chan uint64),
+		capturing: make(chan error),
+		release:   make(chan struct{}),
+		released:  make(chan error),
+	}
+	fail := errors.New("iptables failed adding rule")
+	go func() {
+		attempt := 0
+		for range q.capture {
+			attempt++
+			if attempt == 1 {
+				q.capturing <- fail
+				continue
+			}
+			q.capturing <- nil
+			<-q.release
+			q.released <- fail
+		}
+	}()
+	defer close(q.capture)
+
+	if err := q.Capture(); err != fail {
+		t.Fatalf("found error %v, expected %v", err, fail)
+	}
+	if q.refs != 0 || q.window != nil {
+		t.Fatalf("failed capture not discarded: %d references", q.refs)
+	}
+	if err := q.Capture(); err != nil {
+		t.Fatalf("capture after failure: %v", err)
+	}
+	if err := q.Release(); err != fail {
+		t.Fatalf("found error %v releasing, expected %v", err, fail)
+	}
+	if q.refs != 0 || q.window != nil {
+		t.Fatalf("capture not released: %d references", q.refs)
+	}
+}
+
+// TestNetfilterQueueCaptureCoalescing fires overlapping captures and releases
+// against a fake control loop, checking that captures share the rules
+// installed and that rules are only removed when all captures are released.
+func TestNetfilterQueueCaptureCoalescing(t *testing.T) {
+	q := &netfilterQueue{
+		capture:   make(chan uint64),
+		capturing: make(chan error),
+		release:   make(chan struct{}),
+		released:  make(chan error),
+	}
+	var installed int32
+	windows := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range q.capture {
+			if !atomic.CompareAndSwapInt32(&installed, 0, 1) {
+				t.Error("rules installed twice")
+			}
+			windows++
+			q.capturing <- nil
+			<-q.release
+			atomic.StoreInt32(&installed, 0)
+			q.released <- nil
+		}
+	}()
+
+	const goroutines, iterations = 50, 200
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				if err := q.Capture(); err != nil {
+					t.Error(err)
+				}
+				if atomic.LoadInt32(&installed) != 1 {
+					t.Error("capture returned without rules installed")
+				}
+				q.Release()
+			}
+		}()
+	}
+	wg.Wait()
+	close(q.capture)
+	<-done
+
+	if q.refs != 0 || q.window != nil {
+		t.Fatalf("captures not released: %d references", q.refs)
+	}
+	if atomic.LoadInt32(&installed) != 0 {
+		t.Fatal("rules not removed")
+	}
+	if windows == 0 || windows > goroutines*iterations {
+		t.Fatalf("unexpected number of capture windows: %d", windows)
+	}
+	t.Logf("%d captures coalesced in %d windows", goroutines*iterations, windows)
+
+	// Releases without captures are ignored
+	q.Release()
+}
+
+// benchmarkAcceptPackets measures the time needed to accept retained packets
+// with a verdict that takes some time to be set.
+func benchmarkAcceptPackets(b *testing.B, workers int) {
+	const n = 100
+	packets := make(chan nfqueue.NFPacket, n)
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < n; j++ {
+			packets <- nfqueue.NFPacket{}
+		}
+		acceptPackets(packets, n, workers, func(*nfqueue.NFPacket) {
+			time.Sleep(10 * time.Microsecond)
+		})
+	}
+}
+
+func BenchmarkAcceptPackets1Worker(b *testing.B)   { benchmarkAcceptPackets(b, 1) }
+func BenchmarkAcceptPackets4Workers(b *testing.B)  { benchmarkAcceptPackets(b, 4) }
+func BenchmarkAcceptPackets16Workers(b *testing.B) { benchmarkAcceptPackets(b, 16) }
+
 func BenchmarkProcNetfilterUpdateAndRead(b *testing.B) {
 	lo, _ := netlink.LinkByName("lo")
 	addr, _ := netlink.ParseAddr("127.0.1.101/32")
@@ -257,7 +799,10 @@ func BenchmarkProcNetfilterUpdateAndRead(b *testing.B) {
 	defer netlink.AddrDel(lo, addr)
 
 	queueId := newQueueId()
-	nfQueue := NewNetQueue(queueId, []net.IP{addr.IP})
+	nfQueue, err := NewNetQueue(queueId, []net.IP{addr.IP})
+	if err != nil {
+		b.Fatal(err)
+	}
 	defer nfQueue.Stop()
 
 	pn, err := ReadProcNetfilter()
@@ -286,7 +831,10 @@ func BenchmarkNetfilterQueueCaptureReleaseOverload(b *testing.B) {
 	defer netlink.AddrDel(lo, addr)
 
 	queueId := newQueueId()
-	nfQueue := NewNetQueue(queueId, []net.IP{addr.IP})
+	nfQueue, err := NewNetQueue(queueId, []net.IP{addr.IP})
+	if err != nil {
+		b.Fatal(err)
+	}
 	defer nfQueue.Stop()
 
 	// TODO: Send packets during the capture
@@ -297,3 +845,184 @@ func BenchmarkNetfilterQueueCaptureReleaseOverload(b *testing.B) {
 	}
 	b.StopTimer()
 }
+
+func TestNetfilterQueueBalance(t *testing.T) {
+	ip := net.ParseIP("10.0.0.1")
+	q := &netfilterQueue{Number: 100, options: NetQueueOptions{Queues: 4}}
+	expected := "INPUT -w -p tcp --syn --destination 10.0.0.1 -j NFQUEUE --queue-balance 100:103"
+	if rules := q.rules(ip); len(rules) != 1 || strings.Join(rules[0], " ") != expected {
+		t.Fatalf("found rules %v, expected %s", rules, expected)
+	}
+	if numbers := q.numbers(); !reflect.DeepEqual(numbers, []uint{100, 101, 102, 103}) {
+		t.Fatalf("unexpected queues: %v", numbers)
+	}
+
+	q = &netfilterQueue{Number: 100, options: NetQueueOptions{Queues: 1}}
+	if rules := q.rules(ip); strings.Join(rules[0], " ") != "INPUT -w -p tcp --syn --destination 10.0.0.1 -j NFQUEUE --queue-num 100" {
+		t.Fatalf("unexpected rule for a single queue: %v", rules[0])
+	}
+
+	for _, c := range []struct {
+		n      uint
+		queues int
+		valid  bool
+	}{
+		{0, 1, true},
+		{100, 4, true},
+		{65532, 4, true},
+		{65533, 4, false},
+		{100, 0, false},
+		{100, -1, false},
+	} {
+		if err := validateQueueRange(c.n, c.queues); (err == nil) != c.valid {
+			t.Errorf("unexpected result validating %d queues from %d: %v", c.queues, c.n, err)
+		}
+	}
+
+	pn := &ProcNetfilter{queues: make(map[uint]ProcNetfilterQueue)}
+	stats := "100 1 0 2 65531 0 0 20 1\n101 1 3 2 65531 0 0 20 1\n"
+	if err := pn.read(strings.NewReader(stats)); err != nil {
+		t.Fatal(err)
+	}
+	if !pn.waiting([]uint{100, 101}) || pn.waiting([]uint{100, 102}) {
+		t.Fatal("packets waiting not found in all the queues")
+	}
+}
+
+func TestProcNetfilterColumns(t *testing.T) {
+	pn := &ProcNetfilter{queues: make(map[uint]ProcNetfilterQueue)}
+	stats := `  100 1 0 2 65531 4 5 20 1
+101 1 3 2 65531 0 0 20 1 7 8
+102 1 2
+103 1 x 2 65531 0 0 20 1
+
+`
+	if err := pn.read(strings.NewReader(stats)); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[uint]ProcNetfilterQueue{
+		100: {ID: 100, PortID: 1, CopyMode: 2, CopyRange: 65531, QueueDropped: 4, UserDropped: 5, LastSeq: 20, One: 1},
+		101: {ID: 101, PortID: 1, Waiting: 3, CopyMode: 2, CopyRange: 65531, LastSeq: 20, One: 1},
+		102: {ID: 102, PortID: 1, Waiting: 2},
+	}
+	if !reflect.DeepEqual(pn.queues, expected) {
+		t.Fatalf("found queues %+v, expected %+v", pn.queues, expected)
+	}
+
+	if err := pn.read(strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	if len(pn.queues) != 0 {
+		t.Fatalf("found queues %+v in empty file", pn.queues)
+	}
+}
+
+func TestNetQueueWithoutNetAdmin(t *testing.T) {
+	status := tempConfig(t, "CapEff:\t0000000000000020\n")
+	defer os.Remove(status)
+	defer func(path string) { procSelfStatusPath = path }(procSelfStatusPath)
+	procSelfStatusPath = status
+
+	if err := checkNetAdmin(); err == nil {
+		t.Fatal("expected error without CAP_NET_ADMIN")
+	}
+	q, err := NewNetQueueWithOptions(0, []net.IP{net.ParseIP("10.0.0.1")}, NetQueueOptions{Networking: NetworkingHost})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.(*dummyNetQueue); !ok {
+		t.Fatalf("expected capture disabled without CAP_NET_ADMIN, found %T", q)
+	}
+	if err := q.Capture(); err != nil {
+		t.Fatalf("unexpected error capturing without CAP_NET_ADMIN: %v", err)
+	}
+	if err := q.Release(); err != nil {
+		t.Fatalf("unexpected error releasing without CAP_NET_ADMIN: %v", err)
+	}
+	q.Stop()
+
+	procSelfStatusPath = "/nonexistent"
+	if err := checkNetAdmin(); err != nil {
+		t.Fatalf("capabilities should be assumed if they cannot be read: %v", err)
+	}
+}
+
+func TestNetfilterQueueSetIPs(t *testing.T) {
+	var commands []string
+	defer func(run func(string, ...string) error) { runIptables = run }(runIptables)
+	runIptables = func(command string, args ...string) error {
+		commands = append(commands, command+" "+strings.Join(args, " "))
+		return nil
+	}
+
+	q, err := newNetfilterQueue(3, []net.IP{net.ParseIP("10.0.0.1")}, NetQueueOptions{Networking: NetworkingHost})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.installRules(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SetIPs([]net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")}); err != nil {
+		t.Fatal(err)
+	}
+	// Rules of the capture in progress are removed on release
+	q.removeRules()
+	if err := q.installRules(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"iptables -A INPUT -w -p tcp --syn --destination 10.0.0.1 -j NFQUEUE --queue-num 3",
+		"iptables -D INPUT -w -p tcp --syn --destination 10.0.0.1 -j NFQUEUE --queue-num 3",
+		"iptables -A INPUT -w -p tcp --syn --destination 10.0.0.2 -j NFQUEUE --queue-num 3",
+		"ip6tables -A INPUT -w -p tcp --syn --destination fd00::2 -j NFQUEUE --queue-num 3",
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("found commands %v, expected %v", commands, expected)
+	}
+
+	external, err := newNetfilterQueue(3, []net.IP{net.ParseIP("10.0.0.1")}, NetQueueOptions{Networking: NetworkingHost, ExternalRules: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := external.SetIPs([]net.IP{net.ParseIP("10.0.0.2")}); err == nil {
+		t.Fatal("expected error updating addresses of externally managed rules")
+	}
+	if err := (&dummyNetQueue{}).SetIPs(nil); err != errCaptureDisabled {
+		t.Fatalf("unexpected error updating addresses of dummy queue: %v", err)
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	start := time.Now()
+	err := runCommandTimeout(100*time.Millisecond, "sleep", "10")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout, found %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("command not killed on timeout, took %s", elapsed)
+	}
+
+	if err := runCommandTimeout(time.Second, "true"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommandTimeout(0, "false"); err == nil {
+		t.Fatal("expected error of failed command")
+	}
+}
+
+func TestUnusableIPReason(t *testing.T) {
+	cases := map[string]bool{
+		"10.0.0.1":        false,
+		"fd00::1":         false,
+		"0.0.0.0":         true,
+		"::":              true,
+		"224.0.0.1":       true,
+		"ff02::1":         true,
+		"255.255.255.255": true,
+	}
+	for addr, unusable := range cases {
+		if reason := unusableIPReason(net.ParseIP(addr)); (reason != "") != unusable {
+			t.Errorf("%s: found reason %q, expected unusable: %v", addr, reason, unusable)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// oldWorkers tracks the processes replaced by reloads while they drain their
+// connections, and terminates the ones lingering for longer than a maximum
+// lifetime, if set.
+type oldWorkers struct {
+	sync.Mutex
+	lifetime time.Duration
+	retired  map[int]time.Time
+	killed   int
+
+	// signal sends a signal to a process, it can be replaced in tests
+	signal func(pid int, sig syscall.Signal) error
+}
+
+func newOldWorkers(lifetime time.Duration) *oldWorkers {
+	return &oldWorkers{
+		lifetime: lifetime,
+		retired:  make(map[int]time.Time),
+		signal:   syscall.Kill,
+	}
+}
+
+// Add starts tracking the processes replaced in a reload. Processes already
+// tracked keep the time they were first replaced.
+func (w *oldWorkers) Add(pids []int) {
+	w.Lock()
+	defer w.Unlock()
+	now := time.Now()
+	for _, pid := range pids {
+		if _, found := w.retired[pid]; found {
+			continue
+		}
+		w.retired[pid] = now
+		if w.lifetime > 0 {
+			retired := now
+			pid := pid
+			time.AfterFunc(w.lifetime, func() { w.expire(pid, retired) })
+		}
+	}
+}
+
+// expire kills the process if it is still running since it was replaced.
+func (w *oldWorkers) expire(pid int, retired time.Time) {
+	w.Lock()
+	defer w.Unlock()
+	if t, found := w.retired[pid]; !found || !t.Equal(retired) {
+		return
+	}
+	delete(w.retired, pid)
+	if w.signal(pid, syscall.Signal(0)) != nil {
+		return
+	}
+	if err := w.signal(pid, syscall.SIGKILL); err != nil {
+		log.Printf("Couldn't terminate old haproxy process with pid %d: %v\n", pid, err)
+		return
+	}
+	w.killed++
+	log.Printf("Old process with pid %d terminated after draining connections for %s\n", pid, w.lifetime)
+}
+
+// Finished stops tracking a process that exited by itself.
+func (w *oldWorkers) Finished(pid int) {
+	w.Lock()
+	defer w.Unlock()
+	delete(w.retired, pid)
+}
+
+// Count returns the number of old processes still running and the number
+// of processes terminated after their maximum lifetime.
+func (w *oldWorkers) Count() (running, killed int) {
+	w.Lock()
+	defer w.Unlock()
+	for pid := range w.retired {
+		if w.signal(pid, syscall.Signal(0)) != nil {
+			delete(w.retired, pid)
+		}
+	}
+	return len(w.retired), w.killed
+}
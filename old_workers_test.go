@@ -0,0 +1,102 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeProcesses simulates running processes for oldWorkers.
+type fakeProcesses struct {
+	sync.Mutex
+	running map[int]bool
+	killed  []int
+}
+
+func (p *fakeProcesses) signal(pid int, sig syscall.Signal) error {
+	p.Lock()
+	defer p.Unlock()
+	if !p.running[pid] {
+		return syscall.ESRCH
+	}
+	if sig == syscall.SIGKILL {
+		delete(p.running, pid)
+		p.killed = append(p.killed, pid)
+	}
+	return nil
+}
+
+func (p *fakeProcesses) exit(pid int) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.running, pid)
+}
+
+func (p *fakeProcesses) killedPids() []int {
+	p.Lock()
+	defer p.Unlock()
+	killed := append([]int{}, p.killed...)
+	sort.Ints(killed)
+	return killed
+}
+
+func TestOldWorkersLifetime(t *testing.T) {
+	processes := &fakeProcesses{running: map[int]bool{10: true, 11: true, 20: true}}
+	w := newOldWorkers(200 * time.Millisecond)
+	w.signal = processes.signal
+
+	// First reload replaces 10 and 11, 11 finishes draining by itself
+	w.Add([]int{10, 11})
+	processes.exit(11)
+	time.Sleep(100 * time.Millisecond)
+	// Second reload replaces 20, 10 keeps its original replacement time
+	w.Add([]int{10, 20})
+	if running, killed := w.Count(); running != 2 || killed != 0 {
+		t.Fatalf("unexpected old workers: %d running, %d killed", running, killed)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if killed := processes.killedPids(); !reflect.DeepEqual(killed, []int{10}) {
+		t.Fatalf("unexpected processes killed: %v", killed)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if killed := processes.killedPids(); !reflect.DeepEqual(killed, []int{10, 20}) {
+		t.Fatalf("unexpected processes killed: %v", killed)
+	}
+	if running, killed := w.Count(); running != 0 || killed != 2 {
+		t.Fatalf("unexpected old workers: %d running, %d killed", running, killed)
+	}
+}
+
+func TestOldWorkersUnlimited(t *testing.T) {
+	processes := &fakeProcesses{running: map[int]bool{10: true}}
+	w := newOldWorkers(0)
+	w.signal = processes.signal
+
+	w.Add([]int{10})
+	time.Sleep(20 * time.Millisecond)
+	if running, killed := w.Count(); running != 1 || killed != 0 {
+		t.Fatalf("unexpected old workers: %d running, %d killed", running, killed)
+	}
+	w.Finished(10)
+	if running, _ := w.Count(); running != 0 {
+		t.Fatalf("finished worker still tracked")
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Policy is a set of assertions the configuration must satisfy to be
+// applied, so configurations not following organizational standards are
+// rejected before validating them with haproxy.
+//
+// Policies are read from files with an assertion per line, empty lines and
+// lines starting with # are ignored. Sections are selected by a
+// comma-separated list of kinds. Available assertions are:
+//
+//	section <kind>                    at least one section of the kind exists
+//	directive <kinds> <keywords...>   all the sections have the directive
+//	forbid <kinds> <keywords...>      no section has the directive
+//	bind-ports <kinds> <ports>        all binds of the sections are in the
+//	                                  comma-separated list of ports or ranges
+type Policy struct {
+	assertions []policyAssertion
+}
+
+// policyAssertion checks a configuration, returning its violations.
+type policyAssertion interface {
+	check(config *haproxyConfig) []string
+}
+
+// LoadPolicy reads a policy from a file.
+func LoadPolicy(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParsePolicy(f)
+}
+
+// ParsePolicy reads a policy, with an assertion per line.
+func ParsePolicy(r io.Reader) (*Policy, error) {
+	policy := &Policy{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		assertion, err := parsePolicyAssertion(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		policy.assertions = append(policy.assertions, assertion)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func parsePolicyAssertion(fields []string) (policyAssertion, error) {
+	name, args := fields[0], fields[1:]
+	switch name {
+	case "section":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s expects a section kind", name)
+		}
+		return &requiredSection{kind: args[0]}, nil
+	case "directive", "forbid":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("%s expects section kinds and directive keywords", name)
+		}
+		return &directiveAssertion{kinds: strings.Split(args[0], ","), keywords: args[1:], forbidden: name == "forbid"}, nil
+	case "bind-ports":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s expects section kinds and ports", name)
+		}
+		ranges, err := parsePortRanges(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return &bindPortsAssertion{kinds: strings.Split(args[0], ","), allowed: args[1], ranges: ranges}, nil
+	default:
+		return nil, fmt.Errorf("unknown assertion: %s", name)
+	}
+}
+
+// Check returns an error listing the violations of the policy.
+func (p *Policy) Check(content []byte) error {
+	config := parseHaproxyConfig(content)
+	var violations []string
+	for _, a := range p.assertions {
+		violations = append(violations, a.check(config)...)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("configuration violates policy:\n%s", strings.Join(violations, "\n"))
+	}
+	return nil
+}
+
+// policyDirective is a directive of a section, with its line in the
+// configuration.
+type policyDirective struct {
+	section *configSection
+	line    int
+	fields  []string
+}
+
+func (d policyDirective) String() string {
+	section := d.section.Kind
+	if d.section.Name != "" {
+		section += " " + d.section.Name
+	}
+	return fmt.Sprintf("%s (line %d)", section, d.line)
+}
+
+// selectedDirectives returns the directives of the sections of the given
+// kinds, and the number of sections selected.
+func selectedDirectives(config *haproxyConfig, kinds []string) ([]policyDirective, []*configSection) {
+	selected := make(map[string]bool)
+	for _, kind := range kinds {
+		selected[kind] = true
+	}
+	var directives []policyDirective
+	var sections []*configSection
+	line := len(config.preamble)
+	for _, s := range config.sections {
+		line++
+		if selected[s.Kind] {
+			sections = append(sections, s)
+		}
+		for _, l := range s.Lines {
+			line++
+			if fields := configFields(l); selected[s.Kind] && len(fields) > 0 {
+				directives = append(directives, policyDirective{section: s, line: line, fields: fields})
+			}
+		}
+	}
+	return directives, sections
+}
+
+type requiredSection struct {
+	kind string
+}
+
+func (a *requiredSection) check(config *haproxyConfig) []string {
+	if len(config.Sections(a.kind)) == 0 {
+		return []string{fmt.Sprintf("missing %s section", a.kind)}
+	}
+	return nil
+}
+
+type directiveAssertion struct {
+	kinds     []string
+	keywords  []string
+	forbidden bool
+}
+
+func (a *directiveAssertion) check(config *haproxyConfig) []string {
+	directive := strings.Join(a.keywords, " ")
+	directives, sections := selectedDirectives(config, a.kinds)
+	var violations []string
+	if a.forbidden {
+		for _, d := range directives {
+			if hasPrefixFields(d.fields, a.keywords) {
+				violations = append(violations, fmt.Sprintf("%s: forbidden directive %q", d, directive))
+			}
+		}
+		return violations
+	}
+	for _, s := range sections {
+		if !s.HasDirective(a.keywords...) {
+			name := s.Kind
+			if s.Name != "" {
+				name += " " + s.Name
+			}
+			violations = append(violations, fmt.Sprintf("%s: missing directive %q", name, directive))
+		}
+	}
+	return violations
+}
+
+type portRange struct {
+	from, to int
+}
+
+// parsePortRanges parses a comma-separated list of ports or ranges of
+// ports, as 8000-8999.
+func parsePortRanges(arg string) ([]portRange, error) {
+	var ranges []portRange
+	for _, s := range strings.Split(arg, ",") {
+		r, err := parsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	from, to := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+	var r portRange
+	var err error
+	if r.from, err = strconv.Atoi(from); err != nil || r.from < 1 || r.from > 65535 {
+		return r, fmt.Errorf("invalid port: %s", from)
+	}
+	if r.to, err = strconv.Atoi(to); err != nil || r.to < r.from || r.to > 65535 {
+		return r, fmt.Errorf("invalid port range: %s", s)
+	}
+	return r, nil
+}
+
+type bindPortsAssertion struct {
+	kinds   []string
+	allowed string
+	ranges  []portRange
+}
+
+func (a *bindPortsAssertion) allows(r portRange) bool {
+	for _, allowed := range a.ranges {
+		if r.from >= allowed.from && r.to <= allowed.to {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *bindPortsAssertion) check(config *haproxyConfig) []string {
+	directives, _ := selectedDirectives(config, a.kinds)
+	var violations []string
+	for _, d := range directives {
+		if d.fields[0] != "bind" || len(d.fields) < 2 {
+			continue
+		}
+		for _, address := range strings.Split(d.fields[1], ",") {
+			port, ok := bindPort(address)
+			if !ok {
+				continue
+			}
+			r, err := parsePortRange(port)
+			if err != nil {
+				violations = append(violations, fmt.Sprintf("%s: invalid bind port %q", d, port))
+			} else if !a.allows(r) {
+				violations = append(violations, fmt.Sprintf("%s: bind port %s not allowed (allowed: %s)", d, port, a.allowed))
+			}
+		}
+	}
+	return violations
+}
+
+// bindPort returns the port, or range of ports, of a bind address. Addresses
+// of sockets without ports, as unix sockets, are ignored.
+func bindPort(address string) (string, bool) {
+	if i := strings.Index(address, "@"); i >= 0 {
+		switch address[:i] {
+		case "ipv4", "ipv6", "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "quic4", "quic6":
+			address = address[i+1:]
+		default:
+			return "", false
+		}
+	}
+	if strings.HasPrefix(address, "/") {
+		return "", false
+	}
+	i := strings.LastIndex(address, ":")
+	if i < 0 {
+		return "", false
+	}
+	return address[i+1:], true
+}
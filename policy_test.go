@@ -0,0 +1,175 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const policyTestConfig = `global
+    daemon
+    stats socket /var/run/haproxy.sock mode 600 level admin
+
+defaults
+    timeout connect 5s
+    timeout client 30s
+
+frontend web
+    bind :80,:443
+    default_backend app
+
+frontend admin
+    bind 0.0.0.0:9000
+    bind unix@/var/run/admin.sock
+    bind ipv6@:::8080-8081
+    default_backend app
+
+backend app
+    server app1 10.0.0.1:80
+`
+
+func policyViolations(t *testing.T, policy, config string) []string {
+	p, err := ParsePolicy(strings.NewReader(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Check([]byte(config))
+	if err == nil {
+		return nil
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if lines[0] != "configuration violates policy:" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return lines[1:]
+}
+
+func TestPolicyRules(t *testing.T) {
+	cases := []struct {
+		policy     string
+		violations []string
+	}{
+		{
+			policy: "# Standard sections\nsection global\nsection defaults\n\nsection peers\n",
+			violations: []string{
+				"missing peers section",
+			},
+		},
+		{
+			policy: "directive global stats socket\ndirective defaults timeout connect\ndirective defaults timeout server\n",
+			violations: []string{
+				`defaults: missing directive "timeout server"`,
+			},
+		},
+		{
+			policy: "directive frontend,backend default_backend\n",
+			violations: []string{
+				`backend app: missing directive "default_backend"`,
+			},
+		},
+		{
+			policy: "forbid frontend,listen bind unix@/var/run/admin.sock\nforbid global debug\n",
+			violations: []string{
+				`frontend admin (line 15): forbidden directive "bind unix@/var/run/admin.sock"`,
+			},
+		},
+		{
+			policy: "bind-ports frontend,listen 80,443,8000-8999\n",
+			violations: []string{
+				"frontend admin (line 14): bind port 9000 not allowed (allowed: 80,443,8000-8999)",
+			},
+		},
+		{
+			policy: "bind-ports frontend 80,443,8080,9000\n",
+			violations: []string{
+				"frontend admin (line 16): bind port 8080-8081 not allowed (allowed: 80,443,8080,9000)",
+			},
+		},
+		{
+			policy:     "section global\ndirective global daemon\nbind-ports frontend 1-65535\n",
+			violations: nil,
+		},
+	}
+	for _, c := range cases {
+		if found := policyViolations(t, c.policy, policyTestConfig); !reflect.DeepEqual(found, c.violations) {
+			t.Errorf("%q: expected violations %q, found %q", c.policy, c.violations, found)
+		}
+	}
+}
+
+func TestPolicyDirectiveWithoutSections(t *testing.T) {
+	violations := policyViolations(t, "directive listen option httplog\n", policyTestConfig)
+	if len(violations) != 0 {
+		t.Errorf("expected no violations without selected sections, found %q", violations)
+	}
+	violations = policyViolations(t, "section listen\ndirective listen option httplog\n", policyTestConfig)
+	if expected := []string{"missing listen section"}; !reflect.DeepEqual(violations, expected) {
+		t.Errorf("expected %q, found %q", expected, violations)
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	cases := map[string]string{
+		"section":                      "line 1: section expects a section kind",
+		"\nrequire global":             "line 2: unknown assertion: require",
+		"directive global":             "line 1: directive expects section kinds and directive keywords",
+		"bind-ports frontend":          "line 1: bind-ports expects section kinds and ports",
+		"bind-ports frontend 80,http":  "line 1: invalid port: http",
+		"bind-ports frontend 90-80":    "line 1: invalid port range: 90-80",
+		"bind-ports frontend 80-70000": "line 1: invalid port range: 80-70000",
+	}
+	for policy, expected := range cases {
+		_, err := ParsePolicy(strings.NewReader(policy))
+		if err == nil || err.Error() != expected {
+			t.Errorf("%q: expected error %q, found %v", policy, expected, err)
+		}
+	}
+}
+
+func TestControllerPolicy(t *testing.T) {
+	config := tempConfig(t, policyTestConfig)
+	defer os.Remove(config)
+	haproxy := &fakeHaproxy{}
+	validator := &countingValidator{}
+	c := NewController("", config, haproxy, validator)
+	c.Policy, _ = ParsePolicy(strings.NewReader("bind-ports frontend 80,443\n"))
+
+	outcome := c.ValidatedReload()
+	if outcome.Success || outcome.Phase != ReloadPhasePolicy || !strings.Contains(outcome.Error, "bind port 9000 not allowed") {
+		t.Errorf("expected reload rejected by policy, found %+v", outcome)
+	}
+	if haproxy.reloads != 0 || validator.calls != 0 {
+		t.Errorf("configuration violating policy validated or applied")
+	}
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/validate", nil))
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "bind port 8080-8081 not allowed") {
+		t.Errorf("expected validation rejected by policy, found %d: %s", w.Code, w.Body.String())
+	}
+	if validator.calls != 0 {
+		t.Errorf("configuration violating policy validated")
+	}
+
+	c.Policy, _ = ParsePolicy(strings.NewReader("bind-ports frontend 80,443,8000-9000\n"))
+	if outcome := c.ValidatedReload(); !outcome.Success || validator.calls != 1 {
+		t.Errorf("expected reload of configuration following policy, found %+v", outcome)
+	}
+}
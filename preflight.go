@@ -0,0 +1,170 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Directives checked by default in preflights, with the position of the
+// file after the keyword if it is not the next field
+const defaultPreflightReferences = "crt,crt-list,ca-file,crl-file,errorfile:2,lua-load"
+
+// Base directories of global settings applied to relative paths
+var preflightBases = map[string]string{
+	"crt":      "crt-base",
+	"crt-list": "crt-base",
+	"ca-file":  "ca-base",
+	"crl-file": "ca-base",
+}
+
+// FileReference is a keyword followed by a file in the configuration, the
+// file is in the field after the keyword at the given offset.
+type FileReference struct {
+	Keyword string
+	Offset  int
+}
+
+// parseFileReferences parses a comma-separated list of keywords, with an
+// optional offset in the form keyword:offset.
+func parseFileReferences(arg string) ([]FileReference, error) {
+	var references []FileReference
+	for _, s := range strings.Split(arg, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		reference := FileReference{Keyword: s, Offset: 1}
+		if i := strings.Index(s, ":"); i >= 0 {
+			offset, err := strconv.Atoi(s[i+1:])
+			if err != nil || offset < 1 {
+				return nil, fmt.Errorf("invalid offset in %s", s)
+			}
+			reference = FileReference{Keyword: s[:i], Offset: offset}
+		}
+		references = append(references, reference)
+	}
+	return references, nil
+}
+
+// Preflight checks that the files referenced in a configuration exist and
+// can be read before reloading. Haproxy reads these files while parsing the
+// configuration, before dropping privileges, so they are checked with the
+// user of the wrapper. Entries of crt-list files are checked too.
+type Preflight struct {
+	references []FileReference
+}
+
+func NewPreflight(references []FileReference) *Preflight {
+	return &Preflight{references: references}
+}
+
+// Check returns an error listing the referenced files that cannot be read.
+func (p *Preflight) Check(content []byte) error {
+	var problems []string
+	for _, path := range p.files(parseHaproxyConfig(content)) {
+		if err := checkReadable(path); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("referenced files not available:\n%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// files returns the files referenced in the configuration, in order and
+// without duplicates.
+func (p *Preflight) files(config *haproxyConfig) []string {
+	bases := make(map[string]string)
+	for _, global := range config.Sections("global") {
+		for _, fields := range global.Directives() {
+			if len(fields) > 1 && (fields[0] == "crt-base" || fields[0] == "ca-base") {
+				bases[fields[0]] = fields[1]
+			}
+		}
+	}
+
+	var files []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+	for _, section := range config.sections {
+		for _, fields := range section.Directives() {
+			for i, field := range fields {
+				for _, reference := range p.references {
+					if field != reference.Keyword || i+reference.Offset >= len(fields) {
+						continue
+					}
+					path := fields[i+reference.Offset]
+					if base := bases[preflightBases[reference.Keyword]]; base != "" && !filepath.IsAbs(path) {
+						path = filepath.Join(base, path)
+					}
+					add(path)
+					if reference.Keyword == "crt-list" {
+						for _, entry := range crtListEntries(path) {
+							if base := bases["crt-base"]; base != "" && !filepath.IsAbs(entry) {
+								entry = filepath.Join(base, entry)
+							}
+							add(entry)
+						}
+					}
+				}
+			}
+		}
+	}
+	return files
+}
+
+// crtListEntries returns the certificates listed in a crt-list file, the
+// file itself is checked separately.
+func crtListEntries(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := configFields(scanner.Text()); len(fields) > 0 {
+			entries = append(entries, fields[0])
+		}
+	}
+	return entries
+}
+
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s: not found", path)
+		}
+		if os.IsPermission(err) {
+			return fmt.Errorf("%s: not readable", path)
+		}
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,113 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFileReferences(t *testing.T) {
+	references, err := parseFileReferences(defaultPreflightReferences)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if references[4] != (FileReference{Keyword: "errorfile", Offset: 2}) || references[0] != (FileReference{Keyword: "crt", Offset: 1}) {
+		t.Errorf("unexpected references: %v", references)
+	}
+	if _, err := parseFileReferences("errorfile:x"); err == nil {
+		t.Error("expected error for invalid offset")
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preflight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("site.pem", "")
+	write("503.http", "")
+	write("list.txt", "site.pem\nmissing-in-list.pem [ssl-min-ver TLSv1.2]\n# comment\n")
+
+	config := `global
+    crt-base ` + dir + `
+    lua-load ` + dir + `/missing.lua
+
+frontend web
+    bind :443 ssl crt site.pem crt-list list.txt
+    errorfile 503 ` + dir + `/503.http
+    errorfile 504 ` + dir + `/504.http
+`
+	references, _ := parseFileReferences(defaultPreflightReferences)
+	p := NewPreflight(references)
+
+	files := p.files(parseHaproxyConfig([]byte(config)))
+	expected := []string{
+		dir + "/missing.lua",
+		dir + "/site.pem",
+		dir + "/list.txt",
+		dir + "/missing-in-list.pem",
+		dir + "/503.http",
+		dir + "/504.http",
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("found files %v, expected %v", files, expected)
+	}
+
+	err = p.Check([]byte(config))
+	if err == nil {
+		t.Fatal("expected error for missing files")
+	}
+	for _, missing := range []string{"missing.lua", "missing-in-list.pem", "504.http"} {
+		if !strings.Contains(err.Error(), missing) {
+			t.Errorf("missing file %s not reported: %v", missing, err)
+		}
+	}
+	if strings.Contains(err.Error(), "site.pem:") {
+		t.Errorf("existing file reported: %v", err)
+	}
+
+	// Only configured directives are checked
+	p = NewPreflight([]FileReference{{Keyword: "crt", Offset: 1}})
+	if err := p.Check([]byte(config)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestControllerReloadPreflight(t *testing.T) {
+	config := tempConfig(t, "global\n    lua-load /nonexistent/script.lua\n")
+	defer os.Remove(config)
+	haproxy := &fakeHaproxy{}
+	c := NewController("", config, haproxy, &fakeValidator{})
+	c.Preflight = NewPreflight([]FileReference{{Keyword: "lua-load", Offset: 1}})
+
+	outcome := c.Reload()
+	if outcome.Success || outcome.Phase != ReloadPhasePreflight || !strings.Contains(outcome.Error, "/nonexistent/script.lua") {
+		t.Fatalf("unexpected outcome: %+v", outcome)
+	}
+	if haproxy.reloads != 0 {
+		t.Fatal("haproxy reloaded after failed preflight")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// readiness is the response of /ready.
+type readiness struct {
+	Ready  bool   `json:"ready"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// validationResult is the result of a validation of the configuration.
+type validationResult struct {
+	Time time.Time
+	Err  error
+}
+
+// recordValidation keeps the result of a validation to report readiness.
+func (c *Controller) recordValidation(err error) {
+	c.Lock()
+	defer c.Unlock()
+	c.lastValidation = &validationResult{Time: time.Now(), Err: err}
+}
+
+// readiness reports if haproxy is serving with the last configuration, and
+// the last reload or validation, the most recent one, succeeded. After a
+// failed reload, readiness is kept during the reload failure grace period
+// while haproxy is still running with the previous configuration.
+func (c *Controller) readiness() readiness {
+	c.Lock()
+	lastReload := c.lastReload
+	lastValidation := c.lastValidation
+	c.Unlock()
+	if !c.haproxy.IsRunning() {
+		if c.haproxy.Status().CrashLoop {
+			return readiness{Reason: "haproxy crashed and couldn't be restarted"}
+		}
+		if c.StartFailed && lastReload == nil {
+			return readiness{Reason: "waiting for valid configuration"}
+		}
+		return readiness{Reason: "haproxy is not running"}
+	}
+	if lastValidation != nil && (lastReload == nil || lastValidation.Time.After(lastReload.Time)) {
+		if lastValidation.Err != nil {
+			return readiness{Reason: "last validation failed"}
+		}
+		return readiness{Ready: true}
+	}
+	if lastReload == nil || lastReload.Success {
+		return readiness{Ready: true}
+	}
+	failedAt := lastReload.Time.Add(lastReload.Duration)
+	if elapsed := time.Since(failedAt); elapsed < c.ReloadFailureGrace {
+		return readiness{
+			Ready:  true,
+			Reason: fmt.Sprintf("last reload failed %s ago, serving previous configuration", elapsed.Truncate(time.Second)),
+		}
+	}
+	return readiness{Reason: fmt.Sprintf("last reload failed in phase %s", lastReload.Phase)}
+}
+
+// health is the response of /health.
+type health struct {
+	Running bool   `json:"running"`
+	Mode    string `json:"mode,omitempty"`
+	PID     int    `json:"pid,omitempty"`
+
+	// Reason connections are not retained during reloads, if disabled
+	CaptureDisabled string `json:"capture_disabled,omitempty"`
+
+	// Version of the binary that started haproxy, and of the binary used
+	// to validate configurations, they differ after upgrades of the
+	// binary until haproxy is reloaded or restarted
+	RunningVersion   string `json:"running_version,omitempty"`
+	ValidatorVersion string `json:"validator_version,omitempty"`
+}
+
+// health reports if haproxy is running, so orchestrators can restart the
+// wrapper if haproxy died. Unlike readiness, it doesn't depend on reloads.
+func (c *Controller) health(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	h := health{
+		Running:         c.haproxy.IsRunning(),
+		Mode:            c.Mode,
+		CaptureDisabled: c.CaptureDisabled,
+	}
+	if c.Binary != nil {
+		h.RunningVersion, h.ValidatorVersion, _ = c.Binary.Versions()
+	}
+	if h.Running {
+		h.PID = c.haproxyStatus().PID
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, h)
+}
+
+// live replies while the controller is responsive, regardless of the state
+// of haproxy.
+func (c *Controller) live(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintf(w, "OK\n")
+}
+
+func (c *Controller) ready(w http.ResponseWriter, req *http.Request) {
+	r := c.readiness()
+	if !r.Ready {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, r)
+}
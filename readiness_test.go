@@ -0,0 +1,183 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func getReady(t *testing.T, c *Controller) (int, readiness) {
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	var r readiness
+	if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, r
+}
+
+func TestControllerReadyAfterFailedReload(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{running: true}
+	c := NewController("", config, h, &fakeValidator{})
+
+	if code, r := getReady(t, c); code != http.StatusOK || !r.Ready {
+		t.Fatalf("expected ready before reloads, found %d %+v", code, r)
+	}
+
+	h.err = errors.New("couldn't reload")
+	c.Reload()
+	if code, r := getReady(t, c); code != http.StatusServiceUnavailable || r.Ready {
+		t.Fatalf("expected not ready after failed reload without grace, found %d %+v", code, r)
+	}
+
+	c.ReloadFailureGrace = time.Minute
+	if code, r := getReady(t, c); code != http.StatusOK || !r.Ready || r.Reason == "" {
+		t.Fatalf("expected ready during grace period, found %d %+v", code, r)
+	}
+
+	c.Lock()
+	c.lastReload.Time = time.Now().Add(-2 * time.Minute)
+	c.Unlock()
+	if code, _ := getReady(t, c); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected not ready after grace period, found %d", code)
+	}
+
+	h.err = nil
+	c.Reload()
+	if code, _ := getReady(t, c); code != http.StatusOK {
+		t.Fatalf("expected ready after successful reload, found %d", code)
+	}
+}
+
+func TestControllerReadyAfterFailedReloadStoppingHaproxy(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{running: true}
+	c := NewController("", config, h, &fakeValidator{})
+	c.ReloadFailureGrace = time.Minute
+
+	h.err = errors.New("couldn't reload")
+	c.Reload()
+	h.Lock()
+	h.running = false
+	h.Unlock()
+
+	code, r := getReady(t, c)
+	if code != http.StatusServiceUnavailable || r.Reason != "haproxy is not running" {
+		t.Fatalf("expected not ready with haproxy stopped, found %d %+v", code, r)
+	}
+}
+
+func TestControllerHealth(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+	c.Mode = "daemon"
+	c.Token = "secret"
+	getHealth := func() (int, health) {
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		var r health
+		if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, r
+	}
+
+	if code, r := getHealth(); code != http.StatusServiceUnavailable || r.Running || r.Mode != "daemon" {
+		t.Fatalf("expected unhealthy while haproxy is not running, found %d %+v", code, r)
+	}
+	h.Start()
+	if code, r := getHealth(); code != http.StatusOK || !r.Running {
+		t.Fatalf("expected healthy while haproxy is running, found %d %+v", code, r)
+	}
+
+	// Health doesn't depend on reloads
+	h.err = errors.New("couldn't reload")
+	c.Reload()
+	if code, _ := getHealth(); code != http.StatusOK {
+		t.Fatalf("expected healthy after failed reload, found %d", code)
+	}
+}
+
+func TestControllerLive(t *testing.T) {
+	c := NewController("", "", &fakeHaproxy{}, &fakeValidator{})
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/live", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected live while haproxy is not running, found %d", w.Code)
+	}
+}
+
+func TestControllerReadyAfterValidation(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{running: true}
+	validator := &fakeValidator{}
+	c := NewController("", config, h, validator)
+	validate := func() {
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/validate", nil))
+	}
+
+	validator.err = errors.New("invalid configuration")
+	validate()
+	if code, r := getReady(t, c); code != http.StatusServiceUnavailable || r.Reason != "last validation failed" {
+		t.Fatalf("expected not ready after failed validation, found %d %+v", code, r)
+	}
+
+	// The most recent result is reported
+	validator.err = nil
+	c.Reload()
+	if code, _ := getReady(t, c); code != http.StatusOK {
+		t.Fatalf("expected ready after successful reload, found %d", code)
+	}
+	validator.err = errors.New("invalid configuration")
+	validate()
+	if code, _ := getReady(t, c); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected not ready after failed validation, found %d", code)
+	}
+	validator.err = nil
+	validate()
+	if code, _ := getReady(t, c); code != http.StatusOK {
+		t.Fatalf("expected ready after successful validation, found %d", code)
+	}
+}
+
+func TestControllerReadyWaitingConfig(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+	c.StartFailed = true
+
+	if code, r := getReady(t, c); code != http.StatusServiceUnavailable || r.Reason != "waiting for valid configuration" {
+		t.Fatalf("expected not ready while waiting for valid configuration, found %d %+v", code, r)
+	}
+	h.Start()
+	c.Reload()
+	if code, r := getReady(t, c); code != http.StatusOK {
+		t.Fatalf("expected ready after reloading valid configuration, found %d %+v", code, r)
+	}
+}
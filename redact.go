@@ -0,0 +1,85 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const redactedValue = "<redacted>"
+
+// Patterns of sensitive values in haproxy configuration, submatches are
+// masked, or the whole match if there are no submatches.
+var defaultRedactPatterns = []string{
+	`\b(?:password|insecure-password)\s+(\S+)`,
+	`\bstats\s+auth\s+(\S+)`,
+	`\b(?:crt|crt-list|ca-file|crl-file|key)\s+(\S+)`,
+	`(?i)\bauthorization\s+(.+)`,
+	`\bstick\s+(?:on|match|store-request|store-response)\s+(.+)`,
+}
+
+// ConfigRedactor masks sensitive values in configuration content before it
+// is logged or returned.
+type ConfigRedactor struct {
+	patterns []*regexp.Regexp
+}
+
+func NewConfigRedactor(patterns []string) (*ConfigRedactor, error) {
+	r := &ConfigRedactor{}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %v", p, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// Redact masks sensitive values in content, line by line.
+func (r *ConfigRedactor) Redact(content []byte) []byte {
+	return []byte(r.RedactString(string(content)))
+}
+
+func (r *ConfigRedactor) RedactString(content string) string {
+	if r == nil || len(r.patterns) == 0 {
+		return content
+	}
+	lines := strings.Split(content, "\n")
+	for i := range lines {
+		lines[i] = r.redactLine(lines[i])
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r *ConfigRedactor) redactLine(line string) string {
+	for _, re := range r.patterns {
+		matches := re.FindAllStringSubmatchIndex(line, -1)
+		// Replace from the end to keep indexes valid
+		for m := len(matches) - 1; m >= 0; m-- {
+			match := matches[m]
+			for i := len(match)/2 - 1; i >= 0; i-- {
+				start, end := match[2*i], match[2*i+1]
+				if start < 0 || (i == 0 && len(match) > 2) {
+					continue
+				}
+				line = line[:start] + redactedValue + line[end:]
+			}
+		}
+	}
+	return line
+}
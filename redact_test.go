@@ -0,0 +1,125 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfigRedactorDefaults(t *testing.T) {
+	r, err := NewConfigRedactor(defaultRedactPatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		line, expected string
+	}{
+		{"    user admin password $5$secret", "    user admin password <redacted>"},
+		{"    user admin insecure-password secret groups ops", "    user admin insecure-password <redacted> groups ops"},
+		{"    stats auth admin:secret", "    stats auth <redacted>"},
+		{"    bind :443 ssl crt /etc/ssl/site.pem ca-file /etc/ssl/ca.pem", "    bind :443 ssl crt <redacted> ca-file <redacted>"},
+		{"    http-request set-header Authorization Basic Zm9v", "    http-request set-header Authorization <redacted>"},
+		{"    stick on src table sessions", "    stick on <redacted>"},
+		{"    server app1 10.0.0.2:8080 check", "    server app1 10.0.0.2:8080 check"},
+	}
+	for _, c := range cases {
+		if found := r.RedactString(c.line); found != c.expected {
+			t.Errorf("found %q, expected %q", found, c.expected)
+		}
+	}
+}
+
+func TestConfigRedactorCustomPatterns(t *testing.T) {
+	if _, err := NewConfigRedactor([]string{"("}); err == nil {
+		t.Fatal("expected error with invalid pattern")
+	}
+
+	r, err := NewConfigRedactor([]string{`token=\w+`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := r.RedactString("a token=foo b\nno secrets")
+	if found != "a <redacted> b\nno secrets" {
+		t.Fatalf("unexpected redaction: %q", found)
+	}
+
+	var nilRedactor *ConfigRedactor
+	if found := nilRedactor.RedactString("password foo"); found != "password foo" {
+		t.Fatalf("nil redactor shouldn't modify content: %q", found)
+	}
+}
+
+func TestControllerRedactsSecrets(t *testing.T) {
+	path := tempConfig(t, "userlist users\n    user admin password secret\n")
+	defer os.Remove(path)
+
+	validator := &fakeValidator{err: fmt.Errorf("[ALERT] parsing: 'user admin password secret' invalid")}
+	c := NewController("", path, &fakeHaproxy{}, validator)
+	c.Redactor, _ = NewConfigRedactor(defaultRedactPatterns)
+
+	for _, url := range []string{"/config", "/validate"} {
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		body := w.Body.String()
+		if strings.Contains(body, "secret") || !strings.Contains(body, redactedValue) {
+			t.Errorf("%s: secrets not masked: %q", url, body)
+		}
+	}
+}
+
+func TestControllerConfigRoundTrip(t *testing.T) {
+	content := "userlist users\n    user admin password secret\n"
+	path := tempConfig(t, content)
+	defer os.Remove(path)
+
+	c := NewController("", path, &fakeHaproxy{}, &fakeValidator{})
+	c.Redactor, _ = NewConfigRedactor(defaultRedactPatterns)
+	c.Token = "token"
+	c.NewValidator = func(configFile string) HaproxyConfigValidator {
+		return &contentValidator{path: configFile}
+	}
+	request := func(method string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/config", body)
+		req.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("GET", nil)
+	if w.Code != http.StatusOK || w.Body.String() != content {
+		t.Fatalf("unexpected configuration for authenticated request %d: %q", w.Code, w.Body.String())
+	}
+	if w := request("PUT", strings.NewReader(w.Body.String())); w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	if found, _ := ioutil.ReadFile(path); string(found) != content {
+		t.Fatalf("configuration changed by round-trip: %q", found)
+	}
+
+	// Requests without the token still get secrets masked
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/config", nil))
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Fatalf("secrets not masked without token: %q", w.Body.String())
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Phases of a reload, used to report where a reload failed
+const (
+	ReloadPhasePrecondition = "precondition"
+	ReloadPhaseCoordinate   = "coordinate"
+	ReloadPhaseTemplate     = "template"
+	ReloadPhaseTransform    = "transform"
+	ReloadPhaseAnnotations  = "annotations"
+	ReloadPhasePolicy       = "policy"
+	ReloadPhasePreflight    = "preflight"
+	ReloadPhaseValidate     = "validate"
+	ReloadPhaseBinary       = "binary"
+	ReloadPhaseApproval     = "approval"
+	ReloadPhaseReload       = "reload"
+	ReloadPhaseCapture      = "capture"
+	ReloadPhaseRelease      = "release"
+	ReloadPhaseHealth       = "health"
+	ReloadPhaseShutdown     = "shutdown"
+)
+
+// Interval between checks of the health of backends after reloads
+var healthCheckInterval = 500 * time.Millisecond
+
+// Default time Stop waits for reloads in progress
+const defaultStopTimeout = 30 * time.Second
+
+// Time Stop waits for reloads to finish after cancelling them
+var reloadCancelTimeout = 5 * time.Second
+
+var errControllerStopping = errors.New("controller stopping")
+
+// ReloadOutcome is the result of a reload.
+type ReloadOutcome struct {
+	Time              time.Time       `json:"time"`
+	Success           bool            `json:"success"`
+	Phase             string          `json:"phase,omitempty"`
+	Error             string          `json:"error,omitempty"`
+	Hash              string          `json:"hash,omitempty"`
+	Actor             string          `json:"actor,omitempty"`
+	Duration          time.Duration   `json:"duration_ns"`
+	UnhealthyBackends []string        `json:"unhealthy_backends,omitempty"`
+	ConnectLatency    *LatencySummary `json:"connect_latency,omitempty"`
+	Settings          *ReloadSettings `json:"settings,omitempty"`
+	Changes           *TopologyDelta  `json:"changes,omitempty"`
+	Phases            []PhaseDuration `json:"phases,omitempty"`
+}
+
+// PhaseDuration is the time spent in a phase of a reload.
+type PhaseDuration struct {
+	Phase    string        `json:"phase"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// timePhase records the time spent in a phase started at the given time.
+func (o *ReloadOutcome) timePhase(phase string, start time.Time) {
+	o.Phases = append(o.Phases, PhaseDuration{Phase: phase, Duration: time.Since(start)})
+}
+
+// breakdown formats the time spent in each phase.
+func (o *ReloadOutcome) breakdown() string {
+	phases := make([]string, len(o.Phases))
+	for i, p := range o.Phases {
+		phases[i] = fmt.Sprintf("%s=%s", p.Phase, p.Duration)
+	}
+	return strings.Join(phases, " ")
+}
+
+func (o *ReloadOutcome) fail(phase string, err error) *ReloadOutcome {
+	o.Success = false
+	o.Phase = phase
+	o.Error = err.Error()
+	return o
+}
+
+// httpStatus returns the status code used to report the outcome.
+func (o *ReloadOutcome) httpStatus() int {
+	switch {
+	case o.Success:
+		return http.StatusOK
+	case o.Phase == ReloadPhaseHealth, o.Phase == ReloadPhaseCoordinate, o.Phase == ReloadPhaseShutdown:
+		return http.StatusServiceUnavailable
+	case o.Phase == ReloadPhaseApproval, o.Phase == ReloadPhaseBinary:
+		return http.StatusConflict
+	case o.Phase == ReloadPhasePrecondition:
+		return http.StatusPreconditionFailed
+	case o.Phase == ReloadPhaseValidate, o.Phase == ReloadPhaseTemplate:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Reload applies the configuration transforms and reloads haproxy. If
+// configured, it waits for the changed backends to be healthy. Reloads are
+// serialized.
+func (c *Controller) Reload() *ReloadOutcome {
+	return c.doReload(reloadRequest{})
+}
+
+// ValidatedReload is like Reload, but haproxy is not reloaded if the
+// transformed configuration is not valid.
+func (c *Controller) ValidatedReload() *ReloadOutcome {
+	return c.doReload(reloadRequest{validate: true})
+}
+
+// reloadRequest are the options of a reload.
+type reloadRequest struct {
+	validate bool
+
+	// Actor requesting the reload, if known
+	actor string
+
+	capture CaptureMode
+
+	// If-Match header the configuration must match to be reloaded, if any
+	ifMatch string
+}
+
+// doReload reloads haproxy with the options of the request. Reloads are
+// rejected once the controller is stopping.
+func (c *Controller) doReload(r reloadRequest) *ReloadOutcome {
+	if !c.trackReload() {
+		return (&ReloadOutcome{Time: time.Now(), Actor: r.actor}).fail(ReloadPhaseShutdown, errControllerStopping)
+	}
+	defer c.inflight.Done()
+	return c.runReload(r)
+}
+
+// trackReload registers a reload in progress, so Stop waits for it. It
+// returns false if the controller is stopping.
+func (c *Controller) trackReload() bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.done {
+		return false
+	}
+	c.inflight.Add(1)
+	return true
+}
+
+// reloadsCancelled checks if Stop cancelled the reloads in progress.
+func (c *Controller) reloadsCancelled() bool {
+	select {
+	case <-c.cancelReloads:
+		return true
+	default:
+		return false
+	}
+}
+
+// runReload reloads haproxy, it must be called for reloads registered with
+// trackReload.
+func (c *Controller) runReload(r reloadRequest) *ReloadOutcome {
+	c.reloading.Lock()
+	defer c.reloading.Unlock()
+	if c.reloadsCancelled() {
+		return (&ReloadOutcome{Time: time.Now(), Actor: r.actor}).fail(ReloadPhaseShutdown, errControllerStopping)
+	}
+
+	start := time.Now()
+	var outcome *ReloadOutcome
+	reload := strconv.FormatInt(start.UnixNano(), 10)
+	if err := c.acquireReloadSlot(reload); err != nil {
+		outcome = (&ReloadOutcome{}).fail(ReloadPhaseCoordinate, err)
+		outcome.timePhase(ReloadPhaseCoordinate, start)
+	} else {
+		coordinated := time.Now()
+		latency := c.measureLatency()
+		outcome = c.applyReload(r)
+		outcome.Phases = append([]PhaseDuration{{Phase: ReloadPhaseCoordinate, Duration: coordinated.Sub(start)}}, outcome.Phases...)
+		outcome.ConnectLatency = latency()
+		c.releaseReloadSlot(reload, outcome)
+	}
+	outcome.Time = start
+	outcome.Actor = r.actor
+	outcome.Duration = time.Since(start)
+	if c.SlowReloadThreshold > 0 && outcome.Duration > c.SlowReloadThreshold {
+		logWithFields(LogFields{"actor": r.actor, "duration_seconds": outcome.Duration.Seconds()}, "Warning: slow reload took %s (threshold %s): %s\n", outcome.Duration, c.SlowReloadThreshold, outcome.breakdown())
+		c.slowReloads.Inc()
+	}
+
+	// Reloads rejected by their precondition don't affect haproxy
+	if outcome.Phase == ReloadPhasePrecondition {
+		return outcome
+	}
+
+	c.Lock()
+	c.lastReload = outcome
+	c.Unlock()
+
+	c.reloadHistory.Add(start, outcome.Success)
+	if outcome.Success {
+		c.reloads.Inc("success", "")
+		c.reloadDurations.Observe(outcome.Duration.Seconds(), "success")
+	} else {
+		c.reloads.Inc("failure", outcome.Phase)
+		c.reloadDurations.Observe(outcome.Duration.Seconds(), "failure")
+	}
+	for _, p := range outcome.Phases {
+		c.phaseDurations.Observe(p.Duration.Seconds(), p.Phase)
+	}
+
+	c.EventSocket.Emit(reloadEvent{Event: "reload", ReloadOutcome: outcome})
+	return outcome
+}
+
+// acquireReloadSlot waits for the coordinator, if any, to allow the reload.
+func (c *Controller) acquireReloadSlot(reload string) error {
+	if c.Coordinator == nil {
+		return nil
+	}
+	return c.Coordinator.Acquire(reload, c.CoordinationTimeout)
+}
+
+func (c *Controller) releaseReloadSlot(reload string, outcome *ReloadOutcome) {
+	if c.Coordinator == nil {
+		return
+	}
+	if err := c.Coordinator.Release(reload, outcome); err != nil {
+		log.Printf("Couldn't release reload slot: %v\n", err)
+	}
+}
+
+func (c *Controller) applyReload(r reloadRequest) *ReloadOutcome {
+	outcome := &ReloadOutcome{Success: true}
+	if r.ifMatch != "" {
+		// Checked before the configuration is rendered or transformed,
+		// as the client read it
+		hash, err := c.configETag()
+		if err != nil {
+			return outcome.fail(ReloadPhasePrecondition, fmt.Errorf("couldn't read configuration to check its hash: %v", err))
+		}
+		if !etagMatches(r.ifMatch, hash) {
+			return outcome.fail(ReloadPhasePrecondition, fmt.Errorf("configuration changed, current hash is %s", hash))
+		}
+	}
+	phase := time.Now()
+	if err := c.Template.RenderFile(c.configFile, c.NewValidator); err != nil {
+		return outcome.fail(ReloadPhaseTemplate, errors.New(c.Redactor.RedactString(err.Error())))
+	}
+	if err := c.Pipeline.TransformFile(c.configFile); err != nil {
+		return outcome.fail(ReloadPhaseTransform, fmt.Errorf("couldn't transform configuration: %v", err))
+	}
+	content, err := ioutil.ReadFile(c.configFile)
+	if err != nil {
+		return outcome.fail(ReloadPhaseTransform, fmt.Errorf("couldn't read configuration: %v", err))
+	}
+	outcome.Hash = configHash(content)
+
+	settings := &ReloadSettings{
+		Validate:    r.validate,
+		Capture:     true,
+		WaitHealthy: c.WaitHealthyTimeout,
+	}
+	outcome.Settings = settings
+	if err := settings.applyAnnotations(content); err != nil {
+		return outcome.fail(ReloadPhaseAnnotations, err)
+	}
+	c.Lock()
+	previous := c.applied
+	c.Unlock()
+	r.capture.apply(settings, previous, content)
+
+	if c.Policy != nil {
+		if err := c.Policy.Check(content); err != nil {
+			return outcome.fail(ReloadPhasePolicy, err)
+		}
+	}
+	if c.Preflight != nil {
+		if err := c.Preflight.Check(content); err != nil {
+			return outcome.fail(ReloadPhasePreflight, err)
+		}
+	}
+	outcome.timePhase(ReloadPhaseTransform, phase)
+	// Only validated configurations are staged for approval
+	if settings.Validate || c.Approval != nil {
+		phase = time.Now()
+		_, err := c.validateConfig()
+		outcome.timePhase(ReloadPhaseValidate, phase)
+		if err != nil {
+			return outcome.fail(ReloadPhaseValidate, fmt.Errorf("invalid configuration: %v", c.Redactor.RedactString(err.Error())))
+		}
+	}
+	// Stopped processes are started with the current binary
+	if c.haproxy.IsRunning() && c.Binary != nil {
+		phase = time.Now()
+		err := c.Binary.Check()
+		outcome.timePhase(ReloadPhaseBinary, phase)
+		if err != nil {
+			return outcome.fail(ReloadPhaseBinary, err)
+		}
+	}
+	if c.Approval != nil {
+		phase = time.Now()
+		pending := PendingApproval{Hash: outcome.Hash, Actor: r.actor, Changes: topologyDelta(previous, content)}
+		err := c.Approval.Wait(pending, c.cancelReloads)
+		outcome.timePhase(ReloadPhaseApproval, phase)
+		if err == errControllerStopping {
+			return outcome.fail(ReloadPhaseShutdown, err)
+		} else if err != nil {
+			return outcome.fail(ReloadPhaseApproval, err)
+		}
+		if _, hash, err := readConfig(c.configFile); err != nil || hash != outcome.Hash {
+			return outcome.fail(ReloadPhaseApproval, errors.New("configuration changed while pending approval"))
+		}
+	}
+
+	// Includes the capture of connections, if retained
+	phase = time.Now()
+	err = c.reloadHaproxy(settings)
+	outcome.timePhase(ReloadPhaseReload, phase)
+	if _, ok := err.(*captureError); ok {
+		return outcome.fail(ReloadPhaseCapture, err)
+	} else if err != nil {
+		return outcome.fail(ReloadPhaseReload, err)
+	}
+	c.Binary.Started()
+
+	c.Lock()
+	c.applied = content
+	c.Unlock()
+	c.History.Add(content, r.actor)
+	outcome.Changes = topologyDelta(previous, content)
+
+	if settings.WaitHealthy > 0 && c.StatsSocket != nil {
+		backends := changedBackends(previous, content)
+		phase = time.Now()
+		unhealthy := c.waitHealthy(backends, settings.WaitHealthy)
+		outcome.timePhase(ReloadPhaseHealth, phase)
+		if len(unhealthy) > 0 {
+			outcome.UnhealthyBackends = unhealthy
+			return outcome.fail(ReloadPhaseHealth, fmt.Errorf("backends without healthy servers: %s", strings.Join(unhealthy, ", ")))
+		}
+	}
+	return outcome
+}
+
+// reloadHaproxy reloads haproxy, passing the settings of the reload if it
+// supports them. Sysctls are raised during reloads retaining connections.
+func (c *Controller) reloadHaproxy(settings *ReloadSettings) error {
+	if settings.Capture && len(c.ReloadSysctls) > 0 {
+		defer c.ReloadSysctls.Raise()()
+	}
+	if reloader, ok := c.haproxy.(HaproxyOptionsReloader); ok {
+		return reloader.ReloadWithOptions(ReloadOptions{Capture: settings.Capture})
+	}
+	return c.haproxy.Reload()
+}
+
+// waitHealthy waits for the backends to have at least one healthy server,
+// it returns the backends that are not healthy after the timeout.
+func (c *Controller) waitHealthy(backends []string, timeout time.Duration) []string {
+	pending := make(map[string]bool)
+	for _, b := range backends {
+		pending[b] = true
+	}
+	deadline := time.Now().Add(timeout)
+	for len(pending) > 0 {
+		records, err := c.StatsSocket.ShowStat()
+		if err != nil {
+			log.Printf("Couldn't check health of backends: %v\n", err)
+		} else {
+			for b := range healthyBackends(records) {
+				delete(pending, b)
+			}
+		}
+		if len(pending) == 0 || time.Now().After(deadline) {
+			break
+		}
+		select {
+		case <-time.After(healthCheckInterval):
+			continue
+		case <-c.cancelReloads:
+			log.Println("Wait for healthy backends cancelled")
+		}
+		break
+	}
+
+	unhealthy := make([]string, 0, len(pending))
+	for b := range pending {
+		unhealthy = append(unhealthy, b)
+	}
+	sort.Strings(unhealthy)
+	return unhealthy
+}
@@ -0,0 +1,127 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// CaptureMode decides if connections are retained in a reload, overriding the
+// settings of the wrapper and the annotations of the configuration.
+type CaptureMode int
+
+const (
+	// CaptureDefault uses the settings and annotations
+	CaptureDefault CaptureMode = iota
+	CaptureOn
+	CaptureOff
+	// CaptureAuto retains connections only if the listeners change
+	CaptureAuto
+)
+
+// UnmarshalJSON accepts booleans and "auto".
+func (m *CaptureMode) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch value {
+	case true:
+		*m = CaptureOn
+	case false:
+		*m = CaptureOff
+	case "auto":
+		*m = CaptureAuto
+	default:
+		return fmt.Errorf("invalid capture mode %s, expected true, false or \"auto\"", data)
+	}
+	return nil
+}
+
+// apply sets the capture of the reload, previous is the configuration
+// currently applied.
+func (m CaptureMode) apply(s *ReloadSettings, previous, content []byte) {
+	switch m {
+	case CaptureOn:
+		s.Capture = true
+	case CaptureOff:
+		s.Capture = false
+	case CaptureAuto:
+		s.Capture = previous == nil || listenersChanged(previous, content)
+	}
+}
+
+// reloadRequestBody are the options accepted in the body of /reload.
+type reloadRequestBody struct {
+	Capture CaptureMode `json:"capture"`
+}
+
+// parseReloadRequestBody parses the options of a reload, an empty body uses
+// the defaults.
+func parseReloadRequestBody(r io.Reader) (*reloadRequestBody, error) {
+	options := &reloadRequestBody{}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return options, nil
+	}
+	if err := json.Unmarshal(data, options); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// listenersChanged checks if the frontends (and listen sections) or their
+// bind lines are different in the new configuration.
+func listenersChanged(old, new []byte) bool {
+	oldListeners := configListeners(old)
+	newListeners := configListeners(new)
+	if len(oldListeners) != len(newListeners) {
+		return true
+	}
+	for name, binds := range newListeners {
+		oldBinds, found := oldListeners[name]
+		if !found || oldBinds != binds {
+			return true
+		}
+	}
+	return false
+}
+
+// configListeners returns the bind lines of each frontend and listen section.
+func configListeners(content []byte) map[string]string {
+	listeners := make(map[string]string)
+	for _, s := range parseHaproxyConfig(content).sections {
+		if s.Kind != "frontend" && s.Kind != "listen" {
+			continue
+		}
+		var binds []string
+		for _, fields := range s.Directives() {
+			if fields[0] == "bind" {
+				binds = append(binds, strings.Join(fields, " "))
+			}
+		}
+		sort.Strings(binds)
+		listeners[s.Kind+" "+s.Name] = strings.Join(binds, "\n")
+	}
+	return listeners
+}
@@ -0,0 +1,131 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func reloadWithBody(c *Controller, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/reload", strings.NewReader(body)))
+	return w
+}
+
+func TestControllerReloadCaptureExplicit(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeOptionsHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+
+	for _, body := range []string{"", `{"capture": false}`, `{"capture": true}`, "{}"} {
+		if w := reloadWithBody(c, body); w.Code != http.StatusOK {
+			t.Fatalf("%q: unexpected response %d: %q", body, w.Code, w.Body.String())
+		}
+	}
+	expected := []bool{true, false, true, true}
+	if len(h.options) != len(expected) {
+		t.Fatalf("unexpected reloads: %+v", h.options)
+	}
+	for i := range expected {
+		if h.options[i].Capture != expected[i] {
+			t.Errorf("reload %d: expected capture %v", i, expected[i])
+		}
+	}
+}
+
+func TestControllerReloadCaptureOverridesAnnotations(t *testing.T) {
+	config := tempConfig(t, "global\n#@wrapper: capture=false\n")
+	defer os.Remove(config)
+	h := &fakeOptionsHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+
+	if w := reloadWithBody(c, `{"capture": true}`); w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %q", w.Code, w.Body.String())
+	}
+	if len(h.options) != 1 || !h.options[0].Capture {
+		t.Fatalf("unexpected reload options: %+v", h.options)
+	}
+}
+
+func TestControllerReloadCaptureAuto(t *testing.T) {
+	config := tempConfig(t, "frontend http\n    bind :80\n    default_backend app\nbackend app\n    server s1 10.0.0.1:80\n")
+	defer os.Remove(config)
+	h := &fakeOptionsHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+
+	steps := []struct {
+		config  string
+		capture bool
+	}{
+		// Only backends change
+		{"frontend http\n    bind :80\n    default_backend app\nbackend app\n    server s2 10.0.0.2:80\n", false},
+		// Other directives of frontends don't change listeners
+		{"frontend http\n    bind :80 # public\n    timeout client 5s\n    default_backend app\nbackend app\n    server s2 10.0.0.2:80\n", false},
+		{"frontend http\n    bind :80\n    bind :8080\n    default_backend app\nbackend app\n    server s2 10.0.0.2:80\n", true},
+		{"frontend http\n    bind :80\n    bind :8080\n    default_backend app\nlisten stats\n    bind :9000\n", true},
+		{"frontend web\n    bind :80\n    bind :8080\n    default_backend app\nlisten stats\n    bind :9000\n", true},
+	}
+	for i, step := range steps {
+		if err := ioutil.WriteFile(config, []byte(step.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if w := reloadWithBody(c, `{"capture": "auto"}`); w.Code != http.StatusOK {
+			t.Fatalf("step %d: unexpected response %d: %q", i, w.Code, w.Body.String())
+		}
+		if options := h.options[len(h.options)-1]; options.Capture != step.capture {
+			t.Errorf("step %d: expected capture %v", i, step.capture)
+		}
+		if settings := c.lastReload.Settings; settings.Capture != step.capture {
+			t.Errorf("step %d: unexpected settings in outcome: %+v", i, settings)
+		}
+	}
+}
+
+func TestControllerReloadCaptureAutoWithoutPrevious(t *testing.T) {
+	config := tempConfig(t, "frontend http\n    bind :80\n")
+	defer os.Remove(config)
+	h := &fakeOptionsHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+	c.applied = nil
+
+	if w := reloadWithBody(c, `{"capture": "auto"}`); w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %q", w.Code, w.Body.String())
+	}
+	if len(h.options) != 1 || !h.options[0].Capture {
+		t.Fatalf("expected capture without previous configuration: %+v", h.options)
+	}
+}
+
+func TestControllerReloadInvalidCapture(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeOptionsHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+
+	for _, body := range []string{`{"capture": "sometimes"}`, `{"capture": 1}`, "capture=false"} {
+		if w := reloadWithBody(c, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: unexpected response %d: %q", body, w.Code, w.Body.String())
+		}
+	}
+	if h.reloads != 0 {
+		t.Fatal("haproxy reloaded with invalid options")
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// pendingReload is a reload waiting for the debounce time to pass without
+// new requests, it is run with the options of all the requests coalesced.
+type pendingReload struct {
+	timer   *time.Timer
+	request reloadRequest
+	actors  []string
+}
+
+// merge adds the options of a request, the configuration is validated if
+// any request asked for it, and the last explicit capture mode is used.
+func (p *pendingReload) merge(r reloadRequest) {
+	p.request.validate = p.request.validate || r.validate
+	if r.capture != CaptureDefault {
+		p.request.capture = r.capture
+	}
+	if r.actor == "" {
+		return
+	}
+	for _, actor := range p.actors {
+		if actor == r.actor {
+			return
+		}
+	}
+	p.actors = append(p.actors, r.actor)
+	p.request.actor = strings.Join(p.actors, ",")
+}
+
+// coalesceReload returns true if the request is received during the debounce
+// time of a previous one, and it is coalesced in the pending reload.
+func (c *Controller) coalesceReload(r reloadRequest) bool {
+	if c.ReloadDebounce <= 0 {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	last := c.lastReloadRequest
+	c.lastReloadRequest = now
+	if c.pendingReload == nil {
+		if last.IsZero() || now.Sub(last) >= c.ReloadDebounce {
+			return false
+		}
+		p := &pendingReload{}
+		p.timer = time.AfterFunc(c.ReloadDebounce, func() { c.runPendingReload(p) })
+		c.pendingReload = p
+	} else {
+		c.pendingReload.timer.Reset(c.ReloadDebounce)
+	}
+	c.pendingReload.merge(r)
+	c.coalescedReloads.Inc()
+	log.Printf("Reload requested by %s coalesced into pending reload\n", r.actor)
+	return true
+}
+
+func (c *Controller) runPendingReload(p *pendingReload) {
+	c.Lock()
+	if c.pendingReload != p {
+		// Timer reset after it expired, already run
+		c.Unlock()
+		return
+	}
+	c.pendingReload = nil
+	c.Unlock()
+	if !c.trackReload() {
+		return
+	}
+	defer c.inflight.Done()
+	if outcome := c.runReload(p.request); !outcome.Success {
+		log.Printf("Couldn't run coalesced reload: %v\n", outcome.Error)
+	}
+}
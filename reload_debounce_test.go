@@ -0,0 +1,87 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestControllerReloadDebounce(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{running: true}
+	validator := &countingValidator{}
+	c := NewController("", config, h, validator)
+	c.ReloadDebounce = 200 * time.Millisecond
+	reload := func(query, actor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/reload"+query, nil)
+		req.Header.Set("From", actor)
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, req)
+		return w
+	}
+	reloads := func() int {
+		h.Lock()
+		defer h.Unlock()
+		return h.reloads
+	}
+
+	// The first request reloads, next ones are coalesced
+	if w := reload("?validate=false", "deployer"); w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	for _, actor := range []string{"deployer", "watcher"} {
+		if w := reload("?validate=true", actor); w.Code != http.StatusAccepted {
+			t.Fatalf("unexpected response for coalesced reload %d: %s", w.Code, w.Body.String())
+		}
+	}
+	if n := reloads(); n != 1 {
+		t.Fatalf("expected 1 reload before the debounce time, found %d", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if w := reload("", "watcher"); w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected response for coalesced reload %d", w.Code)
+	}
+	time.Sleep(140 * time.Millisecond)
+	if n := reloads(); n != 1 {
+		t.Fatalf("pending reload run before a quiet debounce time, %d reloads", n)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if n := reloads(); n != 2 {
+		t.Fatalf("expected coalesced requests in a single reload, found %d reloads", n)
+	}
+	c.Lock()
+	outcome := c.lastReload
+	c.Unlock()
+	if outcome.Actor != "deployer,watcher" || outcome.Settings == nil || !outcome.Settings.Validate {
+		t.Fatalf("unexpected outcome of coalesced reload: %+v", outcome)
+	}
+	if validator.calls != 1 {
+		t.Fatalf("expected coalesced reload validated once, found %d", validator.calls)
+	}
+	if coalesced := counterValue(c.coalescedReloads); coalesced != 3 {
+		t.Fatalf("expected 3 coalesced requests, found %v", coalesced)
+	}
+
+	// After the quiet time requests reload again
+	if w := reload("", "deployer"); w.Code != http.StatusOK || reloads() != 3 {
+		t.Fatalf("unexpected response after debounce time %d", w.Code)
+	}
+}
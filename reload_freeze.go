@@ -0,0 +1,271 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// FreezeWindow is a period of the week when automatic reloads are frozen. It
+// starts on the given days, or every day if none, and can end on the next
+// day.
+type FreezeWindow struct {
+	Days       map[time.Weekday]bool
+	Start, End time.Duration
+}
+
+// ParseFreezeSchedule parses a comma-separated list of windows, each one
+// with optional days, as a day or a range of days, and an optional time
+// range, e.g. "mon-fri 18:00-08:00,sat,sun".
+func ParseFreezeSchedule(schedule string) ([]FreezeWindow, error) {
+	var windows []FreezeWindow
+	for _, entry := range strings.Split(schedule, ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("invalid freeze window %q", entry)
+		}
+		w := FreezeWindow{End: 24 * time.Hour}
+		if !strings.Contains(fields[0], ":") {
+			days, err := parseWeekdays(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			w.Days = days
+			fields = fields[1:]
+		}
+		if len(fields) > 0 {
+			times := strings.Split(fields[0], "-")
+			if len(times) != 2 {
+				return nil, fmt.Errorf("invalid time range %q", fields[0])
+			}
+			var err error
+			if w.Start, err = parseTimeOfDay(times[0]); err != nil {
+				return nil, err
+			}
+			if w.End, err = parseTimeOfDay(times[1]); err != nil {
+				return nil, err
+			}
+			if w.End <= w.Start {
+				w.End += 24 * time.Hour
+			}
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseWeekdays(s string) (map[time.Weekday]bool, error) {
+	bounds := strings.Split(strings.ToLower(s), "-")
+	if len(bounds) > 2 {
+		return nil, fmt.Errorf("invalid days %q", s)
+	}
+	var parsed []time.Weekday
+	for _, b := range bounds {
+		day, found := weekdays[b]
+		if !found {
+			return nil, fmt.Errorf("unknown day %q", b)
+		}
+		parsed = append(parsed, day)
+	}
+	days := map[time.Weekday]bool{parsed[0]: true}
+	for day := parsed[0]; day != parsed[len(parsed)-1]; {
+		day = (day + 1) % 7
+		days[day] = true
+	}
+	return days, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+type freezeInterval struct {
+	start, end time.Time
+}
+
+// intervals returns the periods of the windows around the given time, sorted
+// by their start, with overlapping periods merged.
+func freezeIntervals(windows []FreezeWindow, t time.Time) []freezeInterval {
+	var intervals []freezeInterval
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for offset := -1; offset <= 8; offset++ {
+		day := midnight.AddDate(0, 0, offset)
+		for _, w := range windows {
+			if len(w.Days) > 0 && !w.Days[day.Weekday()] {
+				continue
+			}
+			intervals = append(intervals, freezeInterval{start: day.Add(w.Start), end: day.Add(w.End)})
+		}
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].start.Before(intervals[j].start) })
+	var merged []freezeInterval
+	for _, i := range intervals {
+		if n := len(merged); n > 0 && !i.start.After(merged[n-1].end) {
+			if i.end.After(merged[n-1].end) {
+				merged[n-1].end = i.end
+			}
+			continue
+		}
+		merged = append(merged, i)
+	}
+	return merged
+}
+
+// FreezeStatus is the state of the freeze of automatic reloads.
+type FreezeStatus struct {
+	Frozen bool `json:"frozen"`
+
+	// End of the current freeze, or start of the next one
+	Until      *time.Time `json:"until,omitempty"`
+	NextFreeze *time.Time `json:"next_freeze,omitempty"`
+
+	// Actor of the staged reload, if any
+	Pending      bool   `json:"pending"`
+	PendingActor string `json:"pending_actor,omitempty"`
+}
+
+// ReloadFreeze defers automatic reloads requested during freeze windows. The
+// last reload requested is staged, and applied when the freeze ends.
+type ReloadFreeze struct {
+	sync.Mutex
+	windows []FreezeWindow
+	now     func() time.Time
+
+	pending *reloadRequest
+	timer   *time.Timer
+}
+
+func NewReloadFreeze(windows []FreezeWindow) *ReloadFreeze {
+	return &ReloadFreeze{windows: windows, now: time.Now}
+}
+
+// state returns if reloads are frozen at the given time, and the end of the
+// freeze or the start of the next one.
+func (f *ReloadFreeze) state(t time.Time) (bool, time.Time) {
+	for _, i := range freezeIntervals(f.windows, t) {
+		if !t.Before(i.start) && t.Before(i.end) {
+			return true, i.end
+		}
+		if i.start.After(t) {
+			return false, i.start
+		}
+	}
+	return false, time.Time{}
+}
+
+// Stage keeps the reload to apply it when the freeze ends, if reloads are
+// frozen. Reloads staged replace the previous ones, apply is called with the
+// last one. It returns false if reloads are not frozen.
+func (f *ReloadFreeze) Stage(r reloadRequest, apply func(reloadRequest)) bool {
+	f.Lock()
+	defer f.Unlock()
+	now := f.now()
+	frozen, until := f.state(now)
+	if !frozen {
+		return false
+	}
+	f.pending = &r
+	if f.timer == nil {
+		log.Printf("Reloads frozen until %s, reload staged\n", until.Format(time.RFC3339))
+		f.timer = time.AfterFunc(until.Sub(now), func() { f.release(apply) })
+	}
+	return true
+}
+
+// release applies the staged reload if the freeze ended, or waits for its
+// end otherwise.
+func (f *ReloadFreeze) release(apply func(reloadRequest)) {
+	f.Lock()
+	now := f.now()
+	if frozen, until := f.state(now); frozen {
+		f.timer = time.AfterFunc(until.Sub(now), func() { f.release(apply) })
+		f.Unlock()
+		return
+	}
+	pending := f.pending
+	f.pending = nil
+	f.timer = nil
+	f.Unlock()
+	if pending != nil {
+		log.Println("Reloads not frozen anymore, applying staged reload")
+		apply(*pending)
+	}
+}
+
+// Status returns the current state of the freeze.
+func (f *ReloadFreeze) Status() *FreezeStatus {
+	if f == nil {
+		return nil
+	}
+	f.Lock()
+	defer f.Unlock()
+	frozen, t := f.state(f.now())
+	status := &FreezeStatus{Frozen: frozen, Pending: f.pending != nil}
+	if f.pending != nil {
+		status.PendingActor = f.pending.actor
+	}
+	if !t.IsZero() {
+		if frozen {
+			status.Until = &t
+		} else {
+			status.NextFreeze = &t
+		}
+	}
+	return status
+}
+
+// Stop cancels the staged reload, if any.
+func (f *ReloadFreeze) Stop() {
+	f.Lock()
+	defer f.Unlock()
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	f.pending = nil
+}
+
+// autoReload reloads haproxy for automatic sources, as configuration watches
+// or triggers. During freezes the reload is staged and nil is returned.
+func (c *Controller) autoReload(r reloadRequest) *ReloadOutcome {
+	if c.Freeze != nil && c.Freeze.Stage(r, c.applyStagedReload) {
+		return nil
+	}
+	return c.doReload(r)
+}
+
+func (c *Controller) applyStagedReload(r reloadRequest) {
+	if outcome := c.doReload(r); !outcome.Success {
+		log.Printf("Couldn't apply staged reload: %v\n", outcome.Error)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseFreezeSchedule(t *testing.T) {
+	windows, err := ParseFreezeSchedule("mon-fri 18:00-08:00,sat,sun 10:00-12:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 3 {
+		t.Fatalf("found %d windows, expected 3", len(windows))
+	}
+	if len(windows[0].Days) != 5 || !windows[0].Days[time.Friday] || windows[0].Days[time.Saturday] {
+		t.Fatalf("unexpected days: %v", windows[0].Days)
+	}
+	if windows[0].Start != 18*time.Hour || windows[0].End != 32*time.Hour {
+		t.Fatalf("unexpected range: %s-%s", windows[0].Start, windows[0].End)
+	}
+	if !windows[1].Days[time.Saturday] || windows[1].Start != 0 || windows[1].End != 24*time.Hour {
+		t.Fatalf("unexpected window: %+v", windows[1])
+	}
+	if windows[2].End != 12*time.Hour+30*time.Minute {
+		t.Fatalf("unexpected end: %s", windows[2].End)
+	}
+
+	for _, invalid := range []string{"", "someday", "mon 18:00", "mon 25:00-26:00", "mon 10:00-12:00 extra"} {
+		if _, err := ParseFreezeSchedule(invalid); err == nil {
+			t.Errorf("expected error parsing %q", invalid)
+		}
+	}
+}
+
+func TestReloadFreezeState(t *testing.T) {
+	windows, err := ParseFreezeSchedule("fri-mon 22:00-06:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewReloadFreeze(windows)
+
+	// 2018-06-01 is a Friday
+	cases := []struct {
+		t      time.Time
+		frozen bool
+		until  time.Time
+	}{
+		{time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC), false, time.Date(2018, 6, 1, 22, 0, 0, 0, time.UTC)},
+		{time.Date(2018, 6, 1, 23, 0, 0, 0, time.UTC), true, time.Date(2018, 6, 2, 6, 0, 0, 0, time.UTC)},
+		{time.Date(2018, 6, 5, 3, 0, 0, 0, time.UTC), true, time.Date(2018, 6, 5, 6, 0, 0, 0, time.UTC)},
+		{time.Date(2018, 6, 5, 23, 0, 0, 0, time.UTC), false, time.Date(2018, 6, 8, 22, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		frozen, until := f.state(c.t)
+		if frozen != c.frozen || !until.Equal(c.until) {
+			t.Errorf("%s: found frozen %v until %s, expected %v until %s", c.t, frozen, until, c.frozen, c.until)
+		}
+	}
+}
+
+func TestControllerReloadFreeze(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	windows, err := ParseFreezeSchedule("22:00-00:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Clock some milliseconds before the freeze ends
+	start := time.Now()
+	base := time.Date(2018, 6, 1, 23, 59, 59, int(800*time.Millisecond), time.UTC)
+	freeze := NewReloadFreeze(windows)
+	freeze.now = func() time.Time { return base.Add(time.Since(start)) }
+	defer freeze.Stop()
+
+	haproxy := &fakeHaproxy{running: true}
+	c := NewController("", path, haproxy, &fakeValidator{})
+	c.Freeze = freeze
+
+	for _, actor := range []string{"watch-config", "syslog-trigger"} {
+		if outcome := c.autoReload(reloadRequest{validate: true, actor: actor}); outcome != nil {
+			t.Fatalf("reload not deferred during freeze: %+v", outcome)
+		}
+	}
+	status := freeze.Status()
+	if !status.Frozen || !status.Pending || status.PendingActor != "syslog-trigger" {
+		t.Fatalf("unexpected freeze status: %+v", status)
+	}
+	if s := getStatus(t, c)["freeze"]; s["frozen"] != true || s["until"] == nil {
+		t.Fatalf("freeze not reported in status: %v", s)
+	}
+	haproxy.Lock()
+	reloads := haproxy.reloads
+	haproxy.Unlock()
+	if reloads != 0 {
+		t.Fatalf("haproxy reloaded %d times during freeze", reloads)
+	}
+
+	// Manual reloads are not deferred
+	if outcome := c.doReload(reloadRequest{actor: "test"}); !outcome.Success {
+		t.Fatalf("manual reload failed: %v", outcome.Error)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		haproxy.Lock()
+		reloads = haproxy.reloads
+		haproxy.Unlock()
+		if reloads == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("found %d reloads, staged reload not applied after the freeze", reloads)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	status = freeze.Status()
+	if status.Frozen || status.Pending || status.NextFreeze == nil {
+		t.Fatalf("unexpected freeze status after the freeze: %+v", status)
+	}
+	time.Sleep(100 * time.Millisecond)
+	haproxy.Lock()
+	defer haproxy.Unlock()
+	if haproxy.reloads != 2 {
+		t.Fatalf("found %d reloads, expected only one staged reload applied", haproxy.reloads)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Default window used to report the reload success rate
+const defaultReloadSuccessWindow = time.Hour
+
+// Maximum number of reloads kept to compute the success rate
+const reloadHistorySize = 1024
+
+type reloadRecord struct {
+	time    time.Time
+	success bool
+}
+
+// ReloadHistory keeps the results of the last reloads in a ring buffer, to
+// compute their success rate over a sliding window.
+type ReloadHistory struct {
+	sync.Mutex
+	records []reloadRecord
+	next    int
+	full    bool
+}
+
+func NewReloadHistory(size int) *ReloadHistory {
+	return &ReloadHistory{records: make([]reloadRecord, size)}
+}
+
+// Add records the result of a reload, replacing the oldest one if the
+// history is full.
+func (h *ReloadHistory) Add(t time.Time, success bool) {
+	h.Lock()
+	defer h.Unlock()
+	h.records[h.next] = reloadRecord{time: t, success: success}
+	h.next = (h.next + 1) % len(h.records)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// ReloadWindow summarizes the reloads done in a window of time.
+type ReloadWindow struct {
+	Successes int
+	Failures  int
+}
+
+// Rate returns the ratio of successful reloads, NaN if there were no reloads.
+func (w ReloadWindow) Rate() float64 {
+	total := w.Successes + w.Failures
+	if total == 0 {
+		return math.NaN()
+	}
+	return float64(w.Successes) / float64(total)
+}
+
+// Window counts the reloads done in the given time until now.
+func (h *ReloadHistory) Window(now time.Time, window time.Duration) ReloadWindow {
+	h.Lock()
+	defer h.Unlock()
+	n := h.next
+	if h.full {
+		n = len(h.records)
+	}
+	since := now.Add(-window)
+	var w ReloadWindow
+	for i := 0; i < n; i++ {
+		r := h.records[i]
+		if r.time.Before(since) {
+			continue
+		}
+		if r.success {
+			w.Successes++
+		} else {
+			w.Failures++
+		}
+	}
+	return w
+}
+
+func (h *ReloadHistory) collect(window time.Duration) []MetricFamily {
+	w := h.Window(time.Now(), window)
+	return []MetricFamily{
+		gaugeFamily("reload_success_rate", "Ratio of successful reloads in the success rate window", w.Rate()),
+		gaugeFamily("reload_window_successes", "Number of successful reloads in the success rate window", float64(w.Successes)),
+		gaugeFamily("reload_window_failures", "Number of failed reloads in the success rate window", float64(w.Failures)),
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestReloadHistoryWindow(t *testing.T) {
+	now := time.Now()
+	h := NewReloadHistory(4)
+	if w := h.Window(now, time.Hour); w.Successes != 0 || w.Failures != 0 || !math.IsNaN(w.Rate()) {
+		t.Fatalf("unexpected empty window: %+v", w)
+	}
+
+	h.Add(now.Add(-2*time.Hour), false)
+	h.Add(now.Add(-30*time.Minute), true)
+	h.Add(now.Add(-20*time.Minute), false)
+	h.Add(now.Add(-10*time.Minute), true)
+	if w := h.Window(now, time.Hour); w.Successes != 2 || w.Failures != 1 {
+		t.Fatalf("unexpected window: %+v", w)
+	}
+	if w := h.Window(now, 15*time.Minute); w.Successes != 1 || w.Failures != 0 || w.Rate() != 1 {
+		t.Fatalf("unexpected window: %+v", w)
+	}
+
+	// The oldest reloads are replaced when the history is full
+	h.Add(now, true)
+	h.Add(now, true)
+	if w := h.Window(now, 3*time.Hour); w.Successes != 3 || w.Failures != 1 || w.Rate() != 0.75 {
+		t.Fatalf("unexpected window: %+v, rate %v", w, w.Rate())
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Sysctls that can be raised during reloads. The listen backlog of the
+// sockets opened by the new haproxy process is limited by somaxconn, and the
+// queue of connections in handshake by tcp_max_syn_backlog, so they can
+// absorb the burst of connections accepted when the capture is released.
+// netdev_max_backlog limits packets received pending to be processed.
+var reloadSysctlsAllowed = map[string]bool{
+	sysctlSomaxconn:                true,
+	"net.ipv4.tcp_max_syn_backlog": true,
+	"net.core.netdev_max_backlog":  true,
+}
+
+// ReloadSysctls are sysctls raised during reloads retaining connections, and
+// restored after them.
+type ReloadSysctls map[string]int64
+
+// parseReloadSysctls parses a comma-separated list of name=value pairs.
+func parseReloadSysctls(arg string) (ReloadSysctls, error) {
+	values, err := parseKeyValues(arg)
+	if err != nil {
+		return nil, err
+	}
+	sysctls := make(ReloadSysctls)
+	for name, v := range values {
+		if !reloadSysctlsAllowed[name] {
+			return nil, fmt.Errorf("sysctl %s cannot be raised during reloads", name)
+		}
+		value, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || value <= 0 {
+			return nil, fmt.Errorf("invalid value for %s: %s", name, v)
+		}
+		sysctls[name] = value
+	}
+	return sysctls, nil
+}
+
+func writeSysctl(name string, value int64) error {
+	path := filepath.Join(procSysPath, strings.Replace(name, ".", "/", -1))
+	return ioutil.WriteFile(path, []byte(strconv.FormatInt(value, 10)+"\n"), 0644)
+}
+
+// Raise sets the sysctls whose current values are lower than the configured
+// ones, the returned function restores their previous values. Sysctls that
+// cannot be read or written are logged and left unchanged.
+func (s ReloadSysctls) Raise() (restore func()) {
+	previous := make(map[string]int64)
+	for name, value := range s {
+		current, err := readSysctl(name)
+		if err != nil {
+			log.Printf("Couldn't read %s: %v\n", name, err)
+			continue
+		}
+		if current >= value {
+			continue
+		}
+		if err := writeSysctl(name, value); err != nil {
+			log.Printf("Couldn't raise %s: %v\n", name, err)
+			continue
+		}
+		previous[name] = current
+	}
+	return func() {
+		for name, value := range previous {
+			if err := writeSysctl(name, value); err != nil {
+				log.Printf("Couldn't restore %s to %d: %v\n", name, value, err)
+			}
+		}
+	}
+}
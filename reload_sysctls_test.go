@@ -0,0 +1,107 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// sysctlsHaproxy records the value of sysctls during reloads.
+type sysctlsHaproxy struct {
+	fakeHaproxy
+	names  []string
+	values []map[string]int64
+}
+
+func (h *sysctlsHaproxy) Reload() error {
+	values := make(map[string]int64)
+	for _, name := range h.names {
+		values[name], _ = readSysctl(name)
+	}
+	h.values = append(h.values, values)
+	return h.fakeHaproxy.Reload()
+}
+
+func TestReloadSysctlsRaiseRestore(t *testing.T) {
+	defer fakeSysctls(t, map[string]string{
+		sysctlSomaxconn:                "128",
+		"net.ipv4.tcp_max_syn_backlog": "100000",
+	})()
+
+	sysctls := ReloadSysctls{sysctlSomaxconn: 65535, "net.ipv4.tcp_max_syn_backlog": 65535, "net.core.netdev_max_backlog": 5000}
+	restore := sysctls.Raise()
+	if v, _ := readSysctl(sysctlSomaxconn); v != 65535 {
+		t.Errorf("expected somaxconn raised, found %d", v)
+	}
+	if v, _ := readSysctl("net.ipv4.tcp_max_syn_backlog"); v != 100000 {
+		t.Errorf("expected higher value not lowered, found %d", v)
+	}
+	restore()
+	if v, _ := readSysctl(sysctlSomaxconn); v != 128 {
+		t.Errorf("expected somaxconn restored, found %d", v)
+	}
+	if v, _ := readSysctl("net.ipv4.tcp_max_syn_backlog"); v != 100000 {
+		t.Errorf("expected unchanged value, found %d", v)
+	}
+	if _, err := readSysctl("net.core.netdev_max_backlog"); !os.IsNotExist(err) {
+		t.Errorf("unavailable sysctl shouldn't be created, found %v", err)
+	}
+}
+
+func TestControllerReloadRaisesSysctls(t *testing.T) {
+	defer fakeSysctls(t, map[string]string{sysctlSomaxconn: "128"})()
+
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &sysctlsHaproxy{names: []string{sysctlSomaxconn}}
+	c := NewController("", config, h, &fakeValidator{})
+	c.ReloadSysctls = ReloadSysctls{sysctlSomaxconn: 4096}
+
+	if outcome := c.Reload(); !outcome.Success {
+		t.Fatalf("reload failed: %+v", outcome)
+	}
+	if err := writeFileAtomic(config, []byte("#@wrapper: capture=false\nglobal\n")); err != nil {
+		t.Fatal(err)
+	}
+	if outcome := c.Reload(); !outcome.Success {
+		t.Fatalf("reload failed: %+v", outcome)
+	}
+
+	expected := []map[string]int64{{sysctlSomaxconn: 4096}, {sysctlSomaxconn: 128}}
+	if !reflect.DeepEqual(h.values, expected) {
+		t.Errorf("expected sysctls %v during reloads, found %v", expected, h.values)
+	}
+	if v, _ := readSysctl(sysctlSomaxconn); v != 128 {
+		t.Errorf("expected somaxconn restored after reload, found %d", v)
+	}
+}
+
+func TestParseReloadSysctls(t *testing.T) {
+	sysctls, err := parseReloadSysctls("net.core.somaxconn=65535, net.ipv4.tcp_max_syn_backlog=8192")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ReloadSysctls{sysctlSomaxconn: 65535, "net.ipv4.tcp_max_syn_backlog": 8192}
+	if !reflect.DeepEqual(sysctls, expected) {
+		t.Errorf("expected %v, found %v", expected, sysctls)
+	}
+	for _, arg := range []string{"net.ipv4.ip_forward=1", "net.core.somaxconn=many", "net.core.somaxconn=0", "net.core.somaxconn"} {
+		if _, err := parseReloadSysctls(arg); err == nil {
+			t.Errorf("%q: expected error", arg)
+		}
+	}
+}
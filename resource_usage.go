@@ -0,0 +1,76 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// Directory with the file descriptors opened by the wrapper
+var selfFDPath = "/proc/self/fd"
+
+// ResourceUsage is the usage of resources of the wrapper process itself,
+// without haproxy, to detect leaks in the wrapper.
+type ResourceUsage struct {
+	Goroutines  int     `json:"goroutines"`
+	HeapBytes   uint64  `json:"heap_bytes"`
+	MemoryBytes uint64  `json:"memory_bytes"`
+	CPUSeconds  float64 `json:"cpu_seconds"`
+
+	// Open file descriptors, -1 if they cannot be counted
+	OpenFDs int `json:"open_fds"`
+}
+
+// readResourceUsage obtains the current usage of resources of the wrapper.
+func readResourceUsage() ResourceUsage {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	usage := ResourceUsage{
+		Goroutines:  runtime.NumGoroutine(),
+		HeapBytes:   mem.HeapAlloc,
+		MemoryBytes: mem.Sys,
+		OpenFDs:     -1,
+	}
+	var rusage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &rusage); err == nil {
+		cpu := time.Duration(rusage.Utime.Nano() + rusage.Stime.Nano())
+		usage.CPUSeconds = cpu.Seconds()
+	}
+	if fds, err := ioutil.ReadDir(selfFDPath); err == nil {
+		usage.OpenFDs = len(fds)
+	}
+	return usage
+}
+
+func (u ResourceUsage) collect() []MetricFamily {
+	families := []MetricFamily{
+		gaugeFamily("goroutines", "Number of goroutines of the wrapper", float64(u.Goroutines)),
+		gaugeFamily("heap_bytes", "Bytes of allocated heap objects of the wrapper", float64(u.HeapBytes)),
+		gaugeFamily("memory_bytes", "Bytes of memory obtained from the system by the wrapper", float64(u.MemoryBytes)),
+		{
+			Name:    metricsNamespace + "_cpu_seconds_total",
+			Help:    "CPU time used by the wrapper, in user and system mode",
+			Type:    "counter",
+			Samples: []Sample{{Value: u.CPUSeconds}},
+		},
+	}
+	if u.OpenFDs >= 0 {
+		families = append(families, gaugeFamily("open_fds", "Number of file descriptors opened by the wrapper", float64(u.OpenFDs)))
+	}
+	return families
+}
@@ -0,0 +1,86 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResourceUsage(t *testing.T) {
+	before := readResourceUsage()
+	if before.Goroutines == 0 || before.HeapBytes == 0 || before.MemoryBytes == 0 {
+		t.Fatalf("resource usage not populated: %+v", before)
+	}
+	if runtime.GOOS == "linux" && before.OpenFDs <= 0 {
+		t.Fatalf("open file descriptors not counted: %+v", before)
+	}
+
+	stop := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func() { <-stop }()
+	}
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	during := readResourceUsage()
+	if during.Goroutines < before.Goroutines+10 {
+		t.Errorf("goroutines not counted: %d before, %d after", before.Goroutines, during.Goroutines)
+	}
+	if runtime.GOOS == "linux" && during.OpenFDs <= before.OpenFDs {
+		t.Errorf("open file not counted: %d before, %d after", before.OpenFDs, during.OpenFDs)
+	}
+
+	close(stop)
+	f.Close()
+	var after ResourceUsage
+	for retries := 100; retries > 0; retries-- {
+		// Other tests may leave goroutines finishing meanwhile
+		if after = readResourceUsage(); after.Goroutines < before.Goroutines+10 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after.Goroutines >= before.Goroutines+10 || (runtime.GOOS == "linux" && after.OpenFDs >= during.OpenFDs) {
+		t.Errorf("resource usage not stabilized: %+v before, %+v after", before, after)
+	}
+	if after.CPUSeconds < before.CPUSeconds {
+		t.Errorf("CPU time decreased: %f before, %f after", before.CPUSeconds, after.CPUSeconds)
+	}
+}
+
+func TestControllerResourceUsage(t *testing.T) {
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{running: true}, &fakeValidator{})
+	c.Metrics, _ = NewRegistry(nil)
+	c.Metrics.Register(c)
+
+	if wrapper := getStatus(t, c)["wrapper"]; wrapper["goroutines"] == nil || wrapper["heap_bytes"] == float64(0) {
+		t.Errorf("unexpected wrapper section: %v", wrapper)
+	}
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, name := range []string{"goroutines", "heap_bytes", "memory_bytes", "cpu_seconds_total"} {
+		if !strings.Contains(w.Body.String(), "\nhaproxy_wrapper_"+name+" ") {
+			t.Errorf("metric %s not found in:\n%s", name, w.Body.String())
+		}
+	}
+}
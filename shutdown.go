@@ -0,0 +1,116 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Interval between checks of established connections during shutdowns
+var shutdownPollInterval = 500 * time.Millisecond
+
+// Shutdown stops haproxy without dropping connections. New connections are
+// retained, or refused by setting maxconn of all frontends to zero if they
+// cannot be retained. Then it waits for established connections to finish,
+// up to the timeout, before stopping haproxy. Retained connections are
+// released after haproxy is stopped.
+func (c *Controller) Shutdown(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	retainer, _ := c.haproxy.(ConnectionRetainer)
+	retained := retainer != nil && retainer.RetainConnections()
+	if retained {
+		log.Println("Shutdown: retaining new connections")
+		defer func() {
+			retainer.ReleaseConnections()
+			log.Println("Shutdown: retained connections released")
+		}()
+	} else if c.StatsSocket != nil {
+		log.Println("Shutdown: refusing new connections")
+		drain, err := newMaxconnDrain(c.StatsSocket, 0, 1)
+		if err != nil {
+			log.Printf("Couldn't refuse new connections: %v\n", err)
+		} else {
+			for _, frontend := range drain.frontends() {
+				drain.setMaxconn(frontend, 0)
+			}
+		}
+	}
+
+	if c.StatsSocket != nil {
+		c.waitConnections(deadline)
+	} else {
+		log.Println("Shutdown: established connections cannot be checked without stats socket")
+	}
+
+	log.Println("Shutdown: stopping haproxy")
+	if err := c.haproxy.Stop(); err != nil {
+		return fmt.Errorf("couldn't stop haproxy: %v", err)
+	}
+	return nil
+}
+
+// waitConnections waits for the frontends to have no established sessions,
+// or for the deadline.
+func (c *Controller) waitConnections(deadline time.Time) {
+	for {
+		sessions, err := c.currentSessions()
+		if err != nil {
+			log.Printf("Couldn't check established connections: %v\n", err)
+		} else if sessions == 0 {
+			log.Println("Shutdown: all connections finished")
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Shutdown: timeout with %d established connections\n", sessions)
+			return
+		}
+		<-time.After(shutdownPollInterval)
+	}
+}
+
+// currentSessions counts the sessions established in all frontends.
+func (c *Controller) currentSessions() (int, error) {
+	records, err := c.StatsSocket.ShowStat()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, r := range records {
+		if r.Server != "FRONTEND" {
+			continue
+		}
+		n, err := strconv.Atoi(r.Fields["scur"])
+		if err != nil {
+			return 0, fmt.Errorf("invalid sessions of frontend %s: %q", r.Proxy, r.Fields["scur"])
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// handleTermination runs the shutdown once, on the first signal received.
+// Signals received while shutting down call exit, so a stuck shutdown can be
+// interrupted.
+func handleTermination(signals <-chan os.Signal, shutdown func(), exit func()) {
+	log.Printf("Signal received: %v\n", <-signals)
+	go shutdown()
+	log.Printf("Signal received while shutting down: %v, exiting\n", <-signals)
+	exit()
+}
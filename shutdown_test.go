@@ -0,0 +1,302 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tcpHaproxy serves connections that reply to a line after a delay, stopping
+// it resets the connections still established, as killing haproxy would do.
+type tcpHaproxy struct {
+	fakeHaproxy
+
+	listener    net.Listener
+	delay       time.Duration
+	connections map[net.Conn]bool
+	stopped     int
+	events      []string
+}
+
+func newTCPHaproxy(t *testing.T, delay time.Duration) *tcpHaproxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &tcpHaproxy{listener: l, delay: delay, connections: make(map[net.Conn]bool)}
+	h.running = true
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			h.Lock()
+			h.connections[conn] = true
+			h.Unlock()
+			go h.serve(conn)
+		}
+	}()
+	return h
+}
+
+func (h *tcpHaproxy) serve(conn net.Conn) {
+	defer func() {
+		h.Lock()
+		delete(h.connections, conn)
+		h.Unlock()
+		conn.Close()
+	}()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	<-time.After(h.delay)
+	fmt.Fprintf(conn, "OK %s", line)
+}
+
+func (h *tcpHaproxy) sessions() int {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.connections)
+}
+
+func (h *tcpHaproxy) refuse() {
+	h.Lock()
+	h.events = append(h.events, "refuse")
+	h.Unlock()
+	h.listener.Close()
+}
+
+func (h *tcpHaproxy) Stop() error {
+	h.Lock()
+	defer h.Unlock()
+	h.running = false
+	h.stopped = len(h.connections)
+	h.events = append(h.events, "stop")
+	h.listener.Close()
+	for conn := range h.connections {
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}
+	return nil
+}
+
+func (h *tcpHaproxy) statsSocket(t *testing.T) *fakeStatsSocket {
+	return newFakeStatsSocket(t, func(command string) string {
+		switch command {
+		case "show stat":
+			return statHeader + fmt.Sprintf("web,FRONTEND,,,%d,0,100,0,0,0,0,0,,,,,,OPEN,\n", h.sessions())
+		case "set maxconn frontend web 0":
+			h.refuse()
+			return "\n"
+		}
+		return "Unknown command.\n"
+	})
+}
+
+// retainingHaproxy is a tcpHaproxy that can retain connections.
+type retainingHaproxy struct {
+	*tcpHaproxy
+}
+
+func (h *retainingHaproxy) RetainConnections() bool {
+	h.Lock()
+	defer h.Unlock()
+	h.events = append(h.events, "retain")
+	return true
+}
+
+func (h *retainingHaproxy) ReleaseConnections() {
+	h.Lock()
+	defer h.Unlock()
+	h.events = append(h.events, "release")
+}
+
+func setShutdownPollInterval(d time.Duration) func() {
+	previous := shutdownPollInterval
+	shutdownPollInterval = d
+	return func() { shutdownPollInterval = previous }
+}
+
+// openRequests sends a request in n connections, and returns a channel where
+// the responses or errors of each one are sent.
+func openRequests(t *testing.T, address string, n int) <-chan error {
+	results := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer conn.Close()
+			request := fmt.Sprintf("request %d\n", i)
+			_, err := conn.Write([]byte(request))
+			wg.Done()
+			if err != nil {
+				results <- err
+				return
+			}
+			response, err := bufio.NewReader(conn).ReadString('\n')
+			if err == nil && response != "OK "+request {
+				err = fmt.Errorf("unexpected response: %q", response)
+			}
+			results <- err
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+func waitSessions(t *testing.T, h *tcpHaproxy, n int) {
+	for retries := 100; h.sessions() != n; retries-- {
+		if retries == 0 {
+			t.Fatalf("expected %d sessions, found %d", n, h.sessions())
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+}
+
+func TestControllerShutdownNoResets(t *testing.T) {
+	defer setShutdownPollInterval(10 * time.Millisecond)()
+
+	h := newTCPHaproxy(t, 200*time.Millisecond)
+	socket := h.statsSocket(t)
+	defer socket.Close()
+
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, h, &fakeValidator{})
+	c.StatsSocket = NewStatsSocket(socket.Path())
+
+	connections := 10
+	results := openRequests(t, h.listener.Addr().String(), connections)
+	waitSessions(t, h, connections)
+
+	if err := c.Shutdown(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < connections; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("connection failed during shutdown: %v", err)
+		}
+	}
+	if h.stopped != 0 {
+		t.Errorf("haproxy stopped with %d established connections", h.stopped)
+	}
+	if expected := []string{"refuse", "stop"}; !reflect.DeepEqual(h.events, expected) {
+		t.Errorf("expected %v, found %v", expected, h.events)
+	}
+	if _, err := net.Dial("tcp", h.listener.Addr().String()); err == nil {
+		t.Error("new connection accepted after shutdown")
+	}
+}
+
+func TestControllerShutdownRetainedConnections(t *testing.T) {
+	defer setShutdownPollInterval(10 * time.Millisecond)()
+
+	h := &retainingHaproxy{newTCPHaproxy(t, 100*time.Millisecond)}
+	socket := h.statsSocket(t)
+	defer socket.Close()
+
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, h, &fakeValidator{})
+	c.StatsSocket = NewStatsSocket(socket.Path())
+
+	results := openRequests(t, h.listener.Addr().String(), 3)
+	waitSessions(t, h.tcpHaproxy, 3)
+
+	if err := c.Shutdown(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("connection failed during shutdown: %v", err)
+		}
+	}
+	if expected := []string{"retain", "stop", "release"}; !reflect.DeepEqual(h.events, expected) {
+		t.Errorf("expected %v, found %v", expected, h.events)
+	}
+}
+
+func TestControllerShutdownTimeout(t *testing.T) {
+	defer setShutdownPollInterval(10 * time.Millisecond)()
+
+	h := newTCPHaproxy(t, time.Minute)
+	socket := h.statsSocket(t)
+	defer socket.Close()
+
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	c := NewController("", config, h, &fakeValidator{})
+	c.StatsSocket = NewStatsSocket(socket.Path())
+
+	results := openRequests(t, h.listener.Addr().String(), 1)
+	waitSessions(t, h, 1)
+
+	start := time.Now()
+	if err := c.Shutdown(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %s", elapsed)
+	}
+	if h.stopped != 1 {
+		t.Errorf("expected haproxy stopped with 1 established connection, found %d", h.stopped)
+	}
+	if err := <-results; err == nil || !strings.Contains(err.Error(), "reset") {
+		t.Errorf("expected connection reset after timeout, found %v", err)
+	}
+}
+
+func TestHandleTermination(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	shutdowns := make(chan struct{}, 2)
+	exited := make(chan struct{})
+	go handleTermination(signals, func() {
+		shutdowns <- struct{}{}
+	}, func() {
+		close(exited)
+	})
+
+	signals <- syscall.SIGTERM
+	select {
+	case <-shutdowns:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown not started on first signal")
+	}
+
+	signals <- syscall.SIGTERM
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("not exited on second signal")
+	}
+	if len(shutdowns) != 0 {
+		t.Fatal("shutdown started more than once")
+	}
+}
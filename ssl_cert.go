@@ -0,0 +1,156 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Maximum size of certificates sent to /ssl/cert
+const maxCertificateSize = 1 << 20
+
+// CertificateUpdateError is an error reported by haproxy while updating a
+// certificate.
+type CertificateUpdateError struct {
+	Command  string
+	Response string
+}
+
+func (e *CertificateUpdateError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Command, strings.TrimSpace(e.Response))
+}
+
+// validateCertificate checks that content is a PEM bundle with at least a
+// certificate and, if a private key is included, that it matches the first
+// certificate. It returns the bundle without empty lines, as they finish
+// payloads in the runtime API.
+func validateCertificate(content []byte) ([]byte, error) {
+	var certificates, keys [][]byte
+	rest := content
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+				return nil, fmt.Errorf("invalid certificate: %v", err)
+			}
+			certificates = append(certificates, pem.EncodeToMemory(block))
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			keys = append(keys, pem.EncodeToMemory(block))
+		}
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, fmt.Errorf("unexpected content after PEM blocks")
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	if len(keys) > 1 {
+		return nil, fmt.Errorf("more than one private key found")
+	}
+	if len(keys) == 1 {
+		if _, err := tls.X509KeyPair(certificates[0], keys[0]); err != nil {
+			return nil, fmt.Errorf("private key doesn't match certificate: %v", err)
+		}
+	}
+
+	var bundle bytes.Buffer
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) != "" {
+			bundle.WriteString(strings.TrimRight(line, "\r") + "\n")
+		}
+	}
+	return bundle.Bytes(), nil
+}
+
+// UpdateCertificate replaces a certificate loaded by haproxy with the
+// runtime API, without reloading. The transaction is aborted if it cannot be
+// committed.
+func (s *StatsSocket) UpdateCertificate(path string, content []byte) error {
+	set := "set ssl cert " + path
+	response, err := s.Command(set + " <<\n" + string(content))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(response, "Transaction created") && !strings.Contains(response, "Transaction updated") {
+		return &CertificateUpdateError{Command: set, Response: response}
+	}
+
+	commit := "commit ssl cert " + path
+	response, err = s.Command(commit)
+	if err == nil && strings.Contains(response, "Success!") {
+		return nil
+	}
+	if abortResponse, abortErr := s.Command("abort ssl cert " + path); abortErr != nil {
+		log.Printf("Couldn't abort certificate transaction: %v\n", abortErr)
+	} else {
+		log.Printf("Certificate transaction aborted: %s\n", strings.TrimSpace(abortResponse))
+	}
+	if err != nil {
+		return err
+	}
+	return &CertificateUpdateError{Command: commit, Response: response}
+}
+
+func (c *Controller) sslCert(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "PUT" {
+		w.Header().Set("Allow", "PUT")
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorize(w, req) {
+		return
+	}
+	if c.StatsSocket == nil {
+		http.Error(w, "Stats socket not configured\n", http.StatusServiceUnavailable)
+		return
+	}
+	path := req.URL.Query().Get("path")
+	if !filepath.IsAbs(path) || strings.ContainsAny(path, " \t\n") {
+		http.Error(w, "An absolute path without spaces is required\n", http.StatusBadRequest)
+		return
+	}
+	content, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxCertificateSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Couldn't read certificate: %v\n", err), http.StatusBadRequest)
+		return
+	}
+	bundle, err := validateCertificate(content)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid certificate: %v\n", err), http.StatusBadRequest)
+		return
+	}
+	if err := c.StatsSocket.UpdateCertificate(path, bundle); err != nil {
+		msg := fmt.Sprintf("Couldn't update certificate %s: %v\n", path, err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Certificate %s updated\n", path)
+	fmt.Fprintf(w, "OK\n")
+}
@@ -0,0 +1,208 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCertificate generates a self-signed certificate and its key in PEM.
+func testCertificate(t *testing.T) (certificate, key []byte) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestValidateCertificate(t *testing.T) {
+	certificate, key := testCertificate(t)
+	_, otherKey := testCertificate(t)
+
+	bundle, err := validateCertificate([]byte(string(certificate) + "\n\r\n" + string(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(bundle), "\n\n") || !strings.HasSuffix(string(bundle), "-----\n") {
+		t.Fatalf("empty lines in bundle: %q", bundle)
+	}
+	if _, err := validateCertificate(certificate); err != nil {
+		t.Fatalf("certificate without key should be valid: %v", err)
+	}
+
+	invalid := map[string]string{
+		"empty":          "",
+		"only key":       string(key),
+		"mismatched key": string(certificate) + string(otherKey),
+		"garbage":        string(certificate) + "garbage\n",
+		"broken":         "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n",
+	}
+	for name, content := range invalid {
+		if _, err := validateCertificate([]byte(content)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+// certificateSocket responds to the commands of certificate updates, failing
+// commits if commitResponse is set, and records the commands received.
+type certificateSocket struct {
+	sync.Mutex
+	commands       []string
+	commitResponse string
+}
+
+func (s *certificateSocket) respond(command string) string {
+	s.Lock()
+	defer s.Unlock()
+	s.commands = append(s.commands, command)
+	switch {
+	case strings.HasPrefix(command, "set ssl cert "):
+		return "Transaction created for certificate /etc/haproxy/site.pem!\n"
+	case strings.HasPrefix(command, "commit ssl cert "):
+		if s.commitResponse != "" {
+			return s.commitResponse
+		}
+		return "Committing /etc/haproxy/site.pem.\nSuccess!\n"
+	case strings.HasPrefix(command, "abort ssl cert "):
+		return "Transaction aborted for certificate '/etc/haproxy/site.pem'!\n"
+	}
+	return "Unknown command.\n"
+}
+
+func (s *certificateSocket) Commands() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+func putCertificate(c *Controller, path, content string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("PUT", "/ssl/cert?path="+path, strings.NewReader(content)))
+	return w
+}
+
+func TestControllerUpdateCertificate(t *testing.T) {
+	certificate, key := testCertificate(t)
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	fake := &certificateSocket{}
+	socket := newFakeStatsSocket(t, fake.respond)
+	defer socket.Close()
+
+	h := &fakeHaproxy{}
+	c := NewController("", config, h, &fakeValidator{})
+	c.StatsSocket = NewStatsSocket(socket.Path())
+
+	w := putCertificate(c, "/etc/haproxy/site.pem", string(certificate)+"\n"+string(key))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	commands := fake.Commands()
+	if len(commands) != 2 {
+		t.Fatalf("expected set and commit, found %q", commands)
+	}
+	expectedSet := "set ssl cert /etc/haproxy/site.pem <<\n" + string(certificate) + string(key)
+	if commands[0] != strings.TrimSpace(expectedSet) {
+		t.Errorf("unexpected set command: %q", commands[0])
+	}
+	if commands[1] != "commit ssl cert /etc/haproxy/site.pem" {
+		t.Errorf("unexpected commit command: %q", commands[1])
+	}
+	if h.reloads != 0 {
+		t.Errorf("haproxy reloaded to update certificate")
+	}
+}
+
+func TestControllerUpdateCertificateCommitFailure(t *testing.T) {
+	certificate, _ := testCertificate(t)
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	fake := &certificateSocket{commitResponse: "Committing /etc/haproxy/site.pem.\nunable to load the private key\n"}
+	socket := newFakeStatsSocket(t, fake.respond)
+	defer socket.Close()
+
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+	c.StatsSocket = NewStatsSocket(socket.Path())
+
+	w := putCertificate(c, "/etc/haproxy/site.pem", string(certificate))
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "unable to load the private key") {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	commands := fake.Commands()
+	if len(commands) != 3 || commands[2] != "abort ssl cert /etc/haproxy/site.pem" {
+		t.Fatalf("expected transaction to be aborted, found %q", commands)
+	}
+}
+
+func TestControllerUpdateCertificateInvalid(t *testing.T) {
+	certificate, _ := testCertificate(t)
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	fake := &certificateSocket{}
+	socket := newFakeStatsSocket(t, fake.respond)
+	defer socket.Close()
+
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+	c.Token = "secret"
+	c.StatsSocket = NewStatsSocket(socket.Path())
+
+	if w := putCertificate(c, "/etc/haproxy/site.pem", string(certificate)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, found %d", w.Code)
+	}
+	c.Token = ""
+	if w := putCertificate(c, "site.pem", string(certificate)); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 with relative path, found %d", w.Code)
+	}
+	if w := putCertificate(c, "/etc/haproxy/site.pem", "not a certificate"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 with invalid PEM, found %d", w.Code)
+	}
+	if commands := fake.Commands(); len(commands) != 0 {
+		t.Fatalf("commands sent for invalid requests: %q", commands)
+	}
+
+	c.StatsSocket = nil
+	if w := putCertificate(c, "/etc/haproxy/site.pem", string(certificate)); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 without stats socket, found %d", w.Code)
+	}
+}
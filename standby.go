@@ -0,0 +1,224 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var errNoStandby = errors.New("no valid standby configuration")
+
+// StandbyStatus describes the standby configuration.
+type StandbyStatus struct {
+	Hash      string    `json:"hash,omitempty"`
+	Uploaded  time.Time `json:"uploaded,omitempty"`
+	Validated time.Time `json:"validated,omitempty"`
+	Valid     bool      `json:"valid"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// StandbyConfig is an alternate configuration kept validated against the
+// haproxy binary, so it can be promoted without waiting for its validation.
+// It is validated again when the binary changes.
+type StandbyConfig struct {
+	sync.Mutex
+	path      string
+	binary    string
+	validator HaproxyConfigValidator
+
+	// Binary the standby configuration was validated with
+	binaryInfo os.FileInfo
+
+	content []byte
+	status  StandbyStatus
+
+	stop chan struct{}
+}
+
+// NewStandbyConfig keeps the standby configuration in path, validated with the
+// validator of this file for the haproxy binary. A configuration already in
+// path is validated when it is checked the first time.
+func NewStandbyConfig(path, binary string, validator HaproxyConfigValidator) *StandbyConfig {
+	s := &StandbyConfig{
+		path:      path,
+		binary:    binary,
+		validator: validator,
+		stop:      make(chan struct{}),
+	}
+	if content, hash, err := readConfig(path); err == nil {
+		s.content = content
+		s.status = StandbyStatus{Hash: hash}
+	}
+	return s
+}
+
+// Upload replaces the standby configuration if the new one is valid.
+func (s *StandbyConfig) Upload(content []byte) (StandbyStatus, error) {
+	s.Lock()
+	defer s.Unlock()
+	previous := s.content
+	if err := writeFileAtomic(s.path, content); err != nil {
+		return s.status, fmt.Errorf("couldn't write standby configuration: %v", err)
+	}
+	info, err := s.validate()
+	if err != nil {
+		if previous == nil {
+			os.Remove(s.path)
+		} else if err := writeFileAtomic(s.path, previous); err != nil {
+			log.Printf("Couldn't restore standby configuration: %v\n", err)
+		}
+		return s.status, fmt.Errorf("invalid configuration: %v", err)
+	}
+	now := time.Now()
+	s.content = content
+	s.binaryInfo = info
+	s.status = StandbyStatus{Hash: configHash(content), Uploaded: now, Validated: now, Valid: true}
+	return s.status, nil
+}
+
+// validate validates the file in path, returning the binary used.
+func (s *StandbyConfig) validate() (os.FileInfo, error) {
+	info, err := os.Stat(s.binary)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't check haproxy binary: %v", err)
+	}
+	return info, s.validator.Validate()
+}
+
+// Check validates the standby configuration again if the binary changed
+// since it was validated.
+func (s *StandbyConfig) Check() {
+	s.Lock()
+	defer s.Unlock()
+	if s.content == nil {
+		return
+	}
+	if info, err := os.Stat(s.binary); err == nil && s.binaryInfo != nil && sameBinary(s.binaryInfo, info) {
+		return
+	}
+	if _, hash, err := readConfig(s.path); err != nil || hash != s.status.Hash {
+		s.status.Valid = false
+		s.status.Error = "standby configuration modified outside of the wrapper"
+		return
+	}
+	info, err := s.validate()
+	s.status.Validated = time.Now()
+	s.status.Valid = err == nil
+	s.status.Error = ""
+	if err != nil {
+		s.status.Error = err.Error()
+		log.Printf("Standby configuration not valid with current haproxy binary: %v\n", err)
+		return
+	}
+	s.binaryInfo = info
+}
+
+// Run checks the standby configuration every interval until it is stopped.
+func (s *StandbyConfig) Run(interval time.Duration) {
+	s.Check()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(interval):
+		}
+		s.Check()
+	}
+}
+
+func (s *StandbyConfig) Stop() {
+	close(s.stop)
+}
+
+func (s *StandbyConfig) Status() StandbyStatus {
+	s.Lock()
+	defer s.Unlock()
+	return s.status
+}
+
+// ready returns the standby configuration if it is valid.
+func (s *StandbyConfig) ready() ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.content == nil || !s.status.Valid {
+		return nil, errNoStandby
+	}
+	return s.content, nil
+}
+
+// standbyConfig shows the status of the standby configuration, or replaces it
+// on PUT requests.
+func (c *Controller) standbyConfig(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, c.Standby.Status())
+	case http.MethodPut:
+		if !c.authorize(w, req) {
+			return
+		}
+		content, ok := readConfigBody(w, req)
+		if !ok {
+			return
+		}
+		status, err := c.Standby.Upload(content)
+		if err != nil {
+			msg := c.Redactor.RedactString(fmt.Sprintf("Couldn't upload standby configuration: %v\n", err))
+			log.Println(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, status)
+	default:
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+	}
+}
+
+// promoteStandby replaces the configuration with the standby one and reloads
+// haproxy, without validating it again.
+func (c *Controller) promoteStandby(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorize(w, req) {
+		return
+	}
+	content, err := c.Standby.ready()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Couldn't promote standby configuration: %v\n", err), http.StatusConflict)
+		return
+	}
+	if err := writeFileAtomic(c.configFile, content); err != nil {
+		msg := fmt.Sprintf("Couldn't write configuration: %v\n", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Standby configuration %s promoted\n", configHash(content))
+	outcome := c.doReload(reloadRequest{actor: requestActor(req)})
+	if !outcome.Success {
+		msg := fmt.Sprintf("Couldn't reload: %v\n", outcome.Error)
+		log.Println(msg)
+		http.Error(w, msg, outcome.httpStatus())
+		return
+	}
+	fmt.Fprintf(w, "OK\n")
+}
@@ -0,0 +1,202 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// contentValidator rejects configurations in path containing "invalid".
+type contentValidator struct {
+	path  string
+	calls int
+}
+
+func (v *contentValidator) Validate() error {
+	v.calls++
+	content, err := ioutil.ReadFile(v.path)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(content), "invalid") {
+		return errors.New("invalid directive")
+	}
+	return nil
+}
+
+func newTestStandby(t *testing.T) (*StandbyConfig, *contentValidator, string) {
+	dir, err := ioutil.TempDir("", "standby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(dir, "haproxy")
+	if err := ioutil.WriteFile(binary, []byte("1.8"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "standby.cfg")
+	validator := &contentValidator{path: path}
+	return NewStandbyConfig(path, binary, validator), validator, dir
+}
+
+func TestStandbyConfigUpload(t *testing.T) {
+	s, validator, dir := newTestStandby(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := s.ready(); err != errNoStandby {
+		t.Fatalf("unexpected standby before upload: %v", err)
+	}
+	status, err := s.Upload([]byte("global\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Valid || status.Hash != configHash([]byte("global\n")) || validator.calls != 1 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	if _, err := s.Upload([]byte("global\n    invalid\n")); err == nil {
+		t.Fatal("expected invalid configuration to be rejected")
+	}
+	content, err := s.ready()
+	if err != nil || string(content) != "global\n" {
+		t.Fatalf("previous standby not kept: %q, %v", content, err)
+	}
+	if stored, _ := ioutil.ReadFile(s.path); string(stored) != "global\n" {
+		t.Fatalf("previous standby not restored: %q", stored)
+	}
+}
+
+func TestStandbyConfigBinaryChange(t *testing.T) {
+	s, validator, dir := newTestStandby(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := s.Upload([]byte("global\n")); err != nil {
+		t.Fatal(err)
+	}
+	s.Check()
+	if validator.calls != 1 {
+		t.Fatalf("validated again without binary changes: %d", validator.calls)
+	}
+
+	// New binary rejecting the configuration
+	if err := ioutil.WriteFile(s.binary, []byte("2.0-dev"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.path, []byte("global\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	validator.path = filepath.Join(dir, "rejected.cfg")
+	ioutil.WriteFile(validator.path, []byte("invalid"), 0644)
+	s.Check()
+	if status := s.Status(); validator.calls != 2 || status.Valid || status.Error == "" {
+		t.Fatalf("standby not validated again after binary change: %+v", status)
+	}
+	if _, err := s.ready(); err != errNoStandby {
+		t.Fatalf("invalid standby ready: %v", err)
+	}
+}
+
+func TestStandbyConfigModified(t *testing.T) {
+	s, _, dir := newTestStandby(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := s.Upload([]byte("global\n")); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(s.path, []byte("global\n    maxconn 10\n"), 0644)
+	os.Chtimes(s.binary, time.Now(), time.Now().Add(time.Hour))
+	s.Check()
+	if status := s.Status(); status.Valid {
+		t.Fatalf("modified standby still valid: %+v", status)
+	}
+}
+
+func TestStandbyConfigExisting(t *testing.T) {
+	s, validator, dir := newTestStandby(t)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(s.path, []byte("global\n"), 0644)
+
+	s = NewStandbyConfig(s.path, s.binary, validator)
+	if _, err := s.ready(); err != errNoStandby {
+		t.Fatal("existing standby ready before validation")
+	}
+	s.Check()
+	if content, err := s.ready(); err != nil || string(content) != "global\n" {
+		t.Fatalf("existing standby not validated: %q, %v", content, err)
+	}
+}
+
+func TestControllerPromoteStandby(t *testing.T) {
+	s, validator, dir := newTestStandby(t)
+	defer os.RemoveAll(dir)
+	config := tempConfig(t, "global\n")
+	defer os.Remove(config)
+	h := &fakeHaproxy{}
+	v := &countingValidator{}
+	c := NewController("", config, h, v)
+	c.Standby = s
+
+	promote := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/config/promote-standby", nil))
+		return w
+	}
+	if w := promote(); w.Code != http.StatusConflict {
+		t.Fatalf("promoted without standby: %d", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("PUT", "/config/standby", strings.NewReader("global\n    invalid\n")))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid standby uploaded: %d", w.Code)
+	}
+	standby := "global\n    maxconn 100\n"
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("PUT", "/config/standby", strings.NewReader(standby)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/config/standby", nil))
+	var status StandbyStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Valid || status.Hash != configHash([]byte(standby)) {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	if w := promote(); w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %q", w.Code, w.Body.String())
+	}
+	if content, _ := ioutil.ReadFile(config); string(content) != standby {
+		t.Fatalf("standby not promoted: %q", content)
+	}
+	if h.reloads != 1 || v.calls != 0 {
+		t.Fatalf("unexpected reloads %d and validations %d", h.reloads, v.calls)
+	}
+	if validator.calls != 2 {
+		t.Fatalf("unexpected standby validations: %d", validator.calls)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+const statsSocketTimeout = 5 * time.Second
+
+// StatsSocket is a client of the haproxy runtime API.
+type StatsSocket struct {
+	path string
+}
+
+func NewStatsSocket(path string) *StatsSocket {
+	return &StatsSocket{path: path}
+}
+
+// Command sends a command to haproxy and returns its response.
+func (s *StatsSocket) Command(command string) (string, error) {
+	conn, err := net.DialTimeout("unix", s.path, statsSocketTimeout)
+	if err != nil {
+		return "", fmt.Errorf("couldn't connect to stats socket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(statsSocketTimeout))
+
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		return "", fmt.Errorf("couldn't send command: %v", err)
+	}
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read response: %v", err)
+	}
+	return string(response), nil
+}
+
+// StatRecord is a line of the output of show stat.
+type StatRecord struct {
+	Proxy  string
+	Server string
+	Status string
+	Fields map[string]string
+}
+
+// ShowStat returns the statistics of all proxies and servers.
+func (s *StatsSocket) ShowStat() ([]StatRecord, error) {
+	response, err := s.Command("show stat")
+	if err != nil {
+		return nil, err
+	}
+	return parseShowStat(response)
+}
+
+func parseShowStat(response string) ([]StatRecord, error) {
+	response = strings.TrimPrefix(response, "# ")
+	reader := csv.NewReader(strings.NewReader(response))
+	reader.FieldsPerRecord = -1
+	lines, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse stats: %v", err)
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("empty stats")
+	}
+	header := lines[0]
+	records := make([]StatRecord, 0, len(lines)-1)
+	for _, line := range lines[1:] {
+		fields := make(map[string]string)
+		for i, name := range header {
+			if i < len(line) && name != "" {
+				fields[name] = line[i]
+			}
+		}
+		records = append(records, StatRecord{
+			Proxy:  fields["pxname"],
+			Server: fields["svname"],
+			Status: fields["status"],
+			Fields: fields,
+		})
+	}
+	return records, nil
+}
+
+// healthyBackends returns the backends with at least one server up.
+func healthyBackends(records []StatRecord) map[string]bool {
+	healthy := make(map[string]bool)
+	for _, r := range records {
+		if r.Server == "FRONTEND" || r.Server == "BACKEND" {
+			continue
+		}
+		if strings.HasPrefix(r.Status, "UP") || r.Status == "no check" {
+			healthy[r.Proxy] = true
+		}
+	}
+	return healthy
+}
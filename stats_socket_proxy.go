@@ -0,0 +1,133 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Runtime API commands that only read the state of haproxy, other commands
+// can modify it and require the socket admin option.
+var readOnlySocketCommands = map[string]bool{
+	"show": true,
+	"get":  true,
+	"help": true,
+}
+
+// Read-only commands that expose secrets, TLS keys can be used to decrypt
+// captured traffic.
+var sensitiveSocketCommands = []string{"show tls-keys"}
+
+// checkSocketCommand returns an error if the given command, or any of the
+// commands separated by semicolons, is not allowed. Only commands with a
+// payload can have multiple lines.
+func checkSocketCommand(command string, allowAdmin bool) error {
+	line := command
+	if i := strings.Index(command, "\n"); i >= 0 {
+		line = command[:i]
+		if !strings.HasSuffix(strings.TrimSpace(line), "<<") {
+			return fmt.Errorf("multiple lines only allowed in commands with payload")
+		}
+	}
+	if allowAdmin {
+		return nil
+	}
+	for _, c := range strings.Split(line, ";") {
+		fields := strings.Fields(c)
+		if len(fields) == 0 {
+			continue
+		}
+		if !readOnlySocketCommands[fields[0]] {
+			return fmt.Errorf("command not allowed without socket admin: %s", strings.TrimSpace(c))
+		}
+		normalized := strings.Join(fields, " ")
+		for _, sensitive := range sensitiveSocketCommands {
+			if strings.HasPrefix(normalized, sensitive) {
+				return fmt.Errorf("command not allowed without socket admin: %s", strings.TrimSpace(c))
+			}
+		}
+	}
+	return nil
+}
+
+// statsSocketCommand sends the command in the body of the request to the
+// runtime API and streams back its response. Commands that can modify haproxy
+// are only allowed if AllowSocketAdmin is set.
+func (c *Controller) statsSocketCommand(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed\n", http.StatusMethodNotAllowed)
+		return
+	}
+	if !c.authorize(w, req) {
+		return
+	}
+	if c.StatsSocket == nil {
+		http.Error(w, "Stats socket not configured\n", http.StatusServiceUnavailable)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxReloadBodySize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Couldn't read request: %v\n", err), http.StatusBadRequest)
+		return
+	}
+	command := strings.TrimSpace(string(body))
+	if command == "" {
+		http.Error(w, "Expected runtime API command\n", http.StatusBadRequest)
+		return
+	}
+	if err := checkSocketCommand(command, c.AllowSocketAdmin); err != nil {
+		http.Error(w, fmt.Sprintf("%s\n", err), http.StatusForbidden)
+		return
+	}
+	if strings.Contains(command, "\n") {
+		// Payloads finish with an empty line
+		command += "\n"
+	}
+	response, err := c.StatsSocket.Stream(command)
+	if err != nil {
+		msg := fmt.Sprintf("Couldn't run command in stats socket: %v\n", err)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusServiceUnavailable)
+		return
+	}
+	defer response.Close()
+
+	w.Header().Set("Content-Type", "text/plain")
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := response.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("Couldn't read response of stats socket: %v\n", err)
+			return
+		}
+	}
+}
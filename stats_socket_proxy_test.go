@@ -0,0 +1,97 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckSocketCommand(t *testing.T) {
+	cases := []struct {
+		command    string
+		allowAdmin bool
+		allowed    bool
+	}{
+		{"show stat", false, true},
+		{"show servers state app", false, true},
+		{"get weight app/app1", false, true},
+		{"show info; show stat", false, true},
+		{"disable server app/app1", false, false},
+		{"show info; disable server app/app1", false, false},
+		{"show  tls-keys", false, false},
+		{"shutdown sessions server app/app1", false, false},
+		{"disable server app/app1", true, true},
+		{"show info\ndisable server app/app1", true, false},
+		{"set ssl cert /etc/cert.pem <<\n-----BEGIN CERTIFICATE-----", true, true},
+		{"set ssl cert /etc/cert.pem <<\n-----BEGIN CERTIFICATE-----", false, false},
+	}
+	for _, c := range cases {
+		err := checkSocketCommand(c.command, c.allowAdmin)
+		if c.allowed && err != nil {
+			t.Errorf("command %q should be allowed: %v", c.command, err)
+		}
+		if !c.allowed && err == nil {
+			t.Errorf("command %q shouldn't be allowed", c.command)
+		}
+	}
+}
+
+func TestControllerStatsSocketCommand(t *testing.T) {
+	var commands []string
+	socket := newFakeStatsSocket(t, func(command string) string {
+		commands = append(commands, command)
+		return "response to " + command + "\n"
+	})
+	defer socket.Close()
+	c := NewController("", "", &fakeHaproxy{}, &fakeValidator{})
+
+	post := func(command string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/stats-socket", strings.NewReader(command)))
+		return w
+	}
+
+	if w := post("show stat"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected response without stats socket %d", w.Code)
+	}
+
+	c.StatsSocket = NewStatsSocket(socket.Path())
+	if w := post("show stat\n"); w.Code != http.StatusOK || w.Body.String() != "response to show stat\n" {
+		t.Fatalf("unexpected response %d: %q", w.Code, w.Body.String())
+	}
+	if w := post("disable server app/app1"); w.Code != http.StatusForbidden {
+		t.Fatalf("admin command should be forbidden, found %d", w.Code)
+	}
+	if w := post(""); w.Code != http.StatusBadRequest {
+		t.Fatalf("empty command should be rejected, found %d", w.Code)
+	}
+
+	c.AllowSocketAdmin = true
+	if w := post("disable server app/app1"); w.Code != http.StatusOK || w.Body.String() != "response to disable server app/app1\n" {
+		t.Fatalf("unexpected response with socket admin %d: %q", w.Code, w.Body.String())
+	}
+	if len(commands) != 2 {
+		t.Fatalf("unexpected commands sent: %q", commands)
+	}
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/stats-socket", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected response to GET %d", w.Code)
+	}
+}
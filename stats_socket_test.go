@@ -0,0 +1,172 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const statHeader = "# pxname,svname,qcur,qmax,scur,smax,slim,stot,bin,bout,dreq,dresp,ereq,econ,eresp,wretr,wredis,status,\n"
+
+// fakeStatsSocket serves a fake runtime API in a unix socket, responding to
+// commands with the given function.
+type fakeStatsSocket struct {
+	dir      string
+	listener net.Listener
+}
+
+func newFakeStatsSocket(t *testing.T, respond func(command string) string) *fakeStatsSocket {
+	dir, err := ioutil.TempDir("", "stats-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("unix", filepath.Join(dir, "haproxy.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				command, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				// Payloads finish with an empty line
+				if strings.HasSuffix(command, "<<\n") {
+					for {
+						line, err := reader.ReadString('\n')
+						if err != nil || line == "\n" {
+							break
+						}
+						command += line
+					}
+				}
+				conn.Write([]byte(respond(strings.TrimSpace(command))))
+			}(conn)
+		}
+	}()
+	return &fakeStatsSocket{dir: dir, listener: l}
+}
+
+func (s *fakeStatsSocket) Path() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeStatsSocket) Close() {
+	s.listener.Close()
+	os.RemoveAll(s.dir)
+}
+
+func statLine(proxy, server, status string) string {
+	return proxy + "," + server + ",0,0,0,0,,0,0,0,0,0,,0,0,0,0," + status + ",\n"
+}
+
+func TestParseShowStat(t *testing.T) {
+	stats := statHeader +
+		statLine("web", "FRONTEND", "OPEN") +
+		statLine("app", "app1", "DOWN") +
+		statLine("app", "app2", "UP 1/3") +
+		statLine("app", "BACKEND", "UP") +
+		statLine("other", "other1", "MAINT") +
+		statLine("nocheck", "nocheck1", "no check")
+
+	records, err := parseShowStat(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 6 {
+		t.Fatalf("found %d records, expected 6", len(records))
+	}
+	if r := records[1]; r.Proxy != "app" || r.Server != "app1" || r.Status != "DOWN" || r.Fields["scur"] != "0" {
+		t.Fatalf("unexpected record: %+v", r)
+	}
+
+	healthy := healthyBackends(records)
+	expected := map[string]bool{"app": true, "nocheck": true}
+	if !reflect.DeepEqual(healthy, expected) {
+		t.Fatalf("found healthy backends %v, expected %v", healthy, expected)
+	}
+}
+
+func TestStatsSocketCommand(t *testing.T) {
+	s := newFakeStatsSocket(t, func(command string) string {
+		return "received " + command + "\n"
+	})
+	defer s.Close()
+
+	response, err := NewStatsSocket(s.Path()).Command("show info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != "received show info\n" {
+		t.Fatalf("unexpected response: %q", response)
+	}
+}
+
+func TestControllerReloadWaitsHealthyBackends(t *testing.T) {
+	healthCheckInterval = 10 * time.Millisecond
+
+	path := tempConfig(t, "backend app\n    server app1 10.0.0.1:80\n")
+	defer os.Remove(path)
+
+	checks := int32(0)
+	s := newFakeStatsSocket(t, func(string) string {
+		status := "DOWN"
+		if atomic.AddInt32(&checks, 1) > 2 {
+			status = "UP"
+		}
+		return statHeader + statLine("app", "app1", status) + statLine("other", "other1", "DOWN")
+	})
+	defer s.Close()
+
+	c := NewController("", path, &fakeHaproxy{}, &fakeValidator{})
+	c.StatsSocket = NewStatsSocket(s.Path())
+	c.WaitHealthyTimeout = 200 * time.Millisecond
+
+	// Unchanged configuration, nothing to wait for
+	if outcome := c.Reload(); !outcome.Success || atomic.LoadInt32(&checks) > 0 {
+		t.Fatalf("unexpected outcome: %+v (%d checks)", outcome, checks)
+	}
+
+	ioutil.WriteFile(path, []byte("backend app\n    server app1 10.0.0.2:80\n"), 0644)
+	if outcome := c.Reload(); !outcome.Success || atomic.LoadInt32(&checks) != 3 {
+		t.Fatalf("unexpected outcome: %+v (%d checks)", outcome, checks)
+	}
+
+	ioutil.WriteFile(path, []byte("backend app\n    server app1 10.0.0.2:80\nbackend other\n    server other1 10.0.0.3:80\n"), 0644)
+	outcome := c.Reload()
+	if outcome.Success || outcome.Phase != ReloadPhaseHealth || !reflect.DeepEqual(outcome.UnhealthyBackends, []string{"other"}) {
+		t.Fatalf("unexpected outcome: %+v", outcome)
+	}
+	if outcome.httpStatus() != 503 {
+		t.Fatalf("found status %d, expected 503", outcome.httpStatus())
+	}
+}
@@ -15,16 +15,57 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
 	"fmt"
 	"log"
+	"net"
+	"sync"
+)
 
-	"gopkg.in/mcuadros/go-syslog.v2"
+// Transports where the embedded syslog server listens
+const (
+	SyslogTransportUDP  = "udp"
+	SyslogTransportTCP  = "tcp"
+	SyslogTransportBoth = "both"
 )
 
+// validateSyslogTransport checks that the transport is known.
+func validateSyslogTransport(transport string) error {
+	switch transport {
+	case "", SyslogTransportUDP, SyslogTransportTCP, SyslogTransportBoth:
+		return nil
+	}
+	return fmt.Errorf("unknown syslog transport: %s", transport)
+}
+
+// Maximum size of messages received
+const syslogMaxMessageSize = 64 * 1024
+
 type SyslogServer struct {
-	port   uint
-	server *syslog.Server
+	// Transport where messages are received, UDP if empty. Messages
+	// received over TCP are framed by newlines or by octet counting, as
+	// described in RFC6587
+	Transport string
+
+	// Forwarder of received messages to an upstream collector, optional
+	Forwarder *SyslogForwarder
+
+	// Exporter of HTTP logs in Common or Combined Log Format, optional
+	AccessLog *AccessLogExporter
+
+	// Rules running actions on received messages, optional
+	Triggers *SyslogTriggers
+
+	port uint
+
+	sync.Mutex
+	started bool
+	udp     *net.UDPConn
+	tcp     *net.TCPListener
+	conns   map[net.Conn]bool
+	records chan SyslogRecord
+	readers sync.WaitGroup
+	handled chan struct{}
 }
 
 func NewSyslogServer(port uint) *SyslogServer {
@@ -32,50 +73,179 @@ func NewSyslogServer(port uint) *SyslogServer {
 }
 
 func (s *SyslogServer) Start() error {
-	if s.server != nil {
+	s.Lock()
+	defer s.Unlock()
+	if s.started {
 		return fmt.Errorf("Server already started")
 	}
-
-	channel := make(syslog.LogPartsChannel)
-	handler := syslog.NewChannelHandler(channel)
+	if err := validateSyslogTransport(s.Transport); err != nil {
+		return err
+	}
 
 	bindAddress := fmt.Sprintf("127.0.0.1:%d", s.port)
+	if s.Transport != SyslogTransportTCP {
+		addr, err := net.ResolveUDPAddr("udp", bindAddress)
+		if err != nil {
+			return err
+		}
+		if s.udp, err = net.ListenUDP("udp", addr); err != nil {
+			return err
+		}
+	}
+	if s.Transport == SyslogTransportTCP || s.Transport == SyslogTransportBoth {
+		addr, err := net.ResolveTCPAddr("tcp", bindAddress)
+		if err == nil {
+			s.tcp, err = net.ListenTCP("tcp", addr)
+		}
+		if err != nil {
+			if s.udp != nil {
+				s.udp.Close()
+				s.udp = nil
+			}
+			return err
+		}
+	}
 
-	s.server = syslog.NewServer()
-	s.server.SetFormat(syslog.Automatic)
-	s.server.SetHandler(handler)
+	log.Printf("Syslog embedded server listening on %s (%s)", bindAddress, s.transport())
 
-	if err := s.server.ListenUDP(bindAddress); err != nil {
-		return err
+	if s.Forwarder != nil {
+		if err := s.Forwarder.Start(); err != nil {
+			s.closeListeners()
+			return fmt.Errorf("Couldn't start forwarder: %v", err)
+		}
 	}
-	if err := s.server.Boot(); err != nil {
-		return err
+
+	s.started = true
+	s.records = make(chan SyslogRecord)
+	s.conns = make(map[net.Conn]bool)
+	s.handled = make(chan struct{})
+	if s.udp != nil {
+		s.readers.Add(1)
+		go s.readUDP(s.udp)
+	}
+	if s.tcp != nil {
+		s.readers.Add(1)
+		go s.acceptTCP(s.tcp)
 	}
+	go s.handle(s.records, s.Forwarder, s.AccessLog, s.Triggers)
+	return nil
+}
 
-	log.Printf("Syslog embedded server listening on %s", bindAddress)
+// handle forwards, matches and logs the received messages, until the channel
+// is closed.
+func (s *SyslogServer) handle(records <-chan SyslogRecord, forwarder *SyslogForwarder, accessLog *AccessLogExporter, triggers *SyslogTriggers) {
+	defer close(s.handled)
+	for r := range records {
+		if forwarder != nil {
+			forwarder.Forward([]byte(r.Raw))
+		}
+		if triggers != nil {
+			triggers.Match(r.Message)
+		}
+		if accessLog == nil {
+			logWithFields(r.Fields(), "%s", r.Message)
+		} else if err := accessLog.Write(r.Message); err != nil {
+			log.Printf("Couldn't write access log: %v\n", err)
+		}
+	}
+}
 
-	go func(channel syslog.LogPartsChannel) {
-		for logParts := range channel {
-			if content, ok := logParts["content"]; ok {
-				log.Println(content)
-			} else if d, err := json.Marshal(logParts); err == nil {
-				log.Println(d)
-			} else {
-				log.Println(logParts)
-			}
+func (s *SyslogServer) readUDP(conn *net.UDPConn) {
+	defer s.readers.Done()
+	buf := make([]byte, syslogMaxMessageSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
 		}
-	}(channel)
+		s.records <- parseSyslogRecord(string(buf[:n]))
+	}
+}
 
-	return nil
+func (s *SyslogServer) acceptTCP(listener *net.TCPListener) {
+	defer s.readers.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		s.Lock()
+		if !s.started {
+			s.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.readers.Add(1)
+		s.Unlock()
+		go s.readTCP(conn)
+	}
+}
+
+func (s *SyslogServer) readTCP(conn net.Conn) {
+	defer s.readers.Done()
+	defer func() {
+		s.Lock()
+		delete(s.conns, conn)
+		s.Unlock()
+		conn.Close()
+	}()
+	scanner := bufio.NewScanner(conn)
+	// Leave room for the octet count of frames of the maximum size
+	scanner.Buffer(make([]byte, 4096), syslogMaxMessageSize+syslogMaxFrameCount+1)
+	scanner.Split(scanSyslogFrames)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		s.records <- parseSyslogRecord(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Closing syslog connection from %s: %v\n", conn.RemoteAddr(), err)
+	}
+}
+
+// closeListeners closes the listeners and the connections received.
+func (s *SyslogServer) closeListeners() {
+	if s.udp != nil {
+		s.udp.Close()
+		s.udp = nil
+	}
+	if s.tcp != nil {
+		s.tcp.Close()
+		s.tcp = nil
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *SyslogServer) transport() string {
+	if s.Transport == "" {
+		return SyslogTransportUDP
+	}
+	return s.Transport
 }
 
 func (s *SyslogServer) Stop() error {
-	if s.server == nil {
+	s.Lock()
+	if !s.started {
+		s.Unlock()
 		return fmt.Errorf("Server not started")
 	}
-	if err := s.server.Kill(); err != nil {
-		return fmt.Errorf("Couldn't kill server: %v", err)
+	s.closeListeners()
+	s.started = false
+	s.Unlock()
+
+	// Wait for the messages already received to be handled
+	s.readers.Wait()
+	close(s.records)
+	<-s.handled
+
+	if s.Forwarder != nil {
+		if err := s.Forwarder.Stop(); err != nil {
+			return fmt.Errorf("Couldn't stop forwarder: %v", err)
+		}
 	}
-	s.server = nil
 	return nil
 }
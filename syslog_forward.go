@@ -0,0 +1,310 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Policies for messages forwarded over the rate limit
+const (
+	SyslogForwardDrop   = "drop"
+	SyslogForwardBuffer = "buffer"
+)
+
+// Transports used to forward messages to the upstream collector
+const (
+	SyslogForwardUDP = "udp"
+	SyslogForwardTCP = "tcp"
+)
+
+// Size of the queue of messages waiting to be forwarded if no buffer is
+// configured
+const syslogForwardDefaultBuffer = 1000
+
+func validateSyslogForwardTransport(transport string) error {
+	switch transport {
+	case SyslogForwardUDP, SyslogForwardTCP:
+		return nil
+	}
+	return fmt.Errorf("unknown syslog forward transport: %s", transport)
+}
+
+// SyslogForwardLimit configures a rate limit of the messages forwarded, so
+// the upstream collector is not overwhelmed by bursts of logs.
+type SyslogForwardLimit struct {
+	// Messages per second, zero to disable the limit
+	Rate  float64
+	Burst int
+	// Policy for messages over the limit, they are dropped or buffered to be
+	// sent later, dropping them only if the buffer is full
+	Policy string
+	// Messages waiting to be sent, also while reconnecting to the collector
+	Buffer int
+}
+
+func (l *SyslogForwardLimit) enabled() bool {
+	return l != nil && l.Rate > 0
+}
+
+func (l *SyslogForwardLimit) validate() error {
+	if !l.enabled() {
+		return nil
+	}
+	if l.Burst <= 0 {
+		return fmt.Errorf("syslog forward burst must be positive")
+	}
+	switch l.Policy {
+	case SyslogForwardDrop:
+	case SyslogForwardBuffer:
+		if l.Buffer <= 0 {
+			return fmt.Errorf("syslog forward buffer must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown syslog forward policy: %s", l.Policy)
+	}
+	return nil
+}
+
+// tokenBucket is a rate limiter that allows bursts of burst events, refilled
+// at rate events per second.
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+func (b *tokenBucket) refill() {
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take takes a token if available, if not it returns the time to wait for
+// the next one.
+func (b *tokenBucket) take() (bool, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	b.refill()
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// SyslogForwarder sends the messages received by the embedded syslog server
+// to an upstream collector. Messages are queued and sent in the background,
+// so a slow or unreachable collector doesn't block the server.
+type SyslogForwarder struct {
+	// Transport used to connect to the collector, udp by default. Messages
+	// sent over TCP are framed with octet counting.
+	Transport string
+
+	address string
+	limit   SyslogForwardLimit
+	bucket  *tokenBucket
+	conn    net.Conn
+	pending chan []byte
+	stop    chan struct{}
+	done    chan struct{}
+
+	dial          func(network, address string) (net.Conn, error)
+	retryInterval time.Duration
+
+	forwarded *CounterVec
+	dropped   *CounterVec
+}
+
+func NewSyslogForwarder(address string, limit SyslogForwardLimit) (*SyslogForwarder, error) {
+	if err := limit.validate(); err != nil {
+		return nil, err
+	}
+	f := &SyslogForwarder{
+		Transport:     SyslogForwardUDP,
+		address:       address,
+		limit:         limit,
+		dial:          net.Dial,
+		retryInterval: time.Second,
+		forwarded:     NewCounterVec("syslog_forwarded_total", "Number of syslog messages forwarded upstream"),
+		dropped:       NewCounterVec("syslog_forward_dropped_total", "Number of syslog messages not forwarded upstream", "reason"),
+	}
+	if limit.enabled() {
+		f.bucket = newTokenBucket(limit.Rate, limit.Burst)
+	}
+	return f, nil
+}
+
+// Start connects to the upstream collector. If a TCP collector is not
+// reachable, messages are queued while connecting to it in the background.
+func (f *SyslogForwarder) Start() error {
+	if err := validateSyslogForwardTransport(f.Transport); err != nil {
+		return err
+	}
+	conn, err := f.dial(f.Transport, f.address)
+	if err != nil {
+		if f.Transport != SyslogForwardTCP {
+			return err
+		}
+		log.Printf("Warning: couldn't connect to syslog collector in %s, retrying: %v", f.address, err)
+	}
+	f.conn = conn
+	size := f.limit.Buffer
+	if size <= 0 {
+		size = syslogForwardDefaultBuffer
+	}
+	f.pending = make(chan []byte, size)
+	f.stop = make(chan struct{})
+	f.done = make(chan struct{})
+	go f.sendPending()
+	log.Printf("Forwarding syslog messages to %s over %s", f.address, f.Transport)
+	return nil
+}
+
+// Forward queues a message to be sent, or drops it if it is over the rate
+// limit or the queue is full.
+func (f *SyslogForwarder) Forward(message []byte) {
+	if f.bucket != nil && f.limit.Policy == SyslogForwardDrop {
+		if ok, _ := f.bucket.take(); !ok {
+			f.dropped.Inc("rate_limit")
+			return
+		}
+	}
+	select {
+	case f.pending <- message:
+	default:
+		f.dropped.Inc("buffer_full")
+	}
+}
+
+func (f *SyslogForwarder) sendPending() {
+	defer close(f.done)
+	for {
+		select {
+		case message := <-f.pending:
+			if f.bucket != nil && f.limit.Policy == SyslogForwardBuffer && !f.waitToken() {
+				return
+			}
+			if !f.send(message) {
+				return
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// waitToken waits till the rate limit allows to send a message, it returns
+// false if the forwarder is stopped.
+func (f *SyslogForwarder) waitToken() bool {
+	for {
+		ok, wait := f.bucket.take()
+		if ok {
+			return true
+		}
+		select {
+		case <-time.After(wait):
+		case <-f.stop:
+			return false
+		}
+	}
+}
+
+// send sends a message, over TCP it reconnects and retries till the message
+// is sent, so messages queued meanwhile are flushed after reconnecting. It
+// returns false if the forwarder is stopped.
+func (f *SyslogForwarder) send(message []byte) bool {
+	for {
+		if f.conn == nil && !f.reconnect() {
+			return false
+		}
+		err := f.write(message)
+		if err == nil {
+			f.forwarded.Inc()
+			return true
+		}
+		if f.Transport != SyslogForwardTCP {
+			f.dropped.Inc("error")
+			return true
+		}
+		log.Printf("Warning: lost connection with syslog collector in %s: %v", f.address, err)
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+func (f *SyslogForwarder) write(message []byte) error {
+	if f.Transport == SyslogForwardTCP {
+		message = append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+	}
+	_, err := f.conn.Write(message)
+	return err
+}
+
+func (f *SyslogForwarder) reconnect() bool {
+	for {
+		conn, err := f.dial(f.Transport, f.address)
+		if err == nil {
+			log.Printf("Reconnected to syslog collector in %s", f.address)
+			f.conn = conn
+			return true
+		}
+		select {
+		case <-time.After(f.retryInterval):
+		case <-f.stop:
+			return false
+		}
+	}
+}
+
+// Stop stops forwarding, messages still queued are discarded.
+func (f *SyslogForwarder) Stop() error {
+	if f.done == nil {
+		return fmt.Errorf("Forwarder not started")
+	}
+	close(f.stop)
+	<-f.done
+	f.done = nil
+	if f.conn == nil {
+		return nil
+	}
+	err := f.conn.Close()
+	f.conn = nil
+	return err
+}
+
+func (f *SyslogForwarder) Collect() []MetricFamily {
+	return append(f.forwarded.Collect(), f.dropped.Collect()...)
+}
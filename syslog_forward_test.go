@@ -0,0 +1,294 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func listenSyslog(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readSyslog reads messages until none is received in the timeout.
+func readSyslog(conn *net.UDPConn, timeout time.Duration) []string {
+	var messages []string
+	buf := make([]byte, 4096)
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return messages
+		}
+		messages = append(messages, string(buf[:n]))
+	}
+}
+
+func counterValue(c *CounterVec, labelValues ...string) float64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.sample(labelValues).Value
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 5)
+	b.last = now
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		if ok, _ := b.take(); !ok {
+			t.Fatalf("token %d of the burst not available", i)
+		}
+	}
+	ok, wait := b.take()
+	if ok {
+		t.Fatal("token available over the burst")
+	}
+	if wait != 100*time.Millisecond {
+		t.Fatalf("expected to wait 100ms, found %s", wait)
+	}
+
+	now = now.Add(250 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take(); !ok {
+			t.Fatalf("refilled token %d not available", i)
+		}
+	}
+	if ok, _ := b.take(); ok {
+		t.Fatal("token available over the refill")
+	}
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		b.take()
+	}
+	if ok, _ := b.take(); ok {
+		t.Fatal("refill over the burst")
+	}
+}
+
+func TestSyslogForwardLimitValidation(t *testing.T) {
+	cases := []struct {
+		limit SyslogForwardLimit
+		valid bool
+	}{
+		{SyslogForwardLimit{}, true},
+		{SyslogForwardLimit{Rate: 10, Burst: 1, Policy: SyslogForwardDrop}, true},
+		{SyslogForwardLimit{Rate: 10, Burst: 1, Policy: SyslogForwardBuffer, Buffer: 10}, true},
+		{SyslogForwardLimit{Rate: 10, Policy: SyslogForwardDrop}, false},
+		{SyslogForwardLimit{Rate: 10, Burst: 1, Policy: SyslogForwardBuffer}, false},
+		{SyslogForwardLimit{Rate: 10, Burst: 1, Policy: "block"}, false},
+	}
+	for _, c := range cases {
+		if err := c.limit.validate(); (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid %v, found error %v", c.limit, c.valid, err)
+		}
+	}
+}
+
+func TestSyslogForwarderDrop(t *testing.T) {
+	conn := listenSyslog(t)
+	defer conn.Close()
+
+	f, err := NewSyslogForwarder(conn.LocalAddr().String(), SyslogForwardLimit{Rate: 1, Burst: 3, Policy: SyslogForwardDrop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	f.bucket.last = now
+	f.bucket.now = func() time.Time { return now }
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+
+	for i := 0; i < 10; i++ {
+		f.Forward([]byte(fmt.Sprintf("message %d", i)))
+	}
+	messages := readSyslog(conn, 200*time.Millisecond)
+	if len(messages) != 3 || messages[0] != "message 0" || messages[2] != "message 2" {
+		t.Fatalf("expected the first 3 messages, found %v", messages)
+	}
+	if dropped := counterValue(f.dropped, "rate_limit"); dropped != 7 {
+		t.Fatalf("expected 7 messages dropped, found %v", dropped)
+	}
+	if forwarded := counterValue(f.forwarded); forwarded != 3 {
+		t.Fatalf("expected 3 messages forwarded, found %v", forwarded)
+	}
+}
+
+func TestSyslogForwarderBuffer(t *testing.T) {
+	conn := listenSyslog(t)
+	defer conn.Close()
+
+	f, err := NewSyslogForwarder(conn.LocalAddr().String(), SyslogForwardLimit{Rate: 50, Burst: 1, Policy: SyslogForwardBuffer, Buffer: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		f.Forward([]byte(fmt.Sprintf("message %d", i)))
+	}
+	messages := readSyslog(conn, 200*time.Millisecond)
+	if len(messages) != 10 || messages[9] != "message 9" {
+		t.Fatalf("expected all messages in order, found %v", messages)
+	}
+	// 9 messages after the burst at 50 per second
+	if elapsed := time.Since(start); elapsed < 160*time.Millisecond {
+		t.Fatalf("messages forwarded over the rate limit in %s", elapsed)
+	}
+	if dropped := counterValue(f.dropped, "buffer_full"); dropped != 0 {
+		t.Fatalf("expected no messages dropped, found %v", dropped)
+	}
+}
+
+func TestSyslogForwarderTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	f, err := NewSyslogForwarder(l.Addr().String(), SyslogForwardLimit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Transport = SyslogForwardTCP
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+
+	f.Forward([]byte("multi\nline"))
+	f.Forward([]byte("second"))
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(scanSyslogFrames)
+	var messages []string
+	for len(messages) < 2 && scanner.Scan() {
+		messages = append(messages, scanner.Text())
+	}
+	if len(messages) != 2 || messages[0] != "multi\nline" || messages[1] != "second" {
+		t.Fatalf("expected octet counted messages, found %q", messages)
+	}
+}
+
+// flakyConn is a connection that fails after accepting a number of writes.
+type flakyConn struct {
+	net.Conn
+	lock     *sync.Mutex
+	writes   int
+	messages *[]string
+}
+
+func (c *flakyConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.writes == 0 {
+		return 0, fmt.Errorf("connection reset")
+	}
+	c.writes--
+	*c.messages = append(*c.messages, string(b))
+	return len(b), nil
+}
+
+func (c *flakyConn) Close() error {
+	return nil
+}
+
+func TestSyslogForwarderReconnect(t *testing.T) {
+	var lock sync.Mutex
+	var messages []string
+	dials := 0
+	unblock := make(chan struct{})
+
+	f, err := NewSyslogForwarder("collector:514", SyslogForwardLimit{Buffer: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Transport = SyslogForwardTCP
+	f.retryInterval = 10 * time.Millisecond
+	f.dial = func(network, address string) (net.Conn, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		dials++
+		switch dials {
+		case 1:
+			return nil, fmt.Errorf("connection refused")
+		case 2:
+			return &flakyConn{lock: &lock, writes: 1, messages: &messages}, nil
+		}
+		select {
+		case <-unblock:
+			return &flakyConn{lock: &lock, writes: 100, messages: &messages}, nil
+		default:
+			return nil, fmt.Errorf("connection refused")
+		}
+	}
+	if err := f.Start(); err != nil {
+		t.Fatalf("unreachable TCP collector shouldn't fail forwarder: %v", err)
+	}
+	defer f.Stop()
+
+	// Messages are queued while the collector is down
+	for i := 0; i < 8; i++ {
+		f.Forward([]byte(fmt.Sprintf("message %d", i)))
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(unblock)
+	time.Sleep(100 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(messages) != 8 || messages[1] != "9 message 1" || messages[7] != "9 message 7" {
+		t.Fatalf("expected queued messages flushed after reconnecting, found %q", messages)
+	}
+	if dropped := counterValue(f.dropped, "error"); dropped != 0 {
+		t.Fatalf("expected no messages dropped, found %v", dropped)
+	}
+}
+
+func TestSyslogForwarderTransportValidation(t *testing.T) {
+	f, err := NewSyslogForwarder("127.0.0.1:514", SyslogForwardLimit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Transport = "sctp"
+	if err := f.Start(); err == nil {
+		f.Stop()
+		t.Fatal("expected error with unknown transport")
+	}
+}
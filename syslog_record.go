@@ -0,0 +1,190 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// Formats of syslog messages
+const (
+	SyslogRFC5424 = "rfc5424"
+	SyslogRFC3164 = "rfc3164"
+)
+
+// SyslogRecord is a syslog message parsed in its fields. Messages that
+// cannot be parsed are passed through, with the original line as message
+// and without format.
+type SyslogRecord struct {
+	Format         string    `json:"format,omitempty"`
+	Facility       int       `json:"facility"`
+	Severity       int       `json:"severity"`
+	Timestamp      time.Time `json:"timestamp"`
+	Hostname       string    `json:"hostname,omitempty"`
+	AppName        string    `json:"app_name,omitempty"`
+	ProcID         string    `json:"proc_id,omitempty"`
+	MsgID          string    `json:"msg_id,omitempty"`
+	StructuredData string    `json:"structured_data,omitempty"`
+	Message        string    `json:"message"`
+
+	// Line as received
+	Raw string `json:"-"`
+}
+
+// Priority returns the priority of the message, from its facility and
+// severity.
+func (r SyslogRecord) Priority() int {
+	return r.Facility*8 + r.Severity
+}
+
+// Fields returns the parsed fields of the message, to be logged with it.
+func (r SyslogRecord) Fields() LogFields {
+	if r.Format == "" {
+		return LogFields{"source": "syslog"}
+	}
+	fields := LogFields{
+		"source":          "syslog",
+		"syslog_format":   r.Format,
+		"facility":        r.Facility,
+		"severity":        r.Severity,
+		"hostname":        r.Hostname,
+		"app_name":        r.AppName,
+		"proc_id":         r.ProcID,
+		"msg_id":          r.MsgID,
+		"structured_data": r.StructuredData,
+	}
+	if !r.Timestamp.IsZero() {
+		fields["timestamp"] = r.Timestamp.Format(time.RFC3339Nano)
+	}
+	for k, v := range fields {
+		if v == "" {
+			delete(fields, k)
+		}
+	}
+	return fields
+}
+
+// parseSyslogRecord parses a message in the format of RFC5424 or of RFC3164,
+// with the parsers of go-syslog. Malformed messages are passed through, as
+// the format of haproxy varies between versions.
+func parseSyslogRecord(line string) (r SyslogRecord) {
+	line = strings.TrimRight(line, "\r\n")
+	r = SyslogRecord{Raw: line, Message: line}
+	if !strings.HasPrefix(line, "<") {
+		return r
+	}
+	// The parsers don't check bounds in some malformed messages
+	defer func() {
+		if recover() != nil {
+			r = SyslogRecord{Raw: line, Message: line}
+		}
+	}()
+	parser := (&format.Automatic{}).GetParser([]byte(line))
+	if err := parser.Parse(); err != nil {
+		return r
+	}
+	var parts map[string]interface{} = parser.Dump()
+	parsed := SyslogRecord{Raw: line}
+	parsed.Facility, _ = parts["facility"].(int)
+	parsed.Severity, _ = parts["severity"].(int)
+	parsed.Timestamp, _ = parts["timestamp"].(time.Time)
+	parsed.Hostname = logPartString(parts, "hostname")
+	if _, ok := parts["version"]; ok {
+		parsed.Format = SyslogRFC5424
+		parsed.AppName = logPartString(parts, "app_name")
+		parsed.ProcID = logPartString(parts, "proc_id")
+		parsed.MsgID = logPartString(parts, "msg_id")
+		parsed.StructuredData = logPartString(parts, "structured_data")
+		parsed.Message = strings.TrimPrefix(logPartString(parts, "message"), "\xef\xbb\xbf")
+		return parsed
+	}
+	parsed.Format = SyslogRFC3164
+	parsed.AppName = logPartString(parts, "tag")
+	parsed.Message = logPartString(parts, "content")
+	if isSyslogTag(parsed.Hostname) {
+		// Haproxy omits the hostname by default, so the parser takes the
+		// tag as hostname, and the first word of the message as tag
+		tag := strings.TrimSuffix(parsed.Hostname, ":")
+		parsed.Hostname, parsed.AppName = "", tag
+		i := strings.Index(line, tag+":")
+		parsed.Message = strings.TrimSpace(line[i+len(tag)+1:])
+	}
+	if open := strings.IndexByte(parsed.AppName, '['); open > 0 && strings.HasSuffix(parsed.AppName, "]") {
+		parsed.ProcID = parsed.AppName[open+1 : len(parsed.AppName)-1]
+		parsed.AppName = parsed.AppName[:open]
+	}
+	return parsed
+}
+
+// logPartString returns a string field of a parsed message, nil values are
+// returned as empty strings.
+func logPartString(parts map[string]interface{}, name string) string {
+	s, _ := parts[name].(string)
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// isSyslogTag returns true for words formed as tags, as "haproxy[12]:".
+func isSyslogTag(word string) bool {
+	if !strings.HasSuffix(word, ":") || len(word) < 2 {
+		return false
+	}
+	return !strings.ContainsAny(word[:len(word)-1], ": ")
+}
+
+// Maximum length of the octet count of frames, enough for the maximum size
+// of messages
+const syslogMaxFrameCount = 10
+
+// scanSyslogFrames splits messages received over TCP, framed by newlines or
+// by octet counting, as described in RFC6587. Counts larger than the maximum
+// size of messages are rejected, so the connection is closed.
+func scanSyslogFrames(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if len(data) > 0 && data[0] >= '1' && data[0] <= '9' {
+		space := bytes.IndexByte(data, ' ')
+		if space < 0 {
+			if atEOF || len(data) > syslogMaxFrameCount {
+				return bufio.ScanLines(data, atEOF)
+			}
+			return 0, nil, nil
+		}
+		if length, err := strconv.Atoi(string(data[:space])); err == nil {
+			if length < 0 || length > syslogMaxMessageSize {
+				return 0, nil, fmt.Errorf("invalid syslog frame length %d", length)
+			}
+			end := space + 1 + length
+			if len(data) >= end {
+				return end, data[space+1 : end], nil
+			}
+			if atEOF {
+				return len(data), data[space+1:], nil
+			}
+			return 0, nil, nil
+		}
+	}
+	return bufio.ScanLines(data, atEOF)
+}
@@ -0,0 +1,112 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslogRecord(t *testing.T) {
+	year := time.Now().Year()
+	cases := []struct {
+		line     string
+		expected SyslogRecord
+	}{
+		{
+			"<134>Mar  1 10:20:30 haproxy[12]: Connect from 10.0.0.1:4000",
+			SyslogRecord{Format: SyslogRFC3164, Facility: 16, Severity: 6, Timestamp: time.Date(year, 3, 1, 10, 20, 30, 0, time.UTC), AppName: "haproxy", ProcID: "12", Message: "Connect from 10.0.0.1:4000"},
+		},
+		{
+			"<133>Mar 11 10:20:30 lb haproxy: Proxy app started.\n",
+			SyslogRecord{Format: SyslogRFC3164, Facility: 16, Severity: 5, Timestamp: time.Date(year, 3, 11, 10, 20, 30, 0, time.UTC), Hostname: "lb", AppName: "haproxy", Message: "Proxy app started."},
+		},
+		{
+			`<134>1 2018-03-01T10:20:30.5Z lb haproxy 12 - [meta src="a \"b\" ]"][other x="1"] Connect from 10.0.0.1`,
+			SyslogRecord{Format: SyslogRFC5424, Facility: 16, Severity: 6, Timestamp: time.Date(2018, 3, 1, 10, 20, 30, 500000000, time.UTC), Hostname: "lb", AppName: "haproxy", ProcID: "12", StructuredData: `[meta src="a \"b\" ]"][other x="1"]`, Message: "Connect from 10.0.0.1"},
+		},
+		{
+			"<14>1 - - - - - -",
+			SyslogRecord{Format: SyslogRFC5424, Facility: 1, Severity: 6},
+		},
+	}
+	for _, c := range cases {
+		c.expected.Raw = strings.TrimRight(c.line, "\n")
+		if found := parseSyslogRecord(c.line); !reflect.DeepEqual(found, c.expected) {
+			t.Errorf("parsing %q, found %+v, expected %+v", c.line, found, c.expected)
+		}
+	}
+
+	// Messages without header get the time they are received
+	r := parseSyslogRecord("<134>Connect without header")
+	if r.Format != SyslogRFC3164 || r.Message != "Connect without header" || time.Since(r.Timestamp) > time.Minute {
+		t.Errorf("unexpected record without header: %+v", r)
+	}
+
+	// Malformed messages are passed through
+	for _, line := range []string{
+		"no priority",
+		"<1000>Mar  1 10:20:30 haproxy[12]: invalid priority",
+		"<134>1 yesterday lb haproxy 12 - - invalid timestamp",
+		"<134>1 2018-03-01T10:20:30Z lb haproxy 12 - [unclosed structured data",
+		"<134>1 2018-03-01T10:20:30Z lb",
+		"<134>1 ",
+	} {
+		if found := parseSyslogRecord(line); found.Format != "" || found.Message != line || found.Raw != line {
+			t.Errorf("expected %q to be passed through, found %+v", line, found)
+		}
+	}
+}
+
+func TestSyslogRecordFields(t *testing.T) {
+	r := parseSyslogRecord("<134>1 2018-03-01T10:20:30Z lb haproxy 12 - - Connect")
+	expected := LogFields{"source": "syslog", "syslog_format": SyslogRFC5424, "facility": 16, "severity": 6, "hostname": "lb", "app_name": "haproxy", "proc_id": "12", "timestamp": "2018-03-01T10:20:30Z"}
+	if fields := r.Fields(); !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("found fields %v, expected %v", fields, expected)
+	}
+	if fields := parseSyslogRecord("malformed").Fields(); !reflect.DeepEqual(fields, LogFields{"source": "syslog"}) {
+		t.Fatalf("unexpected fields of malformed message: %v", fields)
+	}
+}
+
+func TestScanSyslogFrames(t *testing.T) {
+	input := "first line\n17 octet\ncounted\n 9 spaced \nsecond line\r\n12 short"
+	scanner := bufio.NewScanner(strings.NewReader(input))
+	scanner.Split(scanSyslogFrames)
+	var frames []string
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+	expected := []string{"first line", "octet\ncounted\n 9 ", "spaced ", "second line", "short"}
+	if !reflect.DeepEqual(frames, expected) {
+		t.Fatalf("found frames %q, expected %q", frames, expected)
+	}
+
+	// Counts that would overflow or exceed the maximum size are rejected
+	for _, input := range []string{"9223372036854775807 x", fmt.Sprintf("%d x", syslogMaxMessageSize+1)} {
+		scanner := bufio.NewScanner(strings.NewReader(input))
+		scanner.Split(scanSyslogFrames)
+		for scanner.Scan() {
+			t.Fatalf("unexpected frame %q in %q", scanner.Text(), input)
+		}
+		if scanner.Err() == nil {
+			t.Fatalf("expected error with frame %q", input)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func freeSyslogPort(t *testing.T) uint {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return uint(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestSyslogServerTCP(t *testing.T) {
+	conn := listenSyslog(t)
+	defer conn.Close()
+	forwarder, err := NewSyslogForwarder(conn.LocalAddr().String(), SyslogForwardLimit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := freeSyslogPort(t)
+	s := NewSyslogServer(port)
+	s.Transport = SyslogTransportBoth
+	s.Forwarder = forwarder
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	octetCounted := "<134>1 2018-03-01T10:20:30Z lb haproxy 12 - - octet counted"
+	for _, m := range []struct{ network, message string }{
+		{"tcp", "<134>Mar  1 10:20:30 lb haproxy[12]: newline framed\n<134>Mar  1 10:20:31 lb haproxy[12]: second line\n"},
+		{"tcp", fmt.Sprintf("%d %s", len(octetCounted), octetCounted)},
+		{"udp", "<134>Mar  1 10:20:30 lb haproxy[12]: datagram"},
+		{"udp", "malformed <message"},
+	} {
+		c, err := net.Dial(m.network, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Write([]byte(m.message)); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+
+	received := "\n" + strings.Join(readSyslog(conn, 500*time.Millisecond), "\n")
+	// Messages are forwarded as received
+	for _, content := range []string{"\n<134>Mar  1 10:20:30 lb haproxy[12]: newline framed", "\n<134>Mar  1 10:20:31 lb haproxy[12]: second line", "\n" + octetCounted, "\n<134>Mar  1 10:20:30 lb haproxy[12]: datagram", "\nmalformed <message"} {
+		if !strings.Contains(received, content) {
+			t.Errorf("message %q not received, found %q", content, received)
+		}
+	}
+}
+
+func TestSyslogServerTransportValidation(t *testing.T) {
+	for _, transport := range []string{"", SyslogTransportUDP, SyslogTransportTCP, SyslogTransportBoth} {
+		if err := validateSyslogTransport(transport); err != nil {
+			t.Errorf("unexpected error for %q: %v", transport, err)
+		}
+	}
+	s := NewSyslogServer(freeSyslogPort(t))
+	s.Transport = "sctp"
+	if err := s.Start(); err == nil {
+		s.Stop()
+		t.Fatal("expected error with unknown transport")
+	}
+}
+
+func TestSyslogServerJSONLogs(t *testing.T) {
+	var logs bytes.Buffer
+	if err := setLogFormat(LogFormatJSON, &logs); err != nil {
+		t.Fatal(err)
+	}
+	defer setLogFormat(LogFormatText, os.Stderr)
+
+	port := freeSyslogPort(t)
+	s := NewSyslogServer(port)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte(`<134>1 2018-03-01T10:20:30Z lb haproxy 12 - [meta x="1"] Connect from 10.0.0.1`))
+	c.Close()
+	time.Sleep(100 * time.Millisecond)
+	s.Stop()
+
+	var entry map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if strings.Contains(line, "Connect from") {
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if entry["msg"] != "Connect from 10.0.0.1" || entry["app_name"] != "haproxy" || entry["structured_data"] != `[meta x="1"]` || entry["severity"] != 6.0 {
+		t.Fatalf("unexpected log of syslog message: %q", logs.String())
+	}
+}
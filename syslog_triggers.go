@@ -0,0 +1,152 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions that can be triggered by syslog messages
+const (
+	SyslogActionReload = "reload"
+	SyslogActionAlert  = "alert"
+)
+
+var syslogTriggerActions = map[string]bool{
+	SyslogActionReload: true,
+	SyslogActionAlert:  true,
+}
+
+// SyslogTrigger is a rule running an action when a received syslog message
+// matches its pattern.
+type SyslogTrigger struct {
+	Action  string
+	Pattern *regexp.Regexp
+}
+
+// SyslogTriggers evaluates the received syslog messages against the rules,
+// running the actions of the matching ones. Each rule runs its action at most
+// once per interval, so bursts of messages don't cause storms of actions.
+type SyslogTriggers struct {
+	sync.Mutex
+	rules    []SyslogTrigger
+	limits   []*tokenBucket
+	handlers map[string]func(message string)
+
+	triggers *CounterVec
+}
+
+// NewSyslogTriggers creates the triggers for the rules, the handlers
+// of their actions must be registered with Handle.
+func NewSyslogTriggers(rules []SyslogTrigger, interval time.Duration) *SyslogTriggers {
+	t := &SyslogTriggers{
+		rules:    rules,
+		handlers: make(map[string]func(string)),
+		triggers: NewCounterVec("syslog_triggers_total", "Number of syslog messages matching trigger rules, by action and result", "action", "result"),
+	}
+	for range rules {
+		t.limits = append(t.limits, newTokenBucket(1/interval.Seconds(), 1))
+	}
+	return t
+}
+
+// LoadSyslogTriggers reads the rules in a file.
+func LoadSyslogTriggers(path string) ([]SyslogTrigger, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseSyslogTriggers(f)
+}
+
+// ParseSyslogTriggers reads rules with an action and a regular expression
+// per line, e.g. "reload Server \S+ is DOWN".
+func ParseSyslogTriggers(r io.Reader) ([]SyslogTrigger, error) {
+	var rules []SyslogTrigger
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if !syslogTriggerActions[fields[0]] {
+			return nil, fmt.Errorf("line %d: unknown action %q", n, fields[0])
+		}
+		if len(fields) < 2 || strings.TrimSpace(fields[1]) == "" {
+			return nil, fmt.Errorf("line %d: %s expects a pattern", n, fields[0])
+		}
+		pattern, err := regexp.Compile(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		rules = append(rules, SyslogTrigger{Action: fields[0], Pattern: pattern})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Handle registers the function running an action, messages matching rules
+// of actions without handler are ignored.
+func (t *SyslogTriggers) Handle(action string, handler func(message string)) {
+	t.Lock()
+	defer t.Unlock()
+	t.handlers[action] = handler
+}
+
+// Match runs the actions of the rules matching the message. Actions run in
+// their own goroutines, so they don't block the processing of messages.
+func (t *SyslogTriggers) Match(message string) {
+	for i, rule := range t.rules {
+		if !rule.Pattern.MatchString(message) {
+			continue
+		}
+		if ok, _ := t.limits[i].take(); !ok {
+			t.triggers.Inc(rule.Action, "suppressed")
+			continue
+		}
+		t.Lock()
+		handler := t.handlers[rule.Action]
+		t.Unlock()
+		if handler == nil {
+			t.triggers.Inc(rule.Action, "unhandled")
+			continue
+		}
+		t.triggers.Inc(rule.Action, "fired")
+		log.Printf("Syslog message matched trigger %q, running %s\n", rule.Pattern, rule.Action)
+		go handler(message)
+	}
+}
+
+func (t *SyslogTriggers) Collect() []MetricFamily {
+	return t.triggers.Collect()
+}
+
+// syslogTriggerEvent is the event emitted by alert triggers.
+type syslogTriggerEvent struct {
+	Event   string `json:"event"`
+	Message string `json:"message"`
+}
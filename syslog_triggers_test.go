@@ -0,0 +1,147 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordedActions records the messages of the actions run by triggers.
+type recordedActions struct {
+	sync.Mutex
+	messages map[string][]string
+	done     chan struct{}
+}
+
+func newRecordedActions(t *SyslogTriggers) *recordedActions {
+	r := &recordedActions{messages: make(map[string][]string), done: make(chan struct{}, 10)}
+	for action := range syslogTriggerActions {
+		action := action
+		t.Handle(action, func(message string) {
+			r.Lock()
+			r.messages[action] = append(r.messages[action], message)
+			r.Unlock()
+			r.done <- struct{}{}
+		})
+	}
+	return r
+}
+
+func (r *recordedActions) wait(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("action not run")
+		}
+	}
+}
+
+func (r *recordedActions) count(action string) int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.messages[action])
+}
+
+func TestParseSyslogTriggers(t *testing.T) {
+	rules, err := ParseSyslogTriggers(strings.NewReader(`
+# Reload when servers are marked down
+reload Server \S+ is DOWN
+alert  backend \S+ has no server available!
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Action != "reload" || rules[1].Action != "alert" {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+	if rules[1].Pattern.String() != `backend \S+ has no server available!` {
+		t.Fatalf("unexpected pattern: %q", rules[1].Pattern)
+	}
+
+	cases := []string{
+		"restart Server DOWN",
+		"reload",
+		"reload Server (DOWN",
+	}
+	for _, c := range cases {
+		if _, err := ParseSyslogTriggers(strings.NewReader(c)); err == nil || !strings.Contains(err.Error(), "line 1") {
+			t.Errorf("%q: expected error, found %v", c, err)
+		}
+	}
+}
+
+func TestSyslogTriggersMatch(t *testing.T) {
+	rules, _ := ParseSyslogTriggers(strings.NewReader("reload Server \\S+ is DOWN\nalert has no server available"))
+	triggers := NewSyslogTriggers(rules, time.Minute)
+	actions := newRecordedActions(triggers)
+
+	triggers.Match("Server app/app1 is UP, reason: Layer4 check passed")
+	triggers.Match("Proxy http started.")
+	triggers.Match("Server app/app1 is DOWN, reason: Layer4 timeout")
+	triggers.Match("backend app has no server available!")
+	actions.wait(t, 2)
+
+	if actions.count("reload") != 1 || actions.count("alert") != 1 {
+		t.Fatalf("unexpected actions: %v", actions.messages)
+	}
+	if m := actions.messages["reload"][0]; m != "Server app/app1 is DOWN, reason: Layer4 timeout" {
+		t.Fatalf("unexpected message: %q", m)
+	}
+}
+
+func TestSyslogTriggersRateLimit(t *testing.T) {
+	rules, _ := ParseSyslogTriggers(strings.NewReader("reload is DOWN"))
+	triggers := NewSyslogTriggers(rules, time.Minute)
+	now := time.Now()
+	triggers.limits[0].last = now
+	triggers.limits[0].now = func() time.Time { return now }
+	actions := newRecordedActions(triggers)
+
+	for i := 0; i < 5; i++ {
+		triggers.Match("Server app/app1 is DOWN")
+	}
+	actions.wait(t, 1)
+
+	now = now.Add(time.Minute)
+	triggers.Match("Server app/app2 is DOWN")
+	actions.wait(t, 1)
+
+	if actions.count("reload") != 2 {
+		t.Fatalf("unexpected actions: %v", actions.messages)
+	}
+	families := triggers.Collect()
+	values := make(map[string]float64)
+	for _, s := range families[0].Samples {
+		values[s.Labels[1].Value] = s.Value
+	}
+	if values["fired"] != 2 || values["suppressed"] != 4 {
+		t.Fatalf("unexpected metrics: %+v", families[0].Samples)
+	}
+}
+
+func TestSyslogTriggersUnhandled(t *testing.T) {
+	rules, _ := ParseSyslogTriggers(strings.NewReader("alert is DOWN"))
+	triggers := NewSyslogTriggers(rules, time.Minute)
+	triggers.Match("Server app/app1 is DOWN")
+
+	samples := triggers.Collect()[0].Samples
+	if len(samples) != 1 || samples[0].Labels[1].Value != "unhandled" {
+		t.Fatalf("unexpected metrics: %+v", samples)
+	}
+}
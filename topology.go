@@ -0,0 +1,159 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// configTopology are the proxies of a configuration, with the servers of
+// each backend as backend/server.
+type configTopology struct {
+	frontends map[string]string
+	backends  map[string]bool
+	servers   map[string]bool
+}
+
+// parseTopology extracts the proxies and servers of a configuration.
+// Listen sections are both frontends and backends.
+func parseTopology(content []byte) (*configTopology, error) {
+	t := &configTopology{
+		frontends: make(map[string]string),
+		backends:  make(map[string]bool),
+		servers:   make(map[string]bool),
+	}
+	for _, s := range parseHaproxyConfig(content).sections {
+		frontend := s.Kind == "frontend" || s.Kind == "listen"
+		backend := s.Kind == "backend" || s.Kind == "listen"
+		if !frontend && !backend {
+			continue
+		}
+		if s.Name == "" {
+			return nil, fmt.Errorf("%s section without name", s.Kind)
+		}
+		if frontend {
+			if _, found := t.frontends[s.Name]; found {
+				return nil, fmt.Errorf("duplicated frontend %s", s.Name)
+			}
+			t.frontends[s.Name] = strings.Join(s.Lines, "\n")
+		}
+		if !backend {
+			continue
+		}
+		if t.backends[s.Name] {
+			return nil, fmt.Errorf("duplicated backend %s", s.Name)
+		}
+		t.backends[s.Name] = true
+		for _, fields := range s.Directives() {
+			if fields[0] != "server" {
+				continue
+			}
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("server without name or address in backend %s", s.Name)
+			}
+			t.servers[s.Name+"/"+fields[1]] = true
+		}
+	}
+	return t, nil
+}
+
+// TopologyDelta summarizes the structural changes of a reload.
+type TopologyDelta struct {
+	BackendsAdded    []string `json:"backends_added,omitempty"`
+	BackendsRemoved  []string `json:"backends_removed,omitempty"`
+	ServersAdded     []string `json:"servers_added,omitempty"`
+	ServersRemoved   []string `json:"servers_removed,omitempty"`
+	FrontendsChanged []string `json:"frontends_changed,omitempty"`
+
+	// Unknown is set if the changes couldn't be obtained
+	Unknown bool `json:"unknown,omitempty"`
+}
+
+// topologyDelta compares the topologies of two configurations, the old one
+// is nil if not known.
+func topologyDelta(old, new []byte) *TopologyDelta {
+	if old == nil {
+		return &TopologyDelta{Unknown: true}
+	}
+	oldTopology, err := parseTopology(old)
+	if err != nil {
+		return &TopologyDelta{Unknown: true}
+	}
+	newTopology, err := parseTopology(new)
+	if err != nil {
+		return &TopologyDelta{Unknown: true}
+	}
+	d := &TopologyDelta{}
+	d.BackendsAdded, d.BackendsRemoved = diffNames(oldTopology.backends, newTopology.backends)
+	d.ServersAdded, d.ServersRemoved = diffNames(oldTopology.servers, newTopology.servers)
+	for name, content := range newTopology.frontends {
+		if oldContent, found := oldTopology.frontends[name]; !found || oldContent != content {
+			d.FrontendsChanged = append(d.FrontendsChanged, name)
+		}
+	}
+	for name := range oldTopology.frontends {
+		if _, found := newTopology.frontends[name]; !found {
+			d.FrontendsChanged = append(d.FrontendsChanged, name)
+		}
+	}
+	sort.Strings(d.FrontendsChanged)
+	return d
+}
+
+// diffNames returns the sorted names only in new and only in old.
+func diffNames(old, new map[string]bool) (added, removed []string) {
+	for name := range new {
+		if !old[name] {
+			added = append(added, name)
+		}
+	}
+	for name := range old {
+		if !new[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return
+}
+
+// empty checks if the reload is known to have no structural changes.
+func (d *TopologyDelta) empty() bool {
+	return !d.Unknown && len(d.BackendsAdded)+len(d.BackendsRemoved)+len(d.ServersAdded)+len(d.ServersRemoved)+len(d.FrontendsChanged) == 0
+}
+
+// String summarizes the changes in a line.
+func (d *TopologyDelta) String() string {
+	if d.Unknown {
+		return "unknown changes"
+	}
+	var parts []string
+	add := func(description string, names []string) {
+		if len(names) > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %s", description, strings.Join(names, ", ")))
+		}
+	}
+	add("backends added", d.BackendsAdded)
+	add("backends removed", d.BackendsRemoved)
+	add("servers added", d.ServersAdded)
+	add("servers removed", d.ServersRemoved)
+	add("frontends changed", d.FrontendsChanged)
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, "; ")
+}
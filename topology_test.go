@@ -0,0 +1,185 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTopologyDelta(t *testing.T) {
+	base := `global
+    daemon
+frontend http
+    bind :80
+    default_backend app
+backend app
+    server app1 10.0.0.1:80 check
+    server app2 10.0.0.2:80 check
+backend static
+    server static1 10.0.1.1:80
+`
+	cases := []struct {
+		title    string
+		old, new string
+		expected TopologyDelta
+	}{
+		{
+			title: "same topology",
+			old:   base,
+			new:   base + "    # comment\n",
+		},
+		{
+			title: "server address changed",
+			old:   "backend app\n    server app1 10.0.0.1:80\n",
+			new:   "backend app\n    server app1 10.0.0.9:80\n",
+		},
+		{
+			title: "servers added and removed",
+			old:   base,
+			new: `global
+    daemon
+frontend http
+    bind :80
+    default_backend app
+backend app
+    server app2 10.0.0.2:80 check
+    server app3 10.0.0.3:80 check
+backend static
+    server static1 10.0.1.1:80
+`,
+			expected: TopologyDelta{
+				ServersAdded:   []string{"app/app3"},
+				ServersRemoved: []string{"app/app1"},
+			},
+		},
+		{
+			title: "backends added and removed",
+			old:   base,
+			new: `global
+    daemon
+frontend http
+    bind :80
+    default_backend app
+backend app
+    server app1 10.0.0.1:80 check
+    server app2 10.0.0.2:80 check
+backend api
+    server api1 10.0.2.1:80
+`,
+			expected: TopologyDelta{
+				BackendsAdded:   []string{"api"},
+				BackendsRemoved: []string{"static"},
+				ServersAdded:    []string{"api/api1"},
+				ServersRemoved:  []string{"static/static1"},
+			},
+		},
+		{
+			title: "frontends changed",
+			old:   "frontend http\n    bind :80\nfrontend old\n    bind :81\nlisten stats\n    bind :9000\n",
+			new:   "frontend http\n    bind :8080\nfrontend new\n    bind :82\nlisten stats\n    bind :9000\n",
+			expected: TopologyDelta{
+				FrontendsChanged: []string{"http", "new", "old"},
+			},
+		},
+		{
+			title: "listen sections are also backends",
+			old:   "listen stats\n    bind :9000\n",
+			new:   "listen stats\n    bind :9000\n    server local 127.0.0.1:9001\n",
+			expected: TopologyDelta{
+				ServersAdded:     []string{"stats/local"},
+				FrontendsChanged: []string{"stats"},
+			},
+		},
+		{
+			title:    "unnamed backend",
+			old:      base,
+			new:      "backend\n    server app1 10.0.0.1:80\n",
+			expected: TopologyDelta{Unknown: true},
+		},
+		{
+			title:    "server without address",
+			old:      "backend app\n    server app1\n",
+			new:      base,
+			expected: TopologyDelta{Unknown: true},
+		},
+		{
+			title:    "duplicated backend",
+			old:      base,
+			new:      base + "backend app\n",
+			expected: TopologyDelta{Unknown: true},
+		},
+	}
+	for _, c := range cases {
+		d := topologyDelta([]byte(c.old), []byte(c.new))
+		if !reflect.DeepEqual(*d, c.expected) {
+			t.Errorf("%s: expected %+v, found %+v", c.title, c.expected, *d)
+		}
+	}
+}
+
+func TestTopologyDeltaWithoutPrevious(t *testing.T) {
+	if d := topologyDelta(nil, []byte("backend app\n")); !d.Unknown || d.String() != "unknown changes" {
+		t.Fatalf("expected unknown changes: %+v", d)
+	}
+}
+
+func TestTopologyDeltaString(t *testing.T) {
+	d := &TopologyDelta{
+		BackendsAdded:    []string{"api"},
+		ServersRemoved:   []string{"app/app1", "app/app2"},
+		FrontendsChanged: []string{"http"},
+	}
+	expected := "backends added: api; servers removed: app/app1, app/app2; frontends changed: http"
+	if d.String() != expected {
+		t.Fatalf("unexpected summary: %q", d.String())
+	}
+	if (&TopologyDelta{}).String() != "no changes" {
+		t.Fatal("unexpected summary without changes")
+	}
+}
+
+func TestControllerReloadChanges(t *testing.T) {
+	config := tempConfig(t, "backend app\n    server app1 10.0.0.1:80\n")
+	defer os.Remove(config)
+	c := NewController("", config, &fakeHaproxy{}, &fakeValidator{})
+	c.History = NewConfigHistory(5)
+	c.History.Add(c.applied, "startup")
+
+	if err := ioutil.WriteFile(config, []byte("backend app\n    server app2 10.0.0.2:80\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("POST", "/reload", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "OK\nChanges: servers added: app/app2; servers removed: app/app1\n" {
+		t.Fatalf("unexpected response %d: %q", w.Code, w.Body.String())
+	}
+
+	expected := TopologyDelta{ServersAdded: []string{"app/app2"}, ServersRemoved: []string{"app/app1"}}
+	if changes := c.lastReload.Changes; changes == nil || !reflect.DeepEqual(*changes, expected) {
+		t.Fatalf("unexpected changes in outcome: %+v", changes)
+	}
+	versions := c.History.Versions()
+	if len(versions) != 2 || versions[0].Changes != nil {
+		t.Fatalf("unexpected versions: %+v", versions)
+	}
+	if changes := versions[1].Changes; changes == nil || !reflect.DeepEqual(*changes, expected) {
+		t.Fatalf("unexpected changes in history: %+v", changes)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ValidationCache is a HaproxyConfigValidator that remembers the hashes of
+// configurations successfully validated, so they are not validated again.
+// Entries are only valid for the version of the haproxy binary used to
+// validate them, the cache is cleared if the binary changes. Failed
+// validations are not cached, as they can depend on files not tracked here.
+type ValidationCache struct {
+	sync.Mutex
+
+	validator  HaproxyConfigValidator
+	configFile string
+	path       string
+
+	binary  os.FileInfo
+	version string
+	entries map[string]*validationCacheEntry
+
+	// Used to obtain the version of the binary, mockable for tests
+	versionFunc func(string) (string, error)
+}
+
+type validationCacheEntry struct {
+	Hash      string    `json:"hash"`
+	Hits      int       `json:"hits"`
+	Validated time.Time `json:"validated"`
+	Warnings  []string  `json:"warnings,omitempty"`
+}
+
+// ValidationCacheStatus describes the content of the cache.
+type ValidationCacheStatus struct {
+	Version string                 `json:"haproxy_version"`
+	Entries []validationCacheEntry `json:"entries"`
+}
+
+// NewValidationCache caches the results of a validator of the configFile,
+// or comma-separated list of configuration files, used with the haproxy
+// binary in path.
+func NewValidationCache(validator HaproxyConfigValidator, path, configFile string) *ValidationCache {
+	return &ValidationCache{
+		validator:   validator,
+		configFile:  configFile,
+		path:        path,
+		entries:     make(map[string]*validationCacheEntry),
+		versionFunc: haproxyVersion,
+	}
+}
+
+// Validate returns an error if haproxy has an unusable configuration.
+func (c *ValidationCache) Validate() error {
+	_, err := c.ValidateWithWarnings()
+	return err
+}
+
+// ValidateWithWarnings is like Validate, but also returns the warnings of
+// the configuration, if the validator reports them.
+func (c *ValidationCache) ValidateWithWarnings() ([]string, error) {
+	hash, err := configFilesHash(c.configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if err := c.checkBinary(); err != nil {
+		return nil, err
+	}
+	if entry, found := c.entries[hash]; found {
+		entry.Hits++
+		return entry.Warnings, nil
+	}
+
+	warnings, err := validateWithWarnings(c.validator)
+	if err != nil {
+		return nil, err
+	}
+	c.entries[hash] = &validationCacheEntry{Hash: hash, Validated: time.Now(), Warnings: warnings}
+	return warnings, nil
+}
+
+// checkBinary clears the cache if the haproxy binary has changed.
+func (c *ValidationCache) checkBinary() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return fmt.Errorf("couldn't check haproxy binary: %v", err)
+	}
+	if c.binary != nil && sameBinary(c.binary, info) {
+		return nil
+	}
+	version, err := c.versionFunc(c.path)
+	if err != nil {
+		return fmt.Errorf("couldn't obtain haproxy version: %v", err)
+	}
+	if c.version != "" && version != c.version {
+		log.Printf("Haproxy binary changed from version %s to %s, clearing validation cache\n", c.version, version)
+		c.entries = make(map[string]*validationCacheEntry)
+	}
+	c.binary = info
+	c.version = version
+	return nil
+}
+
+// sameBinary checks if two stats of a binary are of the same file, without
+// modifications.
+func sameBinary(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// Clear removes all hashes from the cache.
+func (c *ValidationCache) Clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.entries = make(map[string]*validationCacheEntry)
+}
+
+func (c *ValidationCache) Status() ValidationCacheStatus {
+	c.Lock()
+	defer c.Unlock()
+	status := ValidationCacheStatus{
+		Version: c.version,
+		Entries: make([]validationCacheEntry, 0, len(c.entries)),
+	}
+	for _, entry := range c.entries {
+		status.Entries = append(status.Entries, *entry)
+	}
+	sort.Slice(status.Entries, func(i, j int) bool {
+		return status.Entries[i].Validated.Before(status.Entries[j].Validated)
+	})
+	return status
+}
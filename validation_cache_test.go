@@ -0,0 +1,146 @@
+// Copyright © 2018 Tuenti Technologies S.L.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+type countingValidator struct {
+	calls int
+	err   error
+}
+
+func (v *countingValidator) Validate() error {
+	v.calls++
+	return v.err
+}
+
+func newTestValidationCache(t *testing.T, validator HaproxyConfigValidator, configFile string) (*ValidationCache, *string) {
+	f, err := ioutil.TempFile("", "haproxy-binary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	version := "1.8.14"
+	cache := NewValidationCache(validator, f.Name(), configFile)
+	cache.versionFunc = func(string) (string, error) { return version, nil }
+	return cache, &version
+}
+
+func TestValidationCache(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	validator := &countingValidator{}
+	cache, _ := newTestValidationCache(t, validator, path)
+	defer os.Remove(cache.path)
+
+	for i := 0; i < 3; i++ {
+		if err := cache.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if validator.calls != 1 {
+		t.Fatalf("found %d validations, expected 1", validator.calls)
+	}
+	status := cache.Status()
+	if len(status.Entries) != 1 || status.Entries[0].Hits != 2 || status.Version != "1.8.14" {
+		t.Fatalf("unexpected cache status: %+v", status)
+	}
+
+	ioutil.WriteFile(path, []byte("global\n    maxconn 10\n"), 0644)
+	validator.err = fmt.Errorf("invalid")
+	for i := 0; i < 2; i++ {
+		if err := cache.Validate(); err == nil {
+			t.Fatal("expected validation error")
+		}
+	}
+	if validator.calls != 3 {
+		t.Fatalf("failed validations shouldn't be cached")
+	}
+
+	cache.Clear()
+	if status := cache.Status(); len(status.Entries) != 0 {
+		t.Fatalf("cache not cleared: %+v", status)
+	}
+}
+
+func TestValidationCacheBinaryChange(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	validator := &countingValidator{}
+	cache, version := newTestValidationCache(t, validator, path)
+	defer os.Remove(cache.path)
+
+	cache.Validate()
+	ioutil.WriteFile(cache.path, []byte("new binary"), 0755)
+	*version = "1.9.0"
+	cache.Validate()
+
+	if validator.calls != 2 {
+		t.Fatalf("found %d validations, expected 2 after binary change", validator.calls)
+	}
+	if status := cache.Status(); status.Version != "1.9.0" || len(status.Entries) != 1 {
+		t.Fatalf("unexpected cache status: %+v", status)
+	}
+}
+
+func TestControllerValidationCache(t *testing.T) {
+	path := tempConfig(t, "global\n")
+	defer os.Remove(path)
+
+	cache, _ := newTestValidationCache(t, &countingValidator{}, path)
+	defer os.Remove(cache.path)
+	cache.Validate()
+
+	c := NewController("", path, &fakeHaproxy{}, cache)
+	c.ValidationCache = cache
+	c.Token = "secret"
+
+	w := httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("GET", "/validate/cache", nil))
+	var status ValidationCacheStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Entries) != 1 || status.Entries[0].Hash != configHash([]byte("global\n")) {
+		t.Fatalf("unexpected cache status: %+v", status)
+	}
+
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, httptest.NewRequest("DELETE", "/validate/cache", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("found status %d, expected %d without token", w.Code, http.StatusUnauthorized)
+	}
+
+	req := httptest.NewRequest("DELETE", "/validate/cache", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	c.handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("found status %d, expected %d", w.Code, http.StatusOK)
+	}
+	if status := cache.Status(); len(status.Entries) != 0 {
+		t.Fatalf("cache not cleared: %+v", status)
+	}
+}